@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/control"
+	"pkb-daemon/internal/sync"
+)
+
+// backfillPollInterval is how often progress is fetched while waiting
+const backfillPollInterval = 2 * time.Second
+
+// runBackfill starts a backfill of a date range, or a re-sync of a source's
+// whole history when resync is set, and follows its progress
+func runBackfill(ctx context.Context, cfg *config.Config, args []string, resync bool) error {
+	name := "backfill"
+	if resync {
+		name = "resync"
+	}
+	if !resync && len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return listBackfills(ctx, cfg, args[1:])
+		case "cancel":
+			return cancelBackfill(ctx, cfg, args[1:])
+		}
+	}
+
+	fs, _, asJSON := newFlagSet(name)
+	source := fs.String("source", "", "Source to re-import")
+	account := fs.String("account", "", "Only this account, for sources with several")
+	var since, until *string
+	if !resync {
+		since = fs.String("since", "", "First day to re-import (YYYY-MM-DD)")
+		until = fs.String("until", "", "Last day to re-import (YYYY-MM-DD), included")
+	}
+	maxPerCycle := fs.Int("max-per-cycle", 0, "Items sent before pausing (default sync.backfill.max_per_cycle)")
+	pause := fs.Duration("pause", 0, "Wait between cycles (default sync.backfill.pause_seconds)")
+	detach := fs.Bool("detach", false, "Return once started instead of following progress")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *source == "" {
+		return fmt.Errorf("usage: pkb-daemon %s -source <source> ...", name)
+	}
+
+	req := sync.BackfillRequest{
+		Source:       *source,
+		Account:      *account,
+		MaxPerCycle:  *maxPerCycle,
+		PauseSeconds: int(pause.Seconds()),
+	}
+	if !resync {
+		var err error
+		if req.Since, err = parseDay(*since); err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+		if req.Until, err = parseDay(*until); err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+		if req.Since.IsZero() && req.Until.IsZero() {
+			return errors.New("backfill needs -since or -until; use resync for the whole history")
+		}
+	}
+
+	client, err := backfillClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	b, err := client.StartBackfill(ctx, req)
+	if err != nil {
+		return err
+	}
+	if *asJSON && *detach {
+		return printJSON(b)
+	}
+	if !*asJSON {
+		if b.Resumed {
+			fmt.Printf("Resuming %s from checkpoint %s\n", b.ID, b.Checkpoint)
+		} else {
+			fmt.Printf("Started %s\n", b.ID)
+		}
+	}
+	if *detach {
+		fmt.Println("Check progress with: pkb-daemon backfill list")
+		return nil
+	}
+
+	b, err = followBackfill(ctx, client, b, *asJSON)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(b)
+	}
+
+	switch b.State {
+	case sync.BackfillDone:
+		fmt.Printf("Done: %d fetched, %d sent, %d filtered, %d failed\n", b.Fetched, b.Sent, b.Filtered, b.Failed)
+		return nil
+	case sync.BackfillCancelled:
+		return fmt.Errorf("%s was cancelled; run the same command again to resume", b.ID)
+	default:
+		return fmt.Errorf("%s failed: %s; run the same command again to resume", b.ID, b.Error)
+	}
+}
+
+// followBackfill prints the progress of a backfill until it stops running
+func followBackfill(ctx context.Context, client *control.Client, b *sync.Backfill, quiet bool) (*sync.Backfill, error) {
+	ticker := time.NewTicker(backfillPollInterval)
+	defer ticker.Stop()
+
+	last := *b
+	for b.State == sync.BackfillRunning {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		var err error
+		if b, err = client.Backfill(ctx, b.ID); err != nil {
+			return nil, err
+		}
+		if !quiet && (b.Fetched != last.Fetched || b.Cycles != last.Cycles) {
+			fmt.Printf("Cycle %d: %d fetched, %d sent, %d filtered, %d failed, checkpoint %s\n",
+				b.Cycles, b.Fetched, b.Sent, b.Filtered, b.Failed, orDash(b.Checkpoint))
+		}
+		last = *b
+	}
+	return b, nil
+}
+
+func listBackfills(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, _, asJSON := newFlagSet("backfill list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	client, err := backfillClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	backfills, err := client.Backfills(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(backfills)
+	}
+	if len(backfills) == 0 {
+		fmt.Println("No backfills since the daemon started")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tSTARTED\tFETCHED\tSENT\tFILTERED\tFAILED\tCHECKPOINT")
+	for _, b := range backfills {
+		state := b.State
+		if b.Error != "" && b.State == sync.BackfillFailed {
+			state = fmt.Sprintf("%s (%s)", b.State, b.Error)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n",
+			b.ID, state, formatTime(b.StartedAt), b.Fetched, b.Sent, b.Filtered, b.Failed, orDash(b.Checkpoint))
+	}
+	return w.Flush()
+}
+
+func cancelBackfill(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: pkb-daemon backfill cancel <id>")
+	}
+	client, err := backfillClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := client.CancelBackfill(ctx, args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Cancelling %s; run it again to resume\n", args[0])
+	return nil
+}
+
+// backfillClient connects to the running daemon. Backfills use its sources
+// and pipeline, so unlike the inspection commands they have no offline mode.
+func backfillClient(ctx context.Context, cfg *config.Config) (*control.Client, error) {
+	if !cfg.Control.Enabled {
+		return nil, errors.New("backfills run inside the daemon and need the control API (control.enabled)")
+	}
+	client, err := control.NewClient(cfg.Control)
+	if err == nil {
+		err = client.Ping(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("daemon not reachable: %w", err)
+	}
+	return client, nil
+}
+
+// parseDay parses a YYYY-MM-DD date in local time, or returns the zero time
+// for an empty string
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
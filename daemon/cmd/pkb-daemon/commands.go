@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/control"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/state"
+	"pkb-daemon/internal/sync"
+)
+
+const commandUsage = `Usage: pkb-daemon [-config path] [command]
+
+Without a command the daemon runs in the foreground.
+
+Commands:
+  status                        show per-source status and queue stats
+  state show [source]           show saved checkpoints
+  state set <source> <value>    overwrite a checkpoint
+  state reset <source>          forget a checkpoint so the source syncs from scratch
+  state history <source>        show recent checkpoint changes of a source
+  state rollback <source> <id>  restore the checkpoint of a history entry
+  backfill -source <source> [-since day] [-until day] [-account name]
+                                re-import a date range without touching the
+                                live checkpoint; the same range resumes
+  resync -source <source> [-account name]
+                                re-import the whole history of a source
+  backfill list                 show backfills and their progress
+  backfill cancel <id>          stop a backfill; starting it again resumes it
+  dry-run [-o file] [-source name] [-from-scratch] [-follow]
+                                run every source once and write what would be
+                                sent as JSONL, without sending or moving
+                                checkpoints
+  replay [-f file] [-skip n]    send a dry-run or queue export to the backend
+  search "words" [-from contact] [-since 30d] [-until day]
+                                search the local archive (sinks.archive)
+  queue list                    list queued requests
+  queue show <id>               show a queued request with its payload
+  queue retry <id>              retry a request now with a fresh retry budget
+  queue retry-all               retry every request now
+  queue drop <id>               delete a request without sending it
+  queue purge [-all]            delete expired requests, or every request with -all
+  queue export [-o file]        write all requests with payloads as JSONL
+  deadletter list               list requests that are no longer retried
+  deadletter show <id>          show a dead letter with its errors and payload
+  deadletter edit <id> [-f file]
+                                replace the payload, from a file or in $EDITOR
+  deadletter replay <id>        move a dead letter back into the queue
+  deadletter replay-all         move every dead letter back into the queue
+  deadletter drop <id>          delete a dead letter
+  deadletter purge              delete every dead letter
+
+Commands talk to the running daemon through the control API when it is
+enabled and reachable, and otherwise read the state and queue files directly.
+Pass -offline to always use the files. Backfills and re-syncs always need the
+running daemon.
+`
+
+// store is what the inspection commands operate on: either a running daemon
+// (*control.Client) or the state and queue files on disk
+type store interface {
+	Status(ctx context.Context) (*control.StatusResponse, error)
+	Checkpoints(ctx context.Context) (map[string]string, error)
+	SetCheckpoint(ctx context.Context, source, checkpoint string) error
+	ResetCheckpoint(ctx context.Context, source string) error
+	CheckpointHistory(ctx context.Context, source string, limit int) ([]state.Change, error)
+	RollbackCheckpoint(ctx context.Context, source string, id int64) error
+	QueueList(ctx context.Context, limit, offset int, withPayload bool) ([]control.QueuedRequest, error)
+	QueueGet(ctx context.Context, id int64) (*control.QueuedRequest, error)
+	QueueRetry(ctx context.Context, id int64) error
+	QueueRetryAll(ctx context.Context) (int64, error)
+	QueueDrop(ctx context.Context, id int64) error
+	QueuePurge(ctx context.Context, all bool) (int64, error)
+	DeadLetterList(ctx context.Context, limit, offset int, withPayload bool) ([]control.DeadLetter, error)
+	DeadLetterGet(ctx context.Context, id int64) (*control.DeadLetter, error)
+	DeadLetterEdit(ctx context.Context, id int64, payload []byte) error
+	DeadLetterReplay(ctx context.Context, id int64) error
+	DeadLetterReplayAll(ctx context.Context) (int64, error)
+	DeadLetterDrop(ctx context.Context, id int64) error
+	DeadLetterPurge(ctx context.Context) (int64, error)
+}
+
+// runCommand runs a CLI subcommand
+func runCommand(cfg *config.Config, args []string) error {
+	// Keep command output clean; only problems are logged
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.Kitchen}).
+		With().Timestamp().Logger().Level(zerolog.WarnLevel)
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "status":
+		return runStatus(ctx, cfg, args[1:])
+	case "state":
+		return runState(ctx, cfg, args[1:])
+	case "backfill":
+		return runBackfill(ctx, cfg, args[1:], false)
+	case "resync":
+		return runBackfill(ctx, cfg, args[1:], true)
+	case "dry-run":
+		return runDryRun(ctx, cfg, args[1:])
+	case "replay":
+		return runReplay(ctx, cfg, args[1:])
+	case "search":
+		return runSearch(ctx, cfg, args[1:])
+	case "queue":
+		return runQueue(ctx, cfg, args[1:])
+	case "deadletter":
+		return runDeadLetter(ctx, cfg, args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(commandUsage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, commandUsage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// newFlagSet creates the flags shared by all inspection commands
+func newFlagSet(name string) (*flag.FlagSet, *bool, *bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	offline := fs.Bool("offline", false, "Read the state and queue files even if the daemon is running")
+	asJSON := fs.Bool("json", false, "Print JSON instead of text")
+	return fs, offline, asJSON
+}
+
+// openStore connects to the running daemon, falling back to the files on disk
+func openStore(ctx context.Context, cfg *config.Config, offline bool) (store, func(), error) {
+	if !offline && cfg.Control.Enabled {
+		client, err := control.NewClient(cfg.Control)
+		if err == nil {
+			err = client.Ping(ctx)
+		}
+		if err == nil {
+			return client, func() {}, nil
+		}
+		log.Warn().Err(err).Msg("Daemon not reachable, using state and queue files directly")
+	}
+
+	st, err := state.Open(cfg.State.DBPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open state: %w", err)
+	}
+	if err := st.Migrate(cfg.State.Path); err != nil {
+		st.Close()
+		return nil, nil, fmt.Errorf("failed to migrate state: %w", err)
+	}
+	s := &fileStore{cfg: cfg, state: st}
+	return s, s.close, nil
+}
+
+// fileStore implements store on top of state.db and queue.db
+type fileStore struct {
+	cfg   *config.Config
+	state *state.Store
+	queue *queue.Queue
+}
+
+func (s *fileStore) close() {
+	s.state.Close()
+	if s.queue != nil {
+		s.queue.Close()
+	}
+}
+
+// openQueue opens the queue database on first use
+func (s *fileStore) openQueue() (*queue.Queue, error) {
+	if s.queue != nil {
+		return s.queue, nil
+	}
+	if s.cfg.Queue.Path == "" {
+		return nil, sync.ErrQueueDisabled
+	}
+	if _, err := os.Stat(s.cfg.Queue.Path); err != nil {
+		return nil, fmt.Errorf("queue database not found at %s: %w", s.cfg.Queue.Path, os.ErrNotExist)
+	}
+
+	q, err := queue.New(queue.ConfigFrom(s.cfg.Queue))
+	if err != nil {
+		return nil, err
+	}
+	s.queue = q
+	return q, nil
+}
+
+func (s *fileStore) Status(ctx context.Context) (*control.StatusResponse, error) {
+	checkpoints, err := s.state.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+	metas, err := s.state.Meta()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &control.StatusResponse{}
+	seen := make(map[string]bool)
+	for _, meta := range metas {
+		seen[meta.Source] = true
+		resp.Sources = append(resp.Sources, control.Source{
+			SourceStatus: sync.SourceStatus{
+				Name:         meta.Source,
+				LastSuccess:  meta.LastSuccess,
+				LastError:    meta.LastError,
+				LastErrorAt:  meta.LastErrorAt,
+				ItemsFetched: meta.ItemsFetched,
+				ItemsSent:    meta.ItemsSent,
+				ItemsFailed:  meta.ItemsFailed,
+			},
+			Checkpoint: checkpoints[meta.Source],
+		})
+	}
+	for name, checkpoint := range checkpoints {
+		if !seen[name] && !sync.IsBackfill(name) {
+			resp.Sources = append(resp.Sources, control.Source{
+				SourceStatus: sync.SourceStatus{Name: name},
+				Checkpoint:   checkpoint,
+			})
+		}
+	}
+
+	sort.Slice(resp.Sources, func(i, j int) bool {
+		return resp.Sources[i].Name < resp.Sources[j].Name
+	})
+
+	q, err := s.openQueue()
+	if err == nil {
+		resp.Queue, err = q.Stats()
+	}
+	// Before the daemon first runs there is no queue yet
+	if err != nil && !errors.Is(err, sync.ErrQueueDisabled) && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *fileStore) Checkpoints(ctx context.Context) (map[string]string, error) {
+	return s.state.Checkpoints()
+}
+
+func (s *fileStore) SetCheckpoint(ctx context.Context, source, checkpoint string) error {
+	return s.state.SetCheckpoint(source, checkpoint, state.ReasonSet)
+}
+
+func (s *fileStore) ResetCheckpoint(ctx context.Context, source string) error {
+	return s.state.DeleteCheckpoint(source)
+}
+
+func (s *fileStore) CheckpointHistory(ctx context.Context, source string, limit int) ([]state.Change, error) {
+	return s.state.History(source, limit)
+}
+
+func (s *fileStore) RollbackCheckpoint(ctx context.Context, source string, id int64) error {
+	_, err := s.state.Rollback(source, id)
+	return err
+}
+
+func (s *fileStore) QueueList(ctx context.Context, limit, offset int, withPayload bool) ([]control.QueuedRequest, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return nil, err
+	}
+	requests, err := q.List(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]control.QueuedRequest, 0, len(requests))
+	for _, req := range requests {
+		result = append(result, control.NewQueuedRequest(req, withPayload))
+	}
+	return result, nil
+}
+
+func (s *fileStore) QueueGet(ctx context.Context, id int64) (*control.QueuedRequest, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return nil, err
+	}
+	req, err := q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	result := control.NewQueuedRequest(*req, true)
+	return &result, nil
+}
+
+func (s *fileStore) QueueRetry(ctx context.Context, id int64) error {
+	q, err := s.openQueue()
+	if err != nil {
+		return err
+	}
+	return q.Retry(id)
+}
+
+func (s *fileStore) QueueRetryAll(ctx context.Context) (int64, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return 0, err
+	}
+	return q.RetryAll()
+}
+
+func (s *fileStore) QueueDrop(ctx context.Context, id int64) error {
+	q, err := s.openQueue()
+	if err != nil {
+		return err
+	}
+	return q.Delete(id)
+}
+
+func (s *fileStore) QueuePurge(ctx context.Context, all bool) (int64, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return 0, err
+	}
+	if all {
+		return q.DeleteAll()
+	}
+	return q.PurgeExpired()
+}
+
+func (s *fileStore) DeadLetterList(ctx context.Context, limit, offset int, withPayload bool) ([]control.DeadLetter, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return nil, err
+	}
+	letters, err := q.ListDeadLetters(limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]control.DeadLetter, 0, len(letters))
+	for _, d := range letters {
+		result = append(result, control.NewDeadLetter(d, withPayload))
+	}
+	return result, nil
+}
+
+func (s *fileStore) DeadLetterGet(ctx context.Context, id int64) (*control.DeadLetter, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return nil, err
+	}
+	d, err := q.GetDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+	result := control.NewDeadLetter(*d, true)
+	return &result, nil
+}
+
+func (s *fileStore) DeadLetterEdit(ctx context.Context, id int64, payload []byte) error {
+	q, err := s.openQueue()
+	if err != nil {
+		return err
+	}
+	return q.UpdateDeadLetter(id, payload)
+}
+
+func (s *fileStore) DeadLetterReplay(ctx context.Context, id int64) error {
+	q, err := s.openQueue()
+	if err != nil {
+		return err
+	}
+	return q.ReplayDeadLetter(id)
+}
+
+func (s *fileStore) DeadLetterReplayAll(ctx context.Context) (int64, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return 0, err
+	}
+	return q.ReplayAllDeadLetters()
+}
+
+func (s *fileStore) DeadLetterDrop(ctx context.Context, id int64) error {
+	q, err := s.openQueue()
+	if err != nil {
+		return err
+	}
+	return q.DeleteDeadLetter(id)
+}
+
+func (s *fileStore) DeadLetterPurge(ctx context.Context) (int64, error) {
+	q, err := s.openQueue()
+	if err != nil {
+		return 0, err
+	}
+	return q.DeleteAllDeadLetters()
+}
+
+// printJSON writes v as indented JSON to stdout
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// formatTime prints a timestamp in local time, or "-" if it is unset
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
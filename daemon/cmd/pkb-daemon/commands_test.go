@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/control"
+	"pkb-daemon/internal/export"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/state"
+)
+
+// loadTestConfig loads a config that keeps state and queue in a temporary directory
+func loadTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	data, err := json.Marshal(map[string]any{
+		"state": map[string]any{"path": filepath.Join(dir, "state.json")},
+		"queue": map[string]any{"enabled": true, "path": filepath.Join(dir, "queue.db")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestFileStoreState(t *testing.T) {
+	cfg := loadTestConfig(t)
+	ctx := context.Background()
+	st, closeStore, err := openStore(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+
+	if err := st.SetCheckpoint(ctx, "imessage", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetCheckpoint(ctx, "notes", "7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.ResetCheckpoint(ctx, "notes"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := st.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Sources) != 1 || status.Sources[0].Name != "imessage" || status.Sources[0].Checkpoint != "42" {
+		t.Errorf("sources = %+v, want imessage at 42", status.Sources)
+	}
+	// The daemon hasn't created the queue yet
+	if status.Queue != nil {
+		t.Errorf("queue = %+v, want none", status.Queue)
+	}
+}
+
+func TestExportQueue(t *testing.T) {
+	cfg := loadTestConfig(t)
+	q, err := queue.New(queue.Config{Path: cfg.Queue.Path, MaxRetries: cfg.Queue.MaxRetries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More than a page, so export has to page through the queue
+	total := exportPageSize + 1
+	for range total {
+		payload := api.BatchUpsertRequest{Communications: []api.Communication{{Source: "imessage"}}}
+		if err := q.Enqueue("imessage", queue.RequestTypeBatchUpsert, payload, "backend down", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	ctx := context.Background()
+	st, closeStore, err := openStore(ctx, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+
+	var out bytes.Buffer
+	n, err := exportQueue(ctx, st, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != total {
+		t.Errorf("exported %d requests, want %d", n, total)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var req control.QueuedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Summary != "batch_upsert: 1 communication from imessage" || len(req.Payload) == 0 {
+			t.Errorf("line %d = %+v, want a summary and the payload", lines+1, req)
+		}
+		lines++
+	}
+	if lines != total {
+		t.Errorf("wrote %d lines, want %d", lines, total)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var received []string
+	failOn := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/health" {
+			return
+		}
+		var req api.BatchUpsertRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		id := req.Communications[0].SourceID
+		if id == failOn {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, id)
+		json.NewEncoder(w).Encode(api.BatchUpsertResponse{Inserted: len(req.Communications)})
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t)
+	cfg.Backend.URL = srv.URL
+	cfg.Backend.APIKey = "key"
+	cfg.Backend.Compression = "none"
+	cfg.Backend.Retry.MaxAttempts = 1
+
+	path := filepath.Join(t.TempDir(), "export.jsonl")
+	w, err := export.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []struct{ source, id string }{{"imessage", "m1"}, {"gmail", "g1"}, {"imessage", "m2"}, {"imessage", "m3"}} {
+		comms := api.BatchUpsertRequest{Communications: []api.Communication{{SourceID: rec.id}}}
+		if err := w.Write(rec.source, queue.RequestTypeBatchUpsert, comms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	ctx := context.Background()
+	if err := runReplay(ctx, cfg, []string{"-f", path, "-source", "imessage", "-skip", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(received, []string{"m2", "m3"}) {
+		t.Errorf("received %v, want [m2 m3]", received)
+	}
+
+	// A temporary failure stops the replay so nothing overtakes the record
+	received, failOn = nil, "g1"
+	err = runReplay(ctx, cfg, []string{"-f", path})
+	if err == nil || !strings.Contains(err.Error(), "resume with -skip 1") {
+		t.Errorf("err = %v, want a hint to resume at line 2", err)
+	}
+	if !slices.Equal(received, []string{"m1"}) {
+		t.Errorf("received %v, want [m1]", received)
+	}
+}
+
+func TestCopyCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "state.db")
+	st, err := state.Open(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for source, checkpoint := range map[string]string{"imessage": "42", "backfill:gmail": "7"} {
+		if err := st.SetCheckpoint(source, checkpoint, state.ReasonSet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.Close()
+
+	to := filepath.Join(dir, "scratch", "state.db")
+	if err := copyCheckpoints(from, to); err != nil {
+		t.Fatal(err)
+	}
+	scratch, err := state.Open(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scratch.Close()
+	checkpoints, err := scratch.Checkpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A dry run syncs the live sources only
+	if len(checkpoints) != 1 || checkpoints["imessage"] != "42" {
+		t.Errorf("checkpoints = %v, want imessage at 42", checkpoints)
+	}
+
+	// Without a state database there is nothing to copy
+	if err := copyCheckpoints(filepath.Join(dir, "missing.db"), filepath.Join(dir, "other.db")); err != nil {
+		t.Error(err)
+	}
+}
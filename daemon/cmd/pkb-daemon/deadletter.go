@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/control"
+)
+
+func runDeadLetter(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pkb-daemon deadletter list|show|edit|replay|replay-all|drop|purge")
+	}
+
+	fs, offline, asJSON := newFlagSet("deadletter " + args[0])
+	limit := fs.Int("limit", 100, "Maximum number of dead letters to list")
+	file := fs.String("f", "", "With edit: read the new payload from this file (- for stdin)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	st, closeStore, err := openStore(ctx, cfg, *offline)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	switch args[0] {
+	case "list":
+		letters, err := st.DeadLetterList(ctx, *limit, 0, false)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(letters)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREASON\tDEAD SINCE\tSUMMARY\tLAST ERROR")
+		for _, d := range letters {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+				d.ID, d.Reason, formatTime(d.DeadAt), d.Summary, truncate(d.LastError, 60))
+		}
+		return w.Flush()
+
+	case "show":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		d, err := st.DeadLetterGet(ctx, id)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(d)
+		}
+		return printDeadLetter(d)
+
+	case "edit":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		payload, err := editedPayload(ctx, st, id, *file)
+		if err != nil {
+			return err
+		}
+		if payload == nil {
+			fmt.Println("Payload unchanged")
+			return nil
+		}
+		if err := st.DeadLetterEdit(ctx, id, payload); err != nil {
+			return err
+		}
+		fmt.Printf("Dead letter %d updated\n", id)
+		return nil
+
+	case "replay":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		if err := st.DeadLetterReplay(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Dead letter %d moved back into the queue\n", id)
+		return nil
+
+	case "replay-all":
+		n, err := st.DeadLetterReplayAll(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d dead letters moved back into the queue\n", n)
+		return nil
+
+	case "drop":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		if err := st.DeadLetterDrop(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Dead letter %d dropped\n", id)
+		return nil
+
+	case "purge":
+		n, err := st.DeadLetterPurge(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d dead letters deleted\n", n)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown deadletter command %q", args[0])
+	}
+}
+
+// editedPayload reads the new payload of a dead letter from file, or lets the
+// user edit the current one in $EDITOR. It returns nil if nothing changed.
+func editedPayload(ctx context.Context, st store, id int64, file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+
+	d, err := st.DeadLetterGet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var current bytes.Buffer
+	if err := json.Indent(&current, d.Payload, "", "  "); err != nil {
+		current.Reset()
+		current.Write(d.Payload)
+	}
+
+	tmp, err := os.CreateTemp("", fmt.Sprintf("pkb-deadletter-%d-*.json", id))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(current.Bytes()); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.CommandContext(ctx, editor, tmp.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor failed: %w", err)
+	}
+
+	edited, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(bytes.TrimSpace(edited), bytes.TrimSpace(current.Bytes())) {
+		return nil, nil
+	}
+	if !json.Valid(edited) {
+		return nil, errors.New("edited payload is not valid JSON")
+	}
+	return edited, nil
+}
+
+// printDeadLetter prints a dead letter's metadata and errors followed by its payload
+func printDeadLetter(d *control.DeadLetter) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%d\n", d.ID)
+	fmt.Fprintf(w, "Summary:\t%s\n", d.Summary)
+	if d.Source != "" {
+		fmt.Fprintf(w, "Source:\t%s (#%d)\n", d.Source, d.Seq)
+	}
+	fmt.Fprintf(w, "Reason:\t%s\n", d.Reason)
+	fmt.Fprintf(w, "Retries:\t%d\n", d.Retries)
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(d.CreatedAt))
+	fmt.Fprintf(w, "Dead since:\t%s\n", formatTime(d.DeadAt))
+	fmt.Fprintf(w, "Payload:\t%d bytes\n", d.PayloadSize)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\nErrors:")
+	for _, e := range d.Errors {
+		fmt.Printf("  %s  %s\n", formatTime(e.At), e.Error)
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, d.Payload, "", "  "); err != nil {
+		fmt.Printf("\n%s\n", d.Payload)
+		return nil
+	}
+	fmt.Printf("\n%s\n", pretty.String())
+	return nil
+}
+
+// truncate shortens s to at most n runes for table output
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
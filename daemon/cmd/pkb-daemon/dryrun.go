@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/sink"
+	"pkb-daemon/internal/state"
+	"pkb-daemon/internal/sync"
+)
+
+// runDryRun runs the sources through the whole pipeline and writes what
+// would be sent as JSONL. Checkpoints move in a scratch copy of the state,
+// so the real ones are left alone.
+func runDryRun(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("dry-run", flag.ContinueOnError)
+	output := fs.String("o", "-", "Append records to this file instead of stdout")
+	source := fs.String("source", "", "Only run this source")
+	fromScratch := fs.Bool("from-scratch", false, "Start every source without a checkpoint")
+	follow := fs.Bool("follow", false, "Keep syncing on the usual schedule until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	scratch, err := os.MkdirTemp("", "pkb-dry-run-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	// The copy shares nothing with the daemon: no queue, no legacy state file
+	dry := *cfg
+	dry.State.Path = ""
+	dry.State.DBPath = filepath.Join(scratch, "state.db")
+	dry.Queue.Enabled = false
+	dry.Queue.Outbox = false
+	if !*fromScratch {
+		if err := copyCheckpoints(cfg.State.DBPath, dry.State.DBPath); err != nil {
+			return err
+		}
+	}
+
+	// The export replaces every sink, so the backend doesn't need to be reachable
+	out, err := sink.OpenFile(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	manager := sync.NewManager(out, &dry)
+	if err := manager.InitState(); err != nil {
+		return err
+	}
+	if err := setupSources(&dry, manager); err != nil {
+		return err
+	}
+
+	if *source != "" {
+		found := false
+		for _, src := range manager.Sources() {
+			if src.Name == *source {
+				found = true
+			} else if err := manager.Pause(src.Name); err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown or disabled source %q", *source)
+		}
+	}
+
+	if *follow {
+		err = manager.Run(ctx)
+	} else {
+		err = manager.RunOnce(ctx)
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %d records to %s\n", out.Records(), *output)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// copyCheckpoints seeds the scratch state with the daemon's checkpoints, so a
+// dry run shows what the next sync would send
+func copyCheckpoints(from, to string) error {
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return nil
+	}
+
+	src, err := state.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	checkpoints, err := src.Checkpoints()
+	if err != nil {
+		return err
+	}
+
+	dst, err := state.Open(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	for source, checkpoint := range checkpoints {
+		if sync.IsBackfill(source) {
+			continue
+		}
+		if err := dst.SetCheckpoint(source, checkpoint, state.ReasonSet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
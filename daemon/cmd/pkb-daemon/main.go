@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,19 +12,20 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
-	"pkb-daemon/internal/api"
 	"pkb-daemon/internal/config"
-	"pkb-daemon/internal/sources/calendar"
-	"pkb-daemon/internal/sources/calls"
-	"pkb-daemon/internal/sources/contacts"
-	"pkb-daemon/internal/sources/gmail"
-	"pkb-daemon/internal/sources/imessage"
-	"pkb-daemon/internal/sources/notes"
+	"pkb-daemon/internal/control"
+	"pkb-daemon/internal/metrics"
+	"pkb-daemon/internal/sink"
 	"pkb-daemon/internal/sync"
+	"pkb-daemon/internal/tracing"
 )
 
 func main() {
 	configPath := flag.String("config", "config.yaml", "Path to config file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Load config
@@ -32,95 +34,62 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to load config")
 	}
 
+	// Inspection commands run instead of the daemon
+	if flag.NArg() > 0 {
+		if err := runCommand(cfg, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Setup logging
 	setupLogging(cfg.Logging)
 
 	log.Info().Msg("Starting PKB daemon")
 
-	// Create API client
-	client := api.NewClient(cfg.Backend.URL, cfg.Backend.APIKey)
-
-	// Verify connection
-	if err := client.HealthCheck(); err != nil {
-		log.Fatal().Err(err).Msg("Backend health check failed")
-	}
-	log.Info().Str("url", cfg.Backend.URL).Msg("Connected to backend")
-
-	// Create sync manager
-	manager := sync.NewManager(client, cfg)
-
-	// Initialize offline queue if enabled
-	if cfg.Queue.Enabled {
-		if err := manager.InitQueue(); err != nil {
-			log.Fatal().Err(err).Msg("Failed to initialize offline queue")
-		}
+	// Tracing is set up first so every backend request can be traced
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid tracing configuration")
 	}
-
-	// Register communication sources
-
-	// iMessage
-	if cfg.Sources.IMessage.Enabled {
-		src, err := imessage.New(cfg.Sources.IMessage, cfg.Blocklist)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to initialize iMessage source")
-		}
-		manager.RegisterSource(src)
+	if cfg.Tracing.Enabled {
+		log.Info().Str("exporter", cfg.Tracing.Exporter).Msg("Tracing enabled")
 	}
 
-	// Gmail
-	if cfg.Sources.Gmail.Enabled {
-		src, err := gmail.New(cfg.Sources.Gmail, cfg.Blocklist)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to initialize Gmail source (skipping)")
-		} else {
-			manager.RegisterSource(src)
-		}
+	// Backend client and local sinks
+	out, err := openSinks(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open sinks")
 	}
+	defer out.Close()
 
-	// Phone Calls
-	if cfg.Sources.Calls.Enabled {
-		src, err := calls.New(cfg.Sources.Calls, cfg.Blocklist)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to initialize Phone Calls source (skipping)")
-		} else {
-			manager.RegisterSource(src)
+	// Verify connection
+	if !cfg.Sinks.LocalOnly {
+		if err := sink.HealthCheck(context.Background(), out); err != nil {
+			log.Fatal().Err(err).Msg("Backend health check failed")
 		}
+		log.Info().Str("url", cfg.Backend.URL).Msg("Connected to backend")
 	}
 
-	// Register contacts sources
+	// Create sync manager
+	manager := sync.NewManager(out, cfg)
 
-	// Apple Contacts
-	if cfg.Sources.Contacts.Enabled {
-		src, err := contacts.New(cfg.Sources.Contacts)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to initialize Apple Contacts source (skipping)")
-		} else {
-			manager.RegisterContactsSource(src)
-		}
+	// Checkpoints and per-source metadata
+	if err := manager.InitState(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to open state database")
 	}
 
-	// Register calendar sources
-
-	// Calendar (Google + Apple)
-	if cfg.Sources.Calendar.Enabled {
-		src, err := calendar.New(cfg.Sources.Calendar)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to initialize Calendar source (skipping)")
-		} else {
-			manager.RegisterCalendarSource(src)
+	// Initialize offline queue if enabled
+	if cfg.Queue.Enabled {
+		if err := manager.InitQueue(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize offline queue")
 		}
 	}
 
-	// Register notes sources
-
-	// Apple Notes
-	if cfg.Sources.Notes.Enabled {
-		src, err := notes.New(cfg.Sources.Notes)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to initialize Apple Notes source (skipping)")
-		} else {
-			manager.RegisterNotesSource(src)
-		}
+	// Filters, classifier, redactor and every enabled source
+	if err := setupSources(cfg, manager); err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up sources")
 	}
 
 	// Handle shutdown gracefully
@@ -134,11 +103,40 @@ func main() {
 		cancel()
 	}()
 
+	// Local control API for the CLI and the menubar app
+	if cfg.Control.Enabled {
+		srv, err := control.NewServer(cfg.Control, manager)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid control API configuration")
+		}
+		go func() {
+			if err := srv.Run(ctx); err != nil {
+				log.Error().Err(err).Msg("Control API failed")
+			}
+		}()
+	}
+
+	// Prometheus metrics
+	if cfg.Metrics.Enabled {
+		go func() {
+			if err := metrics.Serve(ctx, cfg.Metrics.Address); err != nil {
+				log.Error().Err(err).Msg("Metrics endpoint failed")
+			}
+		}()
+	}
+
 	// Start sync loop
 	if err := manager.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("Sync manager failed")
 	}
 
+	// Flush buffered spans before exiting
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Warn().Err(err).Msg("Failed to flush traces")
+	}
+
 	log.Info().Msg("Daemon stopped")
 }
 
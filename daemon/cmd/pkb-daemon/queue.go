@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/control"
+)
+
+// exportPageSize is how many requests are fetched at a time by queue export
+const exportPageSize = 100
+
+func runQueue(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pkb-daemon queue list|show|retry|retry-all|drop|purge|export")
+	}
+
+	fs, offline, asJSON := newFlagSet("queue " + args[0])
+	limit := fs.Int("limit", 100, "Maximum number of requests to list")
+	all := fs.Bool("all", false, "With purge: delete every request, not only expired ones")
+	output := fs.String("o", "", "With export: write to this file instead of stdout")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	st, closeStore, err := openStore(ctx, cfg, *offline)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	switch args[0] {
+	case "list":
+		requests, err := st.QueueList(ctx, *limit, 0, false)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(requests)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSOURCE\tRETRIES\tNEXT RETRY\tCREATED\tSUMMARY")
+		for _, req := range requests {
+			fmt.Fprintf(w, "%d\t%s\t%d/%d\t%s\t%s\t%s\n",
+				req.ID, orDash(req.Source), req.Retries, req.MaxRetries, formatTime(req.NextRetryAt), formatTime(req.CreatedAt), req.Summary)
+		}
+		return w.Flush()
+
+	case "show":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		req, err := st.QueueGet(ctx, id)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(req)
+		}
+		return printRequest(req)
+
+	case "retry":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		if err := st.QueueRetry(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Request %d scheduled for immediate retry\n", id)
+		return nil
+
+	case "retry-all":
+		n, err := st.QueueRetryAll(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d requests scheduled for immediate retry\n", n)
+		return nil
+
+	case "drop":
+		id, err := requestID(fs.Args())
+		if err != nil {
+			return err
+		}
+		if err := st.QueueDrop(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Request %d dropped\n", id)
+		return nil
+
+	case "purge":
+		n, err := st.QueuePurge(ctx, *all)
+		if err != nil {
+			return err
+		}
+		if *all {
+			fmt.Printf("%d requests deleted\n", n)
+		} else {
+			fmt.Printf("%d expired requests deleted\n", n)
+		}
+		return nil
+
+	case "export":
+		out := io.Writer(os.Stdout)
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		n, err := exportQueue(ctx, st, out)
+		if err != nil {
+			return err
+		}
+		if *output != "" {
+			fmt.Printf("%d requests exported to %s\n", n, *output)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown queue command %q", args[0])
+	}
+}
+
+func requestID(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("expected a single request id")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid request id %q", args[0])
+	}
+	return id, nil
+}
+
+// printRequest prints a request's metadata followed by its pretty-printed payload
+func printRequest(req *control.QueuedRequest) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%d\n", req.ID)
+	fmt.Fprintf(w, "Summary:\t%s\n", req.Summary)
+	if req.Source != "" {
+		fmt.Fprintf(w, "Source:\t%s (#%d)\n", req.Source, req.Seq)
+	}
+	fmt.Fprintf(w, "Retries:\t%d/%d\n", req.Retries, req.MaxRetries)
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(req.CreatedAt))
+	fmt.Fprintf(w, "Next retry:\t%s\n", formatTime(req.NextRetryAt))
+	if req.LastError != "" {
+		fmt.Fprintf(w, "Last error:\t%s\n", req.LastError)
+	}
+	fmt.Fprintf(w, "Payload:\t%d bytes\n", req.PayloadSize)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(req.Errors) > 0 {
+		fmt.Println("\nErrors:")
+		for _, e := range req.Errors {
+			fmt.Printf("  %s  %s\n", formatTime(e.At), e.Error)
+		}
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, req.Payload, "", "  "); err != nil {
+		// Not JSON; print as is
+		fmt.Printf("\n%s\n", req.Payload)
+		return nil
+	}
+	fmt.Printf("\n%s\n", pretty.String())
+	return nil
+}
+
+// exportQueue writes every queued request, with payload, as one JSON object per line
+func exportQueue(ctx context.Context, st store, out io.Writer) (int, error) {
+	enc := json.NewEncoder(out)
+	count := 0
+	for offset := 0; ; offset += exportPageSize {
+		requests, err := st.QueueList(ctx, exportPageSize, offset, true)
+		if err != nil {
+			return count, err
+		}
+		for _, req := range requests {
+			if err := enc.Encode(req); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(requests) < exportPageSize {
+			return count, nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/export"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/sink"
+)
+
+// runReplay sends the records of a JSONL export to the backend, in order
+func runReplay(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	input := fs.String("f", "-", "Export to read, or - for stdin")
+	skip := fs.Int("skip", 0, "Skip this many lines, to resume an interrupted replay")
+	source := fs.String("source", "", "Only replay records of this source")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("failed to open export: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	client, err := api.NewClient(cfg.Backend)
+	if err != nil {
+		return err
+	}
+	backend := sink.NewBackend(client)
+	if err := backend.HealthCheck(ctx); err != nil {
+		return fmt.Errorf("backend not reachable: %w", err)
+	}
+
+	sent, rejected := 0, 0
+	err = export.Read(r, func(line int, rec export.Record) error {
+		if line <= *skip || (*source != "" && rec.Source != *source) {
+			return nil
+		}
+
+		err := sink.Deliver(ctx, backend, rec.Source, rec.Type, rec.Payload)
+		switch {
+		case err == nil:
+			sent++
+		case errors.Is(err, sink.ErrUnknownRequestType):
+			return fmt.Errorf("line %d: %w %q", line, err, rec.Type)
+		case api.IsTemporaryError(err):
+			// Stop so nothing later overtakes the failed record
+			return fmt.Errorf("line %d: %w; resume with -skip %d", line, err, line-1)
+		default:
+			// The backend will never take it; keep going like the queue does
+			rejected++
+			log.Warn().
+				Err(err).
+				Int("line", line).
+				Str("type", string(rec.Type)).
+				Str("summary", queue.Summarize(rec.Type, rec.Payload)).
+				Msg("Record rejected by backend")
+		}
+		return nil
+	})
+
+	fmt.Printf("Replayed %d records, %d rejected\n", sent, rejected)
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/sink"
+)
+
+// runSearch looks things up in the local archive. It reads the database
+// directly, so it works while the daemon runs and without the backend.
+func runSearch(ctx context.Context, cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	from := fs.String("from", "", "Only communications with this contact, by name, address or number")
+	since := fs.String("since", "", "Only items from this day (2006-01-02) or this long ago (30d, 2w, 12h) on")
+	until := fs.String("until", "", "Only items before this day or this long ago")
+	limit := fs.Int("limit", 50, "Show at most this many results")
+	asJSON := fs.Bool("json", false, "Print JSON instead of text")
+
+	// Flags may come before or after the search words
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(words) == 0 && *from == "" && *since == "" && *until == "" {
+		return errors.New("usage: pkb-daemon search \"words\" [-from contact] [-since 30d] [-until day] [-limit n]")
+	}
+
+	q := sink.Query{Text: strings.Join(words, " "), From: *from, Limit: *limit}
+	var err error
+	if q.Since, err = parseSince(*since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if q.Until, err = parseSince(*until); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	if _, err := os.Stat(cfg.Sinks.Archive.Path); err != nil {
+		return fmt.Errorf("no archive at %s; enable sinks.archive to keep one", cfg.Sinks.Archive.Path)
+	}
+	archive, err := sink.OpenArchive(cfg.Sinks.Archive.Path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	hits, err := archive.Search(ctx, q)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(hits)
+	}
+	if len(hits) == 0 {
+		fmt.Println("No matches")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tKIND\tSOURCE\tCONTACT\tTEXT")
+	for _, h := range hits {
+		text := h.Snippet
+		if h.Title != "" {
+			text = h.Title + ": " + text
+		}
+		contact := h.Contact
+		if contact != "" && h.Direction == "outbound" {
+			contact = "to " + contact
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			formatTime(h.Time), h.Kind, orDash(h.Source), orDash(contact), truncate(oneLine(text), 100))
+	}
+	return w.Flush()
+}
+
+// parseSince reads a day, or an age like 30d, 2w or 12h counted back from now
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		return time.Now().AddDate(0, 0, -n), nil
+	}
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "w")); err == nil && strings.HasSuffix(s, "w") {
+		return time.Now().AddDate(0, 0, -7*n), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return parseDay(s)
+}
+
+// oneLine joins the lines of s for a table cell
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
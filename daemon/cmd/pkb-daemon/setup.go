@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/classify"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/filter"
+	"pkb-daemon/internal/identity"
+	"pkb-daemon/internal/redact"
+	"pkb-daemon/internal/sink"
+	"pkb-daemon/internal/sources/calendar"
+	"pkb-daemon/internal/sources/calls"
+	"pkb-daemon/internal/sources/contacts"
+	"pkb-daemon/internal/sources/gmail"
+	"pkb-daemon/internal/sources/imessage"
+	"pkb-daemon/internal/sources/notes"
+	"pkb-daemon/internal/sync"
+)
+
+// setupSources configures the manager's pipeline and registers every enabled
+// source. Sources that fail to initialize are skipped, except iMessage and
+// the contacts an address-book allowlist needs.
+func setupSources(cfg *config.Config, manager *sync.Manager) error {
+	// Phone numbers from every source are normalized against the same region
+	phones, err := identity.NewNormalizer(cfg.Identity.DefaultRegion)
+	if err != nil {
+		return fmt.Errorf("invalid identity configuration: %w", err)
+	}
+
+	// Blocklist and allowlist are applied by the manager to every source
+	f, err := filter.New(cfg.Blocklist, cfg.Allowlist, phones)
+	if err != nil {
+		return fmt.Errorf("invalid blocklist/allowlist configuration: %w", err)
+	}
+	if f.NeedsAddressBook() && !cfg.Sources.Contacts.Enabled {
+		return errors.New("allowlist.address_book requires sources.contacts to be enabled")
+	}
+	manager.SetFilter(f)
+
+	// Automated senders and one-time codes are tagged, redacted or dropped
+	if cfg.Classifier.Enabled {
+		c, err := classify.New(cfg.Classifier)
+		if err != nil {
+			return fmt.Errorf("invalid classifier configuration: %w", err)
+		}
+		manager.SetClassifier(c)
+	}
+
+	// Sensitive content is masked before anything is sent to the backend
+	if cfg.Redaction.Enabled {
+		r, err := redact.New(cfg.Redaction)
+		if err != nil {
+			return fmt.Errorf("invalid redaction configuration: %w", err)
+		}
+		manager.SetRedactor(r)
+	}
+
+	// Register communication sources
+
+	// iMessage
+	if cfg.Sources.IMessage.Enabled {
+		src, err := imessage.New(cfg.Sources.IMessage, phones)
+		if err != nil {
+			return fmt.Errorf("failed to initialize iMessage source: %w", err)
+		}
+		manager.RegisterSource(src)
+	}
+
+	// Gmail
+	if cfg.Sources.Gmail.Enabled {
+		src, err := gmail.New(cfg.Sources.Gmail)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to initialize Gmail source (skipping)")
+		} else {
+			manager.RegisterSource(src)
+		}
+	}
+
+	// Phone Calls
+	if cfg.Sources.Calls.Enabled {
+		src, err := calls.New(cfg.Sources.Calls, phones)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to initialize Phone Calls source (skipping)")
+		} else {
+			manager.RegisterSource(src)
+		}
+	}
+
+	// Register contacts sources
+
+	// Apple Contacts
+	if cfg.Sources.Contacts.Enabled {
+		src, err := contacts.New(cfg.Sources.Contacts, phones)
+		if err != nil && f.NeedsAddressBook() {
+			// Sources filtered by the address book would wait for it forever
+			return fmt.Errorf("failed to initialize Apple Contacts source, which allowlist.address_book needs: %w", err)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to initialize Apple Contacts source (skipping)")
+		} else {
+			manager.RegisterContactsSource(src)
+		}
+	}
+
+	// Register calendar sources
+
+	// Calendar (Google + Apple)
+	if cfg.Sources.Calendar.Enabled {
+		src, err := calendar.New(cfg.Sources.Calendar)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to initialize Calendar source (skipping)")
+		} else {
+			manager.RegisterCalendarSource(src)
+		}
+	}
+
+	// Register notes sources
+
+	// Apple Notes
+	if cfg.Sources.Notes.Enabled {
+		src, err := notes.New(cfg.Sources.Notes)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to initialize Apple Notes source (skipping)")
+		} else {
+			manager.RegisterNotesSource(src)
+		}
+	}
+
+	return nil
+}
+
+// openSinks opens every configured sink. The backend comes first so its
+// responses are the ones the manager sees.
+func openSinks(cfg *config.Config) (sink.Sink, error) {
+	var sinks []sink.Sink
+	closeAll := func() {
+		for _, s := range sinks {
+			s.Close()
+		}
+	}
+
+	if !cfg.Sinks.LocalOnly {
+		client, err := api.NewClient(cfg.Backend)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.NewBackend(client))
+	}
+	if cfg.Sinks.Archive.Enabled {
+		archive, err := sink.OpenArchive(cfg.Sinks.Archive.Path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sinks = append(sinks, archive)
+		log.Info().Str("path", cfg.Sinks.Archive.Path).Msg("Archive sink enabled")
+	}
+	if cfg.Sinks.File.Enabled {
+		file, err := sink.OpenFile(cfg.Sinks.File.Path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sinks = append(sinks, file)
+		log.Info().Str("path", cfg.Sinks.File.Path).Msg("File sink enabled")
+	}
+
+	if len(sinks) == 0 {
+		return nil, errors.New("sinks.local_only needs the archive or file sink enabled")
+	}
+	return sink.NewFanout(sinks...), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"pkb-daemon/internal/config"
+)
+
+func runState(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pkb-daemon state show|set|reset|history|rollback")
+	}
+
+	fs, offline, asJSON := newFlagSet("state " + args[0])
+	limit := fs.Int("limit", 20, "Number of history entries to show")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	st, closeStore, err := openStore(ctx, cfg, *offline)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	switch args[0] {
+	case "show":
+		checkpoints, err := st.Checkpoints(ctx)
+		if err != nil {
+			return err
+		}
+		if fs.NArg() > 0 {
+			source := fs.Arg(0)
+			checkpoint, ok := checkpoints[source]
+			if !ok {
+				return fmt.Errorf("no checkpoint for %q", source)
+			}
+			checkpoints = map[string]string{source: checkpoint}
+		}
+		if *asJSON {
+			return printJSON(checkpoints)
+		}
+
+		sources := make([]string, 0, len(checkpoints))
+		for source := range checkpoints {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SOURCE\tCHECKPOINT")
+		for _, source := range sources {
+			fmt.Fprintf(w, "%s\t%s\n", source, checkpoints[source])
+		}
+		return w.Flush()
+
+	case "set":
+		if fs.NArg() != 2 {
+			return errors.New("usage: pkb-daemon state set <source> <checkpoint>")
+		}
+		if err := st.SetCheckpoint(ctx, fs.Arg(0), fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Printf("Checkpoint of %s set to %s\n", fs.Arg(0), fs.Arg(1))
+		return nil
+
+	case "reset":
+		if fs.NArg() != 1 {
+			return errors.New("usage: pkb-daemon state reset <source>")
+		}
+		if err := st.ResetCheckpoint(ctx, fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("Checkpoint of %s reset; the next sync starts from scratch\n", fs.Arg(0))
+		return nil
+
+	case "history":
+		if fs.NArg() != 1 {
+			return errors.New("usage: pkb-daemon state history <source>")
+		}
+		changes, err := st.CheckpointHistory(ctx, fs.Arg(0), *limit)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(changes)
+		}
+		if len(changes) == 0 {
+			fmt.Printf("No checkpoint history for %s\n", fs.Arg(0))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCHANGED\tREASON\tCHECKPOINT")
+		for _, c := range changes {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", c.ID, formatTime(c.ChangedAt), c.Reason, orDash(c.Checkpoint))
+		}
+		return w.Flush()
+
+	case "rollback":
+		if fs.NArg() != 2 {
+			return errors.New("usage: pkb-daemon state rollback <source> <id>")
+		}
+		id, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid history id %q", fs.Arg(1))
+		}
+		if err := st.RollbackCheckpoint(ctx, fs.Arg(0), id); err != nil {
+			return err
+		}
+		fmt.Printf("Checkpoint of %s restored from history entry %d\n", fs.Arg(0), id)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown state command %q", args[0])
+	}
+}
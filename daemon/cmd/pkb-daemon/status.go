@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"pkb-daemon/internal/config"
+)
+
+func runStatus(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, offline, asJSON := newFlagSet("status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, closeStore, err := openStore(ctx, cfg, *offline)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	status, err := st.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(status)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSTATE\tLAST SUCCESS\tNEXT RUN\tFETCHED\tSENT\tFILTERED\tFAILED\tLAST ERROR")
+	for _, src := range status.Sources {
+		state := "idle"
+		switch {
+		case src.Running:
+			state = "running"
+		case src.Paused:
+			state = "paused"
+		case src.Blocked:
+			state = "queue full"
+		case src.BackendDown:
+			state = "backend down"
+		case src.ConsecutiveFailures > 0:
+			state = fmt.Sprintf("failing (%d)", src.ConsecutiveFailures)
+		}
+		lastError := "-"
+		if src.LastError != "" {
+			lastError = fmt.Sprintf("%s (%s)", src.LastError, formatTime(src.LastErrorAt))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n",
+			src.Name, state, formatTime(src.LastSuccess), formatTime(src.NextRun),
+			src.ItemsFetched, src.ItemsSent, src.ItemsFiltered, src.ItemsFailed, lastError)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	if status.Queue == nil {
+		fmt.Println("Queue: disabled")
+		return nil
+	}
+	fmt.Printf("Queue: %d pending, %d expired", status.Queue.PendingCount, status.Queue.ExpiredCount)
+	if status.Queue.OldestPending != nil {
+		fmt.Printf(", oldest %s", formatTime(*status.Queue.OldestPending))
+	}
+	if status.Queue.NextRetry != nil {
+		fmt.Printf(", next retry %s", formatTime(*status.Queue.NextRetry))
+	}
+	if status.Queue.DeadLetters > 0 {
+		fmt.Printf(", %d dead letters", status.Queue.DeadLetters)
+	}
+	fmt.Printf(", %s stored", formatBytes(status.Queue.SizeBytes))
+	if status.Queue.MaxBytes > 0 || status.Queue.MaxCount > 0 {
+		fmt.Printf(" (%.0f%% of budget, %s when full)", status.Queue.Pressure*100, status.Queue.Eviction)
+	}
+	fmt.Println()
+	return nil
+}
+
+// formatBytes prints a size with a binary unit, e.g. "12.3 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
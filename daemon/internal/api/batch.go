@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// countingWriter counts the bytes written to it and drops them
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// encodedSizes measures the JSON of every item without keeping it, so
+// chunking doesn't hold an encoded copy of the whole batch
+func encodedSizes[T any](items []T) ([]int64, error) {
+	sizes := make([]int64, len(items))
+	for i, item := range items {
+		var n countingWriter
+		if err := json.NewEncoder(&n).Encode(item); err != nil {
+			return nil, fmt.Errorf("%w: failed to encode item %d: %w", ErrPermanent, i, err)
+		}
+		sizes[i] = int64(n) - 1 // Encode adds a newline
+	}
+	return sizes, nil
+}
+
+// chunks splits items into requests of at most maxItems items, 0 for no
+// limit, whose JSON stays within maxBytes, 0 for no limit. sizes are the
+// lengths of the items' JSON, needed only with a byte limit. An item larger
+// than maxBytes goes alone; if the backend refuses it, bisecting reports it.
+func chunks[T any](items []T, sizes []int64, maxItems int, maxBytes int64) [][]T {
+	var out [][]T
+	start := 0
+	var size int64
+	for i := range items {
+		itemSize := int64(1) // separating comma
+		if sizes != nil {
+			itemSize += sizes[i]
+		}
+
+		full := maxItems > 0 && i-start >= maxItems
+		over := maxBytes > 0 && i > start && size+itemSize > maxBytes
+		if full || over {
+			out = append(out, items[start:i])
+			start, size = i, 0
+		}
+		size += itemSize
+	}
+	if start < len(items) {
+		out = append(out, items[start:])
+	}
+	return out
+}
+
+// sendChunked sends items in chunks that fit the backend's limits, bisecting
+// any chunk it rejects as a whole, and combines the results. Each chunk is
+// encoded as its request is sent.
+func sendChunked[T any, R any, PR batchResponse[R]](ctx context.Context, items []T, maxItems int, maxBytes int64, send func(context.Context, []T) (*R, error)) (*R, error) {
+	// Sizes only matter with a byte limit
+	var sizes []int64
+	if maxBytes > 0 {
+		var err error
+		if sizes, err = encodedSizes(items); err != nil {
+			return nil, err
+		}
+	}
+	parts := chunks(items, sizes, maxItems, maxBytes)
+	if len(parts) <= 1 {
+		return bisect[T, R, PR](ctx, items, send)
+	}
+	log.Debug().
+		Int("count", len(items)).
+		Int("requests", len(parts)).
+		Msg("Splitting batch to fit request limits")
+
+	total := PR(new(R))
+	offset := 0
+	for _, part := range parts {
+		result, err := bisect[T, R, PR](ctx, part, send)
+		if err != nil {
+			return nil, err
+		}
+		// Adjust error indices to reflect position in original array
+		total.merge(result, offset)
+		offset += len(part)
+	}
+	return total, nil
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// items returns encoded items of the given sizes in bytes, and their sizes
+func items(sizes ...int) ([]string, []int64) {
+	out := make([]string, len(sizes))
+	measured := make([]int64, len(sizes))
+	for i, n := range sizes {
+		out[i] = strings.Repeat("x", n-2)
+		measured[i] = int64(n)
+	}
+	return out, measured
+}
+
+func TestChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		sizes    []int
+		maxItems int
+		maxBytes int64
+		want     []int // items per chunk
+	}{
+		{"no limits", []int{10, 10, 10}, 0, 0, []int{3}},
+		{"empty", nil, 2, 100, nil},
+		{"item limit", []int{10, 10, 10, 10, 10}, 2, 0, []int{2, 2, 1}},
+		// Each item counts one more byte for its comma
+		{"byte limit", []int{10, 10, 10, 10}, 0, 22, []int{2, 2}},
+		{"exactly full", []int{9, 9, 9}, 0, 30, []int{3}},
+		{"one byte over", []int{9, 9, 10}, 0, 30, []int{2, 1}},
+		{"large item alone", []int{10, 50, 10}, 0, 30, []int{1, 1, 1}},
+		{"large first item", []int{50, 10, 10}, 0, 30, []int{1, 2}},
+		{"both limits", []int{5, 5, 5, 30, 5}, 2, 20, []int{2, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, sizes := items(tt.sizes...)
+			measured, err := encodedSizes(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(measured, sizes) {
+				t.Fatalf("encodedSizes = %v, want %v", measured, sizes)
+			}
+			parts := chunks(in, measured, tt.maxItems, tt.maxBytes)
+
+			var got []int
+			var joined []string
+			for _, p := range parts {
+				got = append(got, len(p))
+				joined = append(joined, p...)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("chunk sizes = %v, want %v", got, tt.want)
+			}
+			if len(joined) != len(in) {
+				t.Errorf("chunks hold %d items, want %d", len(joined), len(in))
+			}
+		})
+	}
+}
+
+func TestSendChunkedOffsetsErrors(t *testing.T) {
+	comms := []Communication{{SourceID: "0"}, {SourceID: "1"}, {SourceID: "2"}, {SourceID: "3"}, {SourceID: "4"}}
+
+	var requests [][]string
+	send := func(_ context.Context, batch []Communication) (*BatchUpsertResponse, error) {
+		var ids []string
+		resp := &BatchUpsertResponse{}
+		for i, c := range batch {
+			ids = append(ids, c.SourceID)
+			if c.SourceID == "3" {
+				resp.Errors = append(resp.Errors, BatchError{Index: i, Error: "invalid"})
+				continue
+			}
+			resp.Inserted++
+		}
+		requests = append(requests, ids)
+		return resp, nil
+	}
+
+	result, err := sendChunked(context.Background(), comms, 2, 0, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("sent %d requests, want 3: %v", len(requests), requests)
+	}
+	if result.Inserted != 4 {
+		t.Errorf("inserted = %d, want 4", result.Inserted)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Index != 3 {
+		t.Errorf("errors = %+v, want one at index 3", result.Errors)
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// batchResponse is implemented by the responses of the batch endpoints so
+// partial results can be combined
+type batchResponse[R any] interface {
+	*R
+	// merge adds the counts and errors of other, whose items start at offset
+	merge(other *R, offset int)
+	// reject records a single item the backend refused
+	reject(e BatchError)
+}
+
+func (r *BatchUpsertResponse) merge(other *BatchUpsertResponse, offset int) {
+	r.Inserted += other.Inserted
+	r.Updated += other.Updated
+	r.Errors = appendErrors(r.Errors, other.Errors, offset)
+}
+
+func (r *BatchUpsertResponse) reject(e BatchError) { r.Errors = append(r.Errors, e) }
+
+func (r *ContactsImportResponse) merge(other *ContactsImportResponse, offset int) {
+	r.Created += other.Created
+	r.Updated += other.Updated
+	r.Merged += other.Merged
+	r.Errors = appendErrors(r.Errors, other.Errors, offset)
+}
+
+func (r *ContactsImportResponse) reject(e BatchError) { r.Errors = append(r.Errors, e) }
+
+func (r *CalendarEventsResponse) merge(other *CalendarEventsResponse, offset int) {
+	r.Inserted += other.Inserted
+	r.Updated += other.Updated
+	r.Errors = appendErrors(r.Errors, other.Errors, offset)
+}
+
+func (r *CalendarEventsResponse) reject(e BatchError) { r.Errors = append(r.Errors, e) }
+
+func (r *AppleNotesResponse) merge(other *AppleNotesResponse, offset int) {
+	r.Inserted += other.Inserted
+	r.Updated += other.Updated
+	r.Errors = appendErrors(r.Errors, other.Errors, offset)
+}
+
+func (r *AppleNotesResponse) reject(e BatchError) { r.Errors = append(r.Errors, e) }
+
+// appendErrors appends errors with their indices shifted by offset
+func appendErrors(dst, src []BatchError, offset int) []BatchError {
+	for _, e := range src {
+		e.Index += offset
+		dst = append(dst, e)
+	}
+	return dst
+}
+
+// isBisectable reports whether the backend rejected a batch as a whole in a
+// way that may be caused by a few of its items
+func isBisectable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusRequestEntityTooLarge
+}
+
+// bisect sends items with send. If the backend rejects the batch with 400 or
+// 413, it is split in half and each half is sent on its own, down to single
+// items. Items rejected on their own are reported in the response's errors
+// instead of failing the whole batch.
+func bisect[T any, R any, PR batchResponse[R]](ctx context.Context, items []T, send func(context.Context, []T) (*R, error)) (*R, error) {
+	result, err := send(ctx, items)
+	if err == nil || !isBisectable(err) {
+		return result, err
+	}
+
+	var apiErr *APIError
+	errors.As(err, &apiErr)
+
+	total := PR(new(R))
+	if len(items) == 1 {
+		total.reject(BatchError{Index: 0, Error: err.Error(), StatusCode: apiErr.StatusCode})
+		return total, nil
+	}
+
+	log.Debug().
+		Int("count", len(items)).
+		Int("status", apiErr.StatusCode).
+		Msg("Batch rejected, bisecting")
+
+	mid := len(items) / 2
+	for _, half := range []struct {
+		offset int
+		items  []T
+	}{{0, items[:mid]}, {mid, items[mid:]}} {
+		part, err := bisect[T, R, PR](ctx, half.items, send)
+		if err != nil {
+			return nil, err
+		}
+		total.merge(part, half.offset)
+	}
+	return total, nil
+}
+
+// ItemErrors is returned when the backend accepted a request but rejected
+// some of its items
+type ItemErrors struct {
+	Errors []BatchError
+	Total  int
+}
+
+func (e *ItemErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, item := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("item %d: %s", item.Index, item.Error))
+	}
+	return fmt.Sprintf("%d of %d items failed: %s", len(e.Errors), e.Total, strings.Join(msgs, "; "))
+}
+
+// Unwrap classifies the failure: permanent only if every item was rejected
+// outright with a 4xx
+func (e *ItemErrors) Unwrap() error {
+	for _, item := range e.Errors {
+		if item.StatusCode < 400 || item.StatusCode >= 500 {
+			return ErrTemporary
+		}
+	}
+	return ErrPermanent
+}
+
+// CheckItems returns an *ItemErrors if any of total items failed
+func CheckItems(errs []BatchError, total int) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ItemErrors{Errors: errs, Total: total}
+}
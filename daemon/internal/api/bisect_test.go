@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// sendRejecting answers like the backend: a batch containing a bad item is
+// rejected as a whole with status, otherwise every item is inserted
+func sendRejecting(bad []int, status int, calls *int) func(context.Context, []int) (*BatchUpsertResponse, error) {
+	return func(_ context.Context, items []int) (*BatchUpsertResponse, error) {
+		*calls++
+		for _, item := range items {
+			if slices.Contains(bad, item) {
+				return nil, &APIError{StatusCode: status, Message: "bad item"}
+			}
+		}
+		return &BatchUpsertResponse{Inserted: len(items)}, nil
+	}
+}
+
+func TestBisect(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	tests := []struct {
+		name     string
+		bad      []int
+		status   int
+		inserted int
+		errIdx   []int
+	}{
+		{"accepted", nil, http.StatusBadRequest, 10, nil},
+		{"one bad item", []int{6}, http.StatusBadRequest, 9, []int{6}},
+		{"first and last", []int{0, 9}, http.StatusBadRequest, 8, []int{0, 9}},
+		{"neighbours", []int{3, 4}, http.StatusBadRequest, 8, []int{3, 4}},
+		{"too large", []int{7}, http.StatusRequestEntityTooLarge, 9, []int{7}},
+		{"all bad", items, http.StatusBadRequest, 0, items},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			result, err := bisect[int, BatchUpsertResponse](context.Background(), items, sendRejecting(tt.bad, tt.status, &calls))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Inserted != tt.inserted {
+				t.Errorf("inserted = %d, want %d", result.Inserted, tt.inserted)
+			}
+
+			var idx []int
+			for _, e := range result.Errors {
+				if e.StatusCode != tt.status {
+					t.Errorf("item %d status = %d, want %d", e.Index, e.StatusCode, tt.status)
+				}
+				idx = append(idx, e.Index)
+			}
+			if !slices.Equal(idx, tt.errIdx) {
+				t.Errorf("error indices = %v, want %v", idx, tt.errIdx)
+			}
+		})
+	}
+}
+
+func TestBisectKeepsItemErrorIndices(t *testing.T) {
+	// The backend accepts the batch once item 2 is split off, but reports
+	// item 4 itself; its index must be relative to the whole batch
+	items := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	send := func(_ context.Context, batch []int) (*BatchUpsertResponse, error) {
+		if slices.Contains(batch, 2) && len(batch) > 1 {
+			return nil, &APIError{StatusCode: http.StatusBadRequest}
+		}
+		resp := &BatchUpsertResponse{}
+		for i, item := range batch {
+			if item == 4 {
+				resp.Errors = append(resp.Errors, BatchError{Index: i, Error: "invalid"})
+				continue
+			}
+			resp.Inserted++
+		}
+		return resp, nil
+	}
+
+	result, err := bisect[int, BatchUpsertResponse](context.Background(), items, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Index != 4 {
+		t.Errorf("errors = %+v, want one at index 4", result.Errors)
+	}
+	if result.Inserted != 7 {
+		t.Errorf("inserted = %d, want 7", result.Inserted)
+	}
+}
+
+func TestBisectStopsOnOtherErrors(t *testing.T) {
+	var calls int
+	_, err := bisect[int, BatchUpsertResponse](context.Background(), []int{1, 2, 3, 4}, sendRejecting([]int{1}, http.StatusServiceUnavailable, &calls))
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("err = %v, want the 503", err)
+	}
+	if calls != 1 {
+		t.Errorf("sent %d requests, want 1", calls)
+	}
+}
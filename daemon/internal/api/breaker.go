@@ -0,0 +1,129 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCircuitOpen is returned without sending anything while the backend is
+// considered down
+var ErrCircuitOpen = fmt.Errorf("backend circuit open: %w", ErrTemporary)
+
+// breaker stops requests after threshold consecutive failures. Once cooldown
+// has passed a single request probes the backend: success closes the circuit,
+// failure keeps it open for another cooldown. A nil breaker lets everything
+// through.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero while closed
+	probing  bool
+	onChange func(open bool)
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen unless a request may be sent
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// success records a request the backend answered, closing the circuit
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	wasOpen := !b.openedAt.IsZero()
+	b.failures = 0
+	b.openedAt = time.Time{}
+	b.probing = false
+	onChange := b.onChange
+	b.mu.Unlock()
+
+	if wasOpen {
+		log.Info().Msg("Backend reachable again, circuit closed")
+		if onChange != nil {
+			onChange(false)
+		}
+	}
+}
+
+// failure records a request that failed because the backend is unreachable
+// or overloaded
+func (b *breaker) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.failures++
+	if b.probing {
+		// The probe failed, wait another cooldown
+		b.probing = false
+		b.openedAt = time.Now()
+		b.mu.Unlock()
+		return
+	}
+	opened := b.openedAt.IsZero() && b.failures >= b.threshold
+	if opened {
+		b.openedAt = time.Now()
+	}
+	failures := b.failures
+	onChange := b.onChange
+	b.mu.Unlock()
+
+	if opened {
+		log.Warn().
+			Int("failures", failures).
+			Dur("cooldown", b.cooldown).
+			Msg("Backend unreachable, circuit open")
+		if onChange != nil {
+			onChange(true)
+		}
+	}
+}
+
+// abandon releases a probe that ended without an answer, e.g. on shutdown
+func (b *breaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// open reports whether requests are refused right now, the same way allow
+// decides: during the cooldown and while a probe is in flight after it
+func (b *breaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero() && (b.probing || time.Since(b.openedAt) < b.cooldown)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := newBreaker(1, time.Millisecond)
+	b.failure()
+	if !b.open() || b.allow() == nil {
+		t.Fatal("circuit closed after reaching the threshold")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if b.open() {
+		t.Fatal("circuit open after the cooldown")
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+
+	// While the probe is in flight everything else is refused, and open
+	// says so
+	if b.allow() == nil {
+		t.Error("second request allowed during the probe")
+	}
+	if !b.open() {
+		t.Error("open() = false during the probe, want true like allow")
+	}
+
+	b.success()
+	if b.open() || b.allow() != nil {
+		t.Error("circuit still open after the probe succeeded")
+	}
+}
@@ -1,13 +1,22 @@
 package api
 
 import (
-	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/metrics"
 )
 
 // Error types for retry classification
@@ -23,6 +32,19 @@ type APIError struct {
 	StatusCode int
 	Message    string
 	Temporary  bool
+	RetryAfter time.Duration // as asked for by a 429 or 503, if at all
+}
+
+// newAPIError reads the error a backend response carries
+func newAPIError(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(resp.Body)
+	err := &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    string(body),
+		Temporary:  isTemporaryStatusCode(resp.StatusCode),
+	}
+	err.RetryAfter, _ = retryAfter(resp)
+	return err
 }
 
 func (e *APIError) Error() string {
@@ -45,6 +67,9 @@ func IsTemporaryError(err error) bool {
 	if errors.Is(err, ErrTemporary) {
 		return true
 	}
+	if errors.Is(err, ErrPermanent) {
+		return false
+	}
 	var apiErr *APIError
 	if errors.As(err, &apiErr) {
 		return apiErr.Temporary
@@ -53,24 +78,86 @@ func IsTemporaryError(err error) bool {
 	return true
 }
 
+// RetryAfter returns how long the backend asked to wait before err's request
+// is retried, 0 if it didn't ask
+func RetryAfter(err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+// Client talks to the backend. Upserts are retried with backoff, and after
+// repeated failures a circuit breaker refuses requests for a while instead of
+// hammering a backend that is down.
 type Client struct {
 	baseURL    string
 	apiKey     string
 	httpClient *http.Client
+	retry      retryPolicy
+	breaker    *breaker
+
+	compression     string      // auto, gzip or none
+	gzip            atomic.Bool // cleared when the backend refuses gzip in auto mode
+	maxRequestBytes int64
+	signingSecret   []byte // requests are signed if set
 }
 
-func NewClient(baseURL, apiKey string) *Client {
-	return &Client{
-		baseURL: baseURL,
-		apiKey:  apiKey,
+func NewClient(cfg config.BackendConfig) (*Client, error) {
+	switch cfg.Compression {
+	case "auto", "gzip", "none":
+	default:
+		return nil, fmt.Errorf("unknown backend compression %q (expected auto, gzip or none)", cfg.Compression)
+	}
+	if err := checkTransport(cfg); err != nil {
+		return nil, err
+	}
+	tlsCfg, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	c := &Client{
+		baseURL: cfg.URL,
+		apiKey:  cfg.APIKey,
+		retry: retryPolicy{
+			maxAttempts:   cfg.Retry.MaxAttempts,
+			initial:       time.Duration(cfg.Retry.InitialBackoffMillis) * time.Millisecond,
+			max:           time.Duration(cfg.Retry.MaxBackoffSeconds) * time.Second,
+			maxRetryAfter: time.Duration(cfg.Retry.MaxRetryAfterSeconds) * time.Second,
+		},
+		breaker:         newBreaker(cfg.CircuitBreaker.FailureThreshold, time.Duration(cfg.CircuitBreaker.CooldownSeconds)*time.Second),
+		compression:     cfg.Compression,
+		maxRequestBytes: max(int64(cfg.MaxRequestMB), 0) << 20,
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second,
+			// Creates a client span per request and injects traceparent so
+			// backend traces join the daemon's. Requests outside a trace, such
+			// as the queue's periodic health checks, are left alone.
+			Transport: otelhttp.NewTransport(transport,
+				otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+					return r.Method + " " + r.URL.Path
+				}),
+				otelhttp.WithFilter(func(r *http.Request) bool {
+					return trace.SpanContextFromContext(r.Context()).IsValid()
+				}),
+			),
 		},
 	}
+	c.gzip.Store(cfg.Compression != "none")
+	if cfg.Signing.Secret != "" {
+		c.signingSecret = []byte(cfg.Signing.Secret)
+	}
+	return c, nil
 }
 
-func (c *Client) HealthCheck() error {
-	resp, err := c.get("/api/health")
+// HealthCheck asks the backend whether it is up. It is sent even while the
+// circuit is open, and closes it when the backend answers.
+func (c *Client) HealthCheck(ctx context.Context) error {
+	resp, err := c.get(ctx, "/api/health")
 	if err != nil {
 		return err
 	}
@@ -79,9 +166,23 @@ func (c *Client) HealthCheck() error {
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("health check returned %d", resp.StatusCode)
 	}
+	c.breaker.success()
 	return nil
 }
 
+// CircuitOpen reports whether requests fail fast because the backend is down
+func (c *Client) CircuitOpen() bool {
+	return c.breaker.open()
+}
+
+// OnCircuitChange calls fn when the circuit opens and when it closes again.
+// It must be set before the client is used.
+func (c *Client) OnCircuitChange(fn func(open bool)) {
+	if c.breaker != nil {
+		c.breaker.onChange = fn
+	}
+}
+
 type BatchUpsertRequest struct {
 	Communications []Communication `json:"communications"`
 }
@@ -120,56 +221,22 @@ type BatchUpsertResponse struct {
 type BatchError struct {
 	Index int    `json:"index"`
 	Error string `json:"error"`
+	// StatusCode is set when the item was isolated by bisecting a batch the
+	// backend rejected as a whole, e.g. 400
+	StatusCode int `json:"-"`
 }
 
 // maxBatchSize is the maximum number of communications the backend accepts per request
 const maxBatchSize = 100
 
-func (c *Client) BatchUpsert(comms []Communication) (*BatchUpsertResponse, error) {
-	// Chunk into batches of maxBatchSize to respect backend limits
-	if len(comms) > maxBatchSize {
-		return c.batchUpsertChunked(comms)
-	}
-
-	return c.batchUpsertSingle(comms)
-}
-
-func (c *Client) batchUpsertChunked(comms []Communication) (*BatchUpsertResponse, error) {
-	var totalResult BatchUpsertResponse
-
-	for i := 0; i < len(comms); i += maxBatchSize {
-		end := i + maxBatchSize
-		if end > len(comms) {
-			end = len(comms)
-		}
-		chunk := comms[i:end]
-
-		result, err := c.batchUpsertSingle(chunk)
-		if err != nil {
-			return nil, err
-		}
-
-		totalResult.Inserted += result.Inserted
-		totalResult.Updated += result.Updated
-		// Adjust error indices to reflect position in original array
-		for _, e := range result.Errors {
-			totalResult.Errors = append(totalResult.Errors, BatchError{
-				Index: e.Index + i,
-				Error: e.Error,
-			})
-		}
-	}
-
-	return &totalResult, nil
+// BatchUpsert sends communications in chunks the backend accepts. A chunk
+// rejected as a whole is bisected so only the offending items fail.
+func (c *Client) BatchUpsert(ctx context.Context, comms []Communication) (*BatchUpsertResponse, error) {
+	return sendChunked(ctx, comms, maxBatchSize, c.maxRequestBytes, c.batchUpsertSingle)
 }
 
-func (c *Client) batchUpsertSingle(comms []Communication) (*BatchUpsertResponse, error) {
-	body, err := json.Marshal(BatchUpsertRequest{Communications: comms})
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	resp, err := c.post("/api/communications/batch", body)
+func (c *Client) batchUpsertSingle(ctx context.Context, comms []Communication) (*BatchUpsertResponse, error) {
+	resp, err := c.post(ctx, "/api/communications/batch", BatchUpsertRequest{Communications: comms})
 	if err != nil {
 		// Network errors are temporary
 		return nil, err
@@ -177,12 +244,7 @@ func (c *Client) batchUpsertSingle(comms []Communication) (*BatchUpsertResponse,
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, &APIError{
-			StatusCode: resp.StatusCode,
-			Message:    string(bodyBytes),
-			Temporary:  isTemporaryStatusCode(resp.StatusCode),
-		}
+		return nil, newAPIError(resp)
 	}
 
 	var result BatchUpsertResponse
@@ -196,45 +258,129 @@ func (c *Client) batchUpsertSingle(comms []Communication) (*BatchUpsertResponse,
 // isTemporaryStatusCode returns true for status codes that indicate temporary issues
 func isTemporaryStatusCode(code int) bool {
 	switch code {
-	case http.StatusTooManyRequests,      // 429 - Rate limited
-		http.StatusInternalServerError,   // 500
-		http.StatusBadGateway,            // 502
-		http.StatusServiceUnavailable,    // 503
-		http.StatusGatewayTimeout:        // 504
+	case http.StatusTooManyRequests, // 429 - Rate limited
+		http.StatusInternalServerError, // 500
+		http.StatusBadGateway,          // 502
+		http.StatusServiceUnavailable,  // 503
+		http.StatusGatewayTimeout:      // 504
 		return true
 	default:
 		return false
 	}
 }
 
-func (c *Client) get(path string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("X-API-Key", c.apiKey)
-	return c.httpClient.Do(req)
+	if c.signingSecret != nil {
+		if err := signRequest(req, path, c.signingSecret, nil); err != nil {
+			return nil, err
+		}
+	}
+	return c.do(req, path)
 }
 
-func (c *Client) post(path string, body []byte) (*http.Response, error) {
-	req, err := http.NewRequest("POST", c.baseURL+path, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+// post sends an upsert. Every endpoint posted to is idempotent, so it may be
+// retried. In auto mode a backend that refuses gzip gets the request again
+// uncompressed, and every later one as well.
+func (c *Client) post(ctx context.Context, path string, payload any) (*http.Response, error) {
+	// A signature covers the body's digest, which has to be known before the
+	// headers are sent, so signed requests are encoded up front
+	var body []byte
+	if c.signingSecret != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, fmt.Errorf("%w: failed to encode request: %w", ErrPermanent, err)
+		}
 	}
-	req.Header.Set("X-API-Key", c.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-	return c.httpClient.Do(req)
+
+	compress := c.gzip.Load()
+	resp, err := c.sendWithRetry(ctx, path, func() (*http.Request, error) {
+		// The body is attached last: its encoder runs until the body is read
+		// or closed, which wouldn't happen if building the request failed
+		req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to create request: %w", ErrPermanent, err)
+		}
+		req.Header.Set("X-API-Key", c.apiKey)
+		req.Header.Set("Content-Type", "application/json")
+		if compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if body != nil {
+			// Signed on every attempt, so retries carry a fresh nonce
+			if err := signRequest(req, path, c.signingSecret, body); err != nil {
+				return nil, err
+			}
+		}
+
+		encode := func(w io.Writer) error { return json.NewEncoder(w).Encode(payload) }
+		if body != nil {
+			encode = func(w io.Writer) error {
+				_, err := w.Write(body)
+				return err
+			}
+		}
+		// A zero ContentLength with a body means the length is unknown
+		req.Body = encodeBody(encode, compress)
+		return req, nil
+	})
+	if err == nil && compress && c.compression == "auto" && resp.StatusCode == http.StatusUnsupportedMediaType {
+		resp.Body.Close()
+		c.gzip.Store(false)
+		log.Info().Msg("Backend does not accept gzip, sending requests uncompressed")
+		return c.post(ctx, path, payload)
+	}
+	return resp, err
+}
+
+// encodeBody streams what encode writes, optionally gzipped, so a request's
+// JSON is never held in memory as a whole. The transport closes the body, which
+// stops the encoder if the request fails early.
+func encodeBody(encode func(w io.Writer) error, compress bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		var gz *gzip.Writer
+		if compress {
+			gz = gzip.NewWriter(pw)
+			w = gz
+		}
+		err := encode(w)
+		if err != nil {
+			err = fmt.Errorf("%w: failed to encode request: %w", ErrPermanent, err)
+		} else if gz != nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// do sends a request and records its latency and status code under path
+func (c *Client) do(req *http.Request, path string) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+	}
+	metrics.ObserveBackendRequest(path, code, time.Since(start))
+	return resp, err
 }
 
 // ContactImport represents a contact to be imported
 type ContactImport struct {
-	SourceID    string `json:"source_id"`
-	DisplayName string `json:"display_name"`
-	Emails      []string `json:"emails,omitempty"`
-	Phones      []string `json:"phones,omitempty"`
+	SourceID    string        `json:"source_id"`
+	DisplayName string        `json:"display_name"`
+	Emails      []string      `json:"emails,omitempty"`
+	Phones      []string      `json:"phones,omitempty"`
 	Facts       []ContactFact `json:"facts,omitempty"`
-	Note        string `json:"note,omitempty"`
-	PhotoData   string `json:"photo_data,omitempty"` // base64
+	Note        string        `json:"note,omitempty"`
+	PhotoData   string        `json:"photo_data,omitempty"` // base64
 }
 
 type ContactFact struct {
@@ -253,13 +399,13 @@ type ContactsImportResponse struct {
 	Errors  []BatchError `json:"errors"`
 }
 
-func (c *Client) ImportContacts(imports []ContactImport) (*ContactsImportResponse, error) {
-	body, err := json.Marshal(ContactsImportRequest{Contacts: imports})
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
+// ImportContacts sends contacts, bisecting a batch the backend rejects as a whole
+func (c *Client) ImportContacts(ctx context.Context, imports []ContactImport) (*ContactsImportResponse, error) {
+	return sendChunked(ctx, imports, 0, c.maxRequestBytes, c.importContacts)
+}
 
-	resp, err := c.post("/api/sync/contacts", body)
+func (c *Client) importContacts(ctx context.Context, imports []ContactImport) (*ContactsImportResponse, error) {
+	resp, err := c.post(ctx, "/api/sync/contacts", ContactsImportRequest{Contacts: imports})
 	if err != nil {
 		// Network errors are temporary
 		return nil, err
@@ -267,12 +413,7 @@ func (c *Client) ImportContacts(imports []ContactImport) (*ContactsImportRespons
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, &APIError{
-			StatusCode: resp.StatusCode,
-			Message:    string(bodyBytes),
-			Temporary:  isTemporaryStatusCode(resp.StatusCode),
-		}
+		return nil, newAPIError(resp)
 	}
 
 	var result ContactsImportResponse
@@ -283,26 +424,6 @@ func (c *Client) ImportContacts(imports []ContactImport) (*ContactsImportRespons
 	return &result, nil
 }
 
-// BatchUpsertFromPayload processes a batch upsert from a queued request payload
-func (c *Client) BatchUpsertFromPayload(payload []byte) error {
-	var req BatchUpsertRequest
-	if err := json.Unmarshal(payload, &req); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %w", err)
-	}
-	_, err := c.BatchUpsert(req.Communications)
-	return err
-}
-
-// ImportContactsFromPayload processes a contacts import from a queued request payload
-func (c *Client) ImportContactsFromPayload(payload []byte) error {
-	var req ContactsImportRequest
-	if err := json.Unmarshal(payload, &req); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %w", err)
-	}
-	_, err := c.ImportContacts(req.Contacts)
-	return err
-}
-
 // CalendarEventImport represents a calendar event to be imported
 type CalendarEventImport struct {
 	SourceID    string   `json:"source_id"`
@@ -327,25 +448,20 @@ type CalendarEventsResponse struct {
 	Errors   []BatchError `json:"errors"`
 }
 
-func (c *Client) ImportCalendarEvents(events []CalendarEventImport) (*CalendarEventsResponse, error) {
-	body, err := json.Marshal(CalendarEventsRequest{Events: events})
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
+// ImportCalendarEvents sends events, bisecting a batch the backend rejects as a whole
+func (c *Client) ImportCalendarEvents(ctx context.Context, events []CalendarEventImport) (*CalendarEventsResponse, error) {
+	return sendChunked(ctx, events, 0, c.maxRequestBytes, c.importCalendarEvents)
+}
 
-	resp, err := c.post("/api/sync/calendar", body)
+func (c *Client) importCalendarEvents(ctx context.Context, events []CalendarEventImport) (*CalendarEventsResponse, error) {
+	resp, err := c.post(ctx, "/api/sync/calendar", CalendarEventsRequest{Events: events})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, &APIError{
-			StatusCode: resp.StatusCode,
-			Message:    string(bodyBytes),
-			Temporary:  isTemporaryStatusCode(resp.StatusCode),
-		}
+		return nil, newAPIError(resp)
 	}
 
 	var result CalendarEventsResponse
@@ -376,25 +492,20 @@ type AppleNotesResponse struct {
 	Errors   []BatchError `json:"errors"`
 }
 
-func (c *Client) ImportAppleNotes(notes []AppleNoteImport) (*AppleNotesResponse, error) {
-	body, err := json.Marshal(AppleNotesRequest{Notes: notes})
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
+// ImportAppleNotes sends notes, bisecting a batch the backend rejects as a whole
+func (c *Client) ImportAppleNotes(ctx context.Context, notes []AppleNoteImport) (*AppleNotesResponse, error) {
+	return sendChunked(ctx, notes, 0, c.maxRequestBytes, c.importAppleNotes)
+}
 
-	resp, err := c.post("/api/sync/notes", body)
+func (c *Client) importAppleNotes(ctx context.Context, notes []AppleNoteImport) (*AppleNotesResponse, error) {
+	resp, err := c.post(ctx, "/api/sync/notes", AppleNotesRequest{Notes: notes})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, &APIError{
-			StatusCode: resp.StatusCode,
-			Message:    string(bodyBytes),
-			Temporary:  isTemporaryStatusCode(resp.StatusCode),
-		}
+		return nil, newAPIError(resp)
 	}
 
 	var result AppleNotesResponse
@@ -404,23 +515,3 @@ func (c *Client) ImportAppleNotes(notes []AppleNoteImport) (*AppleNotesResponse,
 
 	return &result, nil
 }
-
-// ImportCalendarEventsFromPayload processes a calendar events import from a queued request payload
-func (c *Client) ImportCalendarEventsFromPayload(payload []byte) error {
-	var req CalendarEventsRequest
-	if err := json.Unmarshal(payload, &req); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %w", err)
-	}
-	_, err := c.ImportCalendarEvents(req.Events)
-	return err
-}
-
-// ImportAppleNotesFromPayload processes an Apple Notes import from a queued request payload
-func (c *Client) ImportAppleNotesFromPayload(payload []byte) error {
-	var req AppleNotesRequest
-	if err := json.Unmarshal(payload, &req); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %w", err)
-	}
-	_, err := c.ImportAppleNotes(req.Notes)
-	return err
-}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"pkb-daemon/internal/config"
+)
+
+func TestTraceparentPropagated(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		json.NewEncoder(w).Encode(AppleNotesResponse{Inserted: 1})
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(config.BackendConfig{
+		URL:         srv.URL,
+		APIKey:      "key",
+		Compression: "none",
+		Retry:       config.RetryConfig{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cycle := provider.Tracer("test").Start(context.Background(), "sync.cycle")
+	if _, err := c.ImportAppleNotes(ctx, []AppleNoteImport{{SourceID: "n1"}}); err != nil {
+		t.Fatal(err)
+	}
+	cycle.End()
+	// Outside a trace nothing is injected
+	if _, err := c.ImportAppleNotes(context.Background(), []AppleNoteImport{{SourceID: "n2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(traceparents) != 2 {
+		t.Fatalf("got %d requests, want 2", len(traceparents))
+	}
+	var request sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Parent().SpanID() == cycle.SpanContext().SpanID() {
+			request = s
+		}
+	}
+	if request == nil {
+		t.Fatal("no client span under the sync cycle")
+	}
+	want := "00-" + request.SpanContext().TraceID().String() + "-" + request.SpanContext().SpanID().String() + "-01"
+	if traceparents[0] != want {
+		t.Errorf("traceparent = %q, want %q", traceparents[0], want)
+	}
+	if traceparents[1] != "" {
+		t.Errorf("traceparent outside a trace = %q, want none", traceparents[1])
+	}
+}
+
+func TestRetryAfterBeyondCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantOpen bool
+	}{
+		// Rate limiting only defers the request; the backend is up
+		{"rate limited", http.StatusTooManyRequests, false},
+		{"unavailable", http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			c, err := NewClient(config.BackendConfig{
+				URL:            srv.URL,
+				APIKey:         "key",
+				Compression:    "none",
+				Retry:          config.RetryConfig{MaxAttempts: 3, MaxRetryAfterSeconds: 60},
+				CircuitBreaker: config.CircuitBreakerConfig{FailureThreshold: 1, CooldownSeconds: 60},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.ImportAppleNotes(context.Background(), []AppleNoteImport{{SourceID: "n1"}})
+			if !IsTemporaryError(err) {
+				t.Fatalf("err = %v, want a temporary error", err)
+			}
+			if after := RetryAfter(err); after != time.Hour {
+				t.Errorf("RetryAfter = %s, want 1h for the queue", after)
+			}
+			if c.CircuitOpen() != tt.wantOpen {
+				t.Errorf("CircuitOpen() = %v, want %v", c.CircuitOpen(), tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestPostUnbuildableRequestStopsEncoder(t *testing.T) {
+	c, err := NewClient(config.BackendConfig{
+		URL:         "http://localhost",
+		APIKey:      "key",
+		Compression: "gzip",
+		Retry:       config.RetryConfig{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A control character makes the URL unparseable
+	c.baseURL = "http://localhost\x7f"
+
+	before := runtime.NumGoroutine()
+	for range 10 {
+		if _, err := c.post(context.Background(), "/api/v1/communications/batch", map[string]string{"a": "b"}); err == nil {
+			t.Fatal("post succeeded with an invalid URL")
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, had %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
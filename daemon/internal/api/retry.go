@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// retryPolicy bounds the attempts of a single request
+type retryPolicy struct {
+	maxAttempts   int
+	initial       time.Duration
+	max           time.Duration
+	maxRetryAfter time.Duration // a longer Retry-After is left to the caller
+}
+
+// backoff returns the wait before the retry following attempt n: exponential,
+// capped, with the upper half jittered so clients don't retry in lockstep
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.initial << (n - 1)
+	if d > p.max || d <= 0 {
+		d = p.max
+	}
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// retryAfter parses the Retry-After header of a 429 or 503, in seconds or as
+// an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// sendWithRetry sends an idempotent request built by newReq, retrying network
+// errors and temporary status codes. The last response is returned as is for
+// the caller to turn into an error. Every outcome is reported to the breaker.
+func (c *Client) sendWithRetry(ctx context.Context, path string, newReq func() (*http.Request, error)) (*http.Response, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			c.breaker.abandon()
+			return nil, err
+		}
+		resp, err := c.do(req, path)
+
+		switch {
+		case ctx.Err() != nil:
+			c.breaker.abandon()
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		case err == nil && !isTemporaryStatusCode(resp.StatusCode):
+			c.breaker.success()
+			return resp, nil
+		case errors.Is(err, ErrPermanent):
+			// The request itself is broken, e.g. it can't be encoded
+			c.breaker.abandon()
+			return nil, err
+		}
+
+		wait := c.retry.backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(resp); ok {
+				if after > c.retry.maxRetryAfter {
+					// Not worth blocking a sync cycle; the queue retries later.
+					// A backend that rate limits is up, so a 429 only defers
+					// the request and doesn't count towards opening the circuit.
+					if resp.StatusCode == http.StatusTooManyRequests {
+						c.breaker.abandon()
+					} else {
+						c.breaker.failure()
+					}
+					return resp, nil
+				}
+				wait = after
+			}
+		}
+		if attempt >= c.retry.maxAttempts {
+			c.breaker.failure()
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		event := log.Debug().Str("path", path).Int("attempt", attempt).Dur("retry_in", wait)
+		if err != nil {
+			event = event.Err(err)
+		} else {
+			event = event.Int("status", resp.StatusCode)
+		}
+		event.Msg("Backend request failed, retrying")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.breaker.abandon()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
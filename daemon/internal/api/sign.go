@@ -0,0 +1,123 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"pkb-daemon/internal/config"
+)
+
+// Headers of a signed request, checked by the backend's require_api_key when
+// it has API_SIGNING_SECRET
+const (
+	headerTimestamp = "X-PKB-Timestamp"
+	headerNonce     = "X-PKB-Nonce"
+	headerSignature = "X-PKB-Signature"
+)
+
+// signRequest adds an HMAC-SHA256 signature over the method, path, a fresh
+// timestamp and nonce, and the digest of the uncompressed body. The backend
+// refuses stale timestamps and nonces it has seen, so a captured request
+// can't be replayed.
+//
+// path is the path and query relative to the backend URL, e.g.
+// /api/sync/notes, without any prefix the URL has. A proxy that serves the
+// backend under a prefix strips it, so this is the path the backend sees.
+func signRequest(req *http.Request, path string, secret, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to create nonce: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonceHex)
+	req.Header.Set(headerSignature, signature(secret, req.Method, path, timestamp, nonceHex, body))
+	return nil
+}
+
+// signature returns the X-PKB-Signature header value
+func signature(secret []byte, method, path, timestamp, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, timestamp, nonce, hex.EncodeToString(digest[:]))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkTransport refuses to send the API key in the clear. Plain HTTP is
+// only allowed to this machine, unless allow_plain_http says otherwise.
+func checkTransport(cfg config.BackendConfig) error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid backend url: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+	default:
+		return fmt.Errorf("backend url %q must start with http:// or https://", cfg.URL)
+	}
+
+	if cfg.TLS != (config.BackendTLSConfig{}) {
+		return errors.New("backend.tls needs an https:// backend url")
+	}
+	if cfg.APIKey == "" || cfg.AllowPlainHTTP || isLoopback(u.Hostname()) {
+		return nil
+	}
+	return fmt.Errorf("refusing to send the API key over plain HTTP to %s; use https:// or set backend.allow_plain_http", u.Host)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newTLSConfig loads the CA bundle the backend's certificate must chain to
+// and the client certificate for mTLS. It returns nil if neither is set.
+func newTLSConfig(cfg config.BackendTLSConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("backend.tls needs both cert_file and key_file for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
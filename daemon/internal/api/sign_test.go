@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"pkb-daemon/internal/config"
+)
+
+func TestSignature(t *testing.T) {
+	// The same vector is checked by the backend's signing tests
+	got := signature([]byte("test-signing-secret"), "POST", "/api/sync/notes", "1700000000",
+		"000102030405060708090a0b0c0d0e0f", []byte(`{"notes":[]}`))
+	want := "v1=dc2a0183c354ca3a0d3355b4b13bce86f4b3871b3a59638066f18111397c33e2"
+	if got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestSignedPathIgnoresURLPrefix(t *testing.T) {
+	secret := "test-signing-secret"
+	var gotPath string
+	var verified bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		// A proxy serving the backend under /pkb strips the prefix
+		path := strings.TrimPrefix(r.URL.RequestURI(), "/pkb")
+		want := signature([]byte(secret), r.Method, path, r.Header.Get(headerTimestamp), r.Header.Get(headerNonce), body)
+		verified = r.Header.Get(headerSignature) == want
+		json.NewEncoder(w).Encode(AppleNotesResponse{Inserted: 1})
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(config.BackendConfig{
+		URL:         srv.URL + "/pkb",
+		APIKey:      "key",
+		Compression: "none",
+		Retry:       config.RetryConfig{MaxAttempts: 1},
+		Signing:     config.SigningConfig{Secret: secret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ImportAppleNotes(context.Background(), []AppleNoteImport{{SourceID: "n1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/pkb/api/sync/notes" {
+		t.Errorf("request went to %s", gotPath)
+	}
+	if !verified {
+		t.Error("signature doesn't cover the path relative to the backend URL")
+	}
+}
@@ -0,0 +1,308 @@
+package classify
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/redact"
+)
+
+// Action is what happens to a communication matched by a rule
+type Action string
+
+const (
+	ActionDrop   Action = "drop"   // don't sync the communication at all
+	ActionTag    Action = "tag"    // sync it with a tag in its metadata
+	ActionRedact Action = "redact" // sync it with the matched content masked
+)
+
+// Rule types
+const (
+	TypeSender        = "sender"         // regex on the sender's email or phone
+	TypeHeader        = "header"         // email header presence or value
+	TypeGmailCategory = "gmail_category" // Gmail category label, e.g. CATEGORY_PROMOTIONS
+	TypeShortCode     = "short_code"     // numeric short code senders (SMS/iMessage)
+	TypeContent       = "content"        // regex on subject and body
+)
+
+// redactedText replaces redacted content
+const redactedText = "[redacted]"
+
+// DefaultRules are used when the classifier is enabled without explicit rules
+var DefaultRules = []config.ClassifierRuleConfig{
+	{
+		Name:     "no_reply",
+		Type:     TypeSender,
+		Patterns: []string{`^(no-?reply|do-?not-?reply|notifications?|mailer-daemon|bounces?)([+.\-_].*)?@`},
+		Action:   string(ActionTag),
+		Tag:      "automated",
+	},
+	{
+		Name:     "bulk_mail",
+		Type:     TypeHeader,
+		Patterns: []string{"list-unsubscribe", "precedence: ^(bulk|list|junk)$", "auto-submitted: ^auto-"},
+		Action:   string(ActionTag),
+		Tag:      "bulk",
+	},
+	{
+		Name:     "gmail_categories",
+		Type:     TypeGmailCategory,
+		Patterns: []string{"CATEGORY_PROMOTIONS", "CATEGORY_SOCIAL", "CATEGORY_UPDATES", "CATEGORY_FORUMS"},
+		Action:   string(ActionTag),
+		Tag:      "bulk",
+	},
+	{
+		Name:   "short_code",
+		Type:   TypeShortCode,
+		Action: string(ActionTag),
+		Tag:    "automated",
+	},
+	{
+		Name:     "one_time_code",
+		Type:     TypeContent,
+		Patterns: redact.OTPPatterns,
+		Action:   string(ActionTag),
+		Tag:      "otp",
+	},
+}
+
+// headerMatcher matches a header by name and optionally by value
+type headerMatcher struct {
+	name  string
+	value *regexp.Regexp
+}
+
+// rule is a compiled config.ClassifierRuleConfig
+type rule struct {
+	name     string
+	typ      string
+	action   Action
+	tag      string
+	sources  map[string]bool
+	patterns []*regexp.Regexp
+	headers  []headerMatcher
+	labels   map[string]bool
+}
+
+// Classifier tags, redacts or drops automated and sensitive communications
+type Classifier struct {
+	rules []*rule
+}
+
+// Result describes what the classifier did to a communication
+type Result struct {
+	Drop  bool
+	Tags  []string
+	Rules []string // names of the matching rules
+}
+
+// New compiles the classifier rules, falling back to DefaultRules
+func New(cfg config.ClassifierConfig) (*Classifier, error) {
+	ruleCfgs := cfg.Rules
+	if len(ruleCfgs) == 0 {
+		ruleCfgs = DefaultRules
+	}
+
+	c := &Classifier{}
+	for i, rc := range ruleCfgs {
+		r, err := compileRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("classifier rule %d (%s): %w", i, rc.Name, err)
+		}
+		c.rules = append(c.rules, r)
+	}
+	return c, nil
+}
+
+func compileRule(rc config.ClassifierRuleConfig) (*rule, error) {
+	r := &rule{
+		name:   rc.Name,
+		typ:    rc.Type,
+		action: Action(rc.Action),
+		tag:    rc.Tag,
+	}
+	if r.tag == "" {
+		r.tag = r.name
+	}
+	if r.action == "" {
+		r.action = ActionTag
+	}
+
+	switch r.action {
+	case ActionDrop, ActionTag, ActionRedact:
+	default:
+		return nil, fmt.Errorf("unknown action %q", rc.Action)
+	}
+
+	if len(rc.Sources) > 0 {
+		r.sources = make(map[string]bool)
+		for _, s := range rc.Sources {
+			r.sources[s] = true
+		}
+	}
+
+	switch r.typ {
+	case TypeSender, TypeContent:
+		for _, p := range rc.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+			r.patterns = append(r.patterns, re)
+		}
+	case TypeHeader:
+		for _, p := range rc.Patterns {
+			hm := headerMatcher{name: strings.ToLower(strings.TrimSpace(p))}
+			if name, value, ok := strings.Cut(p, ":"); ok {
+				re, err := regexp.Compile("(?i)" + strings.TrimSpace(value))
+				if err != nil {
+					return nil, fmt.Errorf("invalid header pattern %q: %w", p, err)
+				}
+				hm.name = strings.ToLower(strings.TrimSpace(name))
+				hm.value = re
+			}
+			r.headers = append(r.headers, hm)
+		}
+	case TypeGmailCategory:
+		r.labels = make(map[string]bool)
+		for _, p := range rc.Patterns {
+			r.labels[strings.ToUpper(p)] = true
+		}
+	case TypeShortCode:
+	default:
+		return nil, fmt.Errorf("unknown type %q", rc.Type)
+	}
+
+	return r, nil
+}
+
+// Classify applies every rule to an inbound communication. Redact rules modify
+// the communication in place and tags are recorded in its metadata.
+func (c *Classifier) Classify(comm *api.Communication) Result {
+	var result Result
+
+	// Messages we sent ourselves are never automated
+	if comm.Direction == "outbound" {
+		return result
+	}
+
+	for _, r := range c.rules {
+		if r.sources != nil && !r.sources[comm.Source] {
+			continue
+		}
+		if !r.match(comm) {
+			continue
+		}
+
+		result.Rules = append(result.Rules, r.name)
+		result.Tags = appendUnique(result.Tags, r.tag)
+
+		switch r.action {
+		case ActionDrop:
+			result.Drop = true
+		case ActionRedact:
+			r.redact(comm)
+		}
+	}
+
+	if len(result.Tags) > 0 {
+		if comm.Metadata == nil {
+			comm.Metadata = make(map[string]interface{})
+		}
+		comm.Metadata["classifier_tags"] = result.Tags
+	}
+
+	return result
+}
+
+func (r *rule) match(comm *api.Communication) bool {
+	switch r.typ {
+	case TypeSender:
+		for _, re := range r.patterns {
+			if re.MatchString(comm.ContactIdentifier.Value) {
+				return true
+			}
+		}
+	case TypeContent:
+		for _, re := range r.patterns {
+			if re.MatchString(comm.Subject) || re.MatchString(comm.Content) {
+				return true
+			}
+		}
+	case TypeHeader:
+		headers, _ := comm.Metadata["headers"].(map[string]string)
+		for _, hm := range r.headers {
+			value, ok := headers[hm.name]
+			if ok && (hm.value == nil || hm.value.MatchString(strings.TrimSpace(value))) {
+				return true
+			}
+		}
+	case TypeGmailCategory:
+		labels, _ := comm.Metadata["labels"].([]string)
+		for _, l := range labels {
+			if r.labels[l] {
+				return true
+			}
+		}
+	case TypeShortCode:
+		return comm.ContactIdentifier.Type == "phone" && isShortCode(comm.ContactIdentifier.Value)
+	}
+	return false
+}
+
+// redact masks the matched content. Content rules mask just the matches;
+// other rule types can't point at specific text so the whole body is masked.
+func (r *rule) redact(comm *api.Communication) {
+	if r.typ != TypeContent {
+		comm.Content = redactedText
+		return
+	}
+	for _, re := range r.patterns {
+		comm.Subject = mask(re, comm.Subject)
+		comm.Content = mask(re, comm.Content)
+	}
+}
+
+// mask replaces every match of re in s. If the pattern has a group named
+// "secret" only that group is masked, keeping the surrounding context readable.
+func mask(re *regexp.Regexp, s string) string {
+	secret := re.SubexpIndex("secret")
+	if secret < 0 {
+		return re.ReplaceAllString(s, redactedText)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[2*secret], m[2*secret+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(redactedText)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// isShortCode reports whether a normalized phone value is a short code.
+// Short codes are kept as bare digits by the identity package; real numbers start with "+".
+func isShortCode(value string) bool {
+	if value == "" || strings.HasPrefix(value, "+") || len(value) > 6 {
+		return false
+	}
+	return strings.Trim(value, "0123456789") == ""
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
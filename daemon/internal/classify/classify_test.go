@@ -0,0 +1,67 @@
+package classify
+
+import (
+	"testing"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+)
+
+func TestDefaultOneTimeCode(t *testing.T) {
+	c, err := New(config.ClassifierConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		content string
+		otp     bool
+	}{
+		{"Your verification code is 123456", true},
+		{"Your Acme security code: 4821", true},
+		{"Use OTP 90210 to sign in", true},
+		{"G-482913 is your Google verification code", true},
+		{"123456 is your one-time passcode", true},
+		{"Passcode 7788 expires in 10 minutes", true},
+		{"code review at 1430", false},
+		{"zip code 94107", false},
+		{"94107 is your zip code", false},
+		{"My PIN is 1234, don't tell anyone", false},
+		{"Call me at 5551234 about the access panel", false},
+		{"Meeting moved to 1530, see the code of conduct", false},
+	}
+	for _, tt := range tests {
+		comm := api.Communication{Source: "imessage", Direction: "inbound", Content: tt.content}
+		result := c.Classify(&comm)
+		tagged := false
+		for _, tag := range result.Tags {
+			if tag == "otp" {
+				tagged = true
+			}
+		}
+		if tagged != tt.otp {
+			t.Errorf("%q: tagged otp = %v, want %v", tt.content, tagged, tt.otp)
+		}
+		if comm.Content != tt.content {
+			t.Errorf("%q: content changed to %q by a tag rule", tt.content, comm.Content)
+		}
+	}
+}
+
+func TestRedactMasksOnlySecret(t *testing.T) {
+	c, err := New(config.ClassifierConfig{Rules: []config.ClassifierRuleConfig{{
+		Name:     "one_time_code",
+		Type:     TypeContent,
+		Patterns: []string{`(?i)\bverification code is (?P<secret>\d{4,8})\b`},
+		Action:   string(ActionRedact),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comm := api.Communication{Direction: "inbound", Content: "Your verification code is 123456. Don't share it."}
+	c.Classify(&comm)
+	if want := "Your verification code is [redacted]. Don't share it."; comm.Content != want {
+		t.Errorf("content = %q, want %q", comm.Content, want)
+	}
+}
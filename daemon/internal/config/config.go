@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,27 +10,69 @@ import (
 )
 
 type Config struct {
-	Backend   BackendConfig   `yaml:"backend"`
-	Sources   SourcesConfig   `yaml:"sources"`
-	Sync      SyncConfig      `yaml:"sync"`
-	Queue     QueueConfig     `yaml:"queue"`
-	Blocklist BlocklistConfig `yaml:"blocklist"`
-	Logging   LoggingConfig   `yaml:"logging"`
-	State     StateConfig     `yaml:"state"`
+	Backend    BackendConfig    `yaml:"backend"`
+	Sinks      SinksConfig      `yaml:"sinks"`
+	Sources    SourcesConfig    `yaml:"sources"`
+	Sync       SyncConfig       `yaml:"sync"`
+	Queue      QueueConfig      `yaml:"queue"`
+	Blocklist  BlocklistConfig  `yaml:"blocklist"`
+	Allowlist  AllowlistConfig  `yaml:"allowlist"`
+	Classifier ClassifierConfig `yaml:"classifier"`
+	Redaction  RedactionConfig  `yaml:"redaction"`
+	Identity   IdentityConfig   `yaml:"identity"`
+	Control    ControlConfig    `yaml:"control"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Logging    LoggingConfig    `yaml:"logging"`
+	State      StateConfig      `yaml:"state"`
 }
 
 type BackendConfig struct {
-	URL    string `yaml:"url"`
-	APIKey string `yaml:"api_key"`
+	URL            string               `yaml:"url"`
+	APIKey         string               `yaml:"api_key"`
+	TimeoutSeconds int                  `yaml:"timeout_seconds"`
+	Compression    string               `yaml:"compression"`    // auto, gzip or none
+	MaxRequestMB   int                  `yaml:"max_request_mb"` // JSON per request before a batch is split
+	Retry          RetryConfig          `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	AllowPlainHTTP bool                 `yaml:"allow_plain_http"` // send the API key over http:// to other hosts
+	TLS            BackendTLSConfig     `yaml:"tls"`
+	Signing        SigningConfig        `yaml:"signing"`
+}
+
+// BackendTLSConfig pins the backend's CA and sets a client certificate for mTLS
+type BackendTLSConfig struct {
+	CAFile   string `yaml:"ca_file"` // replaces the system roots
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// SigningConfig holds the secret requests are signed with, shared with the
+// backend's API_SIGNING_SECRET
+type SigningConfig struct {
+	Secret string `yaml:"secret"`
+}
+
+// RetryConfig bounds the retries of a single backend request
+type RetryConfig struct {
+	MaxAttempts          int `yaml:"max_attempts"` // 1 to never retry
+	InitialBackoffMillis int `yaml:"initial_backoff_ms"`
+	MaxBackoffSeconds    int `yaml:"max_backoff_seconds"`
+	MaxRetryAfterSeconds int `yaml:"max_retry_after_seconds"`
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int `yaml:"failure_threshold"` // -1 disables the breaker
+	CooldownSeconds  int `yaml:"cooldown_seconds"`
 }
 
 type SourcesConfig struct {
-	IMessage IMessageConfig  `yaml:"imessage"`
-	Gmail    GmailConfig     `yaml:"gmail"`
-	Contacts ContactsConfig  `yaml:"contacts"`
-	Calendar CalendarConfig  `yaml:"calendar"`
-	Calls    CallsConfig     `yaml:"calls"`
-	Notes    NotesConfig     `yaml:"notes"`
+	IMessage IMessageConfig `yaml:"imessage"`
+	Gmail    GmailConfig    `yaml:"gmail"`
+	Contacts ContactsConfig `yaml:"contacts"`
+	Calendar CalendarConfig `yaml:"calendar"`
+	Calls    CallsConfig    `yaml:"calls"`
+	Notes    NotesConfig    `yaml:"notes"`
 }
 
 type IMessageConfig struct {
@@ -39,11 +82,11 @@ type IMessageConfig struct {
 }
 
 type GmailConfig struct {
-	Enabled       bool                `yaml:"enabled"`
+	Enabled       bool                 `yaml:"enabled"`
 	Accounts      []GmailAccountConfig `yaml:"accounts"`
-	StartDate     string              `yaml:"start_date"`
-	Labels        []string            `yaml:"labels"`
-	ExcludeLabels []string            `yaml:"exclude_labels"`
+	StartDate     string               `yaml:"start_date"`
+	Labels        []string             `yaml:"labels"`
+	ExcludeLabels []string             `yaml:"exclude_labels"`
 }
 
 type GmailAccountConfig struct {
@@ -67,6 +110,7 @@ type CalendarConfig struct {
 
 type CalendarProviderConfig struct {
 	Type            string `yaml:"type"` // "google" or "apple"
+	Name            string `yaml:"name"` // optional, defaults to type; keys the provider's checkpoint
 	CredentialsPath string `yaml:"credentials_path"`
 	TokenPath       string `yaml:"token_path"`
 }
@@ -83,27 +127,152 @@ type NotesConfig struct {
 }
 
 type SyncConfig struct {
-	IntervalSeconds         int `yaml:"interval_seconds"`
-	ContactsIntervalSeconds int `yaml:"contacts_interval_seconds"`
-	BatchSize               int `yaml:"batch_size"`
-	MaxPerCycle             int `yaml:"max_per_cycle"`
+	IntervalSeconds         int                             `yaml:"interval_seconds"`
+	ContactsIntervalSeconds int                             `yaml:"contacts_interval_seconds"`
+	BatchSize               int                             `yaml:"batch_size"`
+	MaxPerCycle             int                             `yaml:"max_per_cycle"`
+	MaxConcurrent           int                             `yaml:"max_concurrent"`      // sources syncing at the same time
+	JitterSeconds           int                             `yaml:"jitter_seconds"`      // random delay added to every wait
+	MaxRuntimeSeconds       int                             `yaml:"max_runtime_seconds"` // a cycle is cancelled after this long
+	BackoffMaxSeconds       int                             `yaml:"backoff_max_seconds"` // longest wait after repeated failures
+	Sources                 map[string]SourceScheduleConfig `yaml:"sources"`             // per-source overrides, keyed by source name
+	Watch                   WatchConfig                     `yaml:"watch"`
+	Backfill                BackfillConfig                  `yaml:"backfill"`
+}
+
+// WatchConfig triggers a sync of the local Apple sources as soon as their
+// databases change. The sync interval keeps running as a safety net.
+type WatchConfig struct {
+	Enabled             bool `yaml:"enabled"`
+	DebounceMillis      int  `yaml:"debounce_ms"`           // quiet period before a change triggers a sync
+	MaxDelayMillis      int  `yaml:"max_delay_ms"`          // longest a sync waits while changes keep arriving
+	Polling             bool `yaml:"polling"`               // poll instead of using filesystem notifications
+	PollIntervalSeconds int  `yaml:"poll_interval_seconds"` // used when polling
+}
+
+// BackfillConfig throttles backfills and re-syncs, which run alongside the
+// live sync until they reach the end of their range
+type BackfillConfig struct {
+	MaxPerCycle  int `yaml:"max_per_cycle"` // items sent before pausing
+	PauseSeconds int `yaml:"pause_seconds"` // wait between cycles
+}
+
+type SourceScheduleConfig struct {
+	IntervalSeconds   int `yaml:"interval_seconds"`
+	JitterSeconds     int `yaml:"jitter_seconds"`
+	MaxRuntimeSeconds int `yaml:"max_runtime_seconds"`
+	BackoffMaxSeconds int `yaml:"backoff_max_seconds"`
+}
+
+// ControlConfig enables the local HTTP API used by the CLI and the menubar app
+type ControlConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Address   string `yaml:"address"`    // TCP address, must be a loopback address
+	Socket    string `yaml:"socket"`     // unix socket path, used instead of address when set
+	Token     string `yaml:"token"`      // bearer token; generated and stored at token_path when empty
+	TokenPath string `yaml:"token_path"` // where clients read the token from
+}
+
+// MetricsConfig exposes Prometheus metrics at /metrics
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"`
+}
+
+// TracingConfig exports OpenTelemetry traces of sync cycles and backend requests
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Exporter    string            `yaml:"exporter"` // otlphttp, otlpgrpc or stdout
+	Endpoint    string            `yaml:"endpoint"` // host:port of the collector; the exporter's default when empty
+	Insecure    bool              `yaml:"insecure"` // disable TLS to the collector
+	Headers     map[string]string `yaml:"headers"`
+	SampleRatio *float64          `yaml:"sample_ratio"` // 1 when unset
+	ServiceName string            `yaml:"service_name"`
 }
 
 type QueueConfig struct {
-	Enabled              bool   `yaml:"enabled"`
-	Path                 string `yaml:"path"`
-	MaxRetries           int    `yaml:"max_retries"`
-	InitialBackoffSecs   int    `yaml:"initial_backoff_seconds"`
-	MaxBackoffSecs       int    `yaml:"max_backoff_seconds"`
-	BackoffFactor        float64 `yaml:"backoff_factor"`
-	ProcessIntervalSecs  int    `yaml:"process_interval_seconds"`
-	BatchSize            int    `yaml:"batch_size"`
+	Enabled             bool    `yaml:"enabled"`
+	Path                string  `yaml:"path"`
+	MaxRetries          int     `yaml:"max_retries"`
+	InitialBackoffSecs  int     `yaml:"initial_backoff_seconds"`
+	MaxBackoffSecs      int     `yaml:"max_backoff_seconds"`
+	BackoffFactor       float64 `yaml:"backoff_factor"`
+	ProcessIntervalSecs int     `yaml:"process_interval_seconds"`
+	BatchSize           int     `yaml:"batch_size"`
+
+	Compression string   `yaml:"compression"` // none, gzip or zstd
+	MaxSizeMB   int      `yaml:"max_size_mb"` // -1 for no limit
+	MaxCount    int      `yaml:"max_count"`   // 0 for no limit
+	Eviction    string   `yaml:"eviction"`    // oldest, priority or reject
+	Priority    []string `yaml:"priority"`    // request types from most to least important
+
+	// PreserveOrder makes a source with queued requests send them, oldest
+	// first, before it fetches anything new
+	PreserveOrder bool `yaml:"preserve_order"`
+	// Outbox writes every batch to the queue together with its checkpoint
+	// before sending it, instead of only queuing failed requests
+	Outbox bool `yaml:"outbox"`
+}
+
+// FilterRules lists patterns matched against people. Phones and emails match
+// exactly, as a glob ("*@example.com") or as a regex when prefixed with "re:".
+// A phone that isn't a number, like the sender "AMAZON", matches ignoring case.
+// Names match as a case-insensitive substring, glob or regex.
+type FilterRules struct {
+	Phones  []string `yaml:"phones"`
+	Emails  []string `yaml:"emails"`
+	Domains []string `yaml:"domains"` // matches the domain and its subdomains
+	Names   []string `yaml:"names"`
 }
 
 type BlocklistConfig struct {
-	Phones []string `yaml:"phones"`
-	Emails []string `yaml:"emails"`
-	Names  []string `yaml:"names"`
+	FilterRules `yaml:",inline"`
+	Sources     map[string]FilterRules `yaml:"sources"` // extra rules for a single source
+}
+
+type AllowlistConfig struct {
+	Enabled     bool `yaml:"enabled"`
+	AddressBook bool `yaml:"address_book"` // allow anyone found in the synced contacts
+	FilterRules `yaml:",inline"`
+	Sources     map[string]AllowlistConfig `yaml:"sources"` // replaces the allowlist for a single source
+}
+
+type ClassifierConfig struct {
+	Enabled bool                   `yaml:"enabled"`
+	Rules   []ClassifierRuleConfig `yaml:"rules"` // empty uses the built-in rules
+}
+
+type ClassifierRuleConfig struct {
+	Name     string   `yaml:"name"`
+	Type     string   `yaml:"type"`     // "sender", "header", "gmail_category", "short_code" or "content"
+	Patterns []string `yaml:"patterns"` // regexes; for "header" rules "name" or "name: value regex"; a (?P<secret>...) group limits redaction
+	Sources  []string `yaml:"sources"`  // empty applies to all sources
+	Action   string   `yaml:"action"`   // "drop", "tag" or "redact"
+	Tag      string   `yaml:"tag"`      // defaults to the rule name
+}
+
+type RedactionConfig struct {
+	Enabled   bool                             `yaml:"enabled"`
+	Mode      string                           `yaml:"mode"`      // "redact" (default) or "report" for a dry run
+	Detectors []string                         `yaml:"detectors"` // built-in detectors; empty enables all
+	Custom    []RedactionPatternConfig         `yaml:"custom"`
+	Sources   map[string]RedactionSourceConfig `yaml:"sources"`
+}
+
+type RedactionPatternConfig struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"` // a (?P<secret>...) group limits what is masked
+}
+
+type RedactionSourceConfig struct {
+	Mode     string `yaml:"mode"`     // overrides the global mode for this source
+	Disabled bool   `yaml:"disabled"` // skip redaction for this source
+}
+
+type IdentityConfig struct {
+	// ISO region for numbers without a country code, e.g. "US", "GB";
+	// identity.DefaultRegion when empty
+	DefaultRegion string `yaml:"default_region"`
 }
 
 type LoggingConfig struct {
@@ -112,8 +281,29 @@ type LoggingConfig struct {
 	Path   string `yaml:"path"`
 }
 
+// SinksConfig chooses where batches go besides, or instead of, the backend
+type SinksConfig struct {
+	LocalOnly bool              `yaml:"local_only"` // don't send anything to the backend
+	Archive   ArchiveSinkConfig `yaml:"archive"`
+	File      FileSinkConfig    `yaml:"file"`
+}
+
+type ArchiveSinkConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+}
+
+type FileSinkConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"` // JSONL file batches are appended to
+}
+
 type StateConfig struct {
-	Path string `yaml:"path"`
+	Path   string `yaml:"path"`    // state.json of older versions, migrated on start
+	DBPath string `yaml:"db_path"` // SQLite database; may be the queue database
+	// PreviousDBPath is the state database used before the outbox moved the
+	// state into the queue database. Its checkpoints are imported on start.
+	PreviousDBPath string `yaml:"-"`
 }
 
 func expandPath(path string) string {
@@ -141,6 +331,33 @@ func Load(path string) (*Config, error) {
 	}
 
 	// Set defaults
+	if cfg.Backend.TimeoutSeconds == 0 {
+		cfg.Backend.TimeoutSeconds = 30
+	}
+	if cfg.Backend.Compression == "" {
+		cfg.Backend.Compression = "auto"
+	}
+	if cfg.Backend.MaxRequestMB == 0 {
+		cfg.Backend.MaxRequestMB = 10
+	}
+	if cfg.Backend.Retry.MaxAttempts == 0 {
+		cfg.Backend.Retry.MaxAttempts = 3
+	}
+	if cfg.Backend.Retry.InitialBackoffMillis == 0 {
+		cfg.Backend.Retry.InitialBackoffMillis = 500
+	}
+	if cfg.Backend.Retry.MaxBackoffSeconds == 0 {
+		cfg.Backend.Retry.MaxBackoffSeconds = 30
+	}
+	if cfg.Backend.Retry.MaxRetryAfterSeconds == 0 {
+		cfg.Backend.Retry.MaxRetryAfterSeconds = 60
+	}
+	if cfg.Backend.CircuitBreaker.FailureThreshold == 0 {
+		cfg.Backend.CircuitBreaker.FailureThreshold = 5
+	}
+	if cfg.Backend.CircuitBreaker.CooldownSeconds == 0 {
+		cfg.Backend.CircuitBreaker.CooldownSeconds = 60
+	}
 	if cfg.Sync.IntervalSeconds == 0 {
 		cfg.Sync.IntervalSeconds = 60
 	}
@@ -153,20 +370,105 @@ func Load(path string) (*Config, error) {
 	if cfg.Sync.ContactsIntervalSeconds == 0 {
 		cfg.Sync.ContactsIntervalSeconds = 900 // 15 minutes
 	}
+	if cfg.Sync.MaxConcurrent == 0 {
+		cfg.Sync.MaxConcurrent = 4
+	} else if cfg.Sync.MaxConcurrent < 1 {
+		return nil, fmt.Errorf("sync.max_concurrent must be at least 1, got %d", cfg.Sync.MaxConcurrent)
+	}
+	if cfg.Sync.MaxRuntimeSeconds == 0 {
+		cfg.Sync.MaxRuntimeSeconds = 600 // 10 minutes
+	}
+	if cfg.Sync.BackoffMaxSeconds == 0 {
+		cfg.Sync.BackoffMaxSeconds = 3600 // 1 hour
+	}
+	if cfg.Sync.Backfill.MaxPerCycle == 0 {
+		cfg.Sync.Backfill.MaxPerCycle = cfg.Sync.MaxPerCycle
+	}
+	if cfg.Sync.Backfill.PauseSeconds == 0 {
+		cfg.Sync.Backfill.PauseSeconds = 10
+	}
+	if cfg.Sync.Watch.DebounceMillis == 0 {
+		cfg.Sync.Watch.DebounceMillis = 2000
+	}
+	if cfg.Sync.Watch.MaxDelayMillis == 0 {
+		cfg.Sync.Watch.MaxDelayMillis = 10000
+	}
+	if cfg.Sync.Watch.PollIntervalSeconds == 0 {
+		cfg.Sync.Watch.PollIntervalSeconds = 5
+	}
 	if cfg.State.Path == "" {
 		home, _ := os.UserHomeDir()
 		cfg.State.Path = filepath.Join(home, ".pkb-daemon", "state.json")
 	} else {
 		cfg.State.Path = expandPath(cfg.State.Path)
 	}
+	if cfg.State.DBPath == "" {
+		cfg.State.DBPath = filepath.Join(filepath.Dir(cfg.State.Path), "state.db")
+	} else {
+		cfg.State.DBPath = expandPath(cfg.State.DBPath)
+	}
+
+	// Sink defaults
+	if cfg.Sinks.Archive.Path == "" {
+		cfg.Sinks.Archive.Path = filepath.Join(filepath.Dir(cfg.State.Path), "archive.db")
+	} else {
+		cfg.Sinks.Archive.Path = expandPath(cfg.Sinks.Archive.Path)
+	}
+	if cfg.Sinks.File.Path == "" {
+		cfg.Sinks.File.Path = filepath.Join(filepath.Dir(cfg.State.Path), "export.jsonl")
+	} else {
+		cfg.Sinks.File.Path = expandPath(cfg.Sinks.File.Path)
+	}
+
+	// Control API defaults
+	if cfg.Control.Address == "" {
+		cfg.Control.Address = "127.0.0.1:7465"
+	}
+	if cfg.Control.Socket != "" {
+		cfg.Control.Socket = expandPath(cfg.Control.Socket)
+	}
+	if cfg.Control.TokenPath == "" {
+		cfg.Control.TokenPath = filepath.Join(filepath.Dir(cfg.State.Path), "control.token")
+	} else {
+		cfg.Control.TokenPath = expandPath(cfg.Control.TokenPath)
+	}
+
+	// Metrics defaults
+	if cfg.Metrics.Address == "" {
+		cfg.Metrics.Address = "127.0.0.1:9464"
+	}
 
-	// Queue defaults
+	// Tracing defaults
+	if cfg.Tracing.Exporter == "" {
+		cfg.Tracing.Exporter = "otlphttp"
+	}
+	if cfg.Tracing.SampleRatio == nil {
+		ratio := 1.0
+		cfg.Tracing.SampleRatio = &ratio
+	} else if r := *cfg.Tracing.SampleRatio; r < 0 || r > 1 {
+		return nil, fmt.Errorf("tracing.sample_ratio must be between 0 and 1, got %g", r)
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = "pkb-daemon"
+	}
+
+	// Queue defaults. The outbox lives in the queue database.
+	if cfg.Queue.Outbox {
+		cfg.Queue.Enabled = true
+	}
 	if cfg.Queue.Enabled && cfg.Queue.Path == "" {
 		home, _ := os.UserHomeDir()
 		cfg.Queue.Path = filepath.Join(home, ".pkb-daemon", "queue.db")
 	} else if cfg.Queue.Path != "" {
 		cfg.Queue.Path = expandPath(cfg.Queue.Path)
 	}
+	if cfg.Queue.Outbox {
+		// Batches and checkpoints are written in one transaction
+		if cfg.State.DBPath != cfg.Queue.Path {
+			cfg.State.PreviousDBPath = cfg.State.DBPath
+		}
+		cfg.State.DBPath = cfg.Queue.Path
+	}
 	if cfg.Queue.MaxRetries == 0 {
 		cfg.Queue.MaxRetries = 10
 	}
@@ -185,6 +487,24 @@ func Load(path string) (*Config, error) {
 	if cfg.Queue.BatchSize == 0 {
 		cfg.Queue.BatchSize = 10
 	}
+	if cfg.Queue.Compression == "" {
+		cfg.Queue.Compression = "zstd"
+	}
+	if cfg.Queue.MaxSizeMB == 0 {
+		cfg.Queue.MaxSizeMB = 1024
+	}
+	if cfg.Queue.Outbox {
+		// Evicting from the outbox would lose batches whose checkpoint was
+		// already saved
+		if cfg.Queue.Eviction == "" {
+			cfg.Queue.Eviction = "reject"
+		} else if cfg.Queue.Eviction != "reject" {
+			return nil, fmt.Errorf("queue.outbox needs queue.eviction: reject, got %q", cfg.Queue.Eviction)
+		}
+	}
+	if cfg.Queue.Eviction == "" {
+		cfg.Queue.Eviction = "oldest"
+	}
 
 	// Expand paths
 	if cfg.Sources.IMessage.DBPath != "" {
@@ -193,6 +513,11 @@ func Load(path string) (*Config, error) {
 	if cfg.Logging.Path != "" {
 		cfg.Logging.Path = expandPath(cfg.Logging.Path)
 	}
+	for _, path := range []*string{&cfg.Backend.TLS.CAFile, &cfg.Backend.TLS.CertFile, &cfg.Backend.TLS.KeyFile} {
+		if *path != "" {
+			*path = expandPath(*path)
+		}
+	}
 
 	// Gmail account paths
 	for i := range cfg.Sources.Gmail.Accounts {
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadYAML loads a config file with the given contents
+func loadYAML(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestTracingDefaults(t *testing.T) {
+	cfg, err := loadYAML(t, "tracing:\n  enabled: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tracing.Exporter != "otlphttp" || cfg.Tracing.ServiceName != "pkb-daemon" {
+		t.Errorf("exporter %q, service %q, want otlphttp and pkb-daemon", cfg.Tracing.Exporter, cfg.Tracing.ServiceName)
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    float64
+		wantErr bool
+	}{
+		{"tracing: {}", 1, false},
+		{"tracing: {sample_ratio: 0}", 0, false},
+		{"tracing: {sample_ratio: 0.25}", 0.25, false},
+		{"tracing: {sample_ratio: 1}", 1, false},
+		{"tracing: {sample_ratio: 1.5}", 0, true},
+		{"tracing: {sample_ratio: -0.1}", 0, true},
+	}
+	for _, tt := range tests {
+		cfg, err := loadYAML(t, tt.yaml)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: loaded, want an error", tt.yaml)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.yaml, err)
+			continue
+		}
+		if got := *cfg.Tracing.SampleRatio; got != tt.want {
+			t.Errorf("%s: sample ratio = %g, want %g", tt.yaml, got, tt.want)
+		}
+	}
+}
+
+func TestOutboxMovesState(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := loadYAML(t, "state:\n  db_path: "+filepath.Join(dir, "state.db")+"\nqueue:\n  path: "+filepath.Join(dir, "queue.db")+"\n  outbox: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checkpoints of the state database are imported from where they were
+	if cfg.State.DBPath != cfg.Queue.Path || cfg.State.PreviousDBPath != filepath.Join(dir, "state.db") {
+		t.Errorf("db_path %q, previous %q, want the queue database and the old state database", cfg.State.DBPath, cfg.State.PreviousDBPath)
+	}
+}
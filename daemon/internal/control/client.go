@@ -0,0 +1,288 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/state"
+	"pkb-daemon/internal/sync"
+)
+
+// Client talks to the control API of a running daemon
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// APIError is a non-2xx response of the control API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("control API error %d: %s", e.StatusCode, e.Message)
+}
+
+// NewClient creates a client for the configured address or socket
+func NewClient(cfg config.ControlConfig) (*Client, error) {
+	token, err := ReadToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		baseURL:    "http://" + cfg.Address,
+		token:      token,
+		httpClient: &http.Client{Timeout: 2 * time.Minute},
+	}
+
+	if cfg.Socket != "" {
+		socket := cfg.Socket
+		c.baseURL = "http://unix"
+		c.httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+
+	return c, nil
+}
+
+// Ping reports whether the daemon is reachable and accepts the token
+func (c *Client) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return c.do(ctx, http.MethodGet, "/v1/sources", nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case json.RawMessage:
+		// Sent as is, e.g. an edited payload
+		reader = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var e ErrorResponse
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = string(data)
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// IsNotFound reports whether err is a 404 from the control API
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) Status(ctx context.Context) (*StatusResponse, error) {
+	var resp StatusResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/status", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Checkpoints(ctx context.Context) (map[string]string, error) {
+	var resp map[string]string
+	if err := c.do(ctx, http.MethodGet, "/v1/state", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) SetCheckpoint(ctx context.Context, source, checkpoint string) error {
+	return c.do(ctx, http.MethodPut, "/v1/state/"+url.PathEscape(source), CheckpointRequest{Checkpoint: checkpoint}, nil)
+}
+
+func (c *Client) ResetCheckpoint(ctx context.Context, source string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/state/"+url.PathEscape(source), nil, nil)
+}
+
+func (c *Client) CheckpointHistory(ctx context.Context, source string, limit int) ([]state.Change, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	var resp []state.Change
+	if err := c.do(ctx, http.MethodGet, "/v1/state/"+url.PathEscape(source)+"/history?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) RollbackCheckpoint(ctx context.Context, source string, id int64) error {
+	return c.do(ctx, http.MethodPost, "/v1/state/"+url.PathEscape(source)+"/rollback", RollbackRequest{ID: id}, nil)
+}
+
+func (c *Client) StartBackfill(ctx context.Context, req sync.BackfillRequest) (*sync.Backfill, error) {
+	var resp sync.Backfill
+	if err := c.do(ctx, http.MethodPost, "/v1/backfills", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Backfills(ctx context.Context) ([]sync.Backfill, error) {
+	var resp []sync.Backfill
+	if err := c.do(ctx, http.MethodGet, "/v1/backfills", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) Backfill(ctx context.Context, id string) (*sync.Backfill, error) {
+	var resp sync.Backfill
+	if err := c.do(ctx, http.MethodGet, "/v1/backfills/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) CancelBackfill(ctx context.Context, id string) (*sync.Backfill, error) {
+	var resp sync.Backfill
+	if err := c.do(ctx, http.MethodDelete, "/v1/backfills/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) QueueList(ctx context.Context, limit, offset int, withPayload bool) ([]QueuedRequest, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	if withPayload {
+		query.Set("payload", "true")
+	}
+
+	var resp QueueListResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/queue/requests?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Requests, nil
+}
+
+func (c *Client) QueueGet(ctx context.Context, id int64) (*QueuedRequest, error) {
+	var resp QueuedRequest
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/v1/queue/requests/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) QueueRetry(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/queue/requests/%d/retry", id), nil, nil)
+}
+
+func (c *Client) QueueRetryAll(ctx context.Context) (int64, error) {
+	var resp CountResponse
+	err := c.do(ctx, http.MethodPost, "/v1/queue/retry-all", nil, &resp)
+	return resp.Count, err
+}
+
+func (c *Client) QueueDrop(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/v1/queue/requests/%d", id), nil, nil)
+}
+
+func (c *Client) QueuePurge(ctx context.Context, all bool) (int64, error) {
+	path := "/v1/queue/requests"
+	if all {
+		path += "?all=true"
+	}
+	var resp CountResponse
+	err := c.do(ctx, http.MethodDelete, path, nil, &resp)
+	return resp.Count, err
+}
+
+func (c *Client) DeadLetterList(ctx context.Context, limit, offset int, withPayload bool) ([]DeadLetter, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	if withPayload {
+		query.Set("payload", "true")
+	}
+
+	var resp DeadLetterListResponse
+	if err := c.do(ctx, http.MethodGet, "/v1/dead-letters?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.DeadLetters, nil
+}
+
+func (c *Client) DeadLetterGet(ctx context.Context, id int64) (*DeadLetter, error) {
+	var resp DeadLetter
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/v1/dead-letters/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) DeadLetterEdit(ctx context.Context, id int64, payload []byte) error {
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/v1/dead-letters/%d/payload", id), json.RawMessage(payload), nil)
+}
+
+func (c *Client) DeadLetterReplay(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/dead-letters/%d/replay", id), nil, nil)
+}
+
+func (c *Client) DeadLetterReplayAll(ctx context.Context) (int64, error) {
+	var resp CountResponse
+	err := c.do(ctx, http.MethodPost, "/v1/dead-letters/replay-all", nil, &resp)
+	return resp.Count, err
+}
+
+func (c *Client) DeadLetterDrop(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/v1/dead-letters/%d", id), nil, nil)
+}
+
+func (c *Client) DeadLetterPurge(ctx context.Context) (int64, error) {
+	var resp CountResponse
+	err := c.do(ctx, http.MethodDelete, "/v1/dead-letters", nil, &resp)
+	return resp.Count, err
+}
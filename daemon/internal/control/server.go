@@ -0,0 +1,758 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/state"
+	"pkb-daemon/internal/sync"
+)
+
+// Server is the local control API of the daemon. Every endpoint requires
+// "Authorization: Bearer <token>" and responds with JSON.
+type Server struct {
+	cfg     config.ControlConfig
+	manager *sync.Manager
+	token   string
+	mux     *http.ServeMux
+}
+
+func NewServer(cfg config.ControlConfig, manager *sync.Manager) (*Server, error) {
+	if cfg.Socket == "" {
+		if err := checkLoopback(cfg.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := ensureToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		manager: manager,
+		token:   token,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /v1/status", s.handleStatus)
+	s.mux.HandleFunc("GET /v1/sources", s.handleSources)
+	s.mux.HandleFunc("GET /v1/sources/{name}", s.handleSource)
+	s.mux.HandleFunc("POST /v1/sources/{name}/sync", s.handleTrigger)
+	s.mux.HandleFunc("POST /v1/sources/{name}/pause", s.handlePause)
+	s.mux.HandleFunc("POST /v1/sources/{name}/resume", s.handleResume)
+	s.mux.HandleFunc("GET /v1/state", s.handleState)
+	s.mux.HandleFunc("PUT /v1/state/{source}", s.handleStateSet)
+	s.mux.HandleFunc("DELETE /v1/state/{source}", s.handleStateReset)
+	s.mux.HandleFunc("GET /v1/state/{source}/history", s.handleStateHistory)
+	s.mux.HandleFunc("POST /v1/state/{source}/rollback", s.handleStateRollback)
+	s.mux.HandleFunc("GET /v1/backfills", s.handleBackfillList)
+	s.mux.HandleFunc("POST /v1/backfills", s.handleBackfillStart)
+	s.mux.HandleFunc("GET /v1/backfills/{id}", s.handleBackfillGet)
+	s.mux.HandleFunc("DELETE /v1/backfills/{id}", s.handleBackfillCancel)
+	s.mux.HandleFunc("GET /v1/queue", s.handleQueueStats)
+	s.mux.HandleFunc("GET /v1/queue/requests", s.handleQueueList)
+	s.mux.HandleFunc("DELETE /v1/queue/requests", s.handleQueuePurge)
+	s.mux.HandleFunc("GET /v1/queue/requests/{id}", s.handleQueueGet)
+	s.mux.HandleFunc("DELETE /v1/queue/requests/{id}", s.handleQueueDrop)
+	s.mux.HandleFunc("POST /v1/queue/requests/{id}/retry", s.handleQueueRetry)
+	s.mux.HandleFunc("POST /v1/queue/retry-all", s.handleQueueRetryAll)
+	s.mux.HandleFunc("POST /v1/queue/process", s.handleQueueProcess)
+	s.mux.HandleFunc("GET /v1/dead-letters", s.handleDeadLetterList)
+	s.mux.HandleFunc("DELETE /v1/dead-letters", s.handleDeadLetterPurge)
+	s.mux.HandleFunc("GET /v1/dead-letters/{id}", s.handleDeadLetterGet)
+	s.mux.HandleFunc("PUT /v1/dead-letters/{id}/payload", s.handleDeadLetterEdit)
+	s.mux.HandleFunc("DELETE /v1/dead-letters/{id}", s.handleDeadLetterDrop)
+	s.mux.HandleFunc("POST /v1/dead-letters/{id}/replay", s.handleDeadLetterReplay)
+	s.mux.HandleFunc("POST /v1/dead-letters/replay-all", s.handleDeadLetterReplayAll)
+
+	return s, nil
+}
+
+// checkLoopback refuses to expose the API beyond the local machine
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid control address %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("control address %q is not a loopback address", addr)
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if s.cfg.Socket == "" {
+		return net.Listen("tcp", s.cfg.Address)
+	}
+
+	// Remove a stale socket left by a previous run
+	if err := os.Remove(s.cfg.Socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", s.cfg.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(s.cfg.Socket, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Run serves the API until ctx is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("failed to listen for control API: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.authenticate(s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("address", ln.Addr().String()).Str("token_path", s.cfg.TokenPath).Msg("Control API listening")
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug().Err(err).Msg("Failed to write control API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// sources returns the status of every registered source plus any extra
+// entries, such as individual calendar providers
+func (s *Server) sources() []Source {
+	kinds := make(map[string]string)
+	for _, src := range s.manager.Sources() {
+		kinds[src.Name] = src.Kind
+	}
+
+	var result []Source
+	seen := make(map[string]bool)
+	for _, st := range s.manager.Status().Snapshot() {
+		seen[st.Name] = true
+		result = append(result, s.source(st, kinds[st.Name]))
+	}
+	// Sources that haven't run yet have no status entry
+	for name, kind := range kinds {
+		if !seen[name] {
+			st, _ := s.manager.Status().Get(name)
+			result = append(result, s.source(st, kind))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (s *Server) source(st sync.SourceStatus, kind string) Source {
+	src := Source{SourceStatus: st, Kind: kind}
+	if kind != "" {
+		src.Checkpoint = s.manager.Checkpoint(st.Name)
+	}
+	return src
+}
+
+func (s *Server) queueStats() (*queue.Stats, error) {
+	q := s.manager.Queue()
+	if q == nil {
+		return nil, nil
+	}
+	return q.Stats()
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.queueStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, StatusResponse{Sources: s.sources(), Queue: stats})
+}
+
+func (s *Server) handleSources(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.sources())
+}
+
+func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	for _, src := range s.sources() {
+		if src.Name == name {
+			writeJSON(w, http.StatusOK, src)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("unknown source %q", name))
+}
+
+// sourceAction maps the result of a trigger/pause/resume to a response
+func (s *Server) sourceAction(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, sync.ErrPaused):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusNotFound, err)
+	default:
+		st, _ := s.manager.Status().Get(name)
+		writeJSON(w, http.StatusAccepted, st)
+	}
+}
+
+func (s *Server) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.sourceAction(w, name, s.manager.Trigger(name))
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.sourceAction(w, name, s.manager.Pause(name))
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.sourceAction(w, name, s.manager.Resume(name))
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	s.writeCheckpoints(w)
+}
+
+// writeCheckpoints responds with the checkpoints of all sources
+func (s *Server) writeCheckpoints(w http.ResponseWriter) {
+	checkpoints, err := s.manager.Checkpoints()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, checkpoints)
+}
+
+func (s *Server) handleStateSet(w http.ResponseWriter, r *http.Request) {
+	var body CheckpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+	s.stateAction(w, s.manager.SetCheckpoint(r.PathValue("source"), body.Checkpoint))
+}
+
+func (s *Server) handleStateReset(w http.ResponseWriter, r *http.Request) {
+	s.stateAction(w, s.manager.ResetCheckpoint(r.PathValue("source")))
+}
+
+func (s *Server) handleStateHistory(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r, "limit", 20)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	changes, err := s.manager.CheckpointHistory(r.PathValue("source"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if changes == nil {
+		changes = []state.Change{}
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func (s *Server) handleStateRollback(w http.ResponseWriter, r *http.Request) {
+	var body RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+	_, err := s.manager.RollbackCheckpoint(r.PathValue("source"), body.ID)
+	s.stateAction(w, err)
+}
+
+func (s *Server) stateAction(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sync.ErrRunning):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, state.ErrChangeNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		s.writeCheckpoints(w)
+	}
+}
+
+func (s *Server) handleBackfillList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.manager.Backfills())
+}
+
+func (s *Server) handleBackfillStart(w http.ResponseWriter, r *http.Request) {
+	var body sync.BackfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+	b, err := s.manager.StartBackfill(body)
+	if err != nil {
+		writeBackfillError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, b)
+}
+
+func (s *Server) handleBackfillGet(w http.ResponseWriter, r *http.Request) {
+	b, err := s.manager.Backfill(r.PathValue("id"))
+	if err != nil {
+		writeBackfillError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+func (s *Server) handleBackfillCancel(w http.ResponseWriter, r *http.Request) {
+	b, err := s.manager.CancelBackfill(r.PathValue("id"))
+	if err != nil {
+		writeBackfillError(w, err)
+		return
+	}
+	log.Info().Str("id", b.ID).Msg("Backfill cancelled via control API")
+	writeJSON(w, http.StatusAccepted, b)
+}
+
+// writeBackfillError maps a backfill error to a response. Anything else is
+// a bad range or account.
+func writeBackfillError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sync.ErrBackfillNotFound), errors.Is(err, sync.ErrUnknownSource):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, sync.ErrBackfillRunning):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, sync.ErrNotRunning):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+// queue returns the offline queue, or writes an error if it is disabled
+func (s *Server) queue(w http.ResponseWriter) *queue.Queue {
+	q := s.manager.Queue()
+	if q == nil {
+		writeError(w, http.StatusNotFound, sync.ErrQueueDisabled)
+	}
+	return q
+}
+
+// pathID reads the {id} path value, or writes an error if it is invalid
+func pathID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid id %q", r.PathValue("id")))
+		return 0, false
+	}
+	return id, true
+}
+
+// writeQueueError maps a queue error to a response
+func writeQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrNotFound) || errors.Is(err, queue.ErrDeadLetterNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func (s *Server) handleQueueStats(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	stats, err := q.Stats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// intParam reads an optional non-negative integer query parameter
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func (s *Server) handleQueueList(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+
+	limit, offset, ok := listParams(w, r)
+	if !ok {
+		return
+	}
+	withPayload := r.URL.Query().Get("payload") == "true"
+
+	requests, err := q.List(limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := QueueListResponse{Requests: []QueuedRequest{}, Limit: limit, Offset: offset}
+	for _, req := range requests {
+		resp.Requests = append(resp.Requests, NewQueuedRequest(req, withPayload))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleQueueGet(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	req, err := q.Get(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewQueuedRequest(*req, true))
+}
+
+func (s *Server) handleQueueDrop(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := q.Delete(id); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	log.Info().Int64("id", id).Msg("Queued request dropped via control API")
+	writeJSON(w, http.StatusOK, CountResponse{Count: 1})
+}
+
+func (s *Server) handleQueuePurge(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+
+	var n int64
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		n, err = q.DeleteAll()
+	} else {
+		n, err = q.PurgeExpired()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CountResponse{Count: n})
+}
+
+// sendNow processes the queue right away and triggers the sources whose
+// requests only their own sync sends
+func (s *Server) sendNow(ctx context.Context, resp *CountResponse, sources []string) {
+	s.manager.ProcessQueue(ctx)
+	resp.Triggered, resp.Waiting = s.manager.TriggerBacklog(sources)
+}
+
+// queuedSources returns the sources with queued requests, or writes an error
+func queuedSources(w http.ResponseWriter, q *queue.Queue) ([]string, bool) {
+	sources, err := q.Sources()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return sources, true
+}
+
+// handleQueueRetry makes a request due and processes the queue right away
+func (s *Server) handleQueueRetry(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	req, err := q.Get(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	if err := q.Retry(id); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	resp := CountResponse{Count: 1}
+	s.sendNow(r.Context(), &resp, []string{req.Source})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleQueueRetryAll(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+
+	n, err := q.RetryAll()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sources, ok := queuedSources(w, q)
+	if !ok {
+		return
+	}
+	resp := CountResponse{Count: n}
+	s.sendNow(r.Context(), &resp, sources)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleQueueProcess(w http.ResponseWriter, r *http.Request) {
+	if err := s.manager.ProcessQueue(r.Context()); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	s.handleQueueStats(w, r)
+}
+
+// listParams reads the limit and offset query parameters, or writes an error if they are invalid
+func listParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	limit, err := intParam(r, "limit", 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return 0, 0, false
+	}
+	offset, err := intParam(r, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+func (s *Server) handleDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	limit, offset, ok := listParams(w, r)
+	if !ok {
+		return
+	}
+	withPayload := r.URL.Query().Get("payload") == "true"
+
+	letters, err := q.ListDeadLetters(limit, offset)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := DeadLetterListResponse{DeadLetters: []DeadLetter{}, Limit: limit, Offset: offset}
+	for _, d := range letters {
+		resp.DeadLetters = append(resp.DeadLetters, NewDeadLetter(d, withPayload))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleDeadLetterGet(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	d, err := q.GetDeadLetter(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewDeadLetter(*d, true))
+}
+
+// handleDeadLetterEdit replaces the payload of a dead letter with the request body
+func (s *Server) handleDeadLetterEdit(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+	if !json.Valid(payload) {
+		writeError(w, http.StatusBadRequest, errors.New("payload is not valid JSON"))
+		return
+	}
+	if err := q.UpdateDeadLetter(id, payload); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	log.Info().Int64("id", id).Msg("Dead letter edited via control API")
+
+	d, err := q.GetDeadLetter(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, NewDeadLetter(*d, true))
+}
+
+func (s *Server) handleDeadLetterDrop(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := q.DeleteDeadLetter(id); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	log.Info().Int64("id", id).Msg("Dead letter dropped via control API")
+	writeJSON(w, http.StatusOK, CountResponse{Count: 1})
+}
+
+func (s *Server) handleDeadLetterPurge(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+
+	n, err := q.DeleteAllDeadLetters()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CountResponse{Count: n})
+}
+
+// handleDeadLetterReplay moves a dead letter back into the queue and processes it right away
+func (s *Server) handleDeadLetterReplay(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	d, err := q.GetDeadLetter(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	if err := q.ReplayDeadLetter(id); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	resp := CountResponse{Count: 1}
+	s.sendNow(r.Context(), &resp, []string{d.Source})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleDeadLetterReplayAll(w http.ResponseWriter, r *http.Request) {
+	q := s.queue(w)
+	if q == nil {
+		return
+	}
+
+	n, err := q.ReplayAllDeadLetters()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sources, ok := queuedSources(w, q)
+	if !ok {
+		return
+	}
+	resp := CountResponse{Count: n}
+	s.sendNow(r.Context(), &resp, sources)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,208 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/sink"
+	"pkb-daemon/internal/sync"
+)
+
+// idleSource is a registered source that never has anything new
+type idleSource struct{ name string }
+
+func (s idleSource) Name() string { return s.name }
+
+func (s idleSource) Sync(_ context.Context, checkpoint string, _ int) ([]api.Communication, string, error) {
+	return nil, checkpoint, nil
+}
+
+// newTestServer returns a server for a manager with the queue disabled and
+// an "imessage" source registered
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.State.Path = filepath.Join(dir, "state.json")
+	cfg.State.DBPath = filepath.Join(dir, "state.db")
+	cfg.Control = config.ControlConfig{Address: "127.0.0.1:7465", TokenPath: filepath.Join(dir, "control.token")}
+
+	m := sync.NewManager(nil, cfg)
+	if err := m.InitState(); err != nil {
+		t.Fatal(err)
+	}
+	m.RegisterSource(idleSource{name: "imessage"})
+
+	s, err := NewServer(cfg.Control, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newQueueServer returns a server whose manager queues into a temporary
+// directory and delivers to a file sink
+func newQueueServer(t *testing.T, preserveOrder bool) (*Server, *sink.File) {
+	t.Helper()
+	dir := t.TempDir()
+	data, err := json.Marshal(map[string]any{
+		"state":   map[string]any{"path": filepath.Join(dir, "state.json")},
+		"queue":   map[string]any{"enabled": true, "path": filepath.Join(dir, "queue.db"), "preserve_order": preserveOrder},
+		"control": map[string]any{"token_path": filepath.Join(dir, "control.token")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := sink.OpenFile(filepath.Join(dir, "export.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	m := sync.NewManager(file, cfg)
+	if err := m.InitQueue(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Queue().Close() })
+	m.RegisterSource(idleSource{name: "imessage"})
+
+	s, err := NewServer(cfg.Control, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, file
+}
+
+// serve sends a request through the authenticated handler
+func serve(s *Server, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.authenticate(s.mux).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "nope", http.StatusUnauthorized},
+		{"token", s.token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(s, http.MethodGet, "/v1/status", tt.token); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSourceActions(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/v1/sources/imessage", http.StatusOK},
+		{http.MethodGet, "/v1/sources/gmail", http.StatusNotFound},
+		{http.MethodPost, "/v1/sources/imessage/pause", http.StatusAccepted},
+		{http.MethodPost, "/v1/sources/imessage/sync", http.StatusConflict},
+		{http.MethodPost, "/v1/sources/imessage/resume", http.StatusAccepted},
+		{http.MethodPost, "/v1/sources/imessage/sync", http.StatusAccepted},
+		{http.MethodPost, "/v1/sources/gmail/sync", http.StatusNotFound},
+		// The queue is disabled
+		{http.MethodGet, "/v1/queue", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := serve(s, tt.method, tt.path, s.token); rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestCheckLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:7465", true},
+		{"[::1]:7465", true},
+		{"localhost:7465", true},
+		{"0.0.0.0:7465", false},
+		{"192.168.1.10:7465", false},
+		{"7465", false},
+	}
+	for _, tt := range tests {
+		if err := checkLoopback(tt.addr); (err == nil) != tt.ok {
+			t.Errorf("checkLoopback(%q) = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+	}
+}
+
+func TestRetryAllOrdered(t *testing.T) {
+	tests := []struct {
+		name          string
+		preserveOrder bool
+		sent          int
+		triggered     []string
+		waiting       []string
+	}{
+		{"unordered", false, 2, nil, nil},
+		// Only the sync of a source sends its requests; "gmail" isn't registered
+		{"ordered", true, 0, []string{"imessage"}, []string{"gmail"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, file := newQueueServer(t, tt.preserveOrder)
+			q := s.manager.Queue()
+			for _, source := range []string{"imessage", "gmail"} {
+				payload := api.BatchUpsertRequest{Communications: []api.Communication{{Source: source, SourceID: "1"}}}
+				if err := q.Enqueue(source, queue.RequestTypeBatchUpsert, payload, "backend down", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := serve(s, http.MethodPost, "/v1/queue/retry-all", s.token)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var resp CountResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Count != 2 {
+				t.Errorf("count = %d, want 2", resp.Count)
+			}
+			if !slices.Equal(resp.Triggered, tt.triggered) || !slices.Equal(resp.Waiting, tt.waiting) {
+				t.Errorf("triggered %v, waiting %v, want %v and %v", resp.Triggered, resp.Waiting, tt.triggered, tt.waiting)
+			}
+			if file.Records() != tt.sent {
+				t.Errorf("sent %d requests, want %d", file.Records(), tt.sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pkb-daemon/internal/config"
+)
+
+// ReadToken returns the configured token, or the one stored at token_path
+func ReadToken(cfg config.ControlConfig) (string, error) {
+	if cfg.Token != "" {
+		return cfg.Token, nil
+	}
+	data, err := os.ReadFile(cfg.TokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read control token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("control token file %s is empty", cfg.TokenPath)
+	}
+	return token, nil
+}
+
+// ensureToken returns the token the server should accept, generating one and
+// storing it at token_path (readable only by the user) if none is configured
+func ensureToken(cfg config.ControlConfig) (string, error) {
+	token, err := ReadToken(cfg)
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate control token: %w", err)
+	}
+	token = hex.EncodeToString(buf)
+
+	if err := os.MkdirAll(filepath.Dir(cfg.TokenPath), 0700); err != nil {
+		return "", fmt.Errorf("failed to create token directory: %w", err)
+	}
+	if err := os.WriteFile(cfg.TokenPath, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write control token: %w", err)
+	}
+	return token, nil
+}
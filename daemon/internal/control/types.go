@@ -0,0 +1,142 @@
+package control
+
+import (
+	"encoding/json"
+	"time"
+
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/sync"
+)
+
+// Source is the status of a source as returned by the API
+type Source struct {
+	sync.SourceStatus
+	Kind       string `json:"kind,omitempty"`
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// StatusResponse is returned by GET /v1/status
+type StatusResponse struct {
+	Sources []Source     `json:"sources"`
+	Queue   *queue.Stats `json:"queue,omitempty"` // nil when the queue is disabled
+}
+
+// QueuedRequest is a queued request as returned by the API. Payload is only
+// included when a single request is fetched or a listing asks for it.
+type QueuedRequest struct {
+	ID          int64               `json:"id"`
+	Type        queue.RequestType   `json:"type"`
+	Source      string              `json:"source,omitempty"`
+	Seq         int64               `json:"seq"`
+	Retries     int                 `json:"retries"`
+	MaxRetries  int                 `json:"max_retries"`
+	NextRetryAt time.Time           `json:"next_retry_at"`
+	CreatedAt   time.Time           `json:"created_at"`
+	LastError   string              `json:"last_error,omitempty"`
+	Errors      []queue.ErrorRecord `json:"errors,omitempty"`
+	Summary     string              `json:"summary"`
+	PayloadSize int                 `json:"payload_size"`
+	Payload     json.RawMessage     `json:"payload,omitempty"`
+}
+
+// NewQueuedRequest converts a request read from the queue
+func NewQueuedRequest(req queue.QueuedRequest, withPayload bool) QueuedRequest {
+	r := QueuedRequest{
+		ID:          req.ID,
+		Type:        req.Type,
+		Source:      req.Source,
+		Seq:         req.Seq,
+		Retries:     req.Retries,
+		MaxRetries:  req.MaxRetries,
+		NextRetryAt: req.NextRetryAt,
+		CreatedAt:   req.CreatedAt,
+		LastError:   req.LastError,
+		Errors:      req.Errors,
+		Summary:     queue.Summarize(req.Type, req.Payload),
+		PayloadSize: len(req.Payload),
+	}
+	if withPayload {
+		r.Payload = json.RawMessage(req.Payload)
+	}
+	return r
+}
+
+// QueueListResponse is returned by GET /v1/queue/requests
+type QueueListResponse struct {
+	Requests []QueuedRequest `json:"requests"`
+	Limit    int             `json:"limit"`
+	Offset   int             `json:"offset"`
+}
+
+// DeadLetter is a dead letter as returned by the API. Like QueuedRequest,
+// the payload is only included on request.
+type DeadLetter struct {
+	ID          int64               `json:"id"`
+	Type        queue.RequestType   `json:"type"`
+	Source      string              `json:"source,omitempty"`
+	Seq         int64               `json:"seq"`
+	Reason      string              `json:"reason"`
+	Retries     int                 `json:"retries"`
+	CreatedAt   time.Time           `json:"created_at"`
+	DeadAt      time.Time           `json:"dead_at"`
+	LastError   string              `json:"last_error,omitempty"`
+	Errors      []queue.ErrorRecord `json:"errors"`
+	Summary     string              `json:"summary"`
+	PayloadSize int                 `json:"payload_size"`
+	Payload     json.RawMessage     `json:"payload,omitempty"`
+}
+
+// NewDeadLetter converts a dead letter read from the queue
+func NewDeadLetter(d queue.DeadLetter, withPayload bool) DeadLetter {
+	r := DeadLetter{
+		ID:          d.ID,
+		Type:        d.Type,
+		Source:      d.Source,
+		Seq:         d.Seq,
+		Reason:      d.Reason,
+		Retries:     d.Retries,
+		CreatedAt:   d.CreatedAt,
+		DeadAt:      d.DeadAt,
+		LastError:   d.LastError(),
+		Errors:      d.Errors,
+		Summary:     queue.Summarize(d.Type, d.Payload),
+		PayloadSize: len(d.Payload),
+	}
+	if withPayload {
+		r.Payload = json.RawMessage(d.Payload)
+	}
+	return r
+}
+
+// DeadLetterListResponse is returned by GET /v1/dead-letters
+type DeadLetterListResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+	Limit       int          `json:"limit"`
+	Offset      int          `json:"offset"`
+}
+
+// CheckpointRequest is the body of PUT /v1/state/{source}
+type CheckpointRequest struct {
+	Checkpoint string `json:"checkpoint"`
+}
+
+// RollbackRequest is the body of POST /v1/state/{source}/rollback. ID is an
+// entry of the source's checkpoint history.
+type RollbackRequest struct {
+	ID int64 `json:"id"`
+}
+
+// CountResponse reports how many queued requests or dead letters an operation affected
+type CountResponse struct {
+	Count int64 `json:"count"`
+	// With preserve_order or the outbox, the requests of a source are sent by
+	// its own sync: right away for the triggered sources, at the next sync
+	// for the waiting ones, which are paused or not registered
+	Triggered []string `json:"triggered,omitempty"`
+	Waiting   []string `json:"waiting,omitempty"`
+}
+
+// ErrorResponse is the body of every non-2xx response
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,128 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"pkb-daemon/internal/queue"
+)
+
+// Record is a single request in a JSONL export. Type and payload have the
+// shapes of a queued request, so the output of "queue export" can be
+// replayed as well.
+type Record struct {
+	Type    queue.RequestType `json:"type"`
+	Source  string            `json:"source,omitempty"`
+	Time    time.Time         `json:"time"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+// Writer appends records to a JSONL file or stdout. It is safe for
+// concurrent use by several sources.
+type Writer struct {
+	mu      sync.Mutex
+	out     *bufio.Writer
+	file    *os.File // nil for stdout
+	records int
+}
+
+// Create opens path for appending, or writes to stdout if path is "-"
+func Create(path string) (*Writer, error) {
+	if path == "-" || path == "" {
+		return &Writer{out: bufio.NewWriter(os.Stdout)}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create export directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export file: %w", err)
+	}
+	return &Writer{out: bufio.NewWriter(f), file: f}, nil
+}
+
+// Write appends a request of a source. Each record is flushed right away so
+// an interrupted run leaves complete lines behind.
+func (w *Writer) Write(source string, reqType queue.RequestType, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	line, err := json.Marshal(Record{Type: reqType, Source: source, Time: time.Now(), Payload: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	if err := w.out.Flush(); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	w.records++
+	return nil
+}
+
+// Records returns how many records were written
+func (w *Writer) Records() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.records
+}
+
+// Close flushes the writer and closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.out.Flush()
+	if w.file != nil {
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Read calls fn for every record in r with its line number, starting at 1.
+// Blank lines are skipped. Reading stops at the first error fn returns.
+func Read(r io.Reader, fn func(line int, rec Record) error) error {
+	br := bufio.NewReader(r)
+	line := 0
+	for {
+		data, err := br.ReadBytes('\n')
+		if len(data) > 0 {
+			line++
+			if data = bytes.TrimSpace(data); len(data) > 0 {
+				var rec Record
+				if jsonErr := json.Unmarshal(data, &rec); jsonErr != nil {
+					return fmt.Errorf("line %d: invalid record: %w", line, jsonErr)
+				}
+				if rec.Type == "" || len(rec.Payload) == 0 {
+					return fmt.Errorf("line %d: record has no type or payload", line)
+				}
+				if fnErr := fn(line, rec); fnErr != nil {
+					return fnErr
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read export: %w", err)
+		}
+	}
+}
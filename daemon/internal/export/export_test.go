@@ -0,0 +1,93 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"pkb-daemon/internal/queue"
+)
+
+func TestWriteRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.jsonl")
+	w, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write("imessage", queue.RequestTypeBatchUpsert, map[string]string{"id": "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run appends to the same export
+	if w, err = Create(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write("notes", queue.RequestTypeImportNotes, map[string]string{"id": "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Records() != 1 {
+		t.Errorf("records = %d, want 1", w.Records())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	err = Read(f, func(line int, rec Record) error {
+		got = append(got, string(rec.Type)+" "+rec.Source+" "+string(rec.Payload))
+		if rec.Time.IsZero() {
+			t.Errorf("line %d has no time", line)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`batch_upsert imessage {"id":"m1"}`, `import_notes notes {"id":"n1"}`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		lines   []int
+		wantErr string
+	}{
+		{"blank lines are skipped", "{\"type\":\"batch_upsert\",\"payload\":{}}\n\n{\"type\":\"import_notes\",\"payload\":{}}\n", []int{1, 3}, ""},
+		{"no trailing newline", `{"type":"batch_upsert","payload":{}}`, []int{1}, ""},
+		{"invalid JSON", "{\"type\":\"batch_upsert\",\"payload\":{}}\n{broken\n", []int{1}, "line 2: invalid record"},
+		{"missing payload", `{"type":"batch_upsert"}`, nil, "line 1: record has no type or payload"},
+		{"missing type", `{"payload":{}}`, nil, "line 1: record has no type or payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []int
+			err := Read(strings.NewReader(tt.input), func(line int, _ Record) error {
+				lines = append(lines, line)
+				return nil
+			})
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+			if !slices.Equal(lines, tt.lines) {
+				t.Errorf("lines = %v, want %v", lines, tt.lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package filter
+
+import (
+	"fmt"
+	"sync"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+)
+
+// Identifier is a normalized phone number or email address of a person, or a
+// handle such as an alphanumeric SMS sender
+type Identifier struct {
+	Type  string // "phone", "email" or "social_handle"
+	Value string
+}
+
+// Decision is the outcome of checking a person against the filter
+type Decision struct {
+	Blocked bool
+	Reason  string // matching rule, e.g. "blocklist email:*@spam.com" or "allowlist"
+}
+
+// allowlist is a compiled config.AllowlistConfig
+type allowlist struct {
+	enabled     bool
+	addressBook bool
+	rules       *ruleSet
+}
+
+func compileAllowlist(cfg config.AllowlistConfig, phones *identity.Normalizer) (*allowlist, error) {
+	rules, err := compileRules(cfg.FilterRules, phones)
+	if err != nil {
+		return nil, err
+	}
+	return &allowlist{
+		enabled:     cfg.Enabled,
+		addressBook: cfg.AddressBook,
+		rules:       rules,
+	}, nil
+}
+
+// Filter decides which people may be synced, combining the blocklist,
+// the allowlist and per-source overrides of both
+type Filter struct {
+	block       *ruleSet
+	sourceBlock map[string]*ruleSet
+	allow       *allowlist
+	sourceAllow map[string]*allowlist
+
+	mu                sync.RWMutex
+	addressBook       map[Identifier]bool
+	addressBookLoaded bool
+}
+
+// New compiles the blocklist and allowlist configuration
+func New(block config.BlocklistConfig, allow config.AllowlistConfig, phones *identity.Normalizer) (*Filter, error) {
+	f := &Filter{
+		sourceBlock: make(map[string]*ruleSet),
+		sourceAllow: make(map[string]*allowlist),
+		addressBook: make(map[Identifier]bool),
+	}
+
+	var err error
+	if f.block, err = compileRules(block.FilterRules, phones); err != nil {
+		return nil, fmt.Errorf("blocklist: %w", err)
+	}
+	for source, rules := range block.Sources {
+		if f.sourceBlock[source], err = compileRules(rules, phones); err != nil {
+			return nil, fmt.Errorf("blocklist for %s: %w", source, err)
+		}
+	}
+
+	if f.allow, err = compileAllowlist(allow, phones); err != nil {
+		return nil, fmt.Errorf("allowlist: %w", err)
+	}
+	for source, cfg := range allow.Sources {
+		if f.sourceAllow[source], err = compileAllowlist(cfg, phones); err != nil {
+			return nil, fmt.Errorf("allowlist for %s: %w", source, err)
+		}
+	}
+
+	return f, nil
+}
+
+// allowlistFor returns the allowlist that applies to a source
+func (f *Filter) allowlistFor(source string) *allowlist {
+	if a, ok := f.sourceAllow[source]; ok {
+		return a
+	}
+	return f.allow
+}
+
+// NeedsAddressBook reports whether any allowlist admits people from the address book
+func (f *Filter) NeedsAddressBook() bool {
+	if f.allow.enabled && f.allow.addressBook {
+		return true
+	}
+	for _, a := range f.sourceAllow {
+		if a.enabled && a.addressBook {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready reports whether the filter can make decisions for a source. It is false
+// while an address-book allowlist is waiting for the first contacts sync, so
+// messages aren't dropped just because contacts haven't loaded yet.
+func (f *Filter) Ready(source string) bool {
+	a := f.allowlistFor(source)
+	if !a.enabled || !a.addressBook {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.addressBookLoaded
+}
+
+// SetAddressBook replaces the set of identifiers known from the address book
+func (f *Filter) SetAddressBook(ids []Identifier) {
+	book := make(map[Identifier]bool, len(ids))
+	for _, id := range ids {
+		book[id] = true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addressBook = book
+	f.addressBookLoaded = true
+}
+
+// Blocked checks only the blocklist. It is used for the contacts themselves,
+// which make up the address book and so are never subject to the allowlist.
+func (f *Filter) Blocked(source, name string, ids ...Identifier) Decision {
+	for _, rs := range []*ruleSet{f.block, f.sourceBlock[source]} {
+		if rs == nil {
+			continue
+		}
+		if rule := rs.matchName(name); rule != "" {
+			return Decision{Blocked: true, Reason: "blocklist " + rule}
+		}
+		for _, id := range ids {
+			if rule := rs.matchIdentifier(id); rule != "" {
+				return Decision{Blocked: true, Reason: "blocklist " + rule}
+			}
+		}
+	}
+	return Decision{}
+}
+
+// Check decides whether a person seen by a source may be synced. The blocklist
+// always wins; when an allowlist is enabled the person must also match it.
+func (f *Filter) Check(source, name string, ids ...Identifier) Decision {
+	if d := f.Blocked(source, name, ids...); d.Blocked {
+		return d
+	}
+
+	a := f.allowlistFor(source)
+	if !a.enabled {
+		return Decision{}
+	}
+
+	if a.rules.matchName(name) != "" {
+		return Decision{}
+	}
+	for _, id := range ids {
+		if a.rules.matchIdentifier(id) != "" {
+			return Decision{}
+		}
+	}
+
+	if a.addressBook {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		for _, id := range ids {
+			if f.addressBook[id] {
+				return Decision{}
+			}
+		}
+	}
+
+	return Decision{Blocked: true, Reason: "allowlist"}
+}
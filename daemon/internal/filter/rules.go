@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+)
+
+// pattern matches a single value exactly, as a glob or as a regex
+type pattern struct {
+	raw   string
+	exact string
+	fold  bool // exact ignores case
+	glob  string
+	re    *regexp.Regexp
+}
+
+// compilePattern parses "re:<regex>", a glob containing * ? or [, or an exact value.
+// normalize is applied to exact values so they compare against normalized identifiers.
+// A value that doesn't normalize, like the alphanumeric sender "AMAZON" in a
+// phone rule, matches as it is, ignoring case.
+func compilePattern(raw string, normalize func(string) string) (*pattern, error) {
+	p := &pattern{raw: raw}
+
+	switch {
+	case strings.HasPrefix(raw, "re:"):
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(raw, "re:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", raw, err)
+		}
+		p.re = re
+	case strings.ContainsAny(raw, "*?["):
+		if _, err := path.Match(raw, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", raw, err)
+		}
+		p.glob = strings.ToLower(raw)
+	default:
+		p.exact = normalize(raw)
+		if p.exact == "" {
+			p.exact = strings.TrimSpace(raw)
+			p.fold = true
+		}
+		if p.exact == "" {
+			return nil, fmt.Errorf("invalid value %q", raw)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *pattern) match(value string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(value)
+	case p.glob != "":
+		ok, _ := path.Match(p.glob, strings.ToLower(value))
+		return ok
+	case p.fold:
+		return strings.EqualFold(p.exact, value)
+	default:
+		return p.exact == value
+	}
+}
+
+// namePattern matches display names; exact values match as case-insensitive substrings
+type namePattern struct {
+	*pattern
+	substring string
+}
+
+func (p *namePattern) match(name string) bool {
+	if p.substring != "" {
+		return strings.Contains(strings.ToLower(name), p.substring)
+	}
+	return p.pattern.match(name)
+}
+
+// ruleSet is a compiled config.FilterRules
+type ruleSet struct {
+	phones  []*pattern
+	emails  []*pattern
+	domains []string
+	names   []*namePattern
+}
+
+func compileRules(rules config.FilterRules, phones *identity.Normalizer) (*ruleSet, error) {
+	rs := &ruleSet{}
+
+	for _, raw := range rules.Phones {
+		p, err := compilePattern(raw, phones.NormalizePhone)
+		if err != nil {
+			return nil, fmt.Errorf("phone rule: %w", err)
+		}
+		rs.phones = append(rs.phones, p)
+	}
+
+	for _, raw := range rules.Emails {
+		p, err := compilePattern(raw, identity.NormalizeEmail)
+		if err != nil {
+			return nil, fmt.Errorf("email rule: %w", err)
+		}
+		rs.emails = append(rs.emails, p)
+	}
+
+	for _, raw := range rules.Domains {
+		domain := strings.TrimPrefix(identity.NormalizeEmail(raw), "@")
+		if domain != "" {
+			rs.domains = append(rs.domains, domain)
+		}
+	}
+
+	for _, raw := range rules.Names {
+		if strings.HasPrefix(raw, "re:") || strings.ContainsAny(raw, "*?[") {
+			p, err := compilePattern(raw, strings.ToLower)
+			if err != nil {
+				return nil, fmt.Errorf("name rule: %w", err)
+			}
+			rs.names = append(rs.names, &namePattern{pattern: p})
+			continue
+		}
+		if name := strings.ToLower(strings.TrimSpace(raw)); name != "" {
+			rs.names = append(rs.names, &namePattern{substring: name})
+		}
+	}
+
+	return rs, nil
+}
+
+// matchIdentifier returns the rule that matches an identifier, or "" if none does
+func (rs *ruleSet) matchIdentifier(id Identifier) string {
+	switch id.Type {
+	case "phone":
+		for _, p := range rs.phones {
+			if p.match(id.Value) {
+				return "phone:" + p.raw
+			}
+		}
+	case "email":
+		for _, p := range rs.emails {
+			if p.match(id.Value) {
+				return "email:" + p.raw
+			}
+		}
+		if domain := emailDomain(id.Value); domain != "" {
+			for _, d := range rs.domains {
+				if domain == d || strings.HasSuffix(domain, "."+d) {
+					return "domain:" + d
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// matchName returns the rule that matches a display name, or "" if none does
+func (rs *ruleSet) matchName(name string) string {
+	if name == "" {
+		return ""
+	}
+	for _, p := range rs.names {
+		if p.match(name) {
+			if p.substring != "" {
+				return "name:" + p.substring
+			}
+			return "name:" + p.raw
+		}
+	}
+	return ""
+}
+
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[i+1:]
+	}
+	return ""
+}
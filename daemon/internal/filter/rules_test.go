@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"testing"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+)
+
+func newRules(t *testing.T, rules config.FilterRules) *ruleSet {
+	t.Helper()
+	phones, err := identity.NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := compileRules(rules, phones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestMatchIdentifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules config.FilterRules
+		id    Identifier
+		want  string
+	}{
+		{"phone exact", config.FilterRules{Phones: []string{"(415) 555-0100"}}, Identifier{"phone", "+14155550100"}, "phone:(415) 555-0100"},
+		{"phone other number", config.FilterRules{Phones: []string{"(415) 555-0100"}}, Identifier{"phone", "+14155550101"}, ""},
+		{"phone short code", config.FilterRules{Phones: []string{"32665"}}, Identifier{"phone", "32665"}, "phone:32665"},
+		{"phone alphanumeric sender", config.FilterRules{Phones: []string{"AMAZON"}}, Identifier{"phone", "amazon"}, "phone:AMAZON"},
+		{"phone alphanumeric other sender", config.FilterRules{Phones: []string{"AMAZON"}}, Identifier{"phone", "GOOGLE"}, ""},
+		{"phone glob", config.FilterRules{Phones: []string{"+1800*"}}, Identifier{"phone", "+18005550100"}, "phone:+1800*"},
+		{"phone regex", config.FilterRules{Phones: []string{`re:^\+44`}}, Identifier{"phone", "+442079460958"}, `phone:re:^\+44`},
+		{"email exact", config.FilterRules{Emails: []string{"Alice@Example.com"}}, Identifier{"email", "alice@example.com"}, "email:Alice@Example.com"},
+		{"email glob", config.FilterRules{Emails: []string{"*@spam.com"}}, Identifier{"email", "deals@spam.com"}, "email:*@spam.com"},
+		{"email glob ignores case", config.FilterRules{Emails: []string{"NoReply@*"}}, Identifier{"email", "noreply@shop.com"}, "email:NoReply@*"},
+		{"email regex", config.FilterRules{Emails: []string{"re:^no-?reply@"}}, Identifier{"email", "NoReply@shop.com"}, "email:re:^no-?reply@"},
+		{"email rule on a phone", config.FilterRules{Emails: []string{"*"}}, Identifier{"phone", "+14155550100"}, ""},
+		{"domain", config.FilterRules{Domains: []string{"example.com"}}, Identifier{"email", "bob@example.com"}, "domain:example.com"},
+		{"domain with @", config.FilterRules{Domains: []string{"@Example.com"}}, Identifier{"email", "bob@example.com"}, "domain:example.com"},
+		{"subdomain", config.FilterRules{Domains: []string{"example.com"}}, Identifier{"email", "bob@mail.example.com"}, "domain:example.com"},
+		{"domain suffix only", config.FilterRules{Domains: []string{"example.com"}}, Identifier{"email", "bob@notexample.com"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newRules(t, tt.rules).matchIdentifier(tt.id); got != tt.want {
+				t.Errorf("matchIdentifier(%v) = %q, want %q", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		input string
+		want  string
+	}{
+		{"substring", "Acme", "ACME Support", "name:acme"},
+		{"substring missing", "Acme", "Alice", ""},
+		{"glob", "* Bank", "First National Bank", "name:* Bank"},
+		{"glob whole name", "* Bank", "Bank of Alice", ""},
+		{"regex", `re:^dr\.? `, "Dr. Smith", `name:re:^dr\.? `},
+		{"empty name", "Acme", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := newRules(t, config.FilterRules{Names: []string{tt.rule}})
+			if got := rs.matchName(tt.input); got != tt.want {
+				t.Errorf("matchName(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	phones, err := identity.NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		rules config.FilterRules
+	}{
+		{"invalid regex", config.FilterRules{Emails: []string{"re:("}}},
+		{"invalid glob", config.FilterRules{Phones: []string{"[1-"}}},
+		{"empty phone", config.FilterRules{Phones: []string{"  "}}},
+		{"invalid name regex", config.FilterRules{Names: []string{"re:[a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compileRules(tt.rules, phones); err == nil {
+				t.Error("compileRules succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package identity
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// PhoneKind classifies a parsed phone address
+type PhoneKind string
+
+const (
+	// KindE164 is a full international number, e.g. "+442079460958"
+	KindE164 PhoneKind = "e164"
+	// KindShortCode is a short numeric sender, e.g. "32665", only meaningful within a region
+	KindShortCode PhoneKind = "short_code"
+	// KindAlphanumeric is a named sender such as "AMAZON" that cannot be dialed
+	KindAlphanumeric PhoneKind = "alphanumeric"
+	// KindInvalid is anything that could not be parsed
+	KindInvalid PhoneKind = "invalid"
+)
+
+const (
+	// Short codes are 3-6 digits in every region we know of
+	shortCodeMinLength = 3
+	shortCodeMaxLength = 6
+
+	// E.164 numbers are at most 15 digits including the calling code
+	e164MinLength = 7
+	e164MaxLength = 15
+
+	// DefaultRegion is used when no region is configured
+	DefaultRegion = "US"
+)
+
+// Phone is the result of parsing a phone address
+type Phone struct {
+	// Value is the E.164 number, the bare short code digits or the trimmed alphanumeric sender
+	Value  string
+	Kind   PhoneKind
+	Region string // region the number belongs to, if known
+}
+
+// Normalizer parses phone numbers relative to a default region
+type Normalizer struct {
+	region *Region
+}
+
+// NewNormalizer creates a normalizer for the given ISO region code (e.g. "US", "GB")
+func NewNormalizer(defaultRegion string) (*Normalizer, error) {
+	if defaultRegion == "" {
+		defaultRegion = DefaultRegion
+	}
+	region, ok := LookupRegion(strings.ToUpper(defaultRegion))
+	if !ok {
+		return nil, fmt.Errorf("unknown phone region %q", defaultRegion)
+	}
+	return &Normalizer{region: region}, nil
+}
+
+// Region returns the default region code
+func (n *Normalizer) Region() string {
+	return n.region.Code
+}
+
+// NormalizePhone returns the E.164 form of a number, the digits of a short code,
+// or "" if the address is not a dialable number
+func (n *Normalizer) NormalizePhone(raw string) string {
+	p := n.Parse(raw)
+	switch p.Kind {
+	case KindE164, KindShortCode:
+		return p.Value
+	default:
+		return ""
+	}
+}
+
+// Parse classifies and normalizes a phone address
+func (n *Normalizer) Parse(raw string) Phone {
+	raw = stripExtension(strings.TrimSpace(raw))
+	if raw == "" || strings.Contains(raw, "@") {
+		return Phone{Value: raw, Kind: KindInvalid}
+	}
+
+	plus := false
+	var digits strings.Builder
+	for i, r := range raw {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			plus = true
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')' || r == '/' || r == '\u00a0':
+			// Formatting characters
+		case unicode.IsLetter(r):
+			return Phone{Value: raw, Kind: KindAlphanumeric}
+		default:
+			return Phone{Value: raw, Kind: KindInvalid}
+		}
+	}
+
+	d := digits.String()
+	if d == "" {
+		return Phone{Value: raw, Kind: KindInvalid}
+	}
+
+	if plus {
+		return n.parseInternational(d, true)
+	}
+
+	// International prefix of the default region, or the common "00"
+	for _, prefix := range []string{n.region.IntlPrefix, "00"} {
+		if prefix != "" && strings.HasPrefix(d, prefix) && len(d) > len(prefix)+e164MinLength-1 {
+			return n.parseInternational(d[len(prefix):], true)
+		}
+	}
+
+	// National number with trunk prefix, e.g. "020 7946 0958" in the UK
+	if tp := n.region.TrunkPrefix; tp != "" && strings.HasPrefix(d, tp) && n.region.validLength(len(d)-len(tp)) {
+		return n.e164(n.region, d[len(tp):])
+	}
+
+	// National number without trunk prefix, e.g. "555 123 4567" in the US
+	if n.region.validLength(len(d)) {
+		return n.e164(n.region, d)
+	}
+
+	// International number written without "+", e.g. "442079460958". Only
+	// a known calling code makes it one.
+	if len(d) > n.region.MaxLength && len(d) <= e164MaxLength {
+		return n.parseInternational(d, false)
+	}
+
+	if len(d) >= shortCodeMinLength && len(d) <= shortCodeMaxLength {
+		return Phone{Value: d, Kind: KindShortCode, Region: n.region.Code}
+	}
+
+	return Phone{Value: raw, Kind: KindInvalid}
+}
+
+// parseInternational normalizes digits that start with a calling code.
+// explicit is set when the number was written in international format, with
+// "+" or an international prefix, so an unknown calling code is trusted.
+func (n *Normalizer) parseInternational(d string, explicit bool) Phone {
+	// Calling codes never start with 0
+	if len(d) < e164MinLength || len(d) > e164MaxLength || d[0] == '0' {
+		return Phone{Value: d, Kind: KindInvalid}
+	}
+
+	region, national := regionForNumber(d)
+	if region == nil {
+		if !explicit {
+			return Phone{Value: d, Kind: KindInvalid}
+		}
+		// Unknown calling code; trust the explicit international format
+		return Phone{Value: "+" + d, Kind: KindE164}
+	}
+
+	// Drop a trunk prefix written inside an international number, e.g. "+44 (0)20 7946 0958"
+	if tp := region.TrunkPrefix; tp != "" && !region.validLength(len(national)) &&
+		strings.HasPrefix(national, tp) && region.validLength(len(national)-len(tp)) {
+		national = national[len(tp):]
+	}
+
+	return n.e164(region, national)
+}
+
+func (n *Normalizer) e164(region *Region, national string) Phone {
+	return Phone{
+		Value:  "+" + region.CountryCode + national,
+		Kind:   KindE164,
+		Region: region.Code,
+	}
+}
+
+// stripExtension removes extensions such as "x123", "ext. 123" or ";ext=123"
+func stripExtension(s string) string {
+	lower := strings.ToLower(s)
+	for _, marker := range []string{";ext=", " ext.", " ext", " x", "#"} {
+		if i := strings.LastIndex(lower, marker); i > 0 {
+			rest := strings.TrimSpace(strings.TrimLeft(lower[i+len(marker):], ". "))
+			if rest != "" && strings.Trim(rest, "0123456789") == "" {
+				return strings.TrimSpace(s[:i])
+			}
+		}
+	}
+	return s
+}
+
+// NormalizeEmail lowercases and trims an email address
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,160 @@
+package identity
+
+import "testing"
+
+func TestNormalizerParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		region string
+		input  string
+		want   string
+		kind   PhoneKind
+	}{
+		// United States
+		{"us national", "US", "(555) 123-4567", "+15551234567", KindE164},
+		{"us with trunk", "US", "1-555-123-4567", "+15551234567", KindE164},
+		{"us e164", "US", "+1 555 123 4567", "+15551234567", KindE164},
+		{"us idd to uk", "US", "011 44 20 7946 0958", "+442079460958", KindE164},
+		{"us short code", "US", "32665", "32665", KindShortCode},
+		{"us extension", "US", "555-123-4567 x89", "+15551234567", KindE164},
+		{"us uk without plus", "US", "442079460958", "+442079460958", KindE164},
+
+		// United Kingdom
+		{"gb national landline", "GB", "020 7946 0958", "+442079460958", KindE164},
+		{"gb national mobile", "GB", "07700 900123", "+447700900123", KindE164},
+		{"gb e164", "GB", "+44 20 7946 0958", "+442079460958", KindE164},
+		{"gb e164 with trunk", "GB", "+44 (0)20 7946 0958", "+442079460958", KindE164},
+		{"gb idd to us", "GB", "00 1 555 123 4567", "+15551234567", KindE164},
+		{"gb us without plus", "GB", "15551234567", "+15551234567", KindE164},
+		{"gb short code", "GB", "61998", "61998", KindShortCode},
+
+		// Germany
+		{"de national", "DE", "030 1234567", "+49301234567", KindE164},
+		{"de mobile", "DE", "0151 23456789", "+4915123456789", KindE164},
+
+		// France
+		{"fr national", "FR", "06 12 34 56 78", "+33612345678", KindE164},
+		{"fr dotted", "FR", "01.23.45.67.89", "+33123456789", KindE164},
+
+		// Italy keeps the leading zero
+		{"it landline", "IT", "06 1234 5678", "+390612345678", KindE164},
+		{"it e164", "IT", "+39 06 1234 5678", "+390612345678", KindE164},
+
+		// Australia uses 0011 for international calls
+		{"au national", "AU", "0412 345 678", "+61412345678", KindE164},
+		{"au idd", "AU", "0011 1 555 123 4567", "+15551234567", KindE164},
+
+		// Japan
+		{"jp national", "JP", "03-1234-5678", "+81312345678", KindE164},
+
+		// Russia uses 8 as trunk prefix
+		{"ru national", "RU", "8 916 123-45-67", "+79161234567", KindE164},
+
+		// India
+		{"in national", "IN", "098765 43210", "+919876543210", KindE164},
+
+		// Unknown calling code is trusted when written with "+"
+		{"unknown calling code", "US", "+998 90 123 45 67", "+998901234567", KindE164},
+
+		// Calling codes never start with 0, and digits without "+" need a
+		// known one
+		{"us foreign national landline", "US", "020 7946 0958", "02079460958", KindInvalid},
+		{"us foreign national mobile", "US", "07700900123", "07700900123", KindInvalid},
+		{"us zeros", "US", "00000000000", "000000000", KindInvalid},
+		{"zero calling code", "US", "+0123456789", "0123456789", KindInvalid},
+		{"unknown calling code without plus", "US", "99890123456789", "99890123456789", KindInvalid},
+
+		// Non-numbers
+		{"alphanumeric sender", "US", "AMAZON", "AMAZON", KindAlphanumeric},
+		{"alphanumeric with spaces", "GB", " Royal Mail ", "Royal Mail", KindAlphanumeric},
+		{"email", "US", "alice@example.com", "alice@example.com", KindInvalid},
+		{"empty", "US", "", "", KindInvalid},
+		{"too short", "US", "12", "12", KindInvalid},
+		{"too long", "US", "+1234567890123456", "1234567890123456", KindInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := NewNormalizer(tt.region)
+			if err != nil {
+				t.Fatalf("NewNormalizer(%q): %v", tt.region, err)
+			}
+			got := n.Parse(tt.input)
+			if got.Value != tt.want || got.Kind != tt.kind {
+				t.Errorf("Parse(%q) in %s = {%q, %s}, want {%q, %s}",
+					tt.input, tt.region, got.Value, got.Kind, tt.want, tt.kind)
+			}
+		})
+	}
+}
+
+func TestNormalizePhoneMatchesAcrossSources(t *testing.T) {
+	// The same UK number as written by Contacts and by iMessage
+	n, err := NewNormalizer("GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts := n.NormalizePhone("020 7946 0958")
+	imessage := n.NormalizePhone("+442079460958")
+	if contacts != imessage {
+		t.Errorf("contacts %q != imessage %q", contacts, imessage)
+	}
+}
+
+func TestNormalizePhoneDropsNonNumbers(t *testing.T) {
+	n, err := NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{"AMAZON", "alice@example.com", "", "+"} {
+		if got := n.NormalizePhone(input); got != "" {
+			t.Errorf("NormalizePhone(%q) = %q, want empty", input, got)
+		}
+	}
+}
+
+func TestNewNormalizer(t *testing.T) {
+	tests := []struct {
+		region  string
+		want    string
+		wantErr bool
+	}{
+		{"", DefaultRegion, false},
+		{"gb", "GB", false},
+		{"DE", "DE", false},
+		{"XX", "", true},
+	}
+
+	for _, tt := range tests {
+		n, err := NewNormalizer(tt.region)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewNormalizer(%q) expected error", tt.region)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewNormalizer(%q): %v", tt.region, err)
+			continue
+		}
+		if n.Region() != tt.want {
+			t.Errorf("NewNormalizer(%q).Region() = %q, want %q", tt.region, n.Region(), tt.want)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Alice@Example.COM", "alice@example.com"},
+		{"  bob@example.com ", "bob@example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeEmail(tt.input); got != tt.want {
+			t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
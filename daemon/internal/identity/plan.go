@@ -0,0 +1,111 @@
+package identity
+
+// Region describes the numbering plan of a single country
+type Region struct {
+	Code        string // ISO 3166-1 alpha-2 region code
+	CountryCode string // international calling code, without "+"
+	TrunkPrefix string // prefix dialed before national numbers, e.g. "0" in the UK
+	IntlPrefix  string // prefix dialed before international numbers, e.g. "011" in the US
+	MinLength   int    // minimum length of the national significant number
+	MaxLength   int    // maximum length of the national significant number
+}
+
+// validLength reports whether n is a plausible national significant number length
+func (r *Region) validLength(n int) bool {
+	return n >= r.MinLength && n <= r.MaxLength
+}
+
+// regions is the numbering-plan table. National significant number lengths
+// exclude the trunk prefix. Regions sharing a calling code are listed with the
+// main region first, which is the one used when parsing international numbers.
+var regions = []Region{
+	// North American Numbering Plan
+	{Code: "US", CountryCode: "1", TrunkPrefix: "1", IntlPrefix: "011", MinLength: 10, MaxLength: 10},
+	{Code: "CA", CountryCode: "1", TrunkPrefix: "1", IntlPrefix: "011", MinLength: 10, MaxLength: 10},
+
+	// Europe
+	{Code: "GB", CountryCode: "44", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 10},
+	{Code: "IE", CountryCode: "353", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 7, MaxLength: 9},
+	{Code: "FR", CountryCode: "33", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "DE", CountryCode: "49", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 6, MaxLength: 13},
+	{Code: "NL", CountryCode: "31", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "BE", CountryCode: "32", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 9},
+	{Code: "CH", CountryCode: "41", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "AT", CountryCode: "43", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 7, MaxLength: 13},
+	{Code: "IT", CountryCode: "39", IntlPrefix: "00", MinLength: 6, MaxLength: 11}, // leading 0 is part of the number
+	{Code: "ES", CountryCode: "34", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "PT", CountryCode: "351", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "SE", CountryCode: "46", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 7, MaxLength: 9},
+	{Code: "NO", CountryCode: "47", IntlPrefix: "00", MinLength: 8, MaxLength: 8},
+	{Code: "DK", CountryCode: "45", IntlPrefix: "00", MinLength: 8, MaxLength: 8},
+	{Code: "FI", CountryCode: "358", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 6, MaxLength: 11},
+	{Code: "PL", CountryCode: "48", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "CZ", CountryCode: "420", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "GR", CountryCode: "30", IntlPrefix: "00", MinLength: 10, MaxLength: 10},
+	{Code: "RU", CountryCode: "7", TrunkPrefix: "8", IntlPrefix: "810", MinLength: 10, MaxLength: 10},
+	{Code: "UA", CountryCode: "380", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "TR", CountryCode: "90", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 10, MaxLength: 10},
+
+	// Middle East & Africa
+	{Code: "IL", CountryCode: "972", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 9},
+	{Code: "AE", CountryCode: "971", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 9},
+	{Code: "SA", CountryCode: "966", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 9},
+	{Code: "EG", CountryCode: "20", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 10},
+	{Code: "ZA", CountryCode: "27", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "NG", CountryCode: "234", TrunkPrefix: "0", IntlPrefix: "009", MinLength: 8, MaxLength: 10},
+	{Code: "KE", CountryCode: "254", TrunkPrefix: "0", IntlPrefix: "000", MinLength: 9, MaxLength: 9},
+
+	// Asia-Pacific
+	{Code: "AU", CountryCode: "61", TrunkPrefix: "0", IntlPrefix: "0011", MinLength: 9, MaxLength: 9},
+	{Code: "NZ", CountryCode: "64", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 10},
+	{Code: "JP", CountryCode: "81", TrunkPrefix: "0", IntlPrefix: "010", MinLength: 9, MaxLength: 10},
+	{Code: "KR", CountryCode: "82", TrunkPrefix: "0", IntlPrefix: "001", MinLength: 8, MaxLength: 10},
+	{Code: "CN", CountryCode: "86", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 9, MaxLength: 11},
+	{Code: "HK", CountryCode: "852", IntlPrefix: "001", MinLength: 8, MaxLength: 8},
+	{Code: "TW", CountryCode: "886", TrunkPrefix: "0", IntlPrefix: "002", MinLength: 8, MaxLength: 9},
+	{Code: "SG", CountryCode: "65", IntlPrefix: "001", MinLength: 8, MaxLength: 8},
+	{Code: "IN", CountryCode: "91", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 10, MaxLength: 10},
+	{Code: "PH", CountryCode: "63", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 10},
+	{Code: "TH", CountryCode: "66", TrunkPrefix: "0", IntlPrefix: "001", MinLength: 8, MaxLength: 9},
+	{Code: "ID", CountryCode: "62", TrunkPrefix: "0", IntlPrefix: "001", MinLength: 8, MaxLength: 12},
+	{Code: "MY", CountryCode: "60", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 8, MaxLength: 10},
+
+	// Latin America
+	{Code: "MX", CountryCode: "52", IntlPrefix: "00", MinLength: 10, MaxLength: 10},
+	{Code: "BR", CountryCode: "55", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 10, MaxLength: 11},
+	{Code: "AR", CountryCode: "54", TrunkPrefix: "0", IntlPrefix: "00", MinLength: 10, MaxLength: 11},
+	{Code: "CL", CountryCode: "56", IntlPrefix: "00", MinLength: 9, MaxLength: 9},
+	{Code: "CO", CountryCode: "57", IntlPrefix: "00", MinLength: 10, MaxLength: 10},
+}
+
+var (
+	regionsByCode        = make(map[string]*Region)
+	regionsByCountryCode = make(map[string]*Region)
+)
+
+func init() {
+	for i := range regions {
+		r := &regions[i]
+		regionsByCode[r.Code] = r
+		if _, ok := regionsByCountryCode[r.CountryCode]; !ok {
+			regionsByCountryCode[r.CountryCode] = r
+		}
+	}
+}
+
+// LookupRegion returns the numbering plan for an ISO region code
+func LookupRegion(code string) (*Region, bool) {
+	r, ok := regionsByCode[code]
+	return r, ok
+}
+
+// regionForNumber finds the region whose calling code prefixes an international number.
+// Calling codes are prefix-free, so at most one of the 1-3 digit prefixes can match.
+func regionForNumber(digits string) (*Region, string) {
+	for n := 1; n <= 3 && n < len(digits); n++ {
+		if r, ok := regionsByCountryCode[digits[:n]]; ok {
+			return r, digits[n:]
+		}
+	}
+	return nil, digits
+}
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+const namespace = "pkb"
+
+// Registry holds every daemon metric plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	sourceItems = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_items_total",
+		Help:      "Items handled per source, by outcome (fetched, sent, filtered, failed).",
+	}, []string{"source", "outcome"})
+
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of sync cycles per source.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"source", "result"})
+
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful sync cycle per source.",
+	}, []string{"source"})
+
+	consecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_consecutive_failures",
+		Help:      "Number of sync cycles that failed in a row per source.",
+	}, []string{"source"})
+
+	newestItem = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_newest_item_timestamp_seconds",
+		Help:      "Unix time of the newest item in the source.",
+	}, []string{"source"})
+
+	syncedItem = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_synced_item_timestamp_seconds",
+		Help:      "Unix time of the newest item delivered to the backend.",
+	}, []string{"source"})
+
+	checkpointLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_checkpoint_lag_seconds",
+		Help:      "Newest item in the source minus the newest item synced; 0 when caught up.",
+	}, []string{"source"})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of backend API requests by endpoint and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Requests in the offline queue by state (pending, expired, dead).",
+	}, []string{"state"})
+
+	queueOldestAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_oldest_age_seconds",
+		Help:      "Age of the oldest pending request in the offline queue.",
+	})
+
+	queueEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_enqueued_total",
+		Help:      "Requests added to the offline queue by type.",
+	}, []string{"type"})
+
+	queueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_retries_total",
+		Help:      "Retries of queued requests by type and result (success, failure).",
+	}, []string{"type", "result"})
+
+	queueDeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_dead_letters_total",
+		Help:      "Requests moved to the dead letters by type and reason (expired, permanent).",
+	}, []string{"type", "reason"})
+
+	queueSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_size_bytes",
+		Help:      "Stored size of the payloads in the offline queue.",
+	})
+
+	queuePressure = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_budget_pressure",
+		Help:      "Fraction of the offline queue budget in use; 0 without a budget.",
+	})
+
+	queueEvicted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_evicted_total",
+		Help:      "Requests dropped from the offline queue to stay within its budget, by type.",
+	}, []string{"type"})
+
+	queueRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_rejected_total",
+		Help:      "Requests refused by the offline queue because it was full, by type.",
+	}, []string{"type"})
+
+	tokenExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "oauth_token_expiry_timestamp_seconds",
+		Help:      "Unix time at which the current OAuth access token expires.",
+	}, []string{"source", "account"})
+
+	tokenRefreshable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "oauth_token_refreshable",
+		Help:      "1 if the OAuth token has a refresh token, 0 if it stops working at expiry.",
+	}, []string{"source", "account"})
+
+	tokenRefreshErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oauth_token_refresh_errors_total",
+		Help:      "Failed OAuth token refreshes.",
+	}, []string{"source", "account"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		sourceItems,
+		syncDuration,
+		lastSuccess,
+		consecutiveFailures,
+		newestItem,
+		syncedItem,
+		checkpointLag,
+		backendDuration,
+		queueDepth,
+		queueOldestAge,
+		queueEnqueued,
+		queueRetries,
+		queueDeadLetters,
+		queueSize,
+		queuePressure,
+		queueEvicted,
+		queueRejected,
+		tokenExpiry,
+		tokenRefreshable,
+		tokenRefreshErrors,
+	)
+}
+
+// AddItems counts items of a source with the given outcome
+func AddItems(source, outcome string, n int) {
+	if n > 0 {
+		sourceItems.WithLabelValues(source, outcome).Add(float64(n))
+	}
+}
+
+// ObserveSync records a finished sync cycle
+func ObserveSync(source string, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	syncDuration.WithLabelValues(source, result).Observe(d.Seconds())
+}
+
+// SetSourceHealth records the outcome of the latest cycle of a source
+func SetSourceHealth(source string, success time.Time, failures int) {
+	if !success.IsZero() {
+		lastSuccess.WithLabelValues(source).Set(float64(success.Unix()))
+	}
+	consecutiveFailures.WithLabelValues(source).Set(float64(failures))
+}
+
+// SetSynced records the timestamp of the newest item delivered for a source
+func SetSynced(source string, t time.Time) {
+	syncedItem.WithLabelValues(source).Set(float64(t.Unix()))
+}
+
+// SetLag records how far the sync of a source is behind its newest item
+func SetLag(source string, newest time.Time, lag time.Duration) {
+	newestItem.WithLabelValues(source).Set(float64(newest.Unix()))
+	if lag < 0 {
+		lag = 0
+	}
+	checkpointLag.WithLabelValues(source).Set(lag.Seconds())
+}
+
+// ObserveBackendRequest records a backend API request. code is 0 if no response was received.
+func ObserveBackendRequest(endpoint string, code int, d time.Duration) {
+	label := "error"
+	if code > 0 {
+		label = strconv.Itoa(code)
+	}
+	backendDuration.WithLabelValues(endpoint, label).Observe(d.Seconds())
+}
+
+// SetQueueDepth records the size of the offline queue
+func SetQueueDepth(pending, expired, dead int64, oldest *time.Time) {
+	queueDepth.WithLabelValues("pending").Set(float64(pending))
+	queueDepth.WithLabelValues("expired").Set(float64(expired))
+	queueDepth.WithLabelValues("dead").Set(float64(dead))
+	if oldest != nil {
+		queueOldestAge.Set(time.Since(*oldest).Seconds())
+	} else {
+		queueOldestAge.Set(0)
+	}
+}
+
+// AddEnqueued counts a request added to the offline queue
+func AddEnqueued(reqType string) {
+	queueEnqueued.WithLabelValues(reqType).Inc()
+}
+
+// AddRetry counts a retry of a queued request
+func AddRetry(reqType string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	queueRetries.WithLabelValues(reqType, result).Inc()
+}
+
+// AddDeadLetter counts a request moved to the dead letters
+func AddDeadLetter(reqType, reason string) {
+	queueDeadLetters.WithLabelValues(reqType, reason).Inc()
+}
+
+// SetQueueUsage records how much of its budget the offline queue uses
+func SetQueueUsage(sizeBytes int64, pressure float64) {
+	queueSize.Set(float64(sizeBytes))
+	queuePressure.Set(pressure)
+}
+
+// AddQueueEvicted counts a request dropped to keep the queue within its budget
+func AddQueueEvicted(reqType string) {
+	queueEvicted.WithLabelValues(reqType).Inc()
+}
+
+// AddQueueRejected counts a request the full queue refused
+func AddQueueRejected(reqType string) {
+	queueRejected.WithLabelValues(reqType).Inc()
+}
+
+// Serve exposes /metrics on addr until ctx is cancelled
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("address", addr).Msg("Metrics endpoint listening")
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// value returns the value of the gauge or counter series of the named metric
+// whose labels include labels, given as name/value pairs
+func value(t *testing.T, name string, labels ...string) (float64, bool) {
+	t.Helper()
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != namespace+"_"+name {
+			continue
+		}
+	series:
+		for _, m := range mf.GetMetric() {
+			have := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				have[l.GetName()] = l.GetValue()
+			}
+			for i := 0; i < len(labels); i += 2 {
+				if have[labels[i]] != labels[i+1] {
+					continue series
+				}
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue(), true
+			}
+			return m.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestSetLag(t *testing.T) {
+	newest := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		lag  time.Duration
+		want float64
+	}{
+		{"behind", 90 * time.Second, 90},
+		// A synced item newer than the source's newest one, e.g. after clock skew
+		{"ahead", -time.Minute, 0},
+	}
+	for _, tt := range tests {
+		SetLag(tt.name, newest, tt.lag)
+		if got, _ := value(t, "source_checkpoint_lag_seconds", "source", tt.name); got != tt.want {
+			t.Errorf("%s: lag = %g, want %g", tt.name, got, tt.want)
+		}
+		if got, _ := value(t, "source_newest_item_timestamp_seconds", "source", tt.name); got != float64(newest.Unix()) {
+			t.Errorf("%s: newest = %g, want %d", tt.name, got, newest.Unix())
+		}
+	}
+}
+
+func TestAddItemsIgnoresZero(t *testing.T) {
+	AddItems("notes", "sent", 0)
+	AddItems("notes", "fetched", 3)
+	if _, ok := value(t, "source_items_total", "source", "notes", "outcome", "sent"); ok {
+		t.Error("recorded a series for zero items")
+	}
+	if got, _ := value(t, "source_items_total", "source", "notes", "outcome", "fetched"); got != 3 {
+		t.Errorf("fetched = %g, want 3", got)
+	}
+}
+
+// staticTokens returns token, or err
+type staticTokens struct {
+	token *oauth2.Token
+	err   error
+}
+
+func (s staticTokens) Token() (*oauth2.Token, error) { return s.token, s.err }
+
+func TestTokenSource(t *testing.T) {
+	expiry := time.Unix(1700003600, 0)
+	ts := TokenSource("gmail", "me@example.com", staticTokens{token: &oauth2.Token{AccessToken: "secret", Expiry: expiry}})
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := value(t, "oauth_token_expiry_timestamp_seconds", "account", "me@example.com"); got != float64(expiry.Unix()) {
+		t.Errorf("expiry = %g, want %d", got, expiry.Unix())
+	}
+	if got, ok := value(t, "oauth_token_refreshable", "account", "me@example.com"); !ok || got != 0 {
+		t.Errorf("refreshable = %g, want 0 without a refresh token", got)
+	}
+
+	failing := TokenSource("gmail", "other@example.com", staticTokens{err: errors.New("invalid_grant")})
+	if _, err := failing.Token(); err == nil {
+		t.Fatal("want the refresh error")
+	}
+	if got, _ := value(t, "oauth_token_refresh_errors_total", "account", "other@example.com"); got != 1 {
+		t.Errorf("refresh errors = %g, want 1", got)
+	}
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"golang.org/x/oauth2"
+)
+
+// tokenSource records the expiry of every token handed out by an OAuth token source
+type tokenSource struct {
+	source  string
+	account string
+	base    oauth2.TokenSource
+}
+
+// TokenSource wraps ts so that the expiry of its tokens is exported as a metric.
+// The token itself is never recorded.
+func TokenSource(source, account string, ts oauth2.TokenSource) oauth2.TokenSource {
+	return &tokenSource{source: source, account: account, base: ts}
+}
+
+func (t *tokenSource) Token() (*oauth2.Token, error) {
+	token, err := t.base.Token()
+	if err != nil {
+		tokenRefreshErrors.WithLabelValues(t.source, t.account).Inc()
+		return nil, err
+	}
+	ObserveToken(t.source, t.account, token)
+	return token, nil
+}
+
+// ObserveToken records the expiry of a token, e.g. one just read from disk
+func ObserveToken(source, account string, token *oauth2.Token) {
+	if !token.Expiry.IsZero() {
+		tokenExpiry.WithLabelValues(source, account).Set(float64(token.Expiry.Unix()))
+	}
+	refreshable := 0.0
+	if token.RefreshToken != "" {
+		refreshable = 1
+	}
+	tokenRefreshable.WithLabelValues(source, account).Set(refreshable)
+}
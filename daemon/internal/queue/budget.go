@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/metrics"
+)
+
+// Eviction policies for when the queue exceeds its budget
+const (
+	EvictOldest   = "oldest"   // drop the oldest requests
+	EvictPriority = "priority" // drop requests of the least important type first, oldest first
+	EvictReject   = "reject"   // refuse new requests until the queue drains
+)
+
+// ErrQueueFull is returned by Enqueue when a request doesn't fit in the budget
+var ErrQueueFull = errors.New("offline queue is full")
+
+// ErrTooLarge is returned by Enqueue for a request larger than the whole
+// budget, which no eviction could make room for
+var ErrTooLarge = fmt.Errorf("%w: request is larger than the whole queue budget", ErrQueueFull)
+
+// DefaultPriority orders request types from most to least important
+var DefaultPriority = []RequestType{
+	RequestTypeImportContacts,
+	RequestTypeImportCalendar,
+	RequestTypeImportNotes,
+	RequestTypeBatchUpsert,
+}
+
+func validEviction(e string) bool {
+	switch e {
+	case "", EvictOldest, EvictPriority, EvictReject:
+		return true
+	}
+	return false
+}
+
+// usage returns the number of queued requests and the size of their stored payloads
+func usage(db interface {
+	QueryRow(query string, args ...any) *sql.Row
+}) (count, size int64, err error) {
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(LENGTH(payload)), 0) FROM queued_requests
+	`).Scan(&count, &size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read queue size: %w", err)
+	}
+	return count, size, nil
+}
+
+// exceeds reports whether count requests of size bytes are over the budget
+func (q *Queue) exceeds(count, size int64) bool {
+	return (q.config.MaxCount > 0 && count > q.config.MaxCount) ||
+		(q.config.MaxBytes > 0 && size > q.config.MaxBytes)
+}
+
+// pressure returns how much of the budget is used, from 0 to 1 (or more)
+func (q *Queue) pressure(count, size int64) float64 {
+	var p float64
+	if q.config.MaxCount > 0 {
+		p = max(p, float64(count)/float64(q.config.MaxCount))
+	}
+	if q.config.MaxBytes > 0 {
+		p = max(p, float64(size)/float64(q.config.MaxBytes))
+	}
+	return p
+}
+
+// Full reports whether the queue has reached its budget
+func (q *Queue) Full() (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	count, size, err := usage(q.db)
+	if err != nil {
+		return false, err
+	}
+	return q.pressure(count, size) >= 1, nil
+}
+
+// admit checks whether a new payload of the given size fits the budget, for
+// the reject policy
+func (q *Queue) admit(tx *sql.Tx, reqType RequestType, size int64) error {
+	count, used, err := usage(tx)
+	if err != nil {
+		return err
+	}
+	if q.exceeds(count+1, used+size) {
+		metrics.AddQueueRejected(string(reqType))
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// evict drops requests until the queue fits its budget again. Their sources
+// have moved past them, so they are kept as dead letters rather than lost.
+// newID is the request just added; if the policy would drop it, ErrQueueFull
+// is returned and the caller rolls back.
+func (q *Queue) evict(tx *sql.Tx, newID int64) error {
+	count, size, err := usage(tx)
+	if err != nil {
+		return err
+	}
+	if !q.exceeds(count, size) {
+		return nil
+	}
+
+	type candidate struct {
+		id      int64
+		reqType RequestType
+		size    int64
+		rank    int
+	}
+
+	rows, err := tx.Query(`SELECT id, type, LENGTH(payload) FROM queued_requests ORDER BY id ASC`)
+	if err != nil {
+		return fmt.Errorf("failed to query queued requests: %w", err)
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.reqType, &c.size); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if q.config.Eviction != EvictPriority && c.id == newID {
+			// Oldest first never drops the request being added
+			continue
+		}
+		c.rank = q.rank(c.reqType)
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if q.config.Eviction == EvictPriority {
+		// Least important type first; oldest first within a type
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].rank > candidates[j].rank
+		})
+	}
+
+	evicted := 0
+	for _, c := range candidates {
+		if !q.exceeds(count, size) {
+			break
+		}
+		if c.id == newID {
+			metrics.AddQueueRejected(string(c.reqType))
+			return ErrQueueFull
+		}
+		if err := moveToDeadLetters(tx, c.id, DeadReasonEvicted); err != nil {
+			return fmt.Errorf("failed to evict request: %w", err)
+		}
+		metrics.AddQueueEvicted(string(c.reqType))
+		count--
+		size -= c.size
+		evicted++
+	}
+
+	if evicted > 0 {
+		log.Warn().
+			Int("count", evicted).
+			Str("policy", q.config.Eviction).
+			Msg("Offline queue over budget, evicted requests to the dead letters")
+	}
+	return nil
+}
+
+// rank returns the position of a request type in the priority list; unknown
+// types rank after all listed ones
+func (q *Queue) rank(reqType RequestType) int {
+	for i, t := range q.config.Priority {
+		if t == reqType {
+			return i
+		}
+	}
+	return len(q.config.Priority)
+}
@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type queued struct {
+	reqType RequestType
+	name    string
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name     string
+		eviction string
+		maxCount int64
+		enqueue  []queued
+		want     []string
+		wantFull bool // the last Enqueue fails with ErrQueueFull
+	}{
+		{
+			name:     "oldest drops the oldest",
+			eviction: EvictOldest,
+			maxCount: 3,
+			enqueue: []queued{
+				{RequestTypeImportNotes, "n1"},
+				{RequestTypeBatchUpsert, "c1"},
+				{RequestTypeImportContacts, "k1"},
+				{RequestTypeImportNotes, "n2"},
+			},
+			want: []string{"c1", "k1", "n2"},
+		},
+		{
+			name:     "oldest keeps the new request",
+			eviction: EvictOldest,
+			maxCount: 1,
+			enqueue: []queued{
+				{RequestTypeImportContacts, "k1"},
+				{RequestTypeBatchUpsert, "c1"},
+			},
+			want: []string{"c1"},
+		},
+		{
+			name:     "priority drops the least important type",
+			eviction: EvictPriority,
+			maxCount: 3,
+			enqueue: []queued{
+				{RequestTypeImportNotes, "n1"},
+				{RequestTypeBatchUpsert, "c1"},
+				{RequestTypeImportContacts, "k1"},
+				{RequestTypeImportNotes, "n2"},
+			},
+			want: []string{"n1", "k1", "n2"},
+		},
+		{
+			name:     "priority drops the oldest of a type",
+			eviction: EvictPriority,
+			maxCount: 3,
+			enqueue: []queued{
+				{RequestTypeImportNotes, "n1"},
+				{RequestTypeImportContacts, "k1"},
+				{RequestTypeImportNotes, "n2"},
+				{RequestTypeImportCalendar, "e1"},
+			},
+			want: []string{"k1", "n2", "e1"},
+		},
+		{
+			name:     "priority refuses a less important request",
+			eviction: EvictPriority,
+			maxCount: 2,
+			enqueue: []queued{
+				{RequestTypeImportContacts, "k1"},
+				{RequestTypeImportNotes, "n1"},
+				{RequestTypeBatchUpsert, "c1"},
+			},
+			want:     []string{"k1", "n1"},
+			wantFull: true,
+		},
+		{
+			name:     "reject admits up to the budget",
+			eviction: EvictReject,
+			maxCount: 2,
+			enqueue: []queued{
+				{RequestTypeBatchUpsert, "c1"},
+				{RequestTypeBatchUpsert, "c2"},
+			},
+			want: []string{"c1", "c2"},
+		},
+		{
+			name:     "reject refuses over the budget",
+			eviction: EvictReject,
+			maxCount: 2,
+			enqueue: []queued{
+				{RequestTypeBatchUpsert, "c1"},
+				{RequestTypeBatchUpsert, "c2"},
+				{RequestTypeImportContacts, "k1"},
+			},
+			want:     []string{"c1", "c2"},
+			wantFull: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, Config{Eviction: tt.eviction, MaxCount: tt.maxCount})
+
+			for i, r := range tt.enqueue {
+				err := q.Enqueue("test", r.reqType, r.name, "", 0)
+				last := i == len(tt.enqueue)-1
+				if last && tt.wantFull {
+					if !errors.Is(err, ErrQueueFull) {
+						t.Fatalf("enqueue %s: err = %v, want ErrQueueFull", r.name, err)
+					}
+				} else if err != nil {
+					t.Fatalf("enqueue %s: %v", r.name, err)
+				}
+			}
+
+			if got := names(t, q); !slices.Equal(got, tt.want) {
+				t.Errorf("queued = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictionByteBudget(t *testing.T) {
+	// Each payload is 6 bytes of JSON, so two fit in 12 bytes
+	q := newTestQueue(t, Config{Eviction: EvictOldest, MaxBytes: 12})
+	for _, name := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := names(t, q), []string{"bbbb", "cccc"}; !slices.Equal(got, want) {
+		t.Errorf("queued = %v, want %v", got, want)
+	}
+}
+
+func TestEvictionKeepsDeadLetters(t *testing.T) {
+	q := newTestQueue(t, Config{Eviction: EvictOldest, MaxBytes: 12})
+	for _, name := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A request larger than the whole budget would evict everything else
+	// and still not fit
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, strings.Repeat("x", 20), "", 0); !errors.Is(err, ErrTooLarge) || !errors.Is(err, ErrQueueFull) {
+		t.Errorf("err = %v, want ErrTooLarge", err)
+	}
+	if got, want := names(t, q), []string{"bbbb", "cccc"}; !slices.Equal(got, want) {
+		t.Errorf("queued = %v, want %v", got, want)
+	}
+
+	// The source has moved past an evicted request, so it is kept
+	dead, err := q.ListDeadLetters(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || string(dead[0].Payload) != `"aaaa"` || dead[0].Reason != DeadReasonEvicted {
+		t.Errorf("dead letters = %+v, want aaaa evicted", dead)
+	}
+}
+
+func TestFull(t *testing.T) {
+	q := newTestQueue(t, Config{Eviction: EvictReject, MaxCount: 2})
+
+	for i, name := range []string{"c1", "c2"} {
+		full, err := q.Full()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full {
+			t.Fatalf("full with %d of 2 requests", i)
+		}
+		if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	full, err := q.Full()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full {
+		t.Error("not full with 2 of 2 requests")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	payload := strings.Repeat("hello world ", 100)
+	path := filepath.Join(t.TempDir(), "queue.db")
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			q, err := New(Config{Path: path, MaxRetries: 10, Compression: compression})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.Close()
+			if err := q.Enqueue("test", RequestTypeBatchUpsert, payload, "", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			var stored []byte
+			if err := q.db.QueryRow(`SELECT payload FROM queued_requests ORDER BY id DESC LIMIT 1`).Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if compressed := len(stored) < len(payload); compressed != (compression != CompressionNone) {
+				t.Errorf("stored %d bytes of %d", len(stored), len(payload))
+			}
+
+			// Rows written with an earlier setting stay readable
+			reqs, err := q.List(10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range reqs {
+				var got string
+				if err := json.Unmarshal(r.Payload, &got); err != nil || got != payload {
+					t.Errorf("request %d: payload not read back: %v", r.ID, err)
+				}
+			}
+		})
+	}
+}
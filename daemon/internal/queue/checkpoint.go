@@ -0,0 +1,17 @@
+package queue
+
+import (
+	"database/sql"
+
+	"pkb-daemon/internal/state"
+)
+
+// EnqueueWithCheckpoint adds a request of a source to the outbox, due right
+// away, and advances the source's checkpoint in the same transaction. Either
+// both are stored or neither, so a crash can't lose the batch. The state
+// store must use the queue database to see the checkpoint.
+func (q *Queue) EnqueueWithCheckpoint(source string, reqType RequestType, payload interface{}, checkpoint string) error {
+	return q.enqueue(source, reqType, payload, "", 0, func(tx *sql.Tx) error {
+		return state.SetCheckpointTx(tx, source, checkpoint, state.ReasonOutbox)
+	})
+}
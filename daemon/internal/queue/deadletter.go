@@ -0,0 +1,450 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/metrics"
+)
+
+// Reasons a request ends up in the dead letters
+const (
+	DeadReasonExpired   = "expired"   // used up its retries
+	DeadReasonPermanent = "permanent" // rejected by the backend, e.g. with a 4xx
+	DeadReasonEvicted   = "evicted"   // dropped to keep the queue within its budget
+)
+
+// DeadLetter is a request that is no longer retried automatically. It keeps
+// the payload and every error so it can be fixed and replayed.
+type DeadLetter struct {
+	ID        int64         `json:"id"`
+	Type      RequestType   `json:"type"`
+	Source    string        `json:"source,omitempty"`
+	Seq       int64         `json:"seq"`
+	Payload   []byte        `json:"payload"`
+	Reason    string        `json:"reason"`
+	Retries   int           `json:"retries"`
+	Errors    []ErrorRecord `json:"errors"`
+	CreatedAt time.Time     `json:"created_at"`
+	DeadAt    time.Time     `json:"dead_at"`
+}
+
+// LastError returns the most recent error of the dead letter
+func (d *DeadLetter) LastError() string {
+	if len(d.Errors) == 0 {
+		return ""
+	}
+	return d.Errors[len(d.Errors)-1].Error
+}
+
+// AddDeadLetter stores a request of a source that failed permanently without
+// queuing it
+func (q *Queue) AddDeadLetter(source string, reqType RequestType, payload interface{}, lastError string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to add dead letter: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := q.addDeadLetter(tx, source, reqType, payload, lastError); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to add dead letter: %w", err)
+	}
+	metrics.AddDeadLetter(string(reqType), DeadReasonPermanent)
+
+	log.Debug().Str("type", string(reqType)).Msg("Request stored as dead letter")
+	return nil
+}
+
+// addDeadLetter stores a request rejected permanently as a dead letter in tx
+func (q *Queue) addDeadLetter(tx *sql.Tx, source string, reqType RequestType, payload interface{}, lastError string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	stored, err := compressPayload(data, q.config.Compression)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	errs, err := json.Marshal([]ErrorRecord{{Error: lastError, At: now}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal errors: %w", err)
+	}
+
+	seq, err := nextSeq(tx, source)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO dead_letters (type, source, seq, payload, reason, retries, errors, created_at, dead_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?)
+	`, reqType, source, seq, stored, DeadReasonPermanent, string(errs), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to add dead letter: %w", err)
+	}
+	return nil
+}
+
+// MarkPermanent records a failed retry that must not be retried again and
+// moves the request to the dead letters
+func (q *Queue) MarkPermanent(id int64, lastError string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to update request: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE queued_requests SET retries = retries + 1, last_error = ? WHERE id = ?
+	`, lastError, id)
+	if err != nil {
+		return fmt.Errorf("failed to update request: %w", err)
+	}
+	if err := recordError(tx, id, lastError, time.Now()); err != nil {
+		return err
+	}
+	if err := moveToDeadLetters(tx, id, DeadReasonPermanent); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkExpired moves a request that has used up its retries to the dead letters
+func (q *Queue) MarkExpired(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to move expired request: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := moveToDeadLetters(tx, id, DeadReasonExpired); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeadLetterExpired moves requests that have exceeded max retries to the dead letters
+func (q *Queue) DeadLetterExpired() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to move expired requests: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM queued_requests WHERE retries >= max_retries`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired requests: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := moveToDeadLetters(tx, id, DeadReasonExpired); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to move expired requests: %w", err)
+	}
+
+	if len(ids) > 0 {
+		log.Warn().Int("count", len(ids)).Msg("Expired queued requests moved to dead letters")
+	}
+	return int64(len(ids)), nil
+}
+
+// moveToDeadLetters copies a queued request with its error history into the
+// dead letters and removes it from the queue
+func moveToDeadLetters(tx *sql.Tx, id int64, reason string) error {
+	var reqType RequestType
+	var lastError string
+	err := tx.QueryRow(`
+		SELECT type, COALESCE(last_error, '') FROM queued_requests WHERE id = ?
+	`, id).Scan(&reqType, &lastError)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+
+	now := time.Now()
+	history, err := requestErrors(tx, id)
+	if err != nil {
+		return err
+	}
+	// Requests queued before error history was kept only have their last error
+	if len(history) == 0 && lastError != "" {
+		history = []ErrorRecord{{Error: lastError, At: now}}
+	}
+	errs, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("failed to marshal errors: %w", err)
+	}
+
+	// The payload is copied as stored, without recompressing it
+	_, err = tx.Exec(`
+		INSERT INTO dead_letters (type, source, seq, payload, reason, retries, errors, created_at, dead_at)
+		SELECT type, source, seq, payload, ?, retries, ?, created_at, ? FROM queued_requests WHERE id = ?
+	`, reason, string(errs), now, id)
+	if err != nil {
+		return fmt.Errorf("failed to add dead letter: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM queued_requests WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete request: %w", err)
+	}
+	metrics.AddDeadLetter(string(reqType), reason)
+
+	log.Warn().
+		Int64("id", id).
+		Str("type", string(reqType)).
+		Str("reason", reason).
+		Str("last_error", lastError).
+		Msg("Queued request moved to dead letters")
+	return nil
+}
+
+// ListDeadLetters returns dead letters, oldest first
+func (q *Queue) ListDeadLetters(limit, offset int) ([]DeadLetter, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	rows, err := q.db.Query(`
+		SELECT id, type, source, seq, payload, reason, retries, errors, created_at, dead_at
+		FROM dead_letters
+		ORDER BY id ASC
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *d)
+	}
+	return letters, rows.Err()
+}
+
+// GetDeadLetter returns a single dead letter
+func (q *Queue) GetDeadLetter(id int64) (*DeadLetter, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return getDeadLetter(q.db, id)
+}
+
+func getDeadLetter(db interface {
+	QueryRow(query string, args ...any) *sql.Row
+}, id int64) (*DeadLetter, error) {
+	d, err := scanDeadLetter(db.QueryRow(`
+		SELECT id, type, source, seq, payload, reason, retries, errors, created_at, dead_at
+		FROM dead_letters
+		WHERE id = ?
+	`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeadLetterNotFound
+	}
+	return d, err
+}
+
+// scanDeadLetter reads a dead letter from a row of the dead_letters columns
+func scanDeadLetter(row interface{ Scan(dest ...any) error }) (*DeadLetter, error) {
+	var d DeadLetter
+	var errs string
+	err := row.Scan(&d.ID, &d.Type, &d.Source, &d.Seq, &d.Payload, &d.Reason, &d.Retries, &errs, &d.CreatedAt, &d.DeadAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan row: %w", err)
+	}
+	if err := json.Unmarshal([]byte(errs), &d.Errors); err != nil {
+		return nil, fmt.Errorf("failed to decode errors of dead letter %d: %w", d.ID, err)
+	}
+	if d.Payload, err = decompressPayload(d.Payload); err != nil {
+		return nil, fmt.Errorf("dead letter %d: %w", d.ID, err)
+	}
+	return &d, nil
+}
+
+// UpdateDeadLetter replaces the payload of a dead letter, e.g. to fix data
+// the backend rejected. The payload must be valid JSON.
+func (q *Queue) UpdateDeadLetter(id int64, payload []byte) error {
+	if !json.Valid(payload) {
+		return errors.New("payload is not valid JSON")
+	}
+
+	stored, err := compressPayload(payload, q.config.Compression)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec("UPDATE dead_letters SET payload = ? WHERE id = ?", stored, id)
+	if err != nil {
+		return fmt.Errorf("failed to update dead letter: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// ReplayDeadLetter moves a dead letter back into the queue, due immediately
+// with a fresh retry budget. Its error history and its place among the
+// requests of its source are kept.
+func (q *Queue) ReplayDeadLetter(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to replay dead letter: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := q.replay(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplayAllDeadLetters moves every dead letter back into the queue
+func (q *Queue) ReplayAllDeadLetters() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay dead letters: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM dead_letters ORDER BY id ASC")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := q.replay(tx, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to replay dead letters: %w", err)
+	}
+	return int64(len(ids)), nil
+}
+
+func (q *Queue) replay(tx *sql.Tx, id int64) error {
+	d, err := getDeadLetter(tx, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO queued_requests (type, source, seq, payload, retries, max_retries, next_retry_at, created_at, last_error)
+		SELECT type, source, seq, payload, 0, ?, ?, created_at, ? FROM dead_letters WHERE id = ?
+	`, q.config.MaxRetries, time.Now(), d.LastError(), id)
+	if err != nil {
+		return fmt.Errorf("failed to requeue dead letter: %w", err)
+	}
+	newID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to requeue dead letter: %w", err)
+	}
+	for _, e := range d.Errors {
+		if err := recordError(tx, newID, e.Error, e.At); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM dead_letters WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+
+	log.Info().
+		Int64("dead_letter", id).
+		Int64("id", newID).
+		Str("type", string(d.Type)).
+		Msg("Dead letter requeued")
+	return nil
+}
+
+// DeleteDeadLetter removes a dead letter for good
+func (q *Queue) DeleteDeadLetter(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec("DELETE FROM dead_letters WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// DeleteAllDeadLetters removes every dead letter
+func (q *Queue) DeleteAllDeadLetters() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec("DELETE FROM dead_letters")
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete dead letters: %w", err)
+	}
+	return result.RowsAffected()
+}
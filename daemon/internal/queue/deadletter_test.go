@@ -0,0 +1,193 @@
+package queue
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// deadLetters returns every dead letter, oldest first
+func deadLetters(t *testing.T, q *Queue) []DeadLetter {
+	t.Helper()
+	dead, err := q.ListDeadLetters(100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dead
+}
+
+func TestAddDeadLetter(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	if err := q.AddDeadLetter("gmail", RequestTypeBatchUpsert, "c1", "400 invalid"); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := deadLetters(t, q)
+	if len(dead) != 1 {
+		t.Fatalf("dead letters = %d, want 1", len(dead))
+	}
+	d := dead[0]
+	if d.Source != "gmail" || d.Type != RequestTypeBatchUpsert || d.Reason != DeadReasonPermanent {
+		t.Errorf("dead letter = %s %s %s, want gmail batch_upsert permanent", d.Source, d.Type, d.Reason)
+	}
+	if string(d.Payload) != `"c1"` || d.LastError() != "400 invalid" {
+		t.Errorf("payload = %s, error = %q", d.Payload, d.LastError())
+	}
+	if len(names(t, q)) != 0 {
+		t.Error("dead letter was also queued")
+	}
+}
+
+func TestMoveToDeadLetters(t *testing.T) {
+	q := newTestQueue(t, Config{InitialBackoff: time.Hour})
+	for _, name := range []string{"c1", "c2", "c3"} {
+		if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "backend down", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reqs, err := q.List(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.MarkFailed(reqs[0].ID, "503 unavailable", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.MarkPermanent(reqs[0].ID, "400 invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.db.Exec(`UPDATE queued_requests SET retries = max_retries WHERE id = ?`, reqs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	n, err := q.DeadLetterExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expired = %d, want 1", n)
+	}
+
+	if got := names(t, q); !slices.Equal(got, []string{"c3"}) {
+		t.Errorf("queued = %v, want [c3]", got)
+	}
+	dead := deadLetters(t, q)
+	if len(dead) != 2 {
+		t.Fatalf("dead letters = %d, want 2", len(dead))
+	}
+	if dead[0].Reason != DeadReasonPermanent || dead[0].Retries != 2 {
+		t.Errorf("first = %s after %d retries, want permanent after 2", dead[0].Reason, dead[0].Retries)
+	}
+	var errs []string
+	for _, e := range dead[0].Errors {
+		errs = append(errs, e.Error)
+	}
+	if !slices.Equal(errs, []string{"backend down", "503 unavailable", "400 invalid"}) {
+		t.Errorf("errors = %v, want the whole history", errs)
+	}
+	if dead[1].Reason != DeadReasonExpired {
+		t.Errorf("second = %s, want expired", dead[1].Reason)
+	}
+}
+
+func TestUpdateDeadLetter(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	if err := q.AddDeadLetter("test", RequestTypeBatchUpsert, "c1", "400 invalid"); err != nil {
+		t.Fatal(err)
+	}
+	id := deadLetters(t, q)[0].ID
+
+	if err := q.UpdateDeadLetter(id, []byte(`"fixed"`)); err != nil {
+		t.Fatal(err)
+	}
+	d, err := q.GetDeadLetter(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Payload) != `"fixed"` {
+		t.Errorf("payload = %s, want \"fixed\"", d.Payload)
+	}
+
+	if err := q.UpdateDeadLetter(id, []byte(`{"broken`)); err == nil {
+		t.Error("invalid JSON accepted")
+	}
+	if err := q.UpdateDeadLetter(id+1, []byte(`"x"`)); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("unknown id: err = %v, want ErrDeadLetterNotFound", err)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	q := newTestQueue(t, Config{InitialBackoff: time.Hour})
+	for _, name := range []string{"c1", "c2", "c3"} {
+		if err := q.AddDeadLetter("test", RequestTypeBatchUpsert, name, "400 invalid"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dead := deadLetters(t, q)
+
+	if err := q.ReplayDeadLetter(dead[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, q); !slices.Equal(got, []string{"c2"}) {
+		t.Errorf("queued = %v, want [c2]", got)
+	}
+	if err := q.ReplayDeadLetter(dead[1].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("replayed twice: err = %v, want ErrDeadLetterNotFound", err)
+	}
+
+	n, err := q.ReplayAllDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("replayed = %d, want 2", n)
+	}
+	if len(deadLetters(t, q)) != 0 {
+		t.Error("dead letters left after replaying all")
+	}
+
+	// Replayed requests keep their place among the requests of their source
+	reqs, err := q.Backlog("test", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, r := range reqs {
+		order = append(order, string(r.Payload))
+	}
+	if !slices.Equal(order, []string{`"c1"`, `"c2"`, `"c3"`}) {
+		t.Errorf("backlog = %v, want c1 c2 c3", order)
+	}
+	for _, r := range reqs {
+		if r.Retries != 0 || r.NextRetryAt.After(time.Now()) {
+			t.Errorf("%s: retries = %d, next = %v, want a fresh request due now", r.Payload, r.Retries, r.NextRetryAt)
+		}
+		if r.LastError != "400 invalid" {
+			t.Errorf("%s: last error = %q, want it kept", r.Payload, r.LastError)
+		}
+	}
+}
+
+func TestDeleteDeadLetters(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	for _, name := range []string{"c1", "c2", "c3"} {
+		if err := q.AddDeadLetter("test", RequestTypeBatchUpsert, name, "400 invalid"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dead := deadLetters(t, q)
+
+	if err := q.DeleteDeadLetter(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DeleteDeadLetter(dead[0].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("deleted twice: err = %v, want ErrDeadLetterNotFound", err)
+	}
+	n, err := q.DeleteAllDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(deadLetters(t, q)) != 0 {
+		t.Errorf("deleted %d, want the remaining 2", n)
+	}
+}
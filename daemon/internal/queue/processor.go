@@ -3,29 +3,91 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/metrics"
+	"pkb-daemon/internal/tracing"
 )
 
+// ErrOffline is returned by Drain when the API is unavailable
+var ErrOffline = errors.New("API offline")
+
+// ErrBacklogWaiting is returned by Drain when the oldest request of a source
+// is still backing off. Nothing newer may be sent before it.
+var ErrBacklogWaiting = errors.New("waiting to retry queued backlog")
+
+// WaitingError is the ErrBacklogWaiting of a source whose oldest request is
+// due at Until
+type WaitingError struct {
+	ID    int64
+	Until time.Time
+}
+
+func (e *WaitingError) Error() string {
+	return fmt.Sprintf("%s: request %d is due at %s", ErrBacklogWaiting, e.ID, e.Until.Format(time.RFC3339))
+}
+
+func (e *WaitingError) Unwrap() error { return ErrBacklogWaiting }
+
 // RequestHandler is a function that processes a queued request
-// It receives the request type and payload, and returns an error if processing fails
-type RequestHandler func(reqType RequestType, payload []byte) error
+// It receives the request's source, type and payload, and returns an error if processing fails
+type RequestHandler func(ctx context.Context, source string, reqType RequestType, payload []byte) error
+
+// PartialError is returned by a RequestHandler when the backend took only
+// some of the items of a request. Retry is the payload of the items to send
+// again, nil if there are none. Rejected are the items the backend refused
+// outright, which become a dead letter each.
+type PartialError struct {
+	Err      error
+	Retry    interface{}
+	Rejected []RejectedItem
+}
+
+// RejectedItem is the payload of a single item the backend refused, and why
+type RejectedItem struct {
+	Payload interface{}
+	Error   string
+}
+
+func (e *PartialError) Error() string { return e.Err.Error() }
+
+func (e *PartialError) Unwrap() error { return e.Err }
 
 // Processor manages the background processing of queued requests
 type Processor struct {
-	queue          *Queue
-	handler        RequestHandler
-	checkInterval  time.Duration
-	batchSize      int
-	isOnline       bool
-	onlineCheckFn  func() bool
+	queue         *Queue
+	handler       RequestHandler
+	checkInterval time.Duration
+	batchSize     int
+	ordered       bool
+	isOnline      bool
+	onlineCheckFn func() bool
+	permanentFn   func(error) bool
+	orphanedFn    func(source string) bool
+
+	// processing serializes the background loop and ProcessNow
+	processing sync.Mutex
+
+	// draining holds a lock per source, so two callers never send the
+	// backlog of the same source at once
+	draining   map[string]*sync.Mutex
+	drainingMu sync.Mutex
 }
 
 // ProcessorConfig holds processor configuration
 type ProcessorConfig struct {
 	CheckInterval time.Duration // How often to check for pending requests
 	BatchSize     int           // How many requests to process per cycle
+	// Ordered leaves the requests of a source to Drain, so they are sent in
+	// the order the source produced them
+	Ordered bool
 }
 
 // DefaultProcessorConfig returns sensible defaults
@@ -43,7 +105,9 @@ func NewProcessor(queue *Queue, handler RequestHandler, cfg ProcessorConfig) *Pr
 		handler:       handler,
 		checkInterval: cfg.CheckInterval,
 		batchSize:     cfg.BatchSize,
+		ordered:       cfg.Ordered,
 		isOnline:      true,
+		draining:      make(map[string]*sync.Mutex),
 	}
 }
 
@@ -52,6 +116,20 @@ func (p *Processor) SetOnlineChecker(fn func() bool) {
 	p.onlineCheckFn = fn
 }
 
+// SetPermanentChecker sets a function that reports whether an error will
+// never go away by retrying. Such requests are moved to the dead letters
+// right away instead of using up their retries.
+func (p *Processor) SetPermanentChecker(fn func(error) bool) {
+	p.permanentFn = fn
+}
+
+// SetOrphanChecker sets a function that reports whether nothing else sends
+// the requests of a source any more. With ordering preserved, the processor
+// drains such sources itself so their requests aren't left in the queue.
+func (p *Processor) SetOrphanChecker(fn func(source string) bool) {
+	p.orphanedFn = fn
+}
+
 // Run starts the background processor
 func (p *Processor) Run(ctx context.Context) {
 	ticker := time.NewTicker(p.checkInterval)
@@ -78,24 +156,40 @@ func (p *Processor) Run(ctx context.Context) {
 
 // processQueue processes pending requests from the queue
 func (p *Processor) processQueue(ctx context.Context) {
+	p.processing.Lock()
+	defer p.processing.Unlock()
+
+	// Export queue depth on every tick, even while offline
+	defer p.recordDepth()
+
 	// Check if we're online first
 	if p.onlineCheckFn != nil && !p.onlineCheckFn() {
 		log.Debug().Msg("Skipping queue processing: API offline")
 		return
 	}
 
-	// Purge expired requests first
-	if _, err := p.queue.PurgeExpired(); err != nil {
-		log.Error().Err(err).Msg("Failed to purge expired requests")
+	// Move expired requests out of the way first
+	if _, err := p.queue.DeadLetterExpired(); err != nil {
+		log.Error().Err(err).Msg("Failed to move expired requests to dead letters")
 	}
 
 	// Get pending requests
-	requests, err := p.queue.GetPendingRequests(p.batchSize)
+	var requests []QueuedRequest
+	var err error
+	if p.ordered {
+		requests, err = p.queue.GetPendingUnsourcedRequests(p.batchSize)
+	} else {
+		requests, err = p.queue.GetPendingRequests(p.batchSize)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get pending requests")
 		return
 	}
 
+	if p.ordered {
+		p.drainOrphans(ctx)
+	}
+
 	if len(requests) == 0 {
 		return
 	}
@@ -112,25 +206,18 @@ func (p *Processor) processQueue(ctx context.Context) {
 		default:
 		}
 
-		err := p.handler(req.Type, req.Payload)
-		if err != nil {
-			log.Warn().
-				Err(err).
-				Int64("id", req.ID).
-				Str("type", string(req.Type)).
-				Int("retries", req.Retries+1).
-				Msg("Queued request failed")
-
-			if err := p.queue.MarkFailed(req.ID, err.Error()); err != nil {
-				log.Error().Err(err).Int64("id", req.ID).Msg("Failed to mark request as failed")
-			}
+		sendErr, markErr := p.process(ctx, req)
+		if sendErr != nil {
 			failCount++
 		} else {
-			if err := p.queue.MarkSuccess(req.ID); err != nil {
-				log.Error().Err(err).Int64("id", req.ID).Msg("Failed to mark request as success")
-			}
 			successCount++
 		}
+		// The request is still pending as it was; sending more would only
+		// repeat it on the next cycle
+		if markErr != nil {
+			log.Error().Err(markErr).Int64("id", req.ID).Msg("Failed to record queued request outcome")
+			break
+		}
 	}
 
 	if successCount > 0 || failCount > 0 {
@@ -141,6 +228,155 @@ func (p *Processor) processQueue(ctx context.Context) {
 	}
 }
 
+// process sends a single queued request and records the outcome. It returns
+// the handler's error, and markErr if the outcome couldn't be recorded, in
+// which case the request is still pending as it was.
+func (p *Processor) process(ctx context.Context, req QueuedRequest) (sendErr, markErr error) {
+	reqCtx, span := tracing.Start(ctx, "queue.retry",
+		attribute.Int64("id", req.ID),
+		attribute.String("type", string(req.Type)),
+		attribute.String("source", req.Source),
+		attribute.Int("retries", req.Retries),
+	)
+	err := p.handler(reqCtx, req.Source, req.Type, req.Payload)
+	tracing.End(span, err)
+	metrics.AddRetry(string(req.Type), err)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int64("id", req.ID).
+			Str("type", string(req.Type)).
+			Int("retries", req.Retries+1).
+			Msg("Queued request failed")
+
+		// Items the backend already took are not sent again
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			if partial.Retry == nil {
+				err = nil
+			}
+			return err, p.queue.MarkPartial(req.ID, partial, api.RetryAfter(partial))
+		}
+		if p.permanentFn != nil && p.permanentFn(err) {
+			return err, p.queue.MarkPermanent(req.ID, err.Error())
+		}
+		return err, p.queue.MarkFailed(req.ID, err.Error(), api.RetryAfter(err))
+	}
+	return nil, p.queue.MarkSuccess(req.ID)
+}
+
+// drainOrphans sends the backlog of every source nothing else sends any more
+func (p *Processor) drainOrphans(ctx context.Context) {
+	if p.orphanedFn == nil {
+		return
+	}
+	sources, err := p.queue.Sources()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list queued sources")
+		return
+	}
+	for _, source := range sources {
+		if !p.orphanedFn(source) {
+			continue
+		}
+		sent, err := p.Drain(ctx, source)
+		if sent > 0 {
+			log.Info().Str("source", source).Int("count", sent).Msg("Queued backlog sent")
+		}
+		if err != nil {
+			log.Debug().Err(err).Str("source", source).Msg("Queued backlog not sent")
+		}
+	}
+}
+
+// lockSource locks the backlog of a source and returns the unlock function
+func (p *Processor) lockSource(source string) func() {
+	p.drainingMu.Lock()
+	mu, ok := p.draining[source]
+	if !ok {
+		mu = &sync.Mutex{}
+		p.draining[source] = mu
+	}
+	p.drainingMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Drain sends the pending requests of a source in order and returns how many
+// were sent. It stops at the first request that fails temporarily and returns
+// its error, or at the first whose retry isn't due yet and returns
+// ErrBacklogWaiting, so nothing newer overtakes it. Requests rejected
+// permanently or out of retries go to the dead letters and don't block the
+// rest. If the outcome of a request can't be recorded, Drain stops and
+// returns that error rather than send the request again.
+func (p *Processor) Drain(ctx context.Context, source string) (int, error) {
+	defer p.lockSource(source)()
+
+	sent := 0
+	checkedOnline := false
+	for {
+		requests, err := p.queue.Backlog(source, p.batchSize)
+		if err != nil {
+			return sent, err
+		}
+		if len(requests) == 0 {
+			return sent, nil
+		}
+
+		for _, req := range requests {
+			if err := ctx.Err(); err != nil {
+				return sent, err
+			}
+			if req.Retries >= req.MaxRetries {
+				log.Warn().Int64("id", req.ID).Str("source", source).Msg("Queued request out of retries, moved to dead letters")
+				if err := p.queue.MarkExpired(req.ID); err != nil {
+					return sent, err
+				}
+				continue
+			}
+			if time.Until(req.NextRetryAt) > 0 {
+				return sent, &WaitingError{ID: req.ID, Until: req.NextRetryAt}
+			}
+
+			// Failing while offline would only use up the head's retries
+			if !checkedOnline {
+				if p.onlineCheckFn != nil && !p.onlineCheckFn() {
+					return sent, ErrOffline
+				}
+				checkedOnline = true
+			}
+
+			sendErr, markErr := p.process(ctx, req)
+			if sendErr == nil {
+				sent++
+			}
+			// The request would come back at the head of the backlog and be
+			// sent again and again
+			if markErr != nil {
+				return sent, markErr
+			}
+			if sendErr != nil {
+				if p.permanentFn != nil && p.permanentFn(sendErr) {
+					continue
+				}
+				return sent, sendErr
+			}
+		}
+	}
+}
+
+// recordDepth exports the current queue size
+func (p *Processor) recordDepth() {
+	stats, err := p.queue.Stats()
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read queue stats for metrics")
+		return
+	}
+	metrics.SetQueueDepth(stats.PendingCount, stats.ExpiredCount, stats.DeadLetters, stats.OldestPending)
+	metrics.SetQueueUsage(stats.SizeBytes, stats.Pressure)
+}
+
 // ProcessNow triggers immediate processing of the queue
 func (p *Processor) ProcessNow(ctx context.Context) {
 	p.processQueue(ctx)
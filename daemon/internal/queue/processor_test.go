@@ -0,0 +1,208 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/api"
+)
+
+// recordingHandler records the payloads it is given
+func recordingHandler(sent *[]string) RequestHandler {
+	return func(_ context.Context, _ string, _ RequestType, payload []byte) error {
+		var name string
+		if err := json.Unmarshal(payload, &name); err != nil {
+			return err
+		}
+		*sent = append(*sent, name)
+		return nil
+	}
+}
+
+func TestDrainWaitsForHead(t *testing.T) {
+	q := newTestQueue(t, Config{InitialBackoff: time.Hour})
+	// A request queued after a failure backs off; the one after it is due
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, "c1", "backend down", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, "c2", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	p := NewProcessor(q, recordingHandler(&sent), ProcessorConfig{BatchSize: 10, Ordered: true})
+	n, err := p.Drain(context.Background(), "test")
+	if !errors.Is(err, ErrBacklogWaiting) {
+		t.Errorf("err = %v, want ErrBacklogWaiting", err)
+	}
+	if n != 0 || len(sent) != 0 {
+		t.Errorf("sent %v, want nothing before the head is due", sent)
+	}
+
+	reqs, err := q.List(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Retries != 0 {
+		t.Errorf("head retries = %d, want 0", reqs[0].Retries)
+	}
+}
+
+func TestDrainDeadLettersExpiredHead(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	for _, name := range []string{"c1", "c2", "c3"} {
+		if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.db.Exec(`UPDATE queued_requests SET retries = max_retries WHERE seq = (SELECT MIN(seq) FROM queued_requests)`); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	p := NewProcessor(q, recordingHandler(&sent), ProcessorConfig{BatchSize: 10, Ordered: true})
+	n, err := p.Drain(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || !slices.Equal(sent, []string{"c2", "c3"}) {
+		t.Errorf("sent %v, want [c2 c3]", sent)
+	}
+
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DeadLetters != 1 {
+		t.Errorf("dead letters = %d, want 1", stats.DeadLetters)
+	}
+}
+
+func TestDrainStopsWhenMarkFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler RequestHandler
+	}{
+		{"success", func(context.Context, string, RequestType, []byte) error { return nil }},
+		{"permanent", func(context.Context, string, RequestType, []byte) error { return errors.New("rejected") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, Config{})
+			for _, name := range []string{"c1", "c2"} {
+				if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Marking either outcome deletes the request, which now fails
+			if _, err := q.db.Exec(`CREATE TRIGGER fail_delete BEFORE DELETE ON queued_requests
+				BEGIN SELECT RAISE(ABORT, 'disk I/O error'); END`); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := 0
+			handler := func(ctx context.Context, source string, reqType RequestType, payload []byte) error {
+				calls++
+				return tt.handler(ctx, source, reqType, payload)
+			}
+			p := NewProcessor(q, handler, ProcessorConfig{BatchSize: 10, Ordered: true})
+			p.SetPermanentChecker(func(error) bool { return true })
+			if _, err := p.Drain(context.Background(), "test"); err == nil {
+				t.Error("Drain succeeded, want the mark error")
+			}
+			if calls != 1 {
+				t.Errorf("handler called %d times, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestRetryAfterDelaysRetry(t *testing.T) {
+	q := newTestQueue(t, Config{InitialBackoff: time.Second, MaxBackoff: time.Minute, BackoffFactor: 2})
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, "c1", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	throttled := func(context.Context, string, RequestType, []byte) error {
+		return &api.APIError{StatusCode: http.StatusTooManyRequests, Temporary: true, RetryAfter: 2 * time.Hour}
+	}
+	p := NewProcessor(q, throttled, ProcessorConfig{BatchSize: 10})
+	p.ProcessNow(context.Background())
+
+	reqs, err := q.List(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait := time.Until(reqs[0].NextRetryAt); wait < time.Hour {
+		t.Errorf("retried in %s, want the 2h the backend asked for", wait)
+	}
+
+	// Without Retry-After the backoff applies
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, "c2", "backend down", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, "c3", "backend busy", 3*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if reqs, err = q.List(10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if wait := time.Until(reqs[1].NextRetryAt); wait > time.Minute {
+		t.Errorf("c2 retried in %s, want the initial backoff", wait)
+	}
+	if wait := time.Until(reqs[2].NextRetryAt); wait < 2*time.Hour {
+		t.Errorf("c3 retried in %s, want the 3h the backend asked for", wait)
+	}
+}
+
+func TestDrainKeepsOnlyFailedItems(t *testing.T) {
+	q := newTestQueue(t, Config{})
+	for _, name := range []string{"c1", "c2"} {
+		if err := q.Enqueue("test", RequestTypeBatchUpsert, name, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// c1 was taken but for an item rejected outright, which isn't retried
+	var sent []string
+	handler := func(ctx context.Context, source string, reqType RequestType, payload []byte) error {
+		if err := recordingHandler(&sent)(ctx, source, reqType, payload); err != nil {
+			return err
+		}
+		if string(payload) != `"c1"` {
+			return nil
+		}
+		return &PartialError{
+			Err:      &api.ItemErrors{Errors: []api.BatchError{{Index: 1, Error: "invalid", StatusCode: http.StatusBadRequest}}, Total: 2},
+			Rejected: []RejectedItem{{Payload: "c1-item", Error: "invalid"}},
+		}
+	}
+	p := NewProcessor(q, handler, ProcessorConfig{BatchSize: 10, Ordered: true})
+	n, err := p.Drain(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || !slices.Equal(sent, []string{"c1", "c2"}) {
+		t.Errorf("sent %v (%d), want c1 and c2", sent, n)
+	}
+
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PendingCount != 0 || stats.DeadLetters != 1 {
+		t.Errorf("pending = %d, dead letters = %d, want only the rejected item dead", stats.PendingCount, stats.DeadLetters)
+	}
+	dead, err := q.ListDeadLetters(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || string(dead[0].Payload) != `"c1-item"` || dead[0].Source != "test" {
+		t.Errorf("dead letters = %+v, want c1-item of test", dead)
+	}
+}
@@ -3,36 +3,58 @@ package queue
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/metrics"
+	"pkb-daemon/internal/state"
 )
 
 // RequestType identifies the type of API request
 type RequestType string
 
 const (
-	RequestTypeBatchUpsert      RequestType = "batch_upsert"
-	RequestTypeImportContacts   RequestType = "import_contacts"
-	RequestTypeImportCalendar   RequestType = "import_calendar"
-	RequestTypeImportNotes      RequestType = "import_notes"
+	RequestTypeBatchUpsert    RequestType = "batch_upsert"
+	RequestTypeImportContacts RequestType = "import_contacts"
+	RequestTypeImportCalendar RequestType = "import_calendar"
+	RequestTypeImportNotes    RequestType = "import_notes"
+)
+
+var (
+	// ErrNotFound is returned when a queued request does not exist
+	ErrNotFound = errors.New("queued request not found")
+	// ErrDeadLetterNotFound is returned when a dead letter does not exist
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
 )
 
 // QueuedRequest represents a failed API request stored in the queue
 type QueuedRequest struct {
 	ID          int64       `json:"id"`
 	Type        RequestType `json:"type"`
+	Source      string      `json:"source,omitempty"` // sync source that produced the request
+	Seq         int64       `json:"seq"`              // position among the requests of its source
 	Payload     []byte      `json:"payload"`
 	Retries     int         `json:"retries"`
 	MaxRetries  int         `json:"max_retries"`
 	NextRetryAt time.Time   `json:"next_retry_at"`
 	CreatedAt   time.Time   `json:"created_at"`
 	LastError   string      `json:"last_error"`
+	// Errors is every failed attempt, oldest first. Only filled in by Get.
+	Errors []ErrorRecord `json:"errors,omitempty"`
+}
+
+// ErrorRecord is a single failed attempt to send a request
+type ErrorRecord struct {
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
 }
 
 // Config holds queue configuration
@@ -42,6 +64,11 @@ type Config struct {
 	InitialBackoff time.Duration // Initial backoff duration
 	MaxBackoff     time.Duration // Maximum backoff duration
 	BackoffFactor  float64       // Multiplier for exponential backoff
+	Compression    string        // Payload compression: none, gzip or zstd
+	MaxBytes       int64         // Budget for the stored payloads of queued requests, 0 for none
+	MaxCount       int64         // Budget for the number of queued requests, 0 for none
+	Eviction       string        // What happens over budget: oldest, priority or reject
+	Priority       []RequestType // Request types from most to least important, for the priority policy
 }
 
 // DefaultConfig returns sensible default configuration
@@ -52,7 +79,31 @@ func DefaultConfig(basePath string) Config {
 		InitialBackoff: 5 * time.Second,
 		MaxBackoff:     1 * time.Hour,
 		BackoffFactor:  2.0,
+		Compression:    CompressionZstd,
+		Eviction:       EvictOldest,
+		Priority:       DefaultPriority,
+	}
+}
+
+// ConfigFrom builds the queue configuration from the daemon's config
+func ConfigFrom(cfg config.QueueConfig) Config {
+	c := Config{
+		Path:           cfg.Path,
+		MaxRetries:     cfg.MaxRetries,
+		InitialBackoff: time.Duration(cfg.InitialBackoffSecs) * time.Second,
+		MaxBackoff:     time.Duration(cfg.MaxBackoffSecs) * time.Second,
+		BackoffFactor:  cfg.BackoffFactor,
+		Compression:    cfg.Compression,
+		MaxCount:       int64(cfg.MaxCount),
+		Eviction:       cfg.Eviction,
+	}
+	if cfg.MaxSizeMB > 0 {
+		c.MaxBytes = int64(cfg.MaxSizeMB) << 20
 	}
+	for _, t := range cfg.Priority {
+		c.Priority = append(c.Priority, RequestType(t))
+	}
+	return c
 }
 
 // Queue manages the offline request queue
@@ -64,13 +115,28 @@ type Queue struct {
 
 // New creates a new queue with the given configuration
 func New(cfg Config) (*Queue, error) {
+	if !validCompression(cfg.Compression) {
+		return nil, fmt.Errorf("unknown queue compression %q (expected none, gzip or zstd)", cfg.Compression)
+	}
+	if !validEviction(cfg.Eviction) {
+		return nil, fmt.Errorf("unknown queue eviction policy %q (expected oldest, priority or reject)", cfg.Eviction)
+	}
+	if cfg.Eviction == "" {
+		cfg.Eviction = EvictOldest
+	}
+	if len(cfg.Priority) == 0 {
+		cfg.Priority = DefaultPriority
+	}
+
 	// Ensure directory exists
 	dir := filepath.Dir(cfg.Path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create queue directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite3", cfg.Path+"?_journal_mode=WAL")
+	// The CLI may open the queue while the daemon is running. Foreign keys
+	// remove the error history of a request together with the request.
+	db, err := sql.Open("sqlite3", cfg.Path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open queue database: %w", err)
 	}
@@ -104,14 +170,116 @@ func (q *Queue) initialize() error {
 
 	CREATE INDEX IF NOT EXISTS idx_next_retry_at ON queued_requests(next_retry_at);
 	CREATE INDEX IF NOT EXISTS idx_type ON queued_requests(type);
+
+	CREATE TABLE IF NOT EXISTS request_errors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_id INTEGER NOT NULL REFERENCES queued_requests(id) ON DELETE CASCADE,
+		error TEXT NOT NULL,
+		occurred_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_request_errors_request_id ON request_errors(request_id);
+
+	CREATE TABLE IF NOT EXISTS dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		source TEXT NOT NULL DEFAULT '',
+		seq INTEGER NOT NULL DEFAULT 0,
+		payload BLOB NOT NULL,
+		reason TEXT NOT NULL,
+		retries INTEGER NOT NULL DEFAULT 0,
+		errors TEXT NOT NULL DEFAULT '[]',
+		created_at DATETIME NOT NULL,
+		dead_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS source_sequences (
+		source TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL
+	);
 	`
 
-	_, err := q.db.Exec(schema)
-	return err
+	if _, err := q.db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Queues created before requests were tagged with their source
+	if err := addColumn(q.db, "queued_requests", "source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(q.db, "queued_requests", "seq", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	if _, err := q.db.Exec(`CREATE INDEX IF NOT EXISTS idx_source_seq ON queued_requests(source, seq)`); err != nil {
+		return err
+	}
+
+	// The outbox writes checkpoints, so the state tables live here too
+	return state.Init(q.db)
 }
 
-// Enqueue adds a failed request to the queue
-func (q *Queue) Enqueue(reqType RequestType, payload interface{}, lastError string) error {
+// addColumn adds a column to a table unless it already exists
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// nextSeq hands out the next sequence number of a source. Numbers keep
+// growing even when the queue empties, so a replayed dead letter still sorts
+// before everything the source produced after it.
+func nextSeq(tx *sql.Tx, source string) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(`
+		INSERT INTO source_sequences (source, seq) VALUES (?, 1)
+		ON CONFLICT(source) DO UPDATE SET seq = seq + 1
+		RETURNING seq
+	`, source).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to assign sequence: %w", err)
+	}
+	return seq, nil
+}
+
+// Enqueue adds a failed request of a source to the queue, after every
+// request the source queued before. It is retried after the initial backoff,
+// or after retryAfter if the backend asked for longer.
+func (q *Queue) Enqueue(source string, reqType RequestType, payload interface{}, lastError string, retryAfter time.Duration) error {
+	return q.enqueue(source, reqType, payload, lastError, retryAfter, nil)
+}
+
+// enqueue stores a request. A request without an error hasn't been sent yet
+// and is due right away. If set, also runs in the same transaction.
+func (q *Queue) enqueue(source string, reqType RequestType, payload interface{}, lastError string, retryAfter time.Duration, also func(*sql.Tx) error) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
@@ -120,21 +288,76 @@ func (q *Queue) Enqueue(reqType RequestType, payload interface{}, lastError stri
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	nextRetry := time.Now().Add(q.config.InitialBackoff)
+	stored, err := compressPayload(data, q.config.Compression)
+	if err != nil {
+		return err
+	}
+	if q.config.MaxBytes > 0 && int64(len(stored)) > q.config.MaxBytes {
+		metrics.AddQueueRejected(string(reqType))
+		return ErrTooLarge
+	}
 
-	_, err = q.db.Exec(`
-		INSERT INTO queued_requests (type, payload, max_retries, next_retry_at, last_error)
-		VALUES (?, ?, ?, ?, ?)
-	`, reqType, data, q.config.MaxRetries, nextRetry, lastError)
+	now := time.Now()
+	nextRetry := now
+	if lastError != "" {
+		nextRetry = now.Add(max(q.config.InitialBackoff, retryAfter))
+	}
 
+	tx, err := q.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to enqueue request: %w", err)
 	}
+	defer tx.Rollback()
+
+	if q.config.Eviction == EvictReject {
+		if err := q.admit(tx, reqType, int64(len(stored))); err != nil {
+			return err
+		}
+	}
+
+	seq, err := nextSeq(tx, source)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO queued_requests (type, source, seq, payload, max_retries, next_retry_at, last_error)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, reqType, source, seq, stored, q.config.MaxRetries, nextRetry, lastError)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue request: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to enqueue request: %w", err)
+	}
+	if lastError != "" {
+		if err := recordError(tx, id, lastError, now); err != nil {
+			return err
+		}
+	}
+	if also != nil {
+		if err := also(tx); err != nil {
+			return err
+		}
+	}
+	if q.config.Eviction != EvictReject {
+		if err := q.evict(tx, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to enqueue request: %w", err)
+	}
+	metrics.AddEnqueued(string(reqType))
 
 	log.Debug().
 		Str("type", string(reqType)).
+		Str("source", source).
+		Int64("seq", seq).
+		Int("size", len(data)).
+		Int("stored", len(stored)).
 		Time("next_retry", nextRetry).
-		Msg("Request queued for retry")
+		Msg("Request queued")
 
 	return nil
 }
@@ -145,7 +368,7 @@ func (q *Queue) GetPendingRequests(limit int) ([]QueuedRequest, error) {
 	defer q.mu.RUnlock()
 
 	rows, err := q.db.Query(`
-		SELECT id, type, payload, retries, max_retries, next_retry_at, created_at, COALESCE(last_error, '')
+		SELECT id, type, source, seq, payload, retries, max_retries, next_retry_at, created_at, COALESCE(last_error, '')
 		FROM queued_requests
 		WHERE next_retry_at <= ? AND retries < max_retries
 		ORDER BY next_retry_at ASC
@@ -159,26 +382,215 @@ func (q *Queue) GetPendingRequests(limit int) ([]QueuedRequest, error) {
 
 	var requests []QueuedRequest
 	for rows.Next() {
-		var req QueuedRequest
-		err := rows.Scan(
-			&req.ID,
-			&req.Type,
-			&req.Payload,
-			&req.Retries,
-			&req.MaxRetries,
-			&req.NextRetryAt,
-			&req.CreatedAt,
-			&req.LastError,
-		)
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *req)
+	}
+
+	return requests, rows.Err()
+}
+
+// GetPendingUnsourcedRequests returns requests that are ready for retry and
+// don't belong to a source. With ordering preserved, the requests of a
+// source are only sent by Backlog, so they never overtake each other.
+func (q *Queue) GetPendingUnsourcedRequests(limit int) ([]QueuedRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	rows, err := q.db.Query(`
+		SELECT id, type, source, seq, payload, retries, max_retries, next_retry_at, created_at, COALESCE(last_error, '')
+		FROM queued_requests
+		WHERE next_retry_at <= ? AND retries < max_retries AND source = ''
+		ORDER BY next_retry_at ASC
+		LIMIT ?
+	`, time.Now(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []QueuedRequest
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *req)
+	}
+
+	return requests, rows.Err()
+}
+
+// Backlog returns the queued requests of a source in the order the source
+// produced them, whether or not their retry is due or they have used up their
+// retries
+func (q *Queue) Backlog(source string, limit int) ([]QueuedRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	rows, err := q.db.Query(`
+		SELECT id, type, source, seq, payload, retries, max_retries, next_retry_at, created_at, COALESCE(last_error, '')
+		FROM queued_requests
+		WHERE source = ?
+		ORDER BY seq ASC, id ASC
+		LIMIT ?
+	`, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backlog: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []QueuedRequest
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *req)
+	}
+
+	return requests, rows.Err()
+}
+
+// Sources returns the sources that have queued requests, by name
+func (q *Queue) Sources() ([]string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	rows, err := q.db.Query(`SELECT DISTINCT source FROM queued_requests WHERE source != '' ORDER BY source`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sources: %w", err)
+	}
+	defer rows.Close()
+
+	var sources []string
+	for rows.Next() {
+		var source string
+		if err := rows.Scan(&source); err != nil {
+			return nil, fmt.Errorf("failed to read source: %w", err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, rows.Err()
+}
+
+// List returns all queued requests, including expired ones, oldest first
+func (q *Queue) List(limit, offset int) ([]QueuedRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	rows, err := q.db.Query(`
+		SELECT id, type, source, seq, payload, retries, max_retries, next_retry_at, created_at, COALESCE(last_error, '')
+		FROM queued_requests
+		ORDER BY id ASC
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []QueuedRequest
+	for rows.Next() {
+		req, err := scanRequest(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+			return nil, err
 		}
-		requests = append(requests, req)
+		requests = append(requests, *req)
 	}
 
 	return requests, rows.Err()
 }
 
+// Get returns a single queued request
+func (q *Queue) Get(id int64) (*QueuedRequest, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	row := q.db.QueryRow(`
+		SELECT id, type, source, seq, payload, retries, max_retries, next_retry_at, created_at, COALESCE(last_error, '')
+		FROM queued_requests
+		WHERE id = ?
+	`, id)
+
+	req, err := scanRequest(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req.Errors, err = requestErrors(q.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// recordError appends a failed attempt to the error history of a request
+func recordError(tx *sql.Tx, id int64, lastError string, at time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO request_errors (request_id, error, occurred_at) VALUES (?, ?, ?)
+	`, id, lastError, at)
+	if err != nil {
+		return fmt.Errorf("failed to record error: %w", err)
+	}
+	return nil
+}
+
+// requestErrors returns the error history of a request, oldest first
+func requestErrors(db interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}, id int64) ([]ErrorRecord, error) {
+	rows, err := db.Query(`
+		SELECT error, occurred_at FROM request_errors WHERE request_id = ? ORDER BY id ASC
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query errors: %w", err)
+	}
+	defer rows.Close()
+
+	var records []ErrorRecord
+	for rows.Next() {
+		var r ErrorRecord
+		if err := rows.Scan(&r.Error, &r.At); err != nil {
+			return nil, fmt.Errorf("failed to scan error: %w", err)
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// scanRequest reads a queued request from a row of the queued_requests columns
+func scanRequest(row interface{ Scan(dest ...any) error }) (*QueuedRequest, error) {
+	var req QueuedRequest
+	err := row.Scan(
+		&req.ID,
+		&req.Type,
+		&req.Source,
+		&req.Seq,
+		&req.Payload,
+		&req.Retries,
+		&req.MaxRetries,
+		&req.NextRetryAt,
+		&req.CreatedAt,
+		&req.LastError,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan row: %w", err)
+	}
+	if req.Payload, err = decompressPayload(req.Payload); err != nil {
+		return nil, fmt.Errorf("request %d: %w", req.ID, err)
+	}
+	return &req, nil
+}
+
 // MarkSuccess removes a successfully processed request from the queue
 func (q *Queue) MarkSuccess(id int64) error {
 	q.mu.Lock()
@@ -193,24 +605,107 @@ func (q *Queue) MarkSuccess(id int64) error {
 	return nil
 }
 
-// MarkFailed updates a request after a failed retry attempt
-func (q *Queue) MarkFailed(id int64, lastError string) error {
+// MarkFailed updates a request after a failed retry attempt. The next attempt
+// waits for the backoff, or for retryAfter if the backend asked for longer. A
+// request that has used up its retries is moved to the dead letters.
+func (q *Queue) MarkFailed(id int64, lastError string, retryAfter time.Duration) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to update request: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := q.markFailed(tx, id, lastError, retryAfter); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update request: %w", err)
+	}
+	return nil
+}
+
+// MarkPartial records a retry the backend took only part of. The items it
+// rejected outright become one dead letter each. The request keeps only the
+// items to send again and is retried like after MarkFailed, or is done if
+// there are none.
+func (q *Queue) MarkPartial(id int64, partial *PartialError, retryAfter time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var payload []byte
+	if partial.Retry != nil {
+		data, err := json.Marshal(partial.Retry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		if payload, err = compressPayload(data, q.config.Compression); err != nil {
+			return err
+		}
+	}
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to update request: %w", err)
+	}
+	defer tx.Rollback()
+
+	var source string
+	var reqType RequestType
+	err = tx.QueryRow("SELECT source, type FROM queued_requests WHERE id = ?", id).Scan(&source, &reqType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+	for _, r := range partial.Rejected {
+		if err := q.addDeadLetter(tx, source, reqType, r.Payload, r.Error); err != nil {
+			return err
+		}
+	}
+
+	if payload == nil {
+		if _, err := tx.Exec("DELETE FROM queued_requests WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete request: %w", err)
+		}
+	} else {
+		if _, err := tx.Exec("UPDATE queued_requests SET payload = ? WHERE id = ?", payload, id); err != nil {
+			return fmt.Errorf("failed to update request: %w", err)
+		}
+		if err := q.markFailed(tx, id, partial.Error(), retryAfter); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update request: %w", err)
+	}
+	for range partial.Rejected {
+		metrics.AddDeadLetter(string(reqType), DeadReasonPermanent)
+	}
+	return nil
+}
+
+// markFailed counts a failed attempt of a request in tx and schedules the
+// next one, or moves the request to the dead letters if it has used up its
+// retries
+func (q *Queue) markFailed(tx *sql.Tx, id int64, lastError string, retryAfter time.Duration) error {
 	// Get current retry count
-	var retries int
-	err := q.db.QueryRow("SELECT retries FROM queued_requests WHERE id = ?", id).Scan(&retries)
+	var retries, maxRetries int
+	err := tx.QueryRow("SELECT retries, max_retries FROM queued_requests WHERE id = ?", id).Scan(&retries, &maxRetries)
 	if err != nil {
 		return fmt.Errorf("failed to get retry count: %w", err)
 	}
 
 	// Calculate next retry with exponential backoff
+	now := time.Now()
 	newRetries := retries + 1
-	backoff := q.calculateBackoff(newRetries)
-	nextRetry := time.Now().Add(backoff)
+	backoff := max(q.calculateBackoff(newRetries), retryAfter)
+	nextRetry := now.Add(backoff)
 
-	_, err = q.db.Exec(`
+	_, err = tx.Exec(`
 		UPDATE queued_requests
 		SET retries = ?, next_retry_at = ?, last_error = ?
 		WHERE id = ?
@@ -219,6 +714,13 @@ func (q *Queue) MarkFailed(id int64, lastError string) error {
 	if err != nil {
 		return fmt.Errorf("failed to update request: %w", err)
 	}
+	if err := recordError(tx, id, lastError, now); err != nil {
+		return err
+	}
+
+	if newRetries >= maxRetries {
+		return moveToDeadLetters(tx, id, DeadReasonExpired)
+	}
 
 	log.Debug().
 		Int64("id", id).
@@ -230,6 +732,64 @@ func (q *Queue) MarkFailed(id int64, lastError string) error {
 	return nil
 }
 
+// Retry makes a request due immediately with a fresh retry budget
+func (q *Queue) Retry(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec(`
+		UPDATE queued_requests SET retries = 0, next_retry_at = ? WHERE id = ?
+	`, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to retry request: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RetryAll makes every request due immediately, including expired ones
+func (q *Queue) RetryAll() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec(`
+		UPDATE queued_requests SET retries = 0, next_retry_at = ?
+	`, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to retry requests: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// Delete removes a request from the queue without sending it
+func (q *Queue) Delete(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec("DELETE FROM queued_requests WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete request: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteAll removes every request from the queue
+func (q *Queue) DeleteAll() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result, err := q.db.Exec("DELETE FROM queued_requests")
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete requests: %w", err)
+	}
+	return result.RowsAffected()
+}
+
 // calculateBackoff computes exponential backoff duration
 func (q *Queue) calculateBackoff(retries int) time.Duration {
 	backoff := float64(q.config.InitialBackoff)
@@ -244,7 +804,8 @@ func (q *Queue) calculateBackoff(retries int) time.Duration {
 	return time.Duration(backoff)
 }
 
-// PurgeExpired removes requests that have exceeded max retries
+// PurgeExpired deletes requests that have exceeded max retries without
+// keeping them as dead letters
 func (q *Queue) PurgeExpired() (int64, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -267,10 +828,36 @@ func (q *Queue) PurgeExpired() (int64, error) {
 
 // Stats returns queue statistics
 type Stats struct {
-	PendingCount   int64
-	ExpiredCount   int64
-	OldestPending  *time.Time
-	NextRetry      *time.Time
+	PendingCount  int64      `json:"pending_count"`
+	ExpiredCount  int64      `json:"expired_count"`
+	OldestPending *time.Time `json:"oldest_pending,omitempty"`
+	NextRetry     *time.Time `json:"next_retry,omitempty"`
+	DeadLetters   int64      `json:"dead_letters"`
+	// Budget usage counts every queued request, including expired ones
+	SizeBytes int64   `json:"size_bytes"`
+	MaxBytes  int64   `json:"max_bytes,omitempty"`
+	MaxCount  int64   `json:"max_count,omitempty"`
+	Pressure  float64 `json:"pressure"` // fraction of the budget in use; 0 without a budget
+	Eviction  string  `json:"eviction"`
+}
+
+// minTime returns the time an aggregate query selects, or nil when there are
+// no rows. The driver returns aggregates as text, without the column type that
+// would make it parse them.
+func minTime(db *sql.DB, query string, args ...any) (*time.Time, error) {
+	var value sql.NullString
+	if err := db.QueryRow(query, args...).Scan(&value); err != nil {
+		return nil, fmt.Errorf("failed to read queue stats: %w", err)
+	}
+	if !value.Valid {
+		return nil, nil
+	}
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, value.String, time.UTC); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to read queue stats: unknown time format %q", value.String)
 }
 
 func (q *Queue) Stats() (*Stats, error) {
@@ -296,23 +883,38 @@ func (q *Queue) Stats() (*Stats, error) {
 	}
 
 	// Oldest pending request
-	var oldest sql.NullTime
-	q.db.QueryRow(`
+	oldest, err := minTime(q.db, `
 		SELECT MIN(created_at) FROM queued_requests WHERE retries < max_retries
-	`).Scan(&oldest)
-	if oldest.Valid {
-		stats.OldestPending = &oldest.Time
+	`)
+	if err != nil {
+		return nil, err
 	}
+	stats.OldestPending = oldest
 
 	// Next scheduled retry
-	var nextRetry sql.NullTime
-	q.db.QueryRow(`
+	nextRetry, err := minTime(q.db, `
 		SELECT MIN(next_retry_at) FROM queued_requests
 		WHERE retries < max_retries AND next_retry_at > ?
-	`, time.Now()).Scan(&nextRetry)
-	if nextRetry.Valid {
-		stats.NextRetry = &nextRetry.Time
+	`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	stats.NextRetry = nextRetry
+
+	err = q.db.QueryRow(`SELECT COUNT(*) FROM dead_letters`).Scan(&stats.DeadLetters)
+	if err != nil {
+		return nil, err
+	}
+
+	count, size, err := usage(q.db)
+	if err != nil {
+		return nil, err
 	}
+	stats.SizeBytes = size
+	stats.MaxBytes = q.config.MaxBytes
+	stats.MaxCount = q.config.MaxCount
+	stats.Pressure = q.pressure(count, size)
+	stats.Eviction = q.config.Eviction
 
 	return stats, nil
 }
@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/state"
+)
+
+// newTestQueue returns a queue in a temporary directory
+func newTestQueue(t *testing.T, cfg Config) *Queue {
+	t.Helper()
+	cfg.Path = filepath.Join(t.TempDir(), "queue.db")
+	cfg.MaxRetries = 10
+	cfg.Compression = CompressionNone
+	q, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// names returns the payloads of the queued requests, oldest first
+func names(t *testing.T, q *Queue) []string {
+	t.Helper()
+	reqs, err := q.List(100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, r := range reqs {
+		var name string
+		if err := json.Unmarshal(r.Payload, &name); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+func TestStatsTimes(t *testing.T) {
+	q := newTestQueue(t, Config{InitialBackoff: time.Hour})
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.OldestPending != nil || stats.NextRetry != nil {
+		t.Errorf("empty queue: oldest = %v, next = %v, want neither", stats.OldestPending, stats.NextRetry)
+	}
+
+	before := time.Now().Add(-time.Second)
+	if err := q.Enqueue("test", RequestTypeBatchUpsert, "c1", "backend down", 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = q.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.PendingCount != 1 {
+		t.Errorf("pending = %d, want 1", stats.PendingCount)
+	}
+	if stats.OldestPending == nil || stats.OldestPending.Before(before) || stats.OldestPending.After(time.Now()) {
+		t.Errorf("oldest = %v, want about now", stats.OldestPending)
+	}
+	if stats.NextRetry == nil || time.Until(*stats.NextRetry) < 59*time.Minute {
+		t.Errorf("next retry = %v, want in about an hour", stats.NextRetry)
+	}
+}
+
+func TestMigrateUntaggedQueue(t *testing.T) {
+	// A queue written before requests were tagged with their source
+	path := filepath.Join(t.TempDir(), "queue.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE queued_requests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			retries INTEGER DEFAULT 0,
+			max_retries INTEGER NOT NULL,
+			next_retry_at DATETIME NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_error TEXT
+		);
+		INSERT INTO queued_requests (type, payload, max_retries, next_retry_at) VALUES ('batch_upsert', '"old"', 10, datetime('now'));
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := New(Config{Path: path, MaxRetries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Enqueue("imessage", RequestTypeBatchUpsert, "new", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs, err := q.List(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].Source != "" || reqs[1].Source != "imessage" {
+		t.Errorf("requests = %+v, want the untagged one and imessage's", reqs)
+	}
+	backlog, err := q.Backlog("imessage", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || string(backlog[0].Payload) != `"new"` {
+		t.Errorf("imessage backlog = %+v, want only its own request", backlog)
+	}
+}
+
+func TestEnqueueWithCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q, err := New(Config{Path: path, MaxRetries: 10, Eviction: EvictReject, MaxCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// The outbox keeps the state in the queue database
+	st, err := state.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if err := q.EnqueueWithCheckpoint("imessage", RequestTypeBatchUpsert, "c1", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, q); !slices.Equal(got, []string{"c1"}) {
+		t.Errorf("queued = %v, want [c1]", got)
+	}
+	if cp, err := st.Checkpoint("imessage"); err != nil || cp != "100" {
+		t.Errorf("checkpoint = %q (%v), want 100", cp, err)
+	}
+
+	// A batch that can't be queued leaves the checkpoint where it was
+	if err := q.EnqueueWithCheckpoint("imessage", RequestTypeBatchUpsert, "c2", "200"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("err = %v, want ErrQueueFull", err)
+	}
+	if got := names(t, q); !slices.Equal(got, []string{"c1"}) {
+		t.Errorf("queued = %v, want [c1]", got)
+	}
+	if cp, err := st.Checkpoint("imessage"); err != nil || cp != "100" {
+		t.Errorf("checkpoint = %q (%v), want 100", cp, err)
+	}
+}
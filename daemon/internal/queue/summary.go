@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"pkb-daemon/internal/api"
+)
+
+// Summarize describes a queued payload in one line,
+// e.g. "batch_upsert: 100 communications from imessage"
+func Summarize(reqType RequestType, payload []byte) string {
+	var desc string
+	var err error
+
+	switch reqType {
+	case RequestTypeBatchUpsert:
+		var req api.BatchUpsertRequest
+		if err = json.Unmarshal(payload, &req); err == nil {
+			sources := make([]string, 0, len(req.Communications))
+			for _, c := range req.Communications {
+				sources = append(sources, c.Source)
+			}
+			desc = plural(len(req.Communications), "communication") + from(sources)
+		}
+	case RequestTypeImportContacts:
+		var req api.ContactsImportRequest
+		if err = json.Unmarshal(payload, &req); err == nil {
+			desc = plural(len(req.Contacts), "contact")
+		}
+	case RequestTypeImportCalendar:
+		var req api.CalendarEventsRequest
+		if err = json.Unmarshal(payload, &req); err == nil {
+			providers := make([]string, 0, len(req.Events))
+			for _, e := range req.Events {
+				providers = append(providers, e.Provider)
+			}
+			desc = plural(len(req.Events), "calendar event") + from(providers)
+		}
+	case RequestTypeImportNotes:
+		var req api.AppleNotesRequest
+		if err = json.Unmarshal(payload, &req); err == nil {
+			desc = plural(len(req.Notes), "note")
+		}
+	default:
+		desc = fmt.Sprintf("%d bytes", len(payload))
+	}
+
+	if err != nil {
+		desc = fmt.Sprintf("unreadable payload (%d bytes): %v", len(payload), err)
+	}
+	return fmt.Sprintf("%s: %s", reqType, desc)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// from lists the distinct non-empty names, e.g. " from gmail, imessage"
+func from(names []string) string {
+	seen := make(map[string]bool)
+	var distinct []string
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			distinct = append(distinct, name)
+		}
+	}
+	if len(distinct) == 0 {
+		return ""
+	}
+	sort.Strings(distinct)
+	return " from " + strings.Join(distinct, ", ")
+}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"pkb-daemon/internal/api"
+)
+
+func TestSummarize(t *testing.T) {
+	mustJSON := func(v any) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	comms := make([]api.Communication, 100)
+	for i := range comms {
+		comms[i].Source = "imessage"
+	}
+
+	tests := []struct {
+		reqType RequestType
+		payload []byte
+		want    string
+	}{
+		{RequestTypeBatchUpsert, mustJSON(api.BatchUpsertRequest{Communications: comms}), "batch_upsert: 100 communications from imessage"},
+		{RequestTypeBatchUpsert, mustJSON(api.BatchUpsertRequest{Communications: []api.Communication{{Source: "gmail"}, {Source: "calls"}, {Source: "gmail"}}}), "batch_upsert: 3 communications from calls, gmail"},
+		{RequestTypeImportContacts, mustJSON(api.ContactsImportRequest{Contacts: []api.ContactImport{{}}}), "import_contacts: 1 contact"},
+		{RequestTypeImportCalendar, mustJSON(api.CalendarEventsRequest{Events: []api.CalendarEventImport{{Provider: "google"}, {Provider: "google"}}}), "import_calendar: 2 calendar events from google"},
+		{RequestTypeImportNotes, mustJSON(api.AppleNotesRequest{}), "import_notes: 0 notes"},
+		{"upload", []byte("abc"), "upload: 3 bytes"},
+	}
+	for _, tt := range tests {
+		if got := Summarize(tt.reqType, tt.payload); got != tt.want {
+			t.Errorf("Summarize(%s) = %q, want %q", tt.reqType, got, tt.want)
+		}
+	}
+
+	if got := Summarize(RequestTypeBatchUpsert, []byte("{")); !strings.HasPrefix(got, "batch_upsert: unreadable payload (1 bytes)") {
+		t.Errorf("Summarize(invalid) = %q", got)
+	}
+}
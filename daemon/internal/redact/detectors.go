@@ -0,0 +1,274 @@
+package redact
+
+import (
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// detector finds and masks one kind of sensitive data. Only the group named
+// "secret" is masked if a pattern has one, otherwise the whole match.
+type detector struct {
+	name     string
+	patterns []*regexp.Regexp
+	// valid filters candidates that look right but fail a checksum
+	valid func(match string) bool
+	// shorter lists the ends of shorter spans to try, longest first, when a
+	// match fails valid. Greedy patterns run on into the text after a
+	// number, e.g. "DE89 3704 0044 0532 0130 00 EUR".
+	shorter func(match string) []int
+}
+
+// redact masks every valid match in s and returns the new string and the match count
+func (d *detector) redact(s string) (string, int) {
+	total := 0
+	for _, re := range d.patterns {
+		var n int
+		s, n = d.redactPattern(re, s)
+		total += n
+	}
+	return s, total
+}
+
+func (d *detector) redactPattern(re *regexp.Regexp, s string) (string, int) {
+	secret := max(re.SubexpIndex("secret"), 0)
+
+	var b strings.Builder
+	last, count := 0, 0
+
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[2*secret], m[2*secret+1]
+		if start < 0 {
+			continue
+		}
+		if d.valid != nil && !d.valid(s[start:end]) {
+			end = d.shorten(s[start:end])
+			if end < 0 {
+				continue
+			}
+			end += start
+		}
+		b.WriteString(s[last:start])
+		b.WriteString("[redacted:" + d.name + "]")
+		last = end
+		count++
+	}
+
+	if count == 0 {
+		return s, 0
+	}
+	b.WriteString(s[last:])
+	return b.String(), count
+}
+
+// shorten returns the end of the longest shorter span of match that passes
+// valid, or -1
+func (d *detector) shorten(match string) int {
+	if d.shorter == nil {
+		return -1
+	}
+	for _, end := range d.shorter(match) {
+		if d.valid(match[:end]) {
+			return end
+		}
+	}
+	return -1
+}
+
+// Built-in detector names
+const (
+	DetectorCreditCard = "credit_card"
+	DetectorSSN        = "ssn"
+	DetectorIBAN       = "iban"
+	DetectorPassword   = "password"
+	DetectorOTP        = "otp"
+)
+
+// otpKeyword names a one-time code. A bare "code" or "pin" is too common to
+// go by, e.g. "zip code 94107".
+const otpKeyword = `(?:verification|security|login|sign[- ]?in|confirmation|authentication|auth|access|one[- ]time|2fa|mfa)\s+(?:code|pin|passcode)|otp|passcode`
+
+// OTPPatterns match a one-time code, which is in the group named "secret".
+// The classifier's built-in one_time_code rule uses them too, so both agree
+// on what a one-time code is.
+var OTPPatterns = []string{
+	`(?i)\b(?:` + otpKeyword + `)\b(?:\s+is)?[\s:]*\b(?P<secret>\d{4,8})\b`,
+	`(?i)\b(?P<secret>\d{4,8})\b\s+is\s+your\b[^\d\n]{0,30}?\b(?:` + otpKeyword + `)\b`,
+}
+
+func mustCompile(patterns ...string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		res[i] = regexp.MustCompile(p)
+	}
+	return res
+}
+
+// builtinDetectors returns the built-in detectors keyed by name
+func builtinDetectors() map[string]*detector {
+	return map[string]*detector{
+		DetectorCreditCard: {
+			name:     DetectorCreditCard,
+			patterns: mustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+			valid:    luhnValid,
+			shorter:  cardSpans,
+		},
+		DetectorSSN: {
+			name:     DetectorSSN,
+			patterns: mustCompile(`\b\d{3}[- ]\d{2}[- ]\d{4}\b`),
+			valid:    ssnValid,
+		},
+		DetectorIBAN: {
+			name:     DetectorIBAN,
+			patterns: mustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`),
+			valid:    ibanValid,
+			shorter:  ibanSpans,
+		},
+		DetectorPassword: {
+			name:     DetectorPassword,
+			patterns: mustCompile(`(?i)\b(?:password|passwd|pwd|passphrase)\s*(?:is\s*)?[:=]\s*(?P<secret>\S+)`),
+		},
+		DetectorOTP: {
+			name:     DetectorOTP,
+			patterns: mustCompile(OTPPatterns...),
+		},
+	}
+}
+
+// DefaultDetectors lists the built-in detectors in the order they are applied
+var DefaultDetectors = []string{
+	DetectorPassword,
+	DetectorIBAN,
+	DetectorCreditCard,
+	DetectorSSN,
+	DetectorOTP,
+}
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// luhnValid checks a candidate card number with the Luhn checksum
+func luhnValid(match string) bool {
+	digits := digitsOnly(match)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// cardSpans returns the ends of the 13 to 19 digit prefixes of a match that
+// stop at a separator, longest first. A number is never cut in the middle of
+// a group of digits.
+func cardSpans(match string) []int {
+	var ends []int
+	digits := 0
+	for i := 0; i < len(match); i++ {
+		if match[i] >= '0' && match[i] <= '9' {
+			digits++
+			continue
+		}
+		if digits >= 13 && digits <= 19 {
+			ends = append([]int{i}, ends...)
+		}
+	}
+	return ends
+}
+
+// ibanLengths is the length of an IBAN in each country that issues them
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22,
+	"BH": 22, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22,
+	"DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24, "FI": 18, "FO": 18, "FR": 27,
+	"GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28, "HR": 21, "HU": 28,
+	"IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "LY": 25, "MC": 27,
+	"MD": 24, "ME": 22, "MK": 19, "MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15,
+	"PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "SA": 24,
+	"SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28, "TL": 23,
+	"TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+// ibanSpans returns the end of the prefix of a match as long as an IBAN of
+// its country, if it stops at a space
+func ibanSpans(match string) []int {
+	length, ok := ibanLengths[match[:2]]
+	if !ok {
+		return nil
+	}
+	chars := 0
+	for i := 0; i < len(match); i++ {
+		if match[i] == ' ' {
+			continue
+		}
+		chars++
+		if chars == length {
+			if i+1 < len(match) && match[i+1] != ' ' {
+				return nil
+			}
+			return []int{i + 1}
+		}
+	}
+	return nil
+}
+
+// ssnValid rejects numbers the SSA never issues
+func ssnValid(match string) bool {
+	digits := digitsOnly(match)
+	if len(digits) != 9 {
+		return false
+	}
+	area, group, serial := digits[:3], digits[3:5], digits[5:]
+	if area == "000" || area == "666" || area[0] == '9' {
+		return false
+	}
+	return group != "00" && serial != "0000"
+}
+
+// ibanValid checks an IBAN with the ISO 13616 mod-97 checksum
+func ibanValid(match string) bool {
+	iban := strings.ReplaceAll(match, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+
+	// Move the country code and check digits to the end, then map letters to numbers
+	rearranged := iban[4:] + iban[:4]
+	var numeric strings.Builder
+	for _, r := range rearranged {
+		switch {
+		case r >= '0' && r <= '9':
+			numeric.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			numeric.WriteString(strconv.Itoa(int(r-'A') + 10))
+		default:
+			return false
+		}
+	}
+
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	if !ok {
+		return false
+	}
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
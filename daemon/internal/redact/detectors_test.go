@@ -0,0 +1,119 @@
+package redact
+
+import (
+	"testing"
+
+	"pkb-daemon/internal/config"
+)
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"378282246310005", true},       // Amex, 15 digits
+		{"6011111111111117", true},      // Discover
+		{"4111111111111112", false},     // check digit off by one
+		{"1234567890123", false},        // 13 digits, bad checksum
+		{"411111111111", false},         // too short
+		{"41111111111111111111", false}, // too long
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.valid {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.valid)
+		}
+	}
+}
+
+func TestSSNValid(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"123-45-6789", true},
+		{"123 45 6789", true},
+		{"000-12-3456", false}, // area 000
+		{"666-12-3456", false}, // area 666
+		{"900-12-3456", false}, // area 9xx
+		{"123-00-4567", false}, // group 00
+		{"123-45-0000", false}, // serial 0000
+		{"123-45-678", false},  // too short
+	}
+	for _, tt := range tests {
+		if got := ssnValid(tt.number); got != tt.valid {
+			t.Errorf("ssnValid(%q) = %v, want %v", tt.number, got, tt.valid)
+		}
+	}
+}
+
+func TestIBANValid(t *testing.T) {
+	tests := []struct {
+		iban  string
+		valid bool
+	}{
+		{"GB82 WEST 1234 5698 7654 32", true},
+		{"GB82WEST12345698765432", true},
+		{"DE89370400440532013000", true},
+		{"NL91ABNA0417164300", true},
+		{"GB82WEST12345698765433", false}, // last digit changed
+		{"GB28WEST12345698765432", false}, // check digits swapped
+		{"DE8937040044", false},           // too short
+		{"GB82-WEST-1234-5698-7654-32", false},
+	}
+	for _, tt := range tests {
+		if got := ibanValid(tt.iban); got != tt.valid {
+			t.Errorf("ibanValid(%q) = %v, want %v", tt.iban, got, tt.valid)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r, err := New(config.RedactionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"card 4111 1111 1111 1111 exp 12/27", "card [redacted:credit_card] exp 12/27"},
+		{"order 4111 1111 1111 1112 shipped", "order 4111 1111 1111 1112 shipped"},
+		{"SSN 123-45-6789", "SSN [redacted:ssn]"},
+		{"pay to GB82 WEST 1234 5698 7654 32 today", "pay to [redacted:iban] today"},
+		// Checksums fail on the whole match when it runs on into the next word
+		{"card 4111 1111 1111 1111 123", "card [redacted:credit_card] 123"},
+		{"IBAN DE89 3704 0044 0532 0130 00 EUR", "IBAN [redacted:iban] EUR"},
+		{"IBAN DE89370400440532013000 BIC COBADEFFXXX", "IBAN [redacted:iban] BIC COBADEFFXXX"},
+		{"password: hunter2", "password: [redacted:password]"},
+		{"Your verification code is 123456", "Your verification code is [redacted:otp]"},
+		{"482913 is your login code", "[redacted:otp] is your login code"},
+		{"zip code 94107", "zip code 94107"},
+		{"code review at 1430", "code review at 1430"},
+	}
+	for _, tt := range tests {
+		text := tt.text
+		r.Redact("imessage", &text)
+		if text != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.text, text, tt.want)
+		}
+	}
+}
+
+func TestReportModeLeavesContent(t *testing.T) {
+	r, err := New(config.RedactionConfig{Mode: string(ModeReport)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := "SSN 123-45-6789, code: none"
+	report := r.Redact("gmail", &text)
+	if text != "SSN 123-45-6789, code: none" {
+		t.Errorf("content changed in report mode: %q", text)
+	}
+	if report[DetectorSSN] != 1 || len(report) != 1 {
+		t.Errorf("report = %v, want one ssn match", report)
+	}
+}
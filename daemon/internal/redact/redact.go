@@ -0,0 +1,129 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+
+	"pkb-daemon/internal/config"
+)
+
+// Mode controls whether matches are masked or only reported
+type Mode string
+
+const (
+	ModeRedact Mode = "redact"
+	ModeReport Mode = "report" // dry run: detect and report without changing content
+)
+
+// Report counts matches per detector
+type Report map[string]int
+
+// Redactor masks sensitive data such as card numbers and passwords
+type Redactor struct {
+	detectors []*detector
+	mode      Mode
+	sources   map[string]config.RedactionSourceConfig
+}
+
+// New builds a redactor from the configured built-in detectors and custom patterns
+func New(cfg config.RedactionConfig) (*Redactor, error) {
+	r := &Redactor{
+		mode:    ModeRedact,
+		sources: cfg.Sources,
+	}
+
+	if cfg.Mode != "" {
+		mode, err := parseMode(cfg.Mode)
+		if err != nil {
+			return nil, err
+		}
+		r.mode = mode
+	}
+	for source, sc := range cfg.Sources {
+		if sc.Mode != "" {
+			if _, err := parseMode(sc.Mode); err != nil {
+				return nil, fmt.Errorf("redaction for %s: %w", source, err)
+			}
+		}
+	}
+
+	names := cfg.Detectors
+	if len(names) == 0 {
+		names = DefaultDetectors
+	}
+	builtins := builtinDetectors()
+	for _, name := range names {
+		d, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction detector %q", name)
+		}
+		r.detectors = append(r.detectors, d)
+	}
+
+	for _, c := range cfg.Custom {
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %s: %w", c.Name, err)
+		}
+		r.detectors = append(r.detectors, &detector{name: c.Name, patterns: []*regexp.Regexp{re}})
+	}
+
+	return r, nil
+}
+
+func parseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case ModeRedact, ModeReport:
+		return Mode(s), nil
+	default:
+		return "", fmt.Errorf("unknown redaction mode %q", s)
+	}
+}
+
+// Mode returns the effective mode for a source, or "" if redaction is disabled for it
+func (r *Redactor) Mode(source string) Mode {
+	sc, ok := r.sources[source]
+	if !ok {
+		return r.mode
+	}
+	if sc.Disabled {
+		return ""
+	}
+	if sc.Mode != "" {
+		return Mode(sc.Mode)
+	}
+	return r.mode
+}
+
+// Redact scans the given fields of an item from a source. In redact mode the
+// fields are masked in place; in report mode they are left untouched. The
+// returned report counts matches per detector either way.
+func (r *Redactor) Redact(source string, fields ...*string) Report {
+	mode := r.Mode(source)
+	if mode == "" {
+		return nil
+	}
+
+	var report Report
+	for _, field := range fields {
+		if field == nil || *field == "" {
+			continue
+		}
+		text := *field
+		for _, d := range r.detectors {
+			redacted, n := d.redact(text)
+			if n == 0 {
+				continue
+			}
+			if report == nil {
+				report = make(Report)
+			}
+			report[d.name] += n
+			text = redacted
+		}
+		if mode == ModeRedact {
+			*field = text
+		}
+	}
+	return report
+}
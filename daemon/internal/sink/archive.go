@@ -0,0 +1,415 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"pkb-daemon/internal/api"
+)
+
+// Archive keeps a local mirror of everything in SQLite. Items are upserted by
+// their source ID, so writing a batch again only updates it. Attachments and
+// contact photos are stored decoded. Communications, notes and events are
+// indexed for full-text search with FTS5, which go-sqlite3 only includes when
+// built with -tags sqlite_fts5.
+type Archive struct {
+	db *sql.DB
+}
+
+// ErrNoFTS5 is returned by OpenArchive when the daemon was built without FTS5
+var ErrNoFTS5 = errors.New("SQLite was built without FTS5, build with -tags sqlite_fts5 (make build)")
+
+// OpenArchive opens or creates the archive database at path. It fails right
+// away with ErrNoFTS5 in builds without FTS5 instead of creating an archive
+// that can't be searched.
+func OpenArchive(path string) (*Archive, error) {
+	if !fts5Built {
+		return nil, ErrNoFTS5
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	if err := initArchive(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize archive: %w", err)
+	}
+	return &Archive{db: db}, nil
+}
+
+// initArchive creates the tables and search indexes. Archives written before
+// the indexes existed are indexed once.
+func initArchive(db *sql.DB) error {
+	var indexed bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name = 'communications_fts')").Scan(&indexed); err != nil {
+		return err
+	}
+	for _, t := range archiveTables {
+		if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.name, t.columns)); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(archiveIndexes); err != nil {
+		return err
+	}
+
+	for _, idx := range searchIndexes {
+		if _, err := db.Exec(idx.schema()); err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("%w: %w", ErrNoFTS5, err)
+			}
+			return err
+		}
+		if !indexed {
+			if _, err := db.Exec(fmt.Sprintf("INSERT INTO %[1]s_fts(%[1]s_fts) VALUES ('rebuild')", idx.table)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveTable is the name and column definitions of an archive table
+type archiveTable struct {
+	name    string
+	columns string
+}
+
+// archiveTables are created in order. Tables with a search index have an
+// explicit id for the index to refer to, which unlike an implicit rowid
+// doesn't change on VACUUM.
+var archiveTables = []archiveTable{
+	{"communications", `
+	id INTEGER PRIMARY KEY,
+	source TEXT NOT NULL,
+	source_id TEXT NOT NULL,
+	thread_id TEXT NOT NULL DEFAULT '',
+	contact_type TEXT NOT NULL,
+	contact_value TEXT NOT NULL,
+	direction TEXT NOT NULL,
+	subject TEXT NOT NULL DEFAULT '',
+	content TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	metadata TEXT NOT NULL DEFAULT '{}',
+	archived_at DATETIME NOT NULL,
+	UNIQUE (source, source_id)`},
+	{"attachments", `
+	source TEXT NOT NULL,
+	source_id TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	filename TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	size_bytes INTEGER NOT NULL,
+	data BLOB,
+	PRIMARY KEY (source, source_id, position),
+	FOREIGN KEY (source, source_id) REFERENCES communications(source, source_id) ON DELETE CASCADE`},
+	{"contacts", `
+	source_id TEXT PRIMARY KEY,
+	display_name TEXT NOT NULL,
+	emails TEXT NOT NULL DEFAULT '[]',
+	phones TEXT NOT NULL DEFAULT '[]',
+	facts TEXT NOT NULL DEFAULT '[]',
+	note TEXT NOT NULL DEFAULT '',
+	photo BLOB,
+	archived_at DATETIME NOT NULL`},
+	{"calendar_events", `
+	id INTEGER PRIMARY KEY,
+	provider TEXT NOT NULL,
+	source_id TEXT NOT NULL,
+	calendar_id TEXT NOT NULL DEFAULT '',
+	title TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	location TEXT NOT NULL DEFAULT '',
+	start_time TEXT NOT NULL,
+	end_time TEXT NOT NULL DEFAULT '',
+	all_day BOOLEAN NOT NULL DEFAULT 0,
+	attendees TEXT NOT NULL DEFAULT '[]',
+	archived_at DATETIME NOT NULL,
+	UNIQUE (provider, source_id)`},
+	{"notes", `
+	id INTEGER PRIMARY KEY,
+	source_id TEXT NOT NULL UNIQUE,
+	title TEXT NOT NULL DEFAULT '',
+	content TEXT NOT NULL DEFAULT '',
+	folder TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL DEFAULT '',
+	updated_at TEXT NOT NULL DEFAULT '',
+	archived_at DATETIME NOT NULL`},
+}
+
+const archiveIndexes = `
+CREATE INDEX IF NOT EXISTS idx_communications_timestamp ON communications(timestamp);
+`
+
+func (a *Archive) Name() string {
+	return "archive"
+}
+
+func (a *Archive) Communications(ctx context.Context, _ string, comms []api.Communication) (*api.BatchUpsertResponse, error) {
+	var result api.BatchUpsertResponse
+	err := a.write(ctx, func(tx *sql.Tx) error {
+		for i, c := range comms {
+			data, err := decodeAttachments(c.Attachments)
+			if err != nil {
+				result.Errors = append(result.Errors, rejected(i, err))
+				continue
+			}
+			metadata := []byte("{}")
+			if len(c.Metadata) > 0 {
+				if metadata, err = json.Marshal(c.Metadata); err != nil {
+					result.Errors = append(result.Errors, rejected(i, err))
+					continue
+				}
+			}
+
+			exists, err := a.exists(ctx, tx, "SELECT EXISTS(SELECT 1 FROM communications WHERE source = ? AND source_id = ?)", c.Source, c.SourceID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO communications (source, source_id, thread_id, contact_type, contact_value, direction, subject, content, timestamp, metadata, archived_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (source, source_id) DO UPDATE SET
+					thread_id = excluded.thread_id,
+					contact_type = excluded.contact_type,
+					contact_value = excluded.contact_value,
+					direction = excluded.direction,
+					subject = excluded.subject,
+					content = excluded.content,
+					timestamp = excluded.timestamp,
+					metadata = excluded.metadata,
+					archived_at = excluded.archived_at`,
+				c.Source, c.SourceID, c.ThreadID, c.ContactIdentifier.Type, c.ContactIdentifier.Value,
+				c.Direction, c.Subject, c.Content, c.Timestamp, string(metadata), time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to archive communication: %w", err)
+			}
+
+			// Attachments are replaced along with their communication
+			if _, err := tx.ExecContext(ctx, "DELETE FROM attachments WHERE source = ? AND source_id = ?", c.Source, c.SourceID); err != nil {
+				return fmt.Errorf("failed to archive attachments: %w", err)
+			}
+			for pos, att := range c.Attachments {
+				_, err := tx.ExecContext(ctx, `
+					INSERT INTO attachments (source, source_id, position, filename, mime_type, size_bytes, data)
+					VALUES (?, ?, ?, ?, ?, ?, ?)`,
+					c.Source, c.SourceID, pos, att.Filename, att.MimeType, att.SizeBytes, data[pos])
+				if err != nil {
+					return fmt.Errorf("failed to archive attachments: %w", err)
+				}
+			}
+
+			if exists {
+				result.Updated++
+			} else {
+				result.Inserted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *Archive) Contacts(ctx context.Context, _ string, contacts []api.ContactImport) (*api.ContactsImportResponse, error) {
+	var result api.ContactsImportResponse
+	err := a.write(ctx, func(tx *sql.Tx) error {
+		for i, c := range contacts {
+			photo, err := decode(c.PhotoData)
+			if err != nil {
+				result.Errors = append(result.Errors, rejected(i, fmt.Errorf("invalid photo: %w", err)))
+				continue
+			}
+
+			exists, err := a.exists(ctx, tx, "SELECT EXISTS(SELECT 1 FROM contacts WHERE source_id = ?)", c.SourceID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO contacts (source_id, display_name, emails, phones, facts, note, photo, archived_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (source_id) DO UPDATE SET
+					display_name = excluded.display_name,
+					emails = excluded.emails,
+					phones = excluded.phones,
+					facts = excluded.facts,
+					note = excluded.note,
+					photo = excluded.photo,
+					archived_at = excluded.archived_at`,
+				c.SourceID, c.DisplayName, jsonList(c.Emails), jsonList(c.Phones), jsonList(c.Facts), c.Note, photo, time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to archive contact: %w", err)
+			}
+
+			if exists {
+				result.Updated++
+			} else {
+				result.Created++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *Archive) CalendarEvents(ctx context.Context, _ string, events []api.CalendarEventImport) (*api.CalendarEventsResponse, error) {
+	var result api.CalendarEventsResponse
+	err := a.write(ctx, func(tx *sql.Tx) error {
+		for _, e := range events {
+			exists, err := a.exists(ctx, tx, "SELECT EXISTS(SELECT 1 FROM calendar_events WHERE provider = ? AND source_id = ?)", e.Provider, e.SourceID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO calendar_events (provider, source_id, calendar_id, title, description, location, start_time, end_time, all_day, attendees, archived_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (provider, source_id) DO UPDATE SET
+					calendar_id = excluded.calendar_id,
+					title = excluded.title,
+					description = excluded.description,
+					location = excluded.location,
+					start_time = excluded.start_time,
+					end_time = excluded.end_time,
+					all_day = excluded.all_day,
+					attendees = excluded.attendees,
+					archived_at = excluded.archived_at`,
+				e.Provider, e.SourceID, e.CalendarID, e.Title, e.Description, e.Location,
+				e.StartTime, e.EndTime, e.AllDay, jsonList(e.Attendees), time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to archive calendar event: %w", err)
+			}
+
+			if exists {
+				result.Updated++
+			} else {
+				result.Inserted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *Archive) Notes(ctx context.Context, _ string, notes []api.AppleNoteImport) (*api.AppleNotesResponse, error) {
+	var result api.AppleNotesResponse
+	err := a.write(ctx, func(tx *sql.Tx) error {
+		for _, n := range notes {
+			exists, err := a.exists(ctx, tx, "SELECT EXISTS(SELECT 1 FROM notes WHERE source_id = ?)", n.SourceID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO notes (source_id, title, content, folder, created_at, updated_at, archived_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (source_id) DO UPDATE SET
+					title = excluded.title,
+					content = excluded.content,
+					folder = excluded.folder,
+					created_at = excluded.created_at,
+					updated_at = excluded.updated_at,
+					archived_at = excluded.archived_at`,
+				n.SourceID, n.Title, n.Content, n.Folder, n.CreatedAt, n.UpdatedAt, time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to archive note: %w", err)
+			}
+
+			if exists {
+				result.Updated++
+			} else {
+				result.Inserted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+// write runs fn in a transaction, so a batch is archived completely or not at all
+func (a *Archive) write(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin archive transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit archive transaction: %w", err)
+	}
+	return nil
+}
+
+func (a *Archive) exists(ctx context.Context, tx *sql.Tx, query string, args ...any) (bool, error) {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to query archive: %w", err)
+	}
+	return exists, nil
+}
+
+// rejected reports an item the archive can't store. It will never succeed,
+// so it is marked as a client error.
+func rejected(index int, err error) api.BatchError {
+	return api.BatchError{Index: index, Error: err.Error(), StatusCode: http.StatusBadRequest}
+}
+
+func decodeAttachments(atts []api.Attachment) ([][]byte, error) {
+	data := make([][]byte, len(atts))
+	for i, att := range atts {
+		d, err := decode(att.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment %q: %w", att.Filename, err)
+		}
+		data[i] = d
+	}
+	return data, nil
+}
+
+// decode returns nil for empty base64 data
+func decode(data string) ([]byte, error) {
+	if data == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// jsonList encodes a list for a TEXT column, with nil as an empty list
+func jsonList[T any](items []T) string {
+	if items == nil {
+		return "[]"
+	}
+	data, _ := json.Marshal(items)
+	return string(data)
+}
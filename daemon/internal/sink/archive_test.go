@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"pkb-daemon/internal/api"
+)
+
+func search(t *testing.T, a *Archive, text string) []Hit {
+	t.Helper()
+	hits, err := a.Search(context.Background(), Query{Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hits
+}
+
+// message returns an inbound iMessage with the given content
+func message(id, content string) api.Communication {
+	return api.Communication{
+		Source:            "imessage",
+		SourceID:          id,
+		ContactIdentifier: api.ContactIdentifier{Type: "phone", Value: "+15551234567"},
+		Direction:         "inbound",
+		Content:           content,
+		Timestamp:         "2024-05-01T12:00:00Z",
+	}
+}
+
+// requireFTS5 skips tests of the archive's contents in builds without FTS5
+func requireFTS5(t *testing.T) {
+	t.Helper()
+	if !fts5Built {
+		t.Skip("the archive needs FTS5; run the tests with -tags sqlite_fts5 (make test)")
+	}
+}
+
+func TestOpenArchiveWithoutFTS5(t *testing.T) {
+	if fts5Built {
+		t.Skip("built with FTS5")
+	}
+	path := filepath.Join(t.TempDir(), "archive.db")
+	if _, err := OpenArchive(path); !errors.Is(err, ErrNoFTS5) {
+		t.Errorf("err = %v, want ErrNoFTS5", err)
+	}
+}
+
+func TestArchiveSearch(t *testing.T) {
+	requireFTS5(t)
+	path := filepath.Join(t.TempDir(), "archive.db")
+	a, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { a.Close() }()
+
+	ctx := context.Background()
+	if _, err := a.Communications(ctx, "imessage", []api.Communication{message("1", "lunch on friday")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Notes(ctx, "notes", []api.AppleNoteImport{{SourceID: "n1", Title: "Groceries", Content: "oat milk"}}); err != nil {
+		t.Fatal(err)
+	}
+	if hits := search(t, a, "lunch"); len(hits) != 1 || hits[0].SourceID != "1" {
+		t.Errorf("lunch: hits = %+v, want communication 1", hits)
+	}
+	if hits := search(t, a, "oat"); len(hits) != 1 || hits[0].Kind != KindNote {
+		t.Errorf("oat: hits = %+v, want note n1", hits)
+	}
+
+	// Upserts keep the id, and the index follows it
+	if _, err := a.Communications(ctx, "imessage", []api.Communication{message("1", "dinner on saturday")}); err != nil {
+		t.Fatal(err)
+	}
+	if hits := search(t, a, "lunch"); len(hits) != 0 {
+		t.Errorf("lunch after update: hits = %+v, want none", hits)
+	}
+	if hits := search(t, a, "dinner"); len(hits) != 1 {
+		t.Errorf("dinner: hits = %+v, want one", hits)
+	}
+
+	// The index survives VACUUM
+	if _, err := a.db.Exec("VACUUM"); err != nil {
+		t.Fatal(err)
+	}
+	if hits := search(t, a, "dinner"); len(hits) != 1 || hits[0].SourceID != "1" {
+		t.Errorf("dinner after vacuum: hits = %+v, want communication 1", hits)
+	}
+
+	// Opening it again keeps the index
+	a.Close()
+	if a, err = OpenArchive(path); err != nil {
+		t.Fatal(err)
+	}
+	if hits := search(t, a, "dinner"); len(hits) != 1 {
+		t.Errorf("dinner after reopening: hits = %+v, want one", hits)
+	}
+}
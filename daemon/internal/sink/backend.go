@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"context"
+
+	"pkb-daemon/internal/api"
+)
+
+// Backend sends everything to the PKB backend
+type Backend struct {
+	client *api.Client
+}
+
+func NewBackend(client *api.Client) *Backend {
+	return &Backend{client: client}
+}
+
+func (b *Backend) Name() string {
+	return "backend"
+}
+
+func (b *Backend) Communications(ctx context.Context, _ string, comms []api.Communication) (*api.BatchUpsertResponse, error) {
+	return b.client.BatchUpsert(ctx, comms)
+}
+
+func (b *Backend) Contacts(ctx context.Context, _ string, contacts []api.ContactImport) (*api.ContactsImportResponse, error) {
+	return b.client.ImportContacts(ctx, contacts)
+}
+
+func (b *Backend) CalendarEvents(ctx context.Context, _ string, events []api.CalendarEventImport) (*api.CalendarEventsResponse, error) {
+	return b.client.ImportCalendarEvents(ctx, events)
+}
+
+func (b *Backend) Notes(ctx context.Context, _ string, notes []api.AppleNoteImport) (*api.AppleNotesResponse, error) {
+	return b.client.ImportAppleNotes(ctx, notes)
+}
+
+func (b *Backend) HealthCheck(ctx context.Context) error {
+	return b.client.HealthCheck(ctx)
+}
+
+func (b *Backend) CircuitOpen() bool {
+	return b.client.CircuitOpen()
+}
+
+func (b *Backend) OnCircuitChange(fn func(open bool)) {
+	b.client.OnCircuitChange(fn)
+}
+
+func (b *Backend) Close() error {
+	return nil
+}
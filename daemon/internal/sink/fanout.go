@@ -0,0 +1,155 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"pkb-daemon/internal/api"
+)
+
+// Fanout writes every batch to several sinks in turn. The response is the
+// first sink's, with the items any other sink rejected added to its errors.
+// A batch one sink failed as a whole fails everywhere, so it is retried on
+// every sink; upserts make that harmless for the backend and the archive.
+type Fanout struct {
+	sinks []Sink
+}
+
+// NewFanout combines sinks, the first of which answers for all of them.
+// A single sink is returned as is.
+func NewFanout(sinks ...Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return &Fanout{sinks: sinks}
+}
+
+func (f *Fanout) Name() string {
+	names := make([]string, len(f.sinks))
+	for i, s := range f.sinks {
+		names[i] = s.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+func (f *Fanout) Communications(ctx context.Context, source string, comms []api.Communication) (*api.BatchUpsertResponse, error) {
+	return fanout(f.sinks, func(s Sink) (*api.BatchUpsertResponse, *[]api.BatchError, error) {
+		resp, err := s.Communications(ctx, source, comms)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp, &resp.Errors, nil
+	})
+}
+
+func (f *Fanout) Contacts(ctx context.Context, source string, contacts []api.ContactImport) (*api.ContactsImportResponse, error) {
+	return fanout(f.sinks, func(s Sink) (*api.ContactsImportResponse, *[]api.BatchError, error) {
+		resp, err := s.Contacts(ctx, source, contacts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp, &resp.Errors, nil
+	})
+}
+
+func (f *Fanout) CalendarEvents(ctx context.Context, source string, events []api.CalendarEventImport) (*api.CalendarEventsResponse, error) {
+	return fanout(f.sinks, func(s Sink) (*api.CalendarEventsResponse, *[]api.BatchError, error) {
+		resp, err := s.CalendarEvents(ctx, source, events)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp, &resp.Errors, nil
+	})
+}
+
+func (f *Fanout) Notes(ctx context.Context, source string, notes []api.AppleNoteImport) (*api.AppleNotesResponse, error) {
+	return fanout(f.sinks, func(s Sink) (*api.AppleNotesResponse, *[]api.BatchError, error) {
+		resp, err := s.Notes(ctx, source, notes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp, &resp.Errors, nil
+	})
+}
+
+// HealthCheck fails if any sink that can be unreachable is
+func (f *Fanout) HealthCheck(ctx context.Context) error {
+	for _, s := range f.sinks {
+		if err := HealthCheck(ctx, s); err != nil {
+			return fmt.Errorf("%s sink: %w", s.Name(), err)
+		}
+	}
+	return nil
+}
+
+// CircuitOpen reports whether any sink refuses batches right now
+func (f *Fanout) CircuitOpen() bool {
+	for _, s := range f.sinks {
+		if b, ok := s.(Breaker); ok && b.CircuitOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fanout) OnCircuitChange(fn func(open bool)) {
+	for _, s := range f.sinks {
+		if b, ok := s.(Breaker); ok {
+			b.OnCircuitChange(fn)
+		}
+	}
+}
+
+func (f *Fanout) Close() error {
+	var errs []error
+	for _, s := range f.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s sink: %w", s.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fanout calls every sink, even after one failed, so a sink that is down
+// doesn't hold back the others
+func fanout[R any](sinks []Sink, call func(s Sink) (*R, *[]api.BatchError, error)) (*R, error) {
+	var first *R
+	var items *[]api.BatchError
+	var errs []error
+	for i, s := range sinks {
+		resp, rejected, err := call(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s sink: %w", s.Name(), err))
+			continue
+		}
+		if i == 0 {
+			first, items = resp, rejected
+			continue
+		}
+		if items != nil {
+			*items = mergeErrors(*items, *rejected, s.Name())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return first, nil
+}
+
+// mergeErrors adds the items another sink rejected, unless already failed
+func mergeErrors(errs, more []api.BatchError, name string) []api.BatchError {
+	failed := make(map[int]bool, len(errs))
+	for _, e := range errs {
+		failed[e.Index] = true
+	}
+	for _, e := range more {
+		if !failed[e.Index] {
+			failed[e.Index] = true
+			e.Error = name + ": " + e.Error
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
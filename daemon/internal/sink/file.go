@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"context"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/export"
+	"pkb-daemon/internal/queue"
+)
+
+// File appends every batch to a JSONL export, one record per batch, in the
+// format "replay" reads. A batch retried after another sink failed is
+// written again.
+type File struct {
+	w *export.Writer
+}
+
+// OpenFile appends to the export at path, or writes to stdout if path is "-"
+func OpenFile(path string) (*File, error) {
+	w, err := export.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{w: w}, nil
+}
+
+func (f *File) Name() string {
+	return "file"
+}
+
+// Records returns how many records were written
+func (f *File) Records() int {
+	return f.w.Records()
+}
+
+// Communications and the other methods count every item as new
+func (f *File) Communications(_ context.Context, source string, comms []api.Communication) (*api.BatchUpsertResponse, error) {
+	if err := f.w.Write(source, queue.RequestTypeBatchUpsert, api.BatchUpsertRequest{Communications: comms}); err != nil {
+		return nil, err
+	}
+	return &api.BatchUpsertResponse{Inserted: len(comms)}, nil
+}
+
+func (f *File) Contacts(_ context.Context, source string, contacts []api.ContactImport) (*api.ContactsImportResponse, error) {
+	if err := f.w.Write(source, queue.RequestTypeImportContacts, api.ContactsImportRequest{Contacts: contacts}); err != nil {
+		return nil, err
+	}
+	return &api.ContactsImportResponse{Created: len(contacts)}, nil
+}
+
+func (f *File) CalendarEvents(_ context.Context, source string, events []api.CalendarEventImport) (*api.CalendarEventsResponse, error) {
+	if err := f.w.Write(source, queue.RequestTypeImportCalendar, api.CalendarEventsRequest{Events: events}); err != nil {
+		return nil, err
+	}
+	return &api.CalendarEventsResponse{Inserted: len(events)}, nil
+}
+
+func (f *File) Notes(_ context.Context, source string, notes []api.AppleNoteImport) (*api.AppleNotesResponse, error) {
+	if err := f.w.Write(source, queue.RequestTypeImportNotes, api.AppleNotesRequest{Notes: notes}); err != nil {
+		return nil, err
+	}
+	return &api.AppleNotesResponse{Inserted: len(notes)}, nil
+}
+
+func (f *File) Close() error {
+	return f.w.Close()
+}
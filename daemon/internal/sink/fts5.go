@@ -0,0 +1,7 @@
+//go:build sqlite_fts5
+
+package sink
+
+// fts5Built reports whether go-sqlite3 was built with FTS5, which the
+// archive's search indexes need
+const fts5Built = true
@@ -0,0 +1,8 @@
+//go:build !sqlite_fts5
+
+package sink
+
+// fts5Built reports whether go-sqlite3 was built with FTS5, which the
+// archive's search indexes need. Build with -tags sqlite_fts5, as the
+// Makefile does, to include it.
+const fts5Built = false
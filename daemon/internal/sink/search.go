@@ -0,0 +1,182 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// searchIndex is an FTS5 index over some columns of an archive table, kept
+// up to date by triggers
+type searchIndex struct {
+	table   string
+	columns []string
+}
+
+var searchIndexes = []searchIndex{
+	{table: "communications", columns: []string{"subject", "content", "contact_value"}},
+	{table: "notes", columns: []string{"title", "content", "folder"}},
+	{table: "calendar_events", columns: []string{"title", "description", "location", "attendees"}},
+}
+
+// schema returns the index and the triggers that follow every write to the table
+func (idx searchIndex) schema() string {
+	cols := strings.Join(idx.columns, ", ")
+	newCols := "new." + strings.Join(idx.columns, ", new.")
+	oldCols := "old." + strings.Join(idx.columns, ", old.")
+	return fmt.Sprintf(`
+	CREATE VIRTUAL TABLE IF NOT EXISTS %[1]s_fts USING fts5(%[2]s, content='%[1]s', content_rowid='id');
+
+	CREATE TRIGGER IF NOT EXISTS %[1]s_fts_insert AFTER INSERT ON %[1]s BEGIN
+		INSERT INTO %[1]s_fts(rowid, %[2]s) VALUES (new.id, %[3]s);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS %[1]s_fts_delete AFTER DELETE ON %[1]s BEGIN
+		INSERT INTO %[1]s_fts(%[1]s_fts, rowid, %[2]s) VALUES ('delete', old.id, %[4]s);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS %[1]s_fts_update AFTER UPDATE ON %[1]s BEGIN
+		INSERT INTO %[1]s_fts(%[1]s_fts, rowid, %[2]s) VALUES ('delete', old.id, %[4]s);
+		INSERT INTO %[1]s_fts(rowid, %[2]s) VALUES (new.id, %[3]s);
+	END;
+	`, idx.table, cols, newCols, oldCols)
+}
+
+// Kinds of search hits
+const (
+	KindCommunication = "communication"
+	KindNote          = "note"
+	KindEvent         = "event"
+)
+
+// Query selects what Search returns. Every set field narrows the results.
+type Query struct {
+	Text  string    // words that must all appear; a trailing * matches a prefix
+	From  string    // name, address or number of the other party; communications only
+	Since time.Time // inclusive
+	Until time.Time // exclusive
+	Limit int
+}
+
+// Hit is an archived item that matched a query
+type Hit struct {
+	Kind      string    `json:"kind"`
+	Source    string    `json:"source"` // source of a communication, folder of a note, provider of an event
+	SourceID  string    `json:"source_id"`
+	Time      time.Time `json:"time"`
+	Title     string    `json:"title,omitempty"`
+	Contact   string    `json:"contact,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Snippet   string    `json:"snippet"`
+}
+
+// Search returns the newest archived communications, notes and events that
+// match q
+func (a *Archive) Search(ctx context.Context, q Query) ([]Hit, error) {
+	match := matchExpr(q.Text)
+	var parts []string
+	var args []any
+
+	// Without search words the start of the text stands in for a snippet
+	snippet := func(table string, col int, text string) string {
+		if match == "" {
+			return fmt.Sprintf("substr(%s, 1, 120)", text)
+		}
+		return fmt.Sprintf("snippet(%s_fts, %d, '[', ']', '…', 16)", table, col)
+	}
+	// filter adds the conditions shared by every kind
+	filter := func(table, timeCol string) string {
+		var where []string
+		if match != "" {
+			where = append(where, table+"_fts MATCH ?")
+			args = append(args, match)
+		}
+		if !q.Since.IsZero() {
+			where = append(where, fmt.Sprintf("julianday(t.%s) >= julianday(?)", timeCol))
+			args = append(args, q.Since.UTC().Format(time.RFC3339))
+		}
+		if !q.Until.IsZero() {
+			where = append(where, fmt.Sprintf("julianday(t.%s) < julianday(?)", timeCol))
+			args = append(args, q.Until.UTC().Format(time.RFC3339))
+		}
+		if len(where) == 0 {
+			return ""
+		}
+		return " WHERE " + strings.Join(where, " AND ")
+	}
+	from := func(table string) string {
+		if match == "" {
+			return table + " t"
+		}
+		return fmt.Sprintf("%[1]s_fts JOIN %[1]s t ON t.id = %[1]s_fts.rowid", table)
+	}
+
+	part := fmt.Sprintf(`SELECT '%s' AS kind, t.source, t.source_id, t.timestamp AS time, t.subject, t.contact_value, t.direction, %s FROM %s`,
+		KindCommunication, snippet("communications", 1, "t.content"), from("communications"))
+	where := filter("communications", "timestamp")
+	if q.From != "" {
+		// The contact matches itself or the name it has in the address book
+		cond := `(t.contact_value LIKE ? OR t.contact_value IN (
+			SELECT e.value FROM contacts c, json_each(c.emails) e WHERE c.display_name LIKE ?
+			UNION SELECT p.value FROM contacts c, json_each(c.phones) p WHERE c.display_name LIKE ?))`
+		pattern := "%" + q.From + "%"
+		args = append(args, pattern, pattern, pattern)
+		if where == "" {
+			where = " WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+	}
+	parts = append(parts, part+where)
+
+	if q.From == "" {
+		parts = append(parts, fmt.Sprintf(`SELECT '%s', t.folder, t.source_id, t.updated_at, t.title, '', '', %s FROM %s`,
+			KindNote, snippet("notes", 1, "t.content"), from("notes"))+filter("notes", "updated_at"))
+		parts = append(parts, fmt.Sprintf(`SELECT '%s', t.provider, t.source_id, t.start_time, t.title, '', '', %s FROM %s`,
+			KindEvent, snippet("calendar_events", 1, "t.description"), from("calendar_events"))+filter("calendar_events", "start_time"))
+	}
+
+	query := "SELECT * FROM (" + strings.Join(parts, " UNION ALL ") + ") ORDER BY julianday(time) DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search archive: %w", err)
+	}
+	defer rows.Close()
+
+	var hits []Hit
+	for rows.Next() {
+		var h Hit
+		var ts string
+		if err := rows.Scan(&h.Kind, &h.Source, &h.SourceID, &ts, &h.Title, &h.Contact, &h.Direction, &h.Snippet); err != nil {
+			return nil, fmt.Errorf("failed to read search result: %w", err)
+		}
+		h.Time, _ = time.Parse(time.RFC3339, ts)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// matchExpr turns search words into an FTS5 query that finds all of them.
+// Each word is quoted so punctuation can't be read as query syntax.
+func matchExpr(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if word == "" {
+			continue
+		}
+		term := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/queue"
+)
+
+// ErrUnknownRequestType is returned by Deliver for a request type it can't send
+var ErrUnknownRequestType = errors.New("unknown request type")
+
+// Sink receives what the sources produce. Items use the backend's shapes, so
+// attachments travel with their communication. Items a sink rejects one by
+// one are reported in the response; an error means the whole batch failed
+// and may be retried. The source is the name of the job that produced the
+// batch and is empty for requests replayed from the queue.
+type Sink interface {
+	Name() string
+	Communications(ctx context.Context, source string, comms []api.Communication) (*api.BatchUpsertResponse, error)
+	Contacts(ctx context.Context, source string, contacts []api.ContactImport) (*api.ContactsImportResponse, error)
+	CalendarEvents(ctx context.Context, source string, events []api.CalendarEventImport) (*api.CalendarEventsResponse, error)
+	Notes(ctx context.Context, source string, notes []api.AppleNoteImport) (*api.AppleNotesResponse, error)
+	Close() error
+}
+
+// Checker is implemented by sinks that can be unreachable, like the backend
+type Checker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// Breaker is implemented by sinks that stop sending while their destination
+// is down
+type Breaker interface {
+	CircuitOpen() bool
+	OnCircuitChange(fn func(open bool))
+}
+
+// HealthCheck checks s if it can be unreachable. Local sinks are always up.
+func HealthCheck(ctx context.Context, s Sink) error {
+	if c, ok := s.(Checker); ok {
+		return c.HealthCheck(ctx)
+	}
+	return nil
+}
+
+// Deliver sends a request stored as a payload, as in the queue or an export.
+// Items the sink rejects individually are reported as an error.
+func Deliver(ctx context.Context, s Sink, source string, reqType queue.RequestType, payload []byte) error {
+	switch reqType {
+	case queue.RequestTypeBatchUpsert:
+		var req api.BatchUpsertRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %w", err)
+		}
+		result, err := s.Communications(ctx, source, req.Communications)
+		if err != nil {
+			return err
+		}
+		return api.CheckItems(result.Errors, len(req.Communications))
+	case queue.RequestTypeImportContacts:
+		var req api.ContactsImportRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %w", err)
+		}
+		result, err := s.Contacts(ctx, source, req.Contacts)
+		if err != nil {
+			return err
+		}
+		return api.CheckItems(result.Errors, len(req.Contacts))
+	case queue.RequestTypeImportCalendar:
+		var req api.CalendarEventsRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %w", err)
+		}
+		result, err := s.CalendarEvents(ctx, source, req.Events)
+		if err != nil {
+			return err
+		}
+		return api.CheckItems(result.Errors, len(req.Events))
+	case queue.RequestTypeImportNotes:
+		var req api.AppleNotesRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %w", err)
+		}
+		result, err := s.Notes(ctx, source, req.Notes)
+		if err != nil {
+			return err
+		}
+		return api.CheckItems(result.Errors, len(req.Notes))
+	default:
+		return ErrUnknownRequestType
+	}
+}
@@ -0,0 +1,203 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/export"
+	"pkb-daemon/internal/queue"
+)
+
+// memorySink records the batches it is given
+type memorySink struct {
+	name     string
+	calls    []string // method and source of every call
+	rejected []api.BatchError
+	err      error
+}
+
+func (m *memorySink) Name() string { return m.name }
+
+func (m *memorySink) record(method, source string) ([]api.BatchError, error) {
+	m.calls = append(m.calls, method+" "+source)
+	return slices.Clone(m.rejected), m.err
+}
+
+func (m *memorySink) Communications(_ context.Context, source string, _ []api.Communication) (*api.BatchUpsertResponse, error) {
+	rejected, err := m.record("communications", source)
+	if err != nil {
+		return nil, err
+	}
+	return &api.BatchUpsertResponse{Errors: rejected}, nil
+}
+
+func (m *memorySink) Contacts(_ context.Context, source string, _ []api.ContactImport) (*api.ContactsImportResponse, error) {
+	rejected, err := m.record("contacts", source)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ContactsImportResponse{Errors: rejected}, nil
+}
+
+func (m *memorySink) CalendarEvents(_ context.Context, source string, _ []api.CalendarEventImport) (*api.CalendarEventsResponse, error) {
+	rejected, err := m.record("calendar", source)
+	if err != nil {
+		return nil, err
+	}
+	return &api.CalendarEventsResponse{Errors: rejected}, nil
+}
+
+func (m *memorySink) Notes(_ context.Context, source string, _ []api.AppleNoteImport) (*api.AppleNotesResponse, error) {
+	rejected, err := m.record("notes", source)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AppleNotesResponse{Errors: rejected}, nil
+}
+
+func (m *memorySink) Close() error { return nil }
+
+// downSink is a sink that can be unreachable and currently is
+type downSink struct {
+	memorySink
+}
+
+func (d *downSink) HealthCheck(context.Context) error { return errors.New("connection refused") }
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		reqType queue.RequestType
+		payload string
+		want    string
+	}{
+		{queue.RequestTypeBatchUpsert, `{"communications":[{"source_id":"m1"}]}`, "communications gmail"},
+		{queue.RequestTypeImportContacts, `{"contacts":[{"source_id":"c1"}]}`, "contacts gmail"},
+		{queue.RequestTypeImportCalendar, `{"events":[{"source_id":"e1"}]}`, "calendar gmail"},
+		{queue.RequestTypeImportNotes, `{"notes":[{"source_id":"n1"}]}`, "notes gmail"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.reqType), func(t *testing.T) {
+			s := &memorySink{name: "memory"}
+			if err := Deliver(context.Background(), s, "gmail", tt.reqType, []byte(tt.payload)); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(s.calls, []string{tt.want}) {
+				t.Errorf("calls = %v, want [%s]", s.calls, tt.want)
+			}
+
+			// Items rejected one by one fail the delivery
+			s.rejected = []api.BatchError{{Index: 0, Error: "invalid"}}
+			var items *api.ItemErrors
+			if err := Deliver(context.Background(), s, "gmail", tt.reqType, []byte(tt.payload)); !errors.As(err, &items) {
+				t.Errorf("err = %v, want the rejected item", err)
+			}
+		})
+	}
+
+	s := &memorySink{name: "memory"}
+	if err := Deliver(context.Background(), s, "", "import_mail", []byte(`{}`)); !errors.Is(err, ErrUnknownRequestType) {
+		t.Errorf("err = %v, want ErrUnknownRequestType", err)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	first := &memorySink{name: "backend", rejected: []api.BatchError{{Index: 1, Error: "invalid"}}}
+	second := &memorySink{name: "archive", rejected: []api.BatchError{{Index: 1, Error: "dup"}, {Index: 2, Error: "too large"}}}
+	f := NewFanout(first, second)
+	if f.Name() != "backend+archive" {
+		t.Errorf("name = %q", f.Name())
+	}
+
+	resp, err := f.Communications(context.Background(), "imessage", make([]api.Communication, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.calls) != 1 || len(second.calls) != 1 {
+		t.Errorf("calls = %v and %v, want one batch each", first.calls, second.calls)
+	}
+	// An item rejected by both is reported once, under the first sink's error
+	want := []api.BatchError{{Index: 1, Error: "invalid"}, {Index: 2, Error: "archive: too large"}}
+	if !slices.Equal(resp.Errors, want) {
+		t.Errorf("errors = %+v, want %+v", resp.Errors, want)
+	}
+
+	// A sink that fails doesn't hold back the others, but the batch fails
+	first.err = errors.New("backend down")
+	if _, err := f.Notes(context.Background(), "notes", nil); err == nil || !strings.Contains(err.Error(), "backend sink: backend down") {
+		t.Errorf("err = %v, want the backend's error", err)
+	}
+	if !slices.Equal(second.calls, []string{"communications imessage", "notes notes"}) {
+		t.Errorf("archive calls = %v", second.calls)
+	}
+
+	if s := NewFanout(first); s != Sink(first) {
+		t.Error("a single sink was wrapped")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	local := &memorySink{name: "archive"}
+	if err := HealthCheck(context.Background(), local); err != nil {
+		t.Errorf("local sink: %v, want always up", err)
+	}
+	down := &downSink{memorySink{name: "backend"}}
+	err := HealthCheck(context.Background(), NewFanout(local, down))
+	if err == nil || !strings.Contains(err.Error(), "backend sink") {
+		t.Errorf("err = %v, want the backend's failure", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.jsonl")
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	resp, err := f.Communications(ctx, "imessage", []api.Communication{{SourceID: "m1"}, {SourceID: "m2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Inserted != 2 {
+		t.Errorf("inserted = %d, want 2", resp.Inserted)
+	}
+	if _, err := f.Contacts(ctx, "contacts", []api.ContactImport{{SourceID: "c1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CalendarEvents(ctx, "calendar", []api.CalendarEventImport{{SourceID: "e1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Notes(ctx, "notes", []api.AppleNoteImport{{SourceID: "n1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Records() != 4 {
+		t.Errorf("records = %d, want 4", f.Records())
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every record can be delivered again, as replay does
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	replayed := &memorySink{name: "memory"}
+	err = export.Read(in, func(_ int, rec export.Record) error {
+		return Deliver(ctx, replayed, rec.Source, rec.Type, rec.Payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"communications imessage", "contacts contacts", "calendar calendar", "notes notes"}
+	if !slices.Equal(replayed.calls, want) {
+		t.Errorf("replayed %v, want %v", replayed.calls, want)
+	}
+}
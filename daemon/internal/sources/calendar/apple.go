@@ -10,6 +10,8 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"pkb-daemon/internal/identity"
 )
 
 // AppleProvider implements CalendarProvider for Apple Calendar via SQLite
@@ -130,7 +132,7 @@ func (p *AppleProvider) getAttendees(db *sql.DB, eventPK int64) ([]string, error
 		var email sql.NullString
 		rows.Scan(&email)
 		if email.Valid && email.String != "" && strings.Contains(email.String, "@") {
-			attendees = append(attendees, strings.ToLower(email.String))
+			attendees = append(attendees, identity.NormalizeEmail(email.String))
 		}
 	}
 	return attendees, nil
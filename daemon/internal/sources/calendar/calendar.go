@@ -2,6 +2,9 @@ package calendar
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"pkb-daemon/internal/config"
@@ -27,32 +30,65 @@ type CalendarProvider interface {
 	GetEvents(ctx context.Context, start, end time.Time) ([]CalendarEvent, error)
 }
 
+// IncrementalProvider is implemented by providers that can fetch only the
+// events changed since a time, including those whose start lies anywhere in
+// the window
+type IncrementalProvider interface {
+	GetEventsUpdatedSince(ctx context.Context, start, end, since time.Time) ([]CalendarEvent, error)
+}
+
+// namedProvider pairs a provider with the key used for its checkpoint and status
+type namedProvider struct {
+	key      string
+	provider CalendarProvider
+}
+
 // Source aggregates multiple calendar providers
 type Source struct {
-	providers     []CalendarProvider
+	providers     []namedProvider
 	lookbackDays  int
 	lookaheadDays int
 }
 
 // New creates a new calendar source with configured providers
 func New(cfg config.CalendarConfig) (*Source, error) {
-	var providers []CalendarProvider
+	var providers []namedProvider
+	seen := make(map[string]int)
 
 	for _, provCfg := range cfg.Providers {
+		var provider CalendarProvider
 		switch provCfg.Type {
 		case "google":
-			provider, err := NewGoogleProvider(provCfg.CredentialsPath, provCfg.TokenPath)
+			account := provCfg.Name
+			if account == "" {
+				account = "google"
+			}
+			p, err := NewGoogleProvider(provCfg.CredentialsPath, provCfg.TokenPath, account)
 			if err != nil {
 				return nil, err
 			}
-			providers = append(providers, provider)
+			provider = p
 		case "apple":
-			provider, err := NewAppleProvider()
+			p, err := NewAppleProvider()
 			if err != nil {
 				return nil, err
 			}
-			providers = append(providers, provider)
+			provider = p
+		default:
+			continue
 		}
+
+		// Provider keys must be unique so each one gets its own checkpoint
+		key := provCfg.Name
+		if key == "" {
+			key = provider.Name()
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s-%d", key, seen[key])
+		}
+
+		providers = append(providers, namedProvider{key: key, provider: provider})
 	}
 
 	return &Source{
@@ -66,21 +102,133 @@ func (s *Source) Name() string {
 	return "calendar"
 }
 
-// Sync fetches events from all providers within the configured time range
-func (s *Source) Sync(ctx context.Context, checkpoint string) ([]CalendarEvent, string, error) {
-	start := time.Now().AddDate(0, 0, -s.lookbackDays)
-	end := time.Now().AddDate(0, 0, s.lookaheadDays)
+// ProviderResult is the outcome of syncing a single provider.
+// Err is set when the provider failed; Events and Checkpoint are then empty.
+type ProviderResult struct {
+	Provider   string
+	Events     []CalendarEvent
+	Checkpoint string
+	Err        error
+}
+
+// SyncResult holds per-provider results so healthy providers can be committed
+// while failing ones are retried on the next cycle
+type SyncResult struct {
+	Providers []ProviderResult
+}
+
+// Failed returns the results of providers that returned an error
+func (r *SyncResult) Failed() []ProviderResult {
+	var failed []ProviderResult
+	for _, p := range r.Providers {
+		if p.Err != nil {
+			failed = append(failed, p)
+		}
+	}
+	return failed
+}
 
-	var allEvents []CalendarEvent
+// Err returns a combined error for all failed providers, or nil if every provider succeeded
+func (r *SyncResult) Err() error {
+	var errs []error
+	for _, p := range r.Failed() {
+		errs = append(errs, fmt.Errorf("provider %s: %w", p.Provider, p.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// Sync fetches events from all providers within the configured time range.
+// checkpoints holds the checkpoint of each provider from its last successful
+// sync; providers that support it only return what changed since then.
+// A failing provider does not stop the others; its error is reported in the result.
+func (s *Source) Sync(ctx context.Context, checkpoints map[string]string) (*SyncResult, error) {
+	result := &SyncResult{}
+
+	for _, np := range s.providers {
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		default:
+		}
 
-	for _, provider := range s.providers {
-		events, err := provider.GetEvents(ctx, start, end)
+		// Taken before fetching, so changes made during the fetch are seen next time
+		now := time.Now()
+		events, err := s.fetch(ctx, np.provider, checkpoints[np.key], now)
 		if err != nil {
-			// Log but continue with other providers
+			result.Providers = append(result.Providers, ProviderResult{
+				Provider: np.key,
+				Err:      err,
+			})
 			continue
 		}
-		allEvents = append(allEvents, events...)
+
+		result.Providers = append(result.Providers, ProviderResult{
+			Provider:   np.key,
+			Events:     events,
+			Checkpoint: now.Format(time.RFC3339),
+		})
+	}
+
+	return result, nil
+}
+
+// fetch returns the events of a provider in the window around now. Without
+// a checkpoint, or if the provider can't fetch incrementally, that is every
+// event in the window.
+func (s *Source) fetch(ctx context.Context, provider CalendarProvider, checkpoint string, now time.Time) ([]CalendarEvent, error) {
+	start := now.AddDate(0, 0, -s.lookbackDays)
+	end := now.AddDate(0, 0, s.lookaheadDays)
+
+	inc, ok := provider.(IncrementalProvider)
+	since, err := time.Parse(time.RFC3339, checkpoint)
+	if !ok || err != nil || since.After(now) {
+		return provider.GetEvents(ctx, start, end)
 	}
 
-	return allEvents, time.Now().Format(time.RFC3339), nil
+	events, err := inc.GetEventsUpdatedSince(ctx, start, end, since)
+	if err != nil {
+		return nil, err
+	}
+
+	// Events that moved into the lookahead window since the last sync weren't
+	// necessarily changed, so that part of the window is fetched in full
+	prevEnd := since.AddDate(0, 0, s.lookaheadDays)
+	if prevEnd.Before(end) {
+		entered, err := provider.GetEvents(ctx, prevEnd, end)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(events))
+		for _, e := range events {
+			seen[e.SourceID] = true
+		}
+		for _, e := range entered {
+			if !seen[e.SourceID] {
+				events = append(events, e)
+			}
+		}
+	}
+	return events, nil
+}
+
+// ParseCheckpoint decodes a source checkpoint into per-provider checkpoints.
+// Checkpoints written before per-provider tracking are plain timestamps and decode to an empty map.
+func ParseCheckpoint(checkpoint string) map[string]string {
+	checkpoints := make(map[string]string)
+	if checkpoint == "" {
+		return checkpoints
+	}
+	if err := json.Unmarshal([]byte(checkpoint), &checkpoints); err != nil {
+		return make(map[string]string)
+	}
+	return checkpoints
+}
+
+// FormatCheckpoint encodes per-provider checkpoints into a single source checkpoint
+func FormatCheckpoint(checkpoints map[string]string) string {
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return ""
+	}
+	return string(data)
 }
@@ -0,0 +1,103 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProvider returns fixed events, or err
+type fakeProvider struct {
+	name   string
+	events []CalendarEvent
+	err    error
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func (p *fakeProvider) GetEvents(context.Context, time.Time, time.Time) ([]CalendarEvent, error) {
+	return p.events, p.err
+}
+
+// incrementalProvider records the time it was asked for changes since
+type incrementalProvider struct {
+	fakeProvider
+	since time.Time
+}
+
+func (p *incrementalProvider) GetEventsUpdatedSince(_ context.Context, _, _, since time.Time) ([]CalendarEvent, error) {
+	p.since = since
+	return p.events[:1], nil
+}
+
+func TestSyncReportsProviderErrors(t *testing.T) {
+	expired := errors.New("oauth2: token expired")
+	s := &Source{providers: []namedProvider{
+		{key: "work", provider: &fakeProvider{name: "google", err: expired}},
+		{key: "apple", provider: &fakeProvider{name: "apple", events: []CalendarEvent{{SourceID: "e1"}}}},
+	}}
+
+	result, err := s.Sync(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Providers) != 2 {
+		t.Fatalf("got %d provider results, want 2", len(result.Providers))
+	}
+
+	work, apple := result.Providers[0], result.Providers[1]
+	if !errors.Is(work.Err, expired) || work.Checkpoint != "" {
+		t.Errorf("work = %+v, want the token error and no checkpoint", work)
+	}
+	if apple.Err != nil || len(apple.Events) != 1 || apple.Checkpoint == "" {
+		t.Errorf("apple = %+v, want its event and a checkpoint", apple)
+	}
+	if failed := result.Failed(); len(failed) != 1 || failed[0].Provider != "work" {
+		t.Errorf("failed = %+v, want work", failed)
+	}
+	if err := result.Err(); !errors.Is(err, expired) || !strings.Contains(err.Error(), "provider work") {
+		t.Errorf("Err() = %v, want the work provider's error", err)
+	}
+}
+
+func TestSyncUsesProviderCheckpoint(t *testing.T) {
+	events := []CalendarEvent{{SourceID: "changed"}, {SourceID: "unchanged"}}
+	p := &incrementalProvider{fakeProvider: fakeProvider{name: "google", events: events}}
+	s := &Source{providers: []namedProvider{{key: "work", provider: p}}, lookaheadDays: 30}
+
+	// Without a checkpoint the whole window is fetched
+	result, err := s.Sync(context.Background(), map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(result.Providers[0].Events); got != 2 || !p.since.IsZero() {
+		t.Errorf("got %d events since %v, want 2 from a full fetch", got, p.since)
+	}
+
+	since := time.Now().Add(-time.Hour).Truncate(time.Second)
+	result, err = s.Sync(context.Background(), map[string]string{"work": since.Format(time.RFC3339)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.since.Equal(since) {
+		t.Errorf("fetched changes since %v, want %v", p.since, since)
+	}
+	// The day that entered the lookahead window is fetched in full, without duplicates
+	if got := len(result.Providers[0].Events); got != 2 {
+		t.Errorf("got %d events, want 2", got)
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	checkpoints := map[string]string{"work": "2024-01-02T03:04:05Z", "apple": "2024-01-02T03:00:00Z"}
+	if got := ParseCheckpoint(FormatCheckpoint(checkpoints)); !maps.Equal(got, checkpoints) {
+		t.Errorf("round trip = %v, want %v", got, checkpoints)
+	}
+	// A checkpoint from before per-provider tracking starts every provider over
+	if got := ParseCheckpoint("2024-01-02T03:04:05Z"); len(got) != 0 {
+		t.Errorf("legacy checkpoint = %v, want empty", got)
+	}
+}
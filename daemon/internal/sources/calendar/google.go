@@ -11,6 +11,9 @@ import (
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/calendar/v3"
 	"google.golang.org/api/option"
+
+	"pkb-daemon/internal/identity"
+	"pkb-daemon/internal/metrics"
 )
 
 // GoogleProvider implements CalendarProvider for Google Calendar
@@ -18,8 +21,9 @@ type GoogleProvider struct {
 	service *calendar.Service
 }
 
-// NewGoogleProvider creates a new Google Calendar provider
-func NewGoogleProvider(credentialsPath, tokenPath string) (*GoogleProvider, error) {
+// NewGoogleProvider creates a new Google Calendar provider. account labels
+// the provider's token expiry metric.
+func NewGoogleProvider(credentialsPath, tokenPath, account string) (*GoogleProvider, error) {
 	ctx := context.Background()
 
 	// Read credentials file
@@ -39,7 +43,9 @@ func NewGoogleProvider(credentialsPath, tokenPath string) (*GoogleProvider, erro
 		return nil, fmt.Errorf("unable to read token file (run 'pkb-daemon oauth gcal' to authenticate): %w", err)
 	}
 
-	client := config.Client(ctx, token)
+	metrics.ObserveToken("calendar", account, token)
+	ts := metrics.TokenSource("calendar", account, config.TokenSource(ctx, token))
+	client := oauth2.NewClient(ctx, ts)
 	service, err := calendar.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, fmt.Errorf("unable to create Calendar service: %w", err)
@@ -53,14 +59,28 @@ func (p *GoogleProvider) Name() string {
 }
 
 func (p *GoogleProvider) GetEvents(ctx context.Context, start, end time.Time) ([]CalendarEvent, error) {
-	events, err := p.service.Events.List("primary").
+	return p.list(ctx, start, end, time.Time{})
+}
+
+// GetEventsUpdatedSince returns the events in the window changed since the
+// given time
+func (p *GoogleProvider) GetEventsUpdatedSince(ctx context.Context, start, end, since time.Time) ([]CalendarEvent, error) {
+	return p.list(ctx, start, end, since)
+}
+
+// list fetches the events in the window, only those updated since the given
+// time unless it is zero
+func (p *GoogleProvider) list(ctx context.Context, start, end, since time.Time) ([]CalendarEvent, error) {
+	call := p.service.Events.List("primary").
 		TimeMin(start.Format(time.RFC3339)).
 		TimeMax(end.Format(time.RFC3339)).
 		SingleEvents(true).
 		OrderBy("startTime").
-		MaxResults(2500).
-		Context(ctx).
-		Do()
+		MaxResults(2500)
+	if !since.IsZero() {
+		call = call.UpdatedMin(since.Format(time.RFC3339))
+	}
+	events, err := call.Context(ctx).Do()
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch Google Calendar events: %w", err)
@@ -68,6 +88,11 @@ func (p *GoogleProvider) GetEvents(ctx context.Context, start, end time.Time) ([
 
 	var result []CalendarEvent
 	for _, e := range events.Items {
+		// updatedMin also returns deleted events
+		if e.Status == "cancelled" {
+			continue
+		}
+
 		event := CalendarEvent{
 			SourceID:    fmt.Sprintf("gcal:%s", e.Id),
 			Provider:    "google",
@@ -94,7 +119,7 @@ func (p *GoogleProvider) GetEvents(ctx context.Context, start, end time.Time) ([
 		// Extract attendee emails
 		for _, att := range e.Attendees {
 			if att.Email != "" && !att.Self {
-				event.Attendees = append(event.Attendees, att.Email)
+				event.Attendees = append(event.Attendees, identity.NormalizeEmail(att.Email))
 			}
 		}
 
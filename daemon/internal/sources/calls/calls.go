@@ -14,14 +14,18 @@ import (
 
 	"pkb-daemon/internal/api"
 	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+	"pkb-daemon/internal/sources"
 )
 
 type Source struct {
-	dbPath    string
-	blocklist *config.BlocklistConfig
+	dbPath string
+	phones *identity.Normalizer
+	since  time.Time // set on backfills only
+	until  time.Time
 }
 
-func New(cfg config.CallsConfig, blocklist config.BlocklistConfig) (*Source, error) {
+func New(cfg config.CallsConfig, phones *identity.Normalizer) (*Source, error) {
 	dbPath := cfg.DBPath
 	if dbPath == "" {
 		home, _ := os.UserHomeDir()
@@ -29,8 +33,8 @@ func New(cfg config.CallsConfig, blocklist config.BlocklistConfig) (*Source, err
 	}
 
 	return &Source{
-		dbPath:    expandPath(dbPath),
-		blocklist: &blocklist,
+		dbPath: expandPath(dbPath),
+		phones: phones,
 	}, nil
 }
 
@@ -38,6 +42,97 @@ func (s *Source) Name() string {
 	return "calls"
 }
 
+func (s *Source) WatchPaths() []string {
+	return []string{s.dbPath, s.dbPath + "-wal"}
+}
+
+// Call types as stored in ZCALLRECORD.ZCALLTYPE
+const (
+	zCallTypeAudio         = 1
+	zCallTypeFaceTimeVideo = 8
+	zCallTypeFaceTimeAudio = 16
+)
+
+// Handle types as stored in ZCALLRECORD.ZHANDLE_TYPE (mirrors CXHandleType)
+const (
+	zHandleTypePhone = 2
+	zHandleTypeEmail = 3
+)
+
+// Disconnect causes as stored in ZCALLRECORD.ZDISCONNECTED_CAUSE
+const (
+	zDisconnectedRejected = 6
+	zDisconnectedBlocked  = 12
+)
+
+// Service providers as stored in ZCALLRECORD.ZSERVICE_PROVIDER
+const (
+	serviceTelephony = "com.apple.Telephony"
+	serviceFaceTime  = "com.apple.FaceTime"
+)
+
+// Normalized call types reported in metadata
+const (
+	CallTypeAudio         = "audio"
+	CallTypeFaceTimeVideo = "facetime_video"
+	CallTypeFaceTimeAudio = "facetime_audio"
+	CallTypeVoIP          = "voip"
+)
+
+// Columns of ZCALLRECORD that older versions of the CallHistory schema lack,
+// in the order Sync scans them
+var newerColumns = []string{
+	"ZCALLTYPE",
+	"ZSERVICE_PROVIDER",
+	"ZHANDLE_TYPE",
+	"ZNAME",
+	"ZISO_COUNTRY_CODE",
+	"ZDISCONNECTED_CAUSE",
+}
+
+// optionalColumns returns the select list of newerColumns, with NULL standing
+// in for the columns the database doesn't have
+func optionalColumns(ctx context.Context, db *sql.DB) (string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info('ZCALLRECORD')")
+	if err != nil {
+		return "", fmt.Errorf("failed to read CallHistory schema: %w", err)
+	}
+	defer rows.Close()
+
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", fmt.Errorf("failed to read CallHistory schema: %w", err)
+		}
+		have[strings.ToUpper(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to read CallHistory schema: %w", err)
+	}
+
+	cols := make([]string, len(newerColumns))
+	for i, col := range newerColumns {
+		if have[col] {
+			cols[i] = col
+		} else {
+			cols[i] = "NULL AS " + col
+		}
+	}
+	return strings.Join(cols, ", "), nil
+}
+
+// Range returns a copy of the source that only fetches calls made within r
+func (s *Source) Range(r sources.Range) (sources.Source, error) {
+	if r.Account != "" {
+		return nil, fmt.Errorf("call history has no accounts")
+	}
+	ranged := *s
+	ranged.since = r.Since
+	ranged.until = r.Until
+	return &ranged, nil
+}
+
 func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.Communication, string, error) {
 	db, err := sql.Open("sqlite3", s.dbPath+"?mode=ro")
 	if err != nil {
@@ -50,21 +145,41 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 		lastRowID, _ = strconv.ParseInt(checkpoint, 10, 64)
 	}
 
+	optional, err := optionalColumns(ctx, db)
+	if err != nil {
+		return nil, checkpoint, err
+	}
+
+	args := []any{lastRowID}
+	dateRange := ""
+	if !s.since.IsZero() {
+		dateRange += " AND ZDATE >= ?"
+		args = append(args, timeToCoreDataTimestamp(s.since))
+	}
+	if !s.until.IsZero() {
+		dateRange += " AND ZDATE < ?"
+		args = append(args, timeToCoreDataTimestamp(s.until))
+	}
+	args = append(args, limit)
+
+	// ZDATE is declared TIMESTAMP, so the driver would turn whole seconds,
+	// which SQLite stores as integers, into a time it can't scan as a float
 	query := `
 		SELECT
 			Z_PK,
 			ZADDRESS,
 			ZDURATION,
-			ZDATE,
+			CAST(ZDATE AS REAL),
 			ZORIGINATED,
-			ZANSWERED
+			ZANSWERED,
+			` + optional + `
 		FROM ZCALLRECORD
-		WHERE Z_PK > ?
+		WHERE Z_PK > ?` + dateRange + `
 		ORDER BY Z_PK ASC
 		LIMIT ?
 	`
 
-	rows, err := db.QueryContext(ctx, query, lastRowID, limit)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, checkpoint, fmt.Errorf("failed to query calls: %w", err)
 	}
@@ -79,8 +194,11 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 		var duration sql.NullFloat64
 		var dateVal sql.NullFloat64
 		var originated, answered sql.NullInt64
+		var callType, handleType, disconnectedCause sql.NullInt64
+		var serviceProvider, name, countryCode sql.NullString
 
-		err := rows.Scan(&pk, &address, &duration, &dateVal, &originated, &answered)
+		err := rows.Scan(&pk, &address, &duration, &dateVal, &originated, &answered,
+			&callType, &serviceProvider, &handleType, &name, &countryCode, &disconnectedCause)
 		if err != nil {
 			continue
 		}
@@ -91,12 +209,9 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 			continue
 		}
 
-		phone := normalizePhone(address.String)
-		if phone == "" {
-			continue
-		}
-
-		if s.isBlocked(phone) {
+		// FaceTime calls can be placed to an Apple ID email instead of a number
+		identifier := s.parseIdentifier(address.String, handleType.Int64)
+		if identifier == nil {
 			continue
 		}
 
@@ -107,31 +222,39 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 			direction = "outbound"
 		}
 
-		status := "missed"
-		if answered.Int64 == 1 {
-			status = "answered"
-		}
+		status := callStatus(answered.Int64 == 1, disconnectedCause)
+		kind := classifyCall(callType, serviceProvider.String)
 
 		durationSecs := int(duration.Float64)
-		content := fmt.Sprintf("%s call", status)
+		content := fmt.Sprintf("%s %s", status, describeCallType(kind))
 		if durationSecs > 0 {
-			content = fmt.Sprintf("%s call, %s", status, formatDuration(durationSecs))
+			content = fmt.Sprintf("%s %s, %s", status, describeCallType(kind), formatDuration(durationSecs))
+		}
+
+		metadata := map[string]interface{}{
+			"duration_seconds": duration.Float64,
+			"status":           status,
+			"call_type":        kind,
+		}
+		if serviceProvider.String != "" {
+			metadata["service_provider"] = serviceProvider.String
+		}
+		// ZNAME is the caller name the phone showed, useful as a hint for unknown contacts
+		if displayName := strings.TrimSpace(name.String); displayName != "" {
+			metadata["display_name"] = displayName
+		}
+		if countryCode.String != "" {
+			metadata["country_code"] = strings.ToUpper(countryCode.String)
 		}
 
 		comm := api.Communication{
-			Source:   "calls",
-			SourceID: fmt.Sprintf("call:%d", pk),
-			ContactIdentifier: api.ContactIdentifier{
-				Type:  "phone",
-				Value: phone,
-			},
-			Direction: direction,
-			Content:   content,
-			Timestamp: timestamp.Format(time.RFC3339),
-			Metadata: map[string]interface{}{
-				"duration_seconds": duration.Float64,
-				"status":           status,
-			},
+			Source:            "calls",
+			SourceID:          fmt.Sprintf("call:%d", pk),
+			ContactIdentifier: *identifier,
+			Direction:         direction,
+			Content:           content,
+			Timestamp:         timestamp.Format(time.RFC3339),
+			Metadata:          metadata,
 		}
 
 		comms = append(comms, comm)
@@ -140,50 +263,90 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 	return comms, newCheckpoint, nil
 }
 
-func (s *Source) isBlocked(phone string) bool {
-	for _, blocked := range s.blocklist.Phones {
-		normalizedBlocked := normalizePhone(blocked)
-		if normalizedBlocked != "" && phone == normalizedBlocked {
-			return true
-		}
-		// Also check partial match (last 10 digits)
-		if len(phone) >= 10 && len(blocked) >= 10 {
-			phoneSuffix := phone[len(phone)-10:]
-			blockedDigits := strings.Map(func(r rune) rune {
-				if r >= '0' && r <= '9' {
-					return r
-				}
-				return -1
-			}, blocked)
-			if len(blockedDigits) >= 10 && phoneSuffix == blockedDigits[len(blockedDigits)-10:] {
-				return true
-			}
-		}
+// NewestItem returns the timestamp of the newest call in the call history
+func (s *Source) NewestItem(ctx context.Context) (time.Time, error) {
+	db, err := sql.Open("sqlite3", s.dbPath+"?mode=ro")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	var date sql.NullFloat64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(ZDATE) FROM ZCALLRECORD").Scan(&date); err != nil {
+		return time.Time{}, err
 	}
-	return false
+	if !date.Valid {
+		return time.Time{}, nil
+	}
+	return coreDataTimestampToTime(date.Float64), nil
 }
 
-func normalizePhone(phone string) string {
-	// Remove all non-digit characters
-	digits := strings.Map(func(r rune) rune {
-		if r >= '0' && r <= '9' {
-			return r
+// parseIdentifier maps a call address to a contact identifier based on its handle type
+func (s *Source) parseIdentifier(address string, handleType int64) *api.ContactIdentifier {
+	address = strings.TrimSpace(address)
+
+	if handleType == zHandleTypeEmail || (handleType != zHandleTypePhone && strings.Contains(address, "@")) {
+		if !strings.Contains(address, "@") {
+			return nil
 		}
-		return -1
-	}, phone)
+		return &api.ContactIdentifier{Type: "email", Value: identity.NormalizeEmail(address)}
+	}
 
-	// Handle US numbers
-	if len(digits) == 10 {
-		return "+1" + digits
+	phone := s.phones.NormalizePhone(address)
+	if phone == "" {
+		return nil
 	}
-	if len(digits) == 11 && digits[0] == '1' {
-		return "+" + digits
+	return &api.ContactIdentifier{Type: "phone", Value: phone}
+}
+
+// classifyCall maps the call type and service provider to a normalized call type
+func classifyCall(callType sql.NullInt64, serviceProvider string) string {
+	switch serviceProvider {
+	case "", serviceTelephony, serviceFaceTime:
+	default:
+		// Anything else is a CallKit app (WhatsApp, Signal, Zoom, ...)
+		return CallTypeVoIP
 	}
-	if len(digits) > 10 {
-		return "+" + digits
+
+	switch callType.Int64 {
+	case zCallTypeFaceTimeVideo:
+		return CallTypeFaceTimeVideo
+	case zCallTypeFaceTimeAudio:
+		return CallTypeFaceTimeAudio
 	}
 
-	return ""
+	if serviceProvider == serviceFaceTime {
+		return CallTypeFaceTimeAudio
+	}
+	return CallTypeAudio
+}
+
+// describeCallType returns a human-readable label for a normalized call type
+func describeCallType(kind string) string {
+	switch kind {
+	case CallTypeFaceTimeVideo:
+		return "FaceTime video call"
+	case CallTypeFaceTimeAudio:
+		return "FaceTime audio call"
+	case CallTypeVoIP:
+		return "VoIP call"
+	default:
+		return "call"
+	}
+}
+
+// callStatus determines whether a call was answered, missed, rejected or blocked
+func callStatus(answered bool, disconnectedCause sql.NullInt64) string {
+	if answered {
+		return "answered"
+	}
+	switch disconnectedCause.Int64 {
+	case zDisconnectedBlocked:
+		return "blocked"
+	case zDisconnectedRejected:
+		return "rejected"
+	}
+	return "missed"
 }
 
 func coreDataTimestampToTime(timestamp float64) time.Time {
@@ -192,6 +355,11 @@ func coreDataTimestampToTime(timestamp float64) time.Time {
 	return coreDataEpoch.Add(time.Duration(timestamp * float64(time.Second)))
 }
 
+func timeToCoreDataTimestamp(t time.Time) float64 {
+	coreDataEpoch := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	return t.Sub(coreDataEpoch).Seconds()
+}
+
 func expandPath(path string) string {
 	if strings.HasPrefix(path, "~") {
 		home, err := os.UserHomeDir()
@@ -0,0 +1,119 @@
+package calls
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+)
+
+const newerSchema = `CREATE TABLE ZCALLRECORD (
+	Z_PK INTEGER PRIMARY KEY, ZADDRESS VARCHAR, ZDURATION FLOAT, ZDATE TIMESTAMP,
+	ZORIGINATED INTEGER, ZANSWERED INTEGER, ZCALLTYPE INTEGER, ZSERVICE_PROVIDER VARCHAR,
+	ZHANDLE_TYPE INTEGER, ZNAME VARCHAR, ZISO_COUNTRY_CODE VARCHAR, ZDISCONNECTED_CAUSE INTEGER
+)`
+
+// olderSchema predates call types, handle types, caller names and disconnect causes
+const olderSchema = `CREATE TABLE ZCALLRECORD (
+	Z_PK INTEGER PRIMARY KEY, ZADDRESS VARCHAR, ZDURATION FLOAT, ZDATE TIMESTAMP,
+	ZORIGINATED INTEGER, ZANSWERED INTEGER
+)`
+
+// newTestSource returns a source reading a call history built from schema and rows
+func newTestSource(t *testing.T, schema string, rows ...string) *Source {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "CallHistory.storedata")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range append([]string{schema}, rows...) {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	phones, err := identity.NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(config.CallsConfig{DBPath: path}, phones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSyncMapsCallRecords(t *testing.T) {
+	s := newTestSource(t, newerSchema,
+		`INSERT INTO ZCALLRECORD VALUES (1, '(415) 555-0100', 95, 700000000, 0, 1, 1, 'com.apple.Telephony', 2, ' Alice ', 'us', 0)`,
+		`INSERT INTO ZCALLRECORD VALUES (2, 'Bob@iCloud.com', 30, 700000100, 1, 1, 8, 'com.apple.FaceTime', 3, '', NULL, 0)`,
+		`INSERT INTO ZCALLRECORD VALUES (3, '+14155550101', 0, 700000200, 0, 0, 1, 'com.apple.Telephony', 2, NULL, NULL, 12)`,
+		`INSERT INTO ZCALLRECORD VALUES (4, '+14155550102', 0, 700000300, 0, 0, 16, 'com.apple.FaceTime', 2, NULL, NULL, 6)`,
+		`INSERT INTO ZCALLRECORD VALUES (5, '+14155550103', 60, 700000400, 1, 1, 1, 'net.whatsapp.WhatsApp', 2, NULL, NULL, 0)`,
+	)
+	comms, checkpoint, err := s.Sync(context.Background(), "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != "5" || len(comms) != 5 {
+		t.Fatalf("got %d calls up to %q, want 5 up to 5", len(comms), checkpoint)
+	}
+
+	tests := []struct {
+		idType, idValue string
+		callType        string
+		status          string
+		displayName     any
+		content         string
+	}{
+		{"phone", "+14155550100", CallTypeAudio, "answered", "Alice", "answered call, 1m 35s"},
+		{"email", "bob@icloud.com", CallTypeFaceTimeVideo, "answered", nil, "answered FaceTime video call, 30s"},
+		{"phone", "+14155550101", CallTypeAudio, "blocked", nil, "blocked call"},
+		{"phone", "+14155550102", CallTypeFaceTimeAudio, "rejected", nil, "rejected FaceTime audio call"},
+		{"phone", "+14155550103", CallTypeVoIP, "answered", nil, "answered VoIP call, 1m"},
+	}
+	for i, tt := range tests {
+		c := comms[i]
+		if c.ContactIdentifier.Type != tt.idType || c.ContactIdentifier.Value != tt.idValue {
+			t.Errorf("call %d: identifier = %+v, want %s %s", i+1, c.ContactIdentifier, tt.idType, tt.idValue)
+		}
+		if c.Metadata["call_type"] != tt.callType || c.Metadata["status"] != tt.status {
+			t.Errorf("call %d: %v %v, want %s %s", i+1, c.Metadata["status"], c.Metadata["call_type"], tt.status, tt.callType)
+		}
+		if c.Metadata["display_name"] != tt.displayName {
+			t.Errorf("call %d: display_name = %v, want %v", i+1, c.Metadata["display_name"], tt.displayName)
+		}
+		if c.Content != tt.content {
+			t.Errorf("call %d: content = %q, want %q", i+1, c.Content, tt.content)
+		}
+	}
+	if comms[0].Metadata["country_code"] != "US" {
+		t.Errorf("country_code = %v, want US", comms[0].Metadata["country_code"])
+	}
+}
+
+func TestSyncOlderSchema(t *testing.T) {
+	s := newTestSource(t, olderSchema,
+		`INSERT INTO ZCALLRECORD VALUES (1, '+14155550100', 95, 700000000, 0, 1)`,
+		`INSERT INTO ZCALLRECORD VALUES (2, 'bob@icloud.com', 0, 700000100, 1, 0)`,
+	)
+	comms, _, err := s.Sync(context.Background(), "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comms) != 2 {
+		t.Fatalf("got %d calls, want 2", len(comms))
+	}
+	if comms[0].Metadata["call_type"] != CallTypeAudio || comms[0].Metadata["status"] != "answered" {
+		t.Errorf("call 1 metadata = %v", comms[0].Metadata)
+	}
+	// Without a handle type an address with @ is an email
+	if comms[1].ContactIdentifier.Type != "email" || comms[1].Metadata["status"] != "missed" {
+		t.Errorf("call 2 = %+v", comms[1])
+	}
+}
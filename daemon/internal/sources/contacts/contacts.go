@@ -15,14 +15,16 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
 )
 
 type Source struct {
 	dbPath       string
 	importPhotos bool
+	phones       *identity.Normalizer
 }
 
-func New(cfg config.ContactsConfig) (*Source, error) {
+func New(cfg config.ContactsConfig, phones *identity.Normalizer) (*Source, error) {
 	// Default AddressBook database path
 	home, _ := os.UserHomeDir()
 	dbPath := filepath.Join(home, "Library/Application Support/AddressBook/AddressBook-v22.abcddb")
@@ -30,6 +32,7 @@ func New(cfg config.ContactsConfig) (*Source, error) {
 	return &Source{
 		dbPath:       dbPath,
 		importPhotos: cfg.ImportPhotos,
+		phones:       phones,
 	}, nil
 }
 
@@ -37,6 +40,10 @@ func (s *Source) Name() string {
 	return "contacts"
 }
 
+func (s *Source) WatchPaths() []string {
+	return []string{s.dbPath, s.dbPath + "-wal"}
+}
+
 // ContactImport represents a contact to be imported
 type ContactImport struct {
 	SourceID    string
@@ -148,12 +155,12 @@ func (s *Source) syncContactsViaAppleScript(ctx context.Context) ([]ContactImpor
 
 		// Normalize emails
 		for _, email := range c.Emails {
-			contact.Emails = append(contact.Emails, strings.ToLower(email))
+			contact.Emails = append(contact.Emails, identity.NormalizeEmail(email))
 		}
 
 		// Normalize phones
 		for _, phone := range c.Phones {
-			normalized := normalizePhone(phone)
+			normalized := s.phones.NormalizePhone(phone)
 			if normalized != "" {
 				contact.Phones = append(contact.Phones, normalized)
 			}
@@ -285,7 +292,7 @@ func (s *Source) getEmails(db *sql.DB, recordPK int64) ([]string, error) {
 		var email sql.NullString
 		rows.Scan(&email)
 		if email.Valid && email.String != "" {
-			emails = append(emails, strings.ToLower(email.String))
+			emails = append(emails, identity.NormalizeEmail(email.String))
 		}
 	}
 	return emails, nil
@@ -305,7 +312,7 @@ func (s *Source) getPhones(db *sql.DB, recordPK int64) ([]string, error) {
 		var phone sql.NullString
 		rows.Scan(&phone)
 		if phone.Valid && phone.String != "" {
-			normalized := normalizePhone(phone.String)
+			normalized := s.phones.NormalizePhone(phone.String)
 			if normalized != "" {
 				phones = append(phones, normalized)
 			}
@@ -325,29 +332,6 @@ func (s *Source) getPhoto(db *sql.DB, recordPK int64) ([]byte, error) {
 	return data, nil
 }
 
-func normalizePhone(phone string) string {
-	// Remove all non-digit characters
-	digits := strings.Map(func(r rune) rune {
-		if r >= '0' && r <= '9' {
-			return r
-		}
-		return -1
-	}, phone)
-
-	// Handle US numbers
-	if len(digits) == 10 {
-		return "+1" + digits
-	}
-	if len(digits) == 11 && digits[0] == '1' {
-		return "+" + digits
-	}
-	if len(digits) > 10 {
-		return "+" + digits
-	}
-
-	return ""
-}
-
 func coreDataTimestampToTime(timestamp float64) time.Time {
 	// Core Data timestamps are seconds since 2001-01-01
 	coreDataEpoch := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
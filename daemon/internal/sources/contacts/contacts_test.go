@@ -0,0 +1,86 @@
+package contacts
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"pkb-daemon/internal/identity"
+)
+
+const addressBookSchema = `
+CREATE TABLE ZABCDRECORD (Z_PK INTEGER PRIMARY KEY, ZFIRSTNAME VARCHAR, ZLASTNAME VARCHAR,
+	ZORGANIZATION VARCHAR, ZJOBTITLE VARCHAR, ZBIRTHDAY TIMESTAMP, ZNOTE VARCHAR);
+CREATE TABLE ZABCDEMAILADDRESS (Z_PK INTEGER PRIMARY KEY, ZOWNER INTEGER, ZADDRESS VARCHAR);
+CREATE TABLE ZABCDPHONENUMBER (Z_PK INTEGER PRIMARY KEY, ZOWNER INTEGER, ZFULLNUMBER VARCHAR);
+CREATE TABLE ZABCDIMAGE (Z_PK INTEGER PRIMARY KEY, ZRECORD INTEGER, ZDATA BLOB);
+`
+
+// newTestSource returns a source reading an address book built from rows
+func newTestSource(t *testing.T, rows ...string) *Source {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "AddressBook-v22.abcddb")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range append([]string{addressBookSchema}, rows...) {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	phones, err := identity.NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Source{dbPath: path, phones: phones}
+}
+
+func TestSyncContactsViaSQLite(t *testing.T) {
+	s := newTestSource(t,
+		`INSERT INTO ZABCDRECORD VALUES (1, 'Ann', 'Lee', 'Acme', 'Engineer', NULL, 'met at conf')`,
+		`INSERT INTO ZABCDEMAILADDRESS VALUES (1, 1, 'Ann.Lee@Example.com')`,
+		`INSERT INTO ZABCDPHONENUMBER VALUES (1, 1, '(415) 555-0100')`,
+		`INSERT INTO ZABCDPHONENUMBER VALUES (2, 1, 'not a number')`,
+		// Named by their organization only
+		`INSERT INTO ZABCDRECORD VALUES (2, NULL, NULL, 'Dentist', NULL, NULL, NULL)`,
+		`INSERT INTO ZABCDPHONENUMBER VALUES (3, 2, '+1 415 555 0199')`,
+		// Nothing to match them by
+		`INSERT INTO ZABCDRECORD VALUES (3, 'Bob', NULL, NULL, NULL, NULL, NULL)`,
+	)
+	imports, err := s.syncContactsViaSQLite(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imports) != 2 {
+		t.Fatalf("got %d contacts, want 2: %+v", len(imports), imports)
+	}
+
+	ann := imports[0]
+	if ann.SourceID != "ab:1" || ann.DisplayName != "Ann Lee" || ann.Note != "met at conf" {
+		t.Errorf("ann = %+v", ann)
+	}
+	// The allowlist matches people by these, so they are normalized like communications
+	if !slices.Equal(ann.Emails, []string{"ann.lee@example.com"}) || !slices.Equal(ann.Phones, []string{"+14155550100"}) {
+		t.Errorf("ann: emails %v, phones %v", ann.Emails, ann.Phones)
+	}
+	if !slices.Contains(ann.Facts, Fact{Type: "company", Value: "Acme"}) || !slices.Contains(ann.Facts, Fact{Type: "job_title", Value: "Engineer"}) {
+		t.Errorf("ann: facts %v", ann.Facts)
+	}
+
+	dentist := imports[1]
+	if dentist.DisplayName != "Dentist" || !slices.Equal(dentist.Phones, []string{"+14155550199"}) {
+		t.Errorf("dentist = %+v", dentist)
+	}
+}
+
+func TestWatchPaths(t *testing.T) {
+	s := &Source{dbPath: "/Users/ann/AddressBook-v22.abcddb"}
+	if got := s.WatchPaths(); !slices.Equal(got, []string{"/Users/ann/AddressBook-v22.abcddb", "/Users/ann/AddressBook-v22.abcddb-wal"}) {
+		t.Errorf("WatchPaths() = %v", got)
+	}
+}
@@ -11,12 +11,15 @@ import (
 
 	"pkb-daemon/internal/api"
 	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+	"pkb-daemon/internal/sources"
 )
 
 type Source struct {
 	accounts  []*Account
 	startDate time.Time
-	blocklist *config.BlocklistConfig
+	until     time.Time // set on backfills only
+	ranged    bool      // set on backfills, which end after one pass
 	exclude   map[string]bool
 }
 
@@ -26,11 +29,11 @@ type Account struct {
 	userEmail string
 }
 
-func New(cfg config.GmailConfig, blocklist config.BlocklistConfig) (*Source, error) {
+func New(cfg config.GmailConfig) (*Source, error) {
 	var accounts []*Account
 
 	for _, acctCfg := range cfg.Accounts {
-		service, err := createGmailService(acctCfg.CredentialsPath, acctCfg.TokenPath)
+		service, err := createGmailService(acctCfg.CredentialsPath, acctCfg.TokenPath, acctCfg.Name)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create Gmail service for %s: %w", acctCfg.Name, err)
 		}
@@ -61,7 +64,6 @@ func New(cfg config.GmailConfig, blocklist config.BlocklistConfig) (*Source, err
 	return &Source{
 		accounts:  accounts,
 		startDate: startDate,
-		blocklist: &blocklist,
 		exclude:   exclude,
 	}, nil
 }
@@ -70,7 +72,38 @@ func (s *Source) Name() string {
 	return "gmail"
 }
 
+// Range returns a copy of the source that only fetches messages received
+// within r, from a single account if r names one
+func (s *Source) Range(r sources.Range) (sources.Source, error) {
+	ranged := *s
+	if !r.Since.IsZero() {
+		ranged.startDate = r.Since
+	}
+	ranged.until = r.Until
+	ranged.ranged = true
+
+	if r.Account != "" {
+		ranged.accounts = nil
+		for _, acct := range s.accounts {
+			if acct.name == r.Account {
+				ranged.accounts = []*Account{acct}
+			}
+		}
+		if ranged.accounts == nil {
+			return nil, fmt.Errorf("unknown Gmail account %q", r.Account)
+		}
+	}
+	return &ranged, nil
+}
+
+// doneCheckpoint marks a backfill that has listed every account
+const doneCheckpoint = "done"
+
 func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.Communication, string, error) {
+	if checkpoint == doneCheckpoint {
+		return nil, checkpoint, nil
+	}
+
 	// Parse checkpoint: "accountName:pageToken"
 	currentAccount, pageToken := parseCheckpoint(checkpoint)
 
@@ -112,22 +145,33 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 		} else if i+1 < len(s.accounts) {
 			// Move to next account
 			newCheckpoint = fmt.Sprintf("%s:", s.accounts[i+1].name)
+		} else if s.ranged {
+			// All accounts done; the checkpoint stays put from now on
+			newCheckpoint = doneCheckpoint
 		} else {
-			// All accounts done
-			newCheckpoint = checkpoint
+			// All accounts done; the next sync lists the newest messages again
+			newCheckpoint = ""
 		}
 	}
 
 	return comms, newCheckpoint, nil
 }
 
-func (s *Source) syncAccount(ctx context.Context, acct *Account, pageToken string, limit int) ([]api.Communication, string, error) {
-	query := ""
+// query returns the Gmail search query that limits listed messages to the
+// source's date range
+func (s *Source) query() string {
+	var terms []string
 	if !s.startDate.IsZero() {
-		query = fmt.Sprintf("after:%s", s.startDate.Format("2006/01/02"))
+		terms = append(terms, fmt.Sprintf("after:%s", s.startDate.Format("2006/01/02")))
+	}
+	if !s.until.IsZero() {
+		terms = append(terms, fmt.Sprintf("before:%s", s.until.Format("2006/01/02")))
 	}
+	return strings.Join(terms, " ")
+}
 
-	req := acct.service.Users.Messages.List("me").Q(query).MaxResults(int64(limit))
+func (s *Source) syncAccount(ctx context.Context, acct *Account, pageToken string, limit int) ([]api.Communication, string, error) {
+	req := acct.service.Users.Messages.List("me").Q(s.query()).MaxResults(int64(limit))
 	if pageToken != "" {
 		req = req.PageToken(pageToken)
 	}
@@ -162,10 +206,6 @@ func (s *Source) syncAccount(ctx context.Context, acct *Account, pageToken strin
 			continue
 		}
 
-		if s.isBlocked(comm.ContactIdentifier.Value) {
-			continue
-		}
-
 		comms = append(comms, *comm)
 	}
 
@@ -187,14 +227,16 @@ func (s *Source) parseMessage(msg *gmail.Message, acct *Account) (*api.Communica
 	toEmail := parseEmailAddress(to)
 
 	var direction string
-	var contactEmail string
+	var contactEmail, contactName string
 
 	if strings.EqualFold(fromEmail, acct.userEmail) {
 		direction = "outbound"
 		contactEmail = toEmail
+		contactName = parseDisplayName(to)
 	} else {
 		direction = "inbound"
 		contactEmail = fromEmail
+		contactName = parseDisplayName(from)
 	}
 
 	// Parse body
@@ -203,23 +245,31 @@ func (s *Source) parseMessage(msg *gmail.Message, acct *Account) (*api.Communica
 	// Parse timestamp
 	timestamp := time.Unix(msg.InternalDate/1000, 0)
 
+	metadata := map[string]interface{}{
+		"account": acct.name,
+		"labels":  msg.LabelIds,
+		"snippet": msg.Snippet,
+	}
+	if contactName != "" {
+		metadata["display_name"] = contactName
+	}
+	if bulk := bulkHeaders(headers); len(bulk) > 0 {
+		metadata["headers"] = bulk
+	}
+
 	return &api.Communication{
 		Source:   "gmail",
 		SourceID: fmt.Sprintf("%s:%s", acct.name, msg.Id),
 		ContactIdentifier: api.ContactIdentifier{
 			Type:  "email",
-			Value: strings.ToLower(contactEmail),
+			Value: identity.NormalizeEmail(contactEmail),
 		},
 		Direction: direction,
 		Subject:   headers["subject"],
 		Content:   body,
 		Timestamp: timestamp.Format(time.RFC3339),
 		ThreadID:  msg.ThreadId,
-		Metadata: map[string]interface{}{
-			"account": acct.name,
-			"labels":  msg.LabelIds,
-			"snippet": msg.Snippet,
-		},
+		Metadata:  metadata,
 	}, nil
 }
 
@@ -288,6 +338,34 @@ func parseEmailAddress(addr string) string {
 	return strings.TrimSpace(addr)
 }
 
+// bulkHeaderNames are headers that identify mailing lists and automated mail
+var bulkHeaderNames = []string{
+	"list-unsubscribe",
+	"list-id",
+	"precedence",
+	"auto-submitted",
+	"x-auto-response-suppress",
+}
+
+// bulkHeaders returns the subset of headers used to classify automated mail
+func bulkHeaders(headers map[string]string) map[string]string {
+	result := make(map[string]string)
+	for _, name := range bulkHeaderNames {
+		if v, ok := headers[name]; ok {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+// parseDisplayName extracts the name from a "Name <email@example.com>" address
+func parseDisplayName(addr string) string {
+	if start := strings.Index(addr, "<"); start > 0 {
+		return strings.Trim(strings.TrimSpace(addr[:start]), `"`)
+	}
+	return ""
+}
+
 func parseCheckpoint(checkpoint string) (account, pageToken string) {
 	if checkpoint == "" {
 		return "", ""
@@ -298,12 +376,3 @@ func parseCheckpoint(checkpoint string) (account, pageToken string) {
 	}
 	return parts[0], ""
 }
-
-func (s *Source) isBlocked(email string) bool {
-	for _, blocked := range s.blocklist.Emails {
-		if strings.EqualFold(email, blocked) {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,208 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+
+	"pkb-daemon/internal/sources"
+)
+
+// message returns a Gmail message with the given headers and a plain text body
+func message(id string, headers ...string) *gmail.Message {
+	msg := &gmail.Message{
+		Id:           id,
+		ThreadId:     "t-" + id,
+		InternalDate: 1714564800000,
+		Payload:      &gmail.MessagePart{Body: &gmail.MessagePartBody{Data: "aGk="}},
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		msg.Payload.Headers = append(msg.Payload.Headers, &gmail.MessagePartHeader{Name: headers[i], Value: headers[i+1]})
+	}
+	return msg
+}
+
+func TestParseMessage(t *testing.T) {
+	s := &Source{}
+	acct := &Account{name: "personal", userEmail: "me@example.com"}
+	tests := []struct {
+		name        string
+		msg         *gmail.Message
+		direction   string
+		contact     string
+		displayName string
+	}{
+		{"inbound", message("1", "From", `"Ann Lee" <Ann@Example.com>`, "To", "me@example.com"), "inbound", "ann@example.com", "Ann Lee"},
+		{"outbound", message("2", "From", "Me <ME@example.com>", "To", "Bob <bob@example.com>"), "outbound", "bob@example.com", "Bob"},
+		{"bare address", message("3", "From", "carol@example.com", "To", "me@example.com"), "inbound", "carol@example.com", ""},
+	}
+	for _, tt := range tests {
+		comm, err := s.parseMessage(tt.msg, acct)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if comm.Direction != tt.direction || comm.ContactIdentifier.Type != "email" || comm.ContactIdentifier.Value != tt.contact {
+			t.Errorf("%s: %s %+v, want %s %s", tt.name, comm.Direction, comm.ContactIdentifier, tt.direction, tt.contact)
+		}
+		if name, _ := comm.Metadata["display_name"].(string); name != tt.displayName {
+			t.Errorf("%s: display name = %q, want %q", tt.name, name, tt.displayName)
+		}
+		if comm.SourceID != "personal:"+tt.msg.Id || comm.Content != "hi" {
+			t.Errorf("%s: source ID %q, content %q", tt.name, comm.SourceID, comm.Content)
+		}
+	}
+}
+
+func TestParseDisplayName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"Ann Lee <ann@example.com>", "Ann Lee"},
+		{`"Lee, Ann" <ann@example.com>`, "Lee, Ann"},
+		{"<ann@example.com>", ""},
+		{"ann@example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := parseDisplayName(tt.addr); got != tt.want {
+			t.Errorf("parseDisplayName(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// page is one page of a fake account's message list
+type page struct {
+	ids  []string
+	next string
+}
+
+// newTestAccount returns an account served by a fake Gmail API that lists
+// pages by page token, and records the search queries it is sent
+func newTestAccount(t *testing.T, name string, pages map[string]page) (*Account, *[]string) {
+	t.Helper()
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutPrefix(r.URL.Path, "/gmail/v1/users/me/messages/"); ok {
+			json.NewEncoder(w).Encode(message(id, "From", "ann@example.com", "To", name+"@example.com"))
+			return
+		}
+		queries = append(queries, r.URL.Query().Get("q"))
+		p := pages[r.URL.Query().Get("pageToken")]
+		resp := gmail.ListMessagesResponse{NextPageToken: p.next}
+		for _, id := range p.ids {
+			resp.Messages = append(resp.Messages, &gmail.Message{Id: id})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	service, err := gmail.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Account{name: name, service: service, userEmail: name + "@example.com"}, &queries
+}
+
+func TestQuery(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	tests := []struct {
+		name      string
+		startDate time.Time
+		r         sources.Range
+		want      string
+	}{
+		{"everything", time.Time{}, sources.Range{}, ""},
+		{"start date", day("2023-01-01"), sources.Range{}, "after:2023/01/01"},
+		{"range", day("2023-01-01"), sources.Range{Since: day("2024-01-01"), Until: day("2024-06-30")}, "after:2024/01/01 before:2024/06/30"},
+		{"until only", day("2023-01-01"), sources.Range{Until: day("2024-06-30")}, "after:2023/01/01 before:2024/06/30"},
+		{"open start", time.Time{}, sources.Range{Until: day("2024-06-30")}, "before:2024/06/30"},
+	}
+	for _, tt := range tests {
+		s := &Source{startDate: tt.startDate}
+		ranged, err := s.Range(tt.r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := ranged.(*Source).query(); got != tt.want {
+			t.Errorf("%s: query = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRangeAccount(t *testing.T) {
+	s := &Source{accounts: []*Account{{name: "personal"}, {name: "work"}}}
+	ranged, err := s.Range(sources.Range{Account: "work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accounts := ranged.(*Source).accounts; len(accounts) != 1 || accounts[0].name != "work" {
+		t.Errorf("accounts = %v, want only work", accounts)
+	}
+	if len(s.accounts) != 2 {
+		t.Error("Range changed the source it was called on")
+	}
+	if _, err := s.Range(sources.Range{Account: "school"}); err == nil {
+		t.Error("Range of an unknown account succeeded")
+	}
+}
+
+func TestSyncCheckpoints(t *testing.T) {
+	pages := map[string]page{
+		"":    {ids: []string{"p1", "p2"}, next: "tok"},
+		"tok": {ids: []string{"p3"}},
+	}
+	type step struct {
+		want       int
+		checkpoint string
+	}
+	tests := []struct {
+		name   string
+		ranged bool
+		steps  []step
+	}{
+		// Each sync picks up where the last stopped, across accounts, and a
+		// finished pass starts over from the newest messages
+		{"live", false, []step{{2, "personal:tok"}, {2, ""}, {2, "personal:tok"}}},
+		// A finished backfill returns the checkpoint it was given, which is
+		// how it knows it is done
+		{"ranged", true, []step{{2, "personal:tok"}, {2, "done"}, {0, "done"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			personal, queries := newTestAccount(t, "personal", pages)
+			work, _ := newTestAccount(t, "work", map[string]page{"": {ids: []string{"w1"}}})
+			var src sources.Source = &Source{accounts: []*Account{personal, work}}
+			if tt.ranged {
+				var err error
+				if src, err = src.(*Source).Range(sources.Range{Until: time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			checkpoint := ""
+			for i, step := range tt.steps {
+				comms, next, err := src.Sync(context.Background(), checkpoint, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(comms) != step.want || next != step.checkpoint {
+					t.Errorf("sync %d: %d messages up to %q, want %d up to %q", i+1, len(comms), next, step.want, step.checkpoint)
+				}
+				checkpoint = next
+			}
+			if tt.ranged && (*queries)[0] != "before:2024/06/30" {
+				t.Errorf("queries = %q, want the range", *queries)
+			}
+		})
+	}
+}
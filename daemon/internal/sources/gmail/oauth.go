@@ -11,10 +11,13 @@ import (
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
+
+	"pkb-daemon/internal/metrics"
 )
 
-// createGmailService creates a Gmail service using stored OAuth credentials
-func createGmailService(credentialsPath, tokenPath string) (*gmail.Service, error) {
+// createGmailService creates a Gmail service using stored OAuth credentials.
+// account labels the token expiry metric.
+func createGmailService(credentialsPath, tokenPath, account string) (*gmail.Service, error) {
 	ctx := context.Background()
 
 	// Read credentials file
@@ -34,7 +37,9 @@ func createGmailService(credentialsPath, tokenPath string) (*gmail.Service, erro
 		return nil, fmt.Errorf("unable to read token file (run 'pkb-daemon oauth gmail' to authenticate): %w", err)
 	}
 
-	client := config.Client(ctx, token)
+	metrics.ObserveToken("gmail", account, token)
+	ts := metrics.TokenSource("gmail", account, config.TokenSource(ctx, token))
+	client := oauth2.NewClient(ctx, ts)
 	service, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, fmt.Errorf("unable to create Gmail service: %w", err)
@@ -16,15 +16,18 @@ import (
 
 	"pkb-daemon/internal/api"
 	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+	"pkb-daemon/internal/sources"
 )
 
 type Source struct {
 	dbPath    string
 	startDate time.Time
-	blocklist *config.BlocklistConfig
+	until     time.Time // set on backfills only
+	phones    *identity.Normalizer
 }
 
-func New(cfg config.IMessageConfig, blocklist config.BlocklistConfig) (*Source, error) {
+func New(cfg config.IMessageConfig, phones *identity.Normalizer) (*Source, error) {
 	dbPath := cfg.DBPath
 
 	// Verify file exists
@@ -44,7 +47,7 @@ func New(cfg config.IMessageConfig, blocklist config.BlocklistConfig) (*Source,
 	return &Source{
 		dbPath:    dbPath,
 		startDate: startDate,
-		blocklist: &blocklist,
+		phones:    phones,
 	}, nil
 }
 
@@ -52,6 +55,23 @@ func (s *Source) Name() string {
 	return "imessage"
 }
 
+func (s *Source) WatchPaths() []string {
+	return []string{s.dbPath, s.dbPath + "-wal"}
+}
+
+// Range returns a copy of the source that only fetches messages sent within r
+func (s *Source) Range(r sources.Range) (sources.Source, error) {
+	if r.Account != "" {
+		return nil, fmt.Errorf("iMessage has no accounts")
+	}
+	ranged := *s
+	if !r.Since.IsZero() {
+		ranged.startDate = r.Since
+	}
+	ranged.until = r.Until
+	return &ranged, nil
+}
+
 func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.Communication, string, error) {
 	// Open database (read-only)
 	db, err := sql.Open("sqlite3", s.dbPath+"?mode=ro")
@@ -66,6 +86,19 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 		lastRowID, _ = strconv.ParseInt(checkpoint, 10, 64)
 	}
 
+	// Limit the date range in SQL so a backfill doesn't read the whole history
+	args := []any{lastRowID}
+	dateRange := ""
+	if !s.startDate.IsZero() {
+		dateRange += " AND m.date >= ?"
+		args = append(args, timeToAppleTimestamp(s.startDate))
+	}
+	if !s.until.IsZero() {
+		dateRange += " AND m.date < ?"
+		args = append(args, timeToAppleTimestamp(s.until))
+	}
+	args = append(args, limit)
+
 	// Query messages
 	query := `
 		SELECT
@@ -84,12 +117,12 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 		LEFT JOIN chat c ON cmj.chat_id = c.ROWID
 		WHERE m.ROWID > ?
 		  AND m.text IS NOT NULL
-		  AND m.text != ''
+		  AND m.text != ''` + dateRange + `
 		ORDER BY m.ROWID ASC
 		LIMIT ?
 	`
 
-	rows, err := db.QueryContext(ctx, query, lastRowID, limit)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, checkpoint, err
 	}
@@ -114,12 +147,6 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 		// Convert Apple timestamp (nanoseconds since 2001-01-01) to time.Time
 		timestamp := appleTimestampToTime(dateInt)
 
-		// Skip if before start date
-		if !s.startDate.IsZero() && timestamp.Before(s.startDate) {
-			newCheckpoint = strconv.FormatInt(rowID, 10)
-			continue
-		}
-
 		// Determine contact identifier
 		identifier := s.parseIdentifier(handleID.String)
 		if identifier == nil {
@@ -127,12 +154,6 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 			continue
 		}
 
-		// Check blocklist
-		if s.isBlocked(identifier) {
-			newCheckpoint = strconv.FormatInt(rowID, 10)
-			continue
-		}
-
 		direction := "inbound"
 		if isFromMe == 1 {
 			direction = "outbound"
@@ -162,72 +183,41 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]api.
 	return comms, newCheckpoint, nil
 }
 
+// NewestItem returns the timestamp of the newest message in chat.db
+func (s *Source) NewestItem(ctx context.Context) (time.Time, error) {
+	db, err := sql.Open("sqlite3", s.dbPath+"?mode=ro")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	var date sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(date) FROM message").Scan(&date); err != nil {
+		return time.Time{}, err
+	}
+	if !date.Valid {
+		return time.Time{}, nil
+	}
+	return appleTimestampToTime(date.Int64), nil
+}
+
 func (s *Source) parseIdentifier(handleID string) *api.ContactIdentifier {
 	if handleID == "" {
 		return nil
 	}
 
-	// Phone number
-	if strings.HasPrefix(handleID, "+") || strings.HasPrefix(handleID, "1") || len(handleID) == 10 {
-		normalized := normalizePhone(handleID)
-		if normalized != "" {
-			return &api.ContactIdentifier{Type: "phone", Value: normalized}
-		}
-	}
-
 	// Email
 	if strings.Contains(handleID, "@") {
-		return &api.ContactIdentifier{Type: "email", Value: strings.ToLower(handleID)}
+		return &api.ContactIdentifier{Type: "email", Value: identity.NormalizeEmail(handleID)}
 	}
 
-	return nil
-}
-
-func normalizePhone(phone string) string {
-	// Remove all non-digit characters
-	digits := strings.Map(func(r rune) rune {
-		if r >= '0' && r <= '9' {
-			return r
-		}
-		return -1
-	}, phone)
-
-	// Handle US numbers
-	if len(digits) == 10 {
-		return "+1" + digits
-	}
-	if len(digits) == 11 && digits[0] == '1' {
-		return "+" + digits
-	}
-	if len(digits) > 10 {
-		return "+" + digits
+	// Phone number or short code
+	if phone := s.phones.NormalizePhone(handleID); phone != "" {
+		return &api.ContactIdentifier{Type: "phone", Value: phone}
 	}
 
-	return ""
-}
-
-func (s *Source) isBlocked(id *api.ContactIdentifier) bool {
-	if id.Type == "phone" {
-		for _, blocked := range s.blocklist.Phones {
-			// Normalize blocked number for comparison
-			normalizedBlocked := normalizePhone(blocked)
-			if normalizedBlocked != "" && id.Value == normalizedBlocked {
-				return true
-			}
-			// Also check partial match
-			if strings.Contains(id.Value, strings.TrimPrefix(blocked, "+")) {
-				return true
-			}
-		}
-	}
-	if id.Type == "email" {
-		for _, blocked := range s.blocklist.Emails {
-			if strings.EqualFold(id.Value, blocked) {
-				return true
-			}
-		}
-	}
-	return false
+	// Alphanumeric senders (e.g. "AMAZON") are kept as the handle they are
+	return &api.ContactIdentifier{Type: "social_handle", Value: strings.TrimSpace(handleID)}
 }
 
 func (s *Source) getAttachments(db *sql.DB, messageRowID int64) ([]api.Attachment, error) {
@@ -307,3 +297,8 @@ func appleTimestampToTime(appleTime int64) time.Time {
 	appleEpoch := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
 	return appleEpoch.Add(time.Duration(appleTime) * time.Nanosecond)
 }
+
+func timeToAppleTimestamp(t time.Time) int64 {
+	appleEpoch := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	return t.Sub(appleEpoch).Nanoseconds()
+}
@@ -0,0 +1,160 @@
+package imessage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/identity"
+	"pkb-daemon/internal/sources"
+)
+
+const chatSchema = `
+CREATE TABLE handle (ROWID INTEGER PRIMARY KEY, id TEXT NOT NULL, service TEXT NOT NULL);
+CREATE TABLE message (ROWID INTEGER PRIMARY KEY, guid TEXT NOT NULL, text TEXT, date INTEGER,
+	is_from_me INTEGER DEFAULT 0, cache_has_attachments INTEGER DEFAULT 0, handle_id INTEGER DEFAULT 0);
+CREATE TABLE chat (ROWID INTEGER PRIMARY KEY, chat_identifier TEXT);
+CREATE TABLE chat_message_join (chat_id INTEGER, message_id INTEGER);
+INSERT INTO handle VALUES (1, '+14155550100', 'iMessage');
+`
+
+// newTestNormalizer returns a phone normalizer for the US
+func newTestNormalizer(t *testing.T) *identity.Normalizer {
+	t.Helper()
+	phones, err := identity.NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return phones
+}
+
+func TestParseIdentifier(t *testing.T) {
+	s := &Source{phones: newTestNormalizer(t)}
+	tests := []struct {
+		handle string
+		want   *api.ContactIdentifier
+	}{
+		{"", nil},
+		{"Ann@iCloud.com", &api.ContactIdentifier{Type: "email", Value: "ann@icloud.com"}},
+		{"(415) 555-0100", &api.ContactIdentifier{Type: "phone", Value: "+14155550100"}},
+		{"+14155550100", &api.ContactIdentifier{Type: "phone", Value: "+14155550100"}},
+		{"12345", &api.ContactIdentifier{Type: "phone", Value: "12345"}},
+		// Alphanumeric senders can't be matched to a contact but aren't dropped
+		{"AMAZON", &api.ContactIdentifier{Type: "social_handle", Value: "AMAZON"}},
+		{" Chase Bank ", &api.ContactIdentifier{Type: "social_handle", Value: "Chase Bank"}},
+	}
+	for _, tt := range tests {
+		got := s.parseIdentifier(tt.handle)
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("parseIdentifier(%q) = %+v, want %+v", tt.handle, got, tt.want)
+		}
+	}
+}
+
+// newTestSource returns a source reading a chat.db with a message from the
+// same handle sent at each of the given days
+func newTestSource(t *testing.T, days ...string) *Source {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(chatSchema); err != nil {
+		t.Fatal(err)
+	}
+	for i, day := range days {
+		date, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO message (guid, text, date, handle_id) VALUES (?, ?, ?, 1)`,
+			day, "message "+day, timeToAppleTimestamp(date))
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	s, err := New(config.IMessageConfig{DBPath: path}, newTestNormalizer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSyncRange(t *testing.T) {
+	s := newTestSource(t, "2023-12-31", "2024-01-01", "2024-03-15", "2024-06-30", "2024-07-01")
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	tests := []struct {
+		name       string
+		r          sources.Range
+		want       []string
+		checkpoint string
+	}{
+		{"everything", sources.Range{}, []string{"2023-12-31", "2024-01-01", "2024-03-15", "2024-06-30", "2024-07-01"}, "5"},
+		// Since is inclusive and until exclusive
+		{"range", sources.Range{Since: day("2024-01-01"), Until: day("2024-06-30")}, []string{"2024-01-01", "2024-03-15"}, "3"},
+		{"since", sources.Range{Since: day("2024-06-30")}, []string{"2024-06-30", "2024-07-01"}, "5"},
+		{"until", sources.Range{Until: day("2024-01-01")}, []string{"2023-12-31"}, "1"},
+	}
+	for _, tt := range tests {
+		ranged, err := s.Range(tt.r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		comms, checkpoint, err := ranged.Sync(context.Background(), "", 100)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, c := range comms {
+			got = append(got, c.SourceID)
+		}
+		if !slices.Equal(got, tt.want) || checkpoint != tt.checkpoint {
+			t.Errorf("%s: synced %v up to %q, want %v up to %q", tt.name, got, checkpoint, tt.want, tt.checkpoint)
+		}
+	}
+
+	// The date filter is in the query, so a limit counts only messages in range
+	ranged, _ := s.Range(sources.Range{Since: day("2024-01-01")})
+	if comms, checkpoint, err := ranged.Sync(context.Background(), "", 1); err != nil || len(comms) != 1 || comms[0].SourceID != "2024-01-01" || checkpoint != "2" {
+		t.Errorf("limited sync = %v up to %q (%v), want 2024-01-01 up to 2", comms, checkpoint, err)
+	}
+
+	if _, err := s.Range(sources.Range{Account: "work"}); err == nil {
+		t.Error("Range of an account succeeded")
+	}
+}
+
+func TestNewestItem(t *testing.T) {
+	newest, err := newTestSource(t).NewestItem(context.Background())
+	if err != nil || !newest.IsZero() {
+		t.Errorf("empty chat.db: newest = %s (%v), want zero", newest, err)
+	}
+
+	s := newTestSource(t, "2024-03-15", "2024-07-01", "2024-01-01")
+	newest, err = s.NewestItem(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC); !newest.Equal(want) {
+		t.Errorf("newest = %s, want %s", newest, want)
+	}
+}
+
+func TestWatchPaths(t *testing.T) {
+	s := &Source{dbPath: "/Users/ann/Library/Messages/chat.db"}
+	want := []string{"/Users/ann/Library/Messages/chat.db", "/Users/ann/Library/Messages/chat.db-wal"}
+	if got := s.WatchPaths(); !slices.Equal(got, want) {
+		t.Errorf("WatchPaths() = %v, want %v", got, want)
+	}
+}
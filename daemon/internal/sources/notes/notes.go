@@ -48,6 +48,10 @@ func (s *Source) Name() string {
 	return "notes"
 }
 
+func (s *Source) WatchPaths() []string {
+	return []string{s.dbPath, s.dbPath + "-wal"}
+}
+
 // Sync fetches notes from the Apple Notes database
 // Notes are imported as notes, not communications
 // They can be used for contact enrichment via LLM processing later
@@ -131,6 +135,29 @@ func (s *Source) Sync(ctx context.Context, checkpoint string, limit int) ([]Note
 	return notes, newCheckpoint, nil
 }
 
+// NewestItem returns the creation time of the newest note, matching the
+// Z_PK order in which notes are synced
+func (s *Source) NewestItem(ctx context.Context) (time.Time, error) {
+	db, err := sql.Open("sqlite3", s.dbPath+"?mode=ro")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	var date sql.NullFloat64
+	err = db.QueryRowContext(ctx, `
+		SELECT MAX(ZCREATIONDATE1) FROM ZICCLOUDSYNCINGOBJECT
+		WHERE ZTYPEUTI1 = 'com.apple.notes.note'
+	`).Scan(&date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !date.Valid {
+		return time.Time{}, nil
+	}
+	return coreDataTimestampToTime(date.Float64), nil
+}
+
 // extractNoteContent extracts text content from Apple Notes data
 // Apple Notes stores content as gzipped protobuf
 // This is a simplified extraction that handles common cases
@@ -0,0 +1,133 @@
+package notes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const noteStoreSchema = `
+CREATE TABLE ZICCLOUDSYNCINGOBJECT (Z_PK INTEGER PRIMARY KEY, ZTITLE1 VARCHAR, ZTITLE2 VARCHAR,
+	ZTYPEUTI1 VARCHAR, ZFOLDER INTEGER, ZMARKEDFORDELETION INTEGER,
+	ZMODIFICATIONDATE1 TIMESTAMP, ZCREATIONDATE1 TIMESTAMP);
+CREATE TABLE ZICNOTEDATA (Z_PK INTEGER PRIMARY KEY, ZNOTE INTEGER, ZDATA BLOB);
+`
+
+// noteData returns text the way Notes stores it, gzipped and prefixed with its
+// length like a protobuf string field
+func noteData(t *testing.T, text string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte{byte(len(text))})
+	zw.Write([]byte(text))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestSource returns a source reading a note store built from schema and rows
+func newTestSource(t *testing.T, schema string, rows ...string) (*Source, *sql.DB) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "NoteStore.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, stmt := range append([]string{schema}, rows...) {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Source{dbPath: path}, db
+}
+
+func TestSync(t *testing.T) {
+	// Dates have fractional seconds; whole ones would be read as times
+	s, db := newTestSource(t, noteStoreSchema,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (1, NULL, 'Personal', 'com.apple.notes.folder', NULL, NULL, NULL, NULL)`,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (2, 'Wifi', NULL, 'com.apple.notes.note', 1, NULL, 700000100.5, 700000000.5)`,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (3, 'Old', NULL, 'com.apple.notes.note', 1, 1, 700000200.5, 700000200.5)`,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (4, 'Groceries', NULL, 'com.apple.notes.note', 1, NULL, 700000300.5, 700000300.5)`,
+	)
+	for pk, text := range map[int]string{2: "password: hunter2 for the guest network", 3: "deleted", 4: "oat milk"} {
+		if _, err := db.Exec(`INSERT INTO ZICNOTEDATA (ZNOTE, ZDATA) VALUES (?, ?)`, pk, noteData(t, text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notes, checkpoint, err := s.Sync(context.Background(), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || checkpoint != "4" {
+		t.Fatalf("got %d notes up to %q, want 2 up to 4: %+v", len(notes), checkpoint, notes)
+	}
+	// The content is what the redaction stage masks before it leaves the machine
+	wifi := notes[0]
+	if wifi.SourceID != "note:2" || wifi.Title != "Wifi" || wifi.Folder != "Personal" || wifi.Content != "password: hunter2 for the guest network" {
+		t.Errorf("wifi = %+v", wifi)
+	}
+	if !wifi.CreatedAt.Before(wifi.UpdatedAt) {
+		t.Errorf("wifi created %s, updated %s", wifi.CreatedAt, wifi.UpdatedAt)
+	}
+
+	if notes, checkpoint, err = s.Sync(context.Background(), checkpoint, 10); err != nil || len(notes) != 0 || checkpoint != "4" {
+		t.Errorf("second sync: %d notes up to %q (%v), want none", len(notes), checkpoint, err)
+	}
+}
+
+func TestExtractNoteContent(t *testing.T) {
+	long := strings.Repeat("a", 30)
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, ""},
+		{"gzipped field", noteData(t, "call the dentist"), "call the dentist"},
+		{"plain field", append([]byte{0x12, 5}, "hello"...), "hello"},
+		{"long text run", append([]byte{0x00}, long...), long},
+	}
+	for _, tt := range tests {
+		if got := extractNoteContent(tt.data); got != tt.want {
+			t.Errorf("%s: extractNoteContent = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewestItem(t *testing.T) {
+	s, _ := newTestSource(t, noteStoreSchema)
+	newest, err := s.NewestItem(context.Background())
+	if err != nil || !newest.IsZero() {
+		t.Errorf("empty note store: newest = %s (%v), want zero", newest, err)
+	}
+
+	// Notes sync in the order they were created, so edits don't count
+	s, _ = newTestSource(t, noteStoreSchema,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (1, NULL, 'Personal', 'com.apple.notes.folder', NULL, NULL, 800000000.5, 800000000.5)`,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (2, 'Wifi', NULL, 'com.apple.notes.note', 1, NULL, 750000000.5, 700000000.5)`,
+		`INSERT INTO ZICCLOUDSYNCINGOBJECT VALUES (3, 'Groceries', NULL, 'com.apple.notes.note', 1, NULL, 710000000.5, 710000000.5)`,
+	)
+	newest, err = s.NewestItem(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := coreDataTimestampToTime(710000000.5); !newest.Equal(want) {
+		t.Errorf("newest = %s, want %s", newest, want)
+	}
+}
+
+func TestWatchPaths(t *testing.T) {
+	s := &Source{dbPath: "/Users/ann/NoteStore.sqlite"}
+	if got := s.WatchPaths(); !slices.Equal(got, []string{"/Users/ann/NoteStore.sqlite", "/Users/ann/NoteStore.sqlite-wal"}) {
+		t.Errorf("WatchPaths() = %v", got)
+	}
+}
@@ -2,6 +2,7 @@ package sources
 
 import (
 	"context"
+	"time"
 
 	"pkb-daemon/internal/api"
 )
@@ -16,3 +17,17 @@ type Source interface {
 	// The checkpoint is source-specific and allows for incremental syncing.
 	Sync(ctx context.Context, checkpoint string, limit int) ([]api.Communication, string, error)
 }
+
+// Range bounds a backfill. Zero times leave that side open.
+type Range struct {
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+	Account string    // only this account, for sources with several
+}
+
+// RangeSource is implemented by sources that can re-import part of their
+// history. Range returns a source that only fetches items within r and
+// starts from scratch given an empty checkpoint.
+type RangeSource interface {
+	Range(r Range) (Source, error)
+}
@@ -0,0 +1,473 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons recorded in the checkpoint history
+const (
+	ReasonSync     = "sync"     // advanced by a sync cycle
+	ReasonOutbox   = "outbox"   // advanced together with a batch written to the outbox
+	ReasonSet      = "set"      // overwritten by hand
+	ReasonReset    = "reset"    // forgotten so the source syncs from scratch
+	ReasonRollback = "rollback" // restored from the history
+	ReasonMigrate  = "migrate"  // imported from state.json
+)
+
+// HistoryLimit is how many checkpoint changes are kept per source
+const HistoryLimit = 100
+
+// ErrChangeNotFound is returned when a checkpoint change does not exist
+var ErrChangeNotFound = errors.New("checkpoint change not found")
+
+// Change is an entry of the checkpoint history of a source
+type Change struct {
+	ID         int64     `json:"id"`
+	Source     string    `json:"source"`
+	Checkpoint string    `json:"checkpoint"` // empty after a reset
+	Previous   string    `json:"previous"`
+	Reason     string    `json:"reason"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// Meta is what the store remembers about a source across restarts
+type Meta struct {
+	Source       string    `json:"source"`
+	LastSuccess  time.Time `json:"last_success"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastErrorAt  time.Time `json:"last_error_at"`
+	ItemsFetched int64     `json:"items_fetched"`
+	ItemsSent    int64     `json:"items_sent"`
+	ItemsFailed  int64     `json:"items_failed"`
+}
+
+// Store keeps the sync checkpoint of every source in SQLite, with a history of
+// changes and per-source metadata. Every update is its own transaction, so a
+// crash never leaves a half-written state behind. The database may be shared
+// with the offline queue.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens or creates the state database at path
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	// The CLI and the queue may open the same database
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	if err := Init(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Init creates the state tables in db
+func Init(db interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS checkpoints (
+		source TEXT PRIMARY KEY,
+		checkpoint TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS checkpoint_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		source TEXT NOT NULL,
+		checkpoint TEXT NOT NULL,
+		previous TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		changed_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_checkpoint_history_source ON checkpoint_history(source, id);
+
+	CREATE TABLE IF NOT EXISTS source_meta (
+		source TEXT PRIMARY KEY,
+		last_success DATETIME,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_error_at DATETIME,
+		items_fetched INTEGER NOT NULL DEFAULT 0,
+		items_sent INTEGER NOT NULL DEFAULT 0,
+		items_failed INTEGER NOT NULL DEFAULT 0
+	);
+	`)
+	return err
+}
+
+// Migrate imports the checkpoints of a state.json file written by older
+// versions. It runs once: afterwards the file is renamed to .migrated.
+func (s *Store) Migrate(jsonPath string) error {
+	data, err := os.ReadFile(jsonPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var checkpoints map[string]string
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return fmt.Errorf("failed to parse state file: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to migrate state: %w", err)
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for source, checkpoint := range checkpoints {
+		// Checkpoints already in the database are newer than the file
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM checkpoints WHERE source = ?)", source).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to migrate state: %w", err)
+		}
+		if exists {
+			continue
+		}
+		if err := SetCheckpointTx(tx, source, checkpoint, ReasonMigrate); err != nil {
+			return err
+		}
+		imported++
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate state: %w", err)
+	}
+
+	if err := os.Rename(jsonPath, jsonPath+".migrated"); err != nil {
+		return fmt.Errorf("failed to rename migrated state file: %w", err)
+	}
+	log.Info().
+		Int("sources", imported).
+		Str("from", jsonPath).
+		Msg("Checkpoints migrated to the state database")
+	return nil
+}
+
+// Import copies the checkpoints of another state database, e.g. the one used
+// before the outbox moved the state into the queue database. It only runs
+// while this database has no checkpoints, so it never overwrites newer ones.
+func (s *Store) Import(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM checkpoints)").Scan(&exists); err != nil {
+		return fmt.Errorf("failed to read checkpoints: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	from, err := Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open previous state database: %w", err)
+	}
+	defer from.Close()
+	checkpoints, err := from.Checkpoints()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to import state: %w", err)
+	}
+	defer tx.Rollback()
+	for source, checkpoint := range checkpoints {
+		if err := SetCheckpointTx(tx, source, checkpoint, ReasonMigrate); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to import state: %w", err)
+	}
+
+	if len(checkpoints) > 0 {
+		log.Info().
+			Int("sources", len(checkpoints)).
+			Str("from", path).
+			Msg("Checkpoints imported from the previous state database")
+	}
+	return nil
+}
+
+// Checkpoint returns the checkpoint of a source, or "" if it has none
+func (s *Store) Checkpoint(source string) (string, error) {
+	var checkpoint string
+	err := s.db.QueryRow("SELECT checkpoint FROM checkpoints WHERE source = ?", source).Scan(&checkpoint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// Checkpoints returns the checkpoints of all sources
+func (s *Store) Checkpoints() (map[string]string, error) {
+	rows, err := s.db.Query("SELECT source, checkpoint FROM checkpoints")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query checkpoints: %w", err)
+	}
+	defer rows.Close()
+
+	checkpoints := make(map[string]string)
+	for rows.Next() {
+		var source, checkpoint string
+		if err := rows.Scan(&source, &checkpoint); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		checkpoints[source] = checkpoint
+	}
+	return checkpoints, rows.Err()
+}
+
+// SetCheckpoint stores the checkpoint of a source and records the change
+func (s *Store) SetCheckpoint(source, checkpoint, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := SetCheckpointTx(tx, source, checkpoint, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// SetCheckpointTx stores the checkpoint of a source within tx, so it can be
+// written together with other data such as an outbox entry
+func SetCheckpointTx(tx *sql.Tx, source, checkpoint, reason string) error {
+	previous, err := currentCheckpoint(tx, source)
+	if err != nil {
+		return err
+	}
+	if checkpoint == previous {
+		return nil
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO checkpoints (source, checkpoint, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(source) DO UPDATE SET checkpoint = excluded.checkpoint, updated_at = excluded.updated_at
+	`, source, checkpoint, now)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return recordChange(tx, source, checkpoint, previous, reason, now)
+}
+
+// DeleteCheckpoint forgets a source's checkpoint so its next sync starts
+// from scratch. The history keeps the old value.
+func (s *Store) DeleteCheckpoint(source string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	defer tx.Rollback()
+
+	previous, err := currentCheckpoint(tx, source)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM checkpoints WHERE source = ?", source); err != nil {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	if previous != "" {
+		if err := recordChange(tx, source, "", previous, ReasonReset, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	return nil
+}
+
+// History returns the most recent checkpoint changes of a source, newest first
+func (s *Store) History(source string, limit int) ([]Change, error) {
+	rows, err := s.db.Query(`
+		SELECT id, source, checkpoint, previous, reason, changed_at
+		FROM checkpoint_history
+		WHERE source = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query checkpoint history: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.ID, &c.Source, &c.Checkpoint, &c.Previous, &c.Reason, &c.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// Rollback restores the checkpoint a source had right after the given change
+func (s *Store) Rollback(source string, id int64) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to roll back checkpoint: %w", err)
+	}
+	defer tx.Rollback()
+
+	var checkpoint string
+	err = tx.QueryRow(`
+		SELECT checkpoint FROM checkpoint_history WHERE id = ? AND source = ?
+	`, id, source).Scan(&checkpoint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrChangeNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint history: %w", err)
+	}
+
+	if checkpoint == "" {
+		previous, err := currentCheckpoint(tx, source)
+		if err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("DELETE FROM checkpoints WHERE source = ?", source); err != nil {
+			return "", fmt.Errorf("failed to delete checkpoint: %w", err)
+		}
+		if previous != "" {
+			if err := recordChange(tx, source, "", previous, ReasonRollback, time.Now()); err != nil {
+				return "", err
+			}
+		}
+	} else if err := SetCheckpointTx(tx, source, checkpoint, ReasonRollback); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to roll back checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+func currentCheckpoint(tx *sql.Tx, source string) (string, error) {
+	var checkpoint string
+	err := tx.QueryRow("SELECT checkpoint FROM checkpoints WHERE source = ?", source).Scan(&checkpoint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// recordChange appends to the history of a source and drops entries beyond
+// HistoryLimit
+func recordChange(tx *sql.Tx, source, checkpoint, previous, reason string, at time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO checkpoint_history (source, checkpoint, previous, reason, changed_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, source, checkpoint, previous, reason, at)
+	if err != nil {
+		return fmt.Errorf("failed to record checkpoint change: %w", err)
+	}
+	_, err = tx.Exec(`
+		DELETE FROM checkpoint_history
+		WHERE source = ? AND id NOT IN (
+			SELECT id FROM checkpoint_history WHERE source = ? ORDER BY id DESC LIMIT ?
+		)
+	`, source, source, HistoryLimit)
+	if err != nil {
+		return fmt.Errorf("failed to prune checkpoint history: %w", err)
+	}
+	return nil
+}
+
+// RecordRun updates the metadata of a source after a sync cycle. The item
+// counts are added to the totals. A successful cycle clears the last error but
+// keeps when it happened.
+func (s *Store) RecordRun(source string, runErr error, fetched, sent, failed int64) error {
+	now := time.Now()
+	var lastSuccess, lastErrorAt sql.NullTime
+	lastError := ""
+	if runErr != nil {
+		lastError = runErr.Error()
+		lastErrorAt = sql.NullTime{Time: now, Valid: true}
+	} else {
+		lastSuccess = sql.NullTime{Time: now, Valid: true}
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO source_meta (source, last_success, last_error, last_error_at, items_fetched, items_sent, items_failed)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(source) DO UPDATE SET
+			last_success = COALESCE(excluded.last_success, last_success),
+			last_error = CASE WHEN excluded.last_success IS NULL THEN excluded.last_error ELSE '' END,
+			last_error_at = COALESCE(excluded.last_error_at, last_error_at),
+			items_fetched = items_fetched + excluded.items_fetched,
+			items_sent = items_sent + excluded.items_sent,
+			items_failed = items_failed + excluded.items_failed
+	`, source, lastSuccess, lastError, lastErrorAt, fetched, sent, failed)
+	if err != nil {
+		return fmt.Errorf("failed to record source metadata: %w", err)
+	}
+	return nil
+}
+
+// Meta returns the metadata of every source that has run
+func (s *Store) Meta() ([]Meta, error) {
+	rows, err := s.db.Query(`
+		SELECT source, last_success, last_error, last_error_at, items_fetched, items_sent, items_failed
+		FROM source_meta
+		ORDER BY source
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source metadata: %w", err)
+	}
+	defer rows.Close()
+
+	var metas []Meta
+	for rows.Next() {
+		var m Meta
+		var lastSuccess, lastErrorAt sql.NullTime
+		err := rows.Scan(&m.Source, &lastSuccess, &m.LastError, &lastErrorAt, &m.ItemsFetched, &m.ItemsSent, &m.ItemsFailed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		m.LastSuccess = lastSuccess.Time
+		m.LastErrorAt = lastErrorAt.Time
+		metas = append(metas, m)
+	}
+	return metas, rows.Err()
+}
+
+// Close closes the database connection
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,241 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func checkpoint(t *testing.T, s *Store, source string) string {
+	t.Helper()
+	cp, err := s.Checkpoint(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+func TestMigrate(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.SetCheckpoint("gmail", "newer", ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"imessage": "42", "gmail": "older"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Migrate(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := checkpoint(t, s, "imessage"); got != "42" {
+		t.Errorf("imessage = %q, want 42", got)
+	}
+	// The database is newer than the file
+	if got := checkpoint(t, s, "gmail"); got != "newer" {
+		t.Errorf("gmail = %q, want newer", got)
+	}
+
+	history, err := s.History("imessage", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Reason != ReasonMigrate {
+		t.Errorf("history = %+v, want one migrate entry", history)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file still exists: %v", err)
+	}
+	if _, err := os.Stat(path + ".migrated"); err != nil {
+		t.Error(err)
+	}
+
+	// Without the file there is nothing to do
+	if err := s.Migrate(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s := openTestStore(t)
+	for _, cp := range []string{"1", "2", "3"} {
+		if err := s.SetCheckpoint("notes", cp, ReasonSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := s.History("notes", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("history has %d entries, want 3", len(history))
+	}
+	first := history[2]
+
+	got, err := s.Rollback("notes", first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1" || checkpoint(t, s, "notes") != "1" {
+		t.Errorf("rolled back to %q, want 1", got)
+	}
+
+	history, err = s.History("notes", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := history[0]; h.Reason != ReasonRollback || h.Previous != "3" || h.Checkpoint != "1" {
+		t.Errorf("newest change = %+v, want a rollback from 3 to 1", h)
+	}
+
+	if _, err := s.Rollback("gmail", first.ID); !errors.Is(err, ErrChangeNotFound) {
+		t.Errorf("rollback of another source's change: err = %v, want ErrChangeNotFound", err)
+	}
+}
+
+func TestRollbackToReset(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.SetCheckpoint("calls", "1", ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteCheckpoint("calls"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCheckpoint("calls", "2", ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := s.History("calls", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := history[1]
+	if reset.Reason != ReasonReset {
+		t.Fatalf("change = %+v, want the reset", reset)
+	}
+
+	if _, err := s.Rollback("calls", reset.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkpoint(t, s, "calls"); got != "" {
+		t.Errorf("checkpoint = %q, want none", got)
+	}
+}
+
+func TestHistoryPruned(t *testing.T) {
+	s := openTestStore(t)
+	for i := range HistoryLimit + 10 {
+		if err := s.SetCheckpoint("imessage", fmt.Sprint(i), ReasonSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetCheckpoint("gmail", "1", ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := s.History("imessage", 2*HistoryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != HistoryLimit {
+		t.Fatalf("history has %d entries, want %d", len(history), HistoryLimit)
+	}
+	if newest, oldest := history[0].Checkpoint, history[len(history)-1].Checkpoint; newest != fmt.Sprint(HistoryLimit+9) || oldest != "10" {
+		t.Errorf("history spans %s to %s, want 10 to %d", oldest, newest, HistoryLimit+9)
+	}
+
+	// Pruning is per source
+	if history, _ := s.History("gmail", 10); len(history) != 1 {
+		t.Errorf("gmail history has %d entries, want 1", len(history))
+	}
+}
+
+func TestRecordRunClearsError(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.RecordRun("gmail", errors.New("token expired"), 10, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordRun("gmail", nil, 5, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	metas, err := s.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 {
+		t.Fatalf("got %d sources, want 1", len(metas))
+	}
+	m := metas[0]
+	if m.LastError != "" {
+		t.Errorf("last error = %q, want it cleared", m.LastError)
+	}
+	if m.LastErrorAt.IsZero() || m.LastSuccess.IsZero() {
+		t.Errorf("last error at %v, last success %v, want both set", m.LastErrorAt, m.LastSuccess)
+	}
+	if m.ItemsFetched != 15 || m.ItemsSent != 5 || m.ItemsFailed != 10 {
+		t.Errorf("totals = %d/%d/%d, want 15/5/10", m.ItemsFetched, m.ItemsSent, m.ItemsFailed)
+	}
+
+	if err := s.RecordRun("gmail", errors.New("rate limited"), 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	metas, err = s.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metas[0].LastError != "rate limited" {
+		t.Errorf("last error = %q, want rate limited", metas[0].LastError)
+	}
+}
+
+func TestImport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	previous, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := previous.SetCheckpoint("imessage", "42", ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+	previous.Close()
+
+	s := openTestStore(t)
+	if err := s.Import(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkpoint(t, s, "imessage"); got != "42" {
+		t.Errorf("imessage = %q, want 42", got)
+	}
+
+	// Once the database has checkpoints of its own they are newer
+	if err := s.SetCheckpoint("imessage", "43", ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Import(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkpoint(t, s, "imessage"); got != "43" {
+		t.Errorf("imessage = %q after a second import, want 43", got)
+	}
+
+	// A missing database has nothing to import
+	if err := s.Import(filepath.Join(t.TempDir(), "missing.db")); err != nil {
+		t.Fatal(err)
+	}
+}
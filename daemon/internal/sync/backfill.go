@@ -0,0 +1,427 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/sources"
+	"pkb-daemon/internal/tracing"
+)
+
+// BackfillPrefix starts the ID of every backfill. The ID doubles as the key
+// of the backfill's checkpoint, next to the checkpoints of the live sources.
+const BackfillPrefix = "backfill:"
+
+// IsBackfill reports whether a checkpoint key belongs to a backfill
+func IsBackfill(name string) bool {
+	return strings.HasPrefix(name, BackfillPrefix)
+}
+
+// Backfill states
+const (
+	BackfillRunning   = "running"
+	BackfillDone      = "done"
+	BackfillFailed    = "failed"
+	BackfillCancelled = "cancelled"
+)
+
+var (
+	// ErrBackfillNotFound is returned for an unknown backfill ID
+	ErrBackfillNotFound = errors.New("backfill not found")
+	// ErrBackfillRunning is returned when starting a range that is already running
+	ErrBackfillRunning = errors.New("backfill is already running")
+	// ErrNoBackfill is returned for sources that can't fetch a range
+	ErrNoBackfill = errors.New("source does not support backfills")
+	// ErrNotRunning is returned when starting a backfill before the manager runs
+	ErrNotRunning = errors.New("sync manager is not running")
+)
+
+// BackfillRequest describes a backfill. Since and Until are days, both
+// included; zero leaves that side open. Zero throttling values fall back to
+// the sync.backfill settings.
+type BackfillRequest struct {
+	Source       string    `json:"source"`
+	Since        time.Time `json:"since"`
+	Until        time.Time `json:"until"`
+	Account      string    `json:"account,omitempty"`
+	MaxPerCycle  int       `json:"max_per_cycle,omitempty"`
+	PauseSeconds int       `json:"pause_seconds,omitempty"`
+}
+
+// ID identifies the range of a backfill. Starting the same range again
+// resumes from where the previous run stopped.
+func (r BackfillRequest) ID() string {
+	id := BackfillPrefix + r.Source
+	if !r.Since.IsZero() || !r.Until.IsZero() {
+		id += ":" + formatDate(r.Since) + ".." + formatDate(r.Until)
+	}
+	if r.Account != "" {
+		id += "@" + r.Account
+	}
+	return id
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// Backfill is the progress of a backfill
+type Backfill struct {
+	BackfillRequest
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	Checkpoint string    `json:"checkpoint,omitempty"`
+	Resumed    bool      `json:"resumed"` // started from the checkpoint of an earlier run
+	Cycles     int       `json:"cycles"`
+	Fetched    int64     `json:"fetched"`
+	Sent       int64     `json:"sent"`
+	Filtered   int64     `json:"filtered"`
+	Failed     int64     `json:"failed"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// backfillRun is a backfill started by this process
+type backfillRun struct {
+	progress Backfill
+	cancel   context.CancelFunc
+}
+
+// rangeSource records the source if it can fetch a range
+func (m *Manager) rangeSource(name string, src any) {
+	if rs, ok := src.(sources.RangeSource); ok {
+		m.ranged[name] = rs
+	}
+}
+
+// StartBackfill re-imports a range of a source in the background, next to
+// its live sync. The backfill has its own checkpoint, so the live
+// checkpoint is left alone and a failed or cancelled backfill can be resumed
+// by starting it again.
+func (m *Manager) StartBackfill(req BackfillRequest) (Backfill, error) {
+	if _, err := m.job(req.Source); err != nil {
+		return Backfill{}, err
+	}
+	rs, ok := m.ranged[req.Source]
+	if !ok {
+		return Backfill{}, fmt.Errorf("%w: %s", ErrNoBackfill, req.Source)
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && req.Until.Before(req.Since) {
+		return Backfill{}, errors.New("until is before since")
+	}
+	r := sources.Range{Since: req.Since, Account: req.Account}
+	if !req.Until.IsZero() {
+		r.Until = req.Until.AddDate(0, 0, 1)
+	}
+	src, err := rs.Range(r)
+	if err != nil {
+		return Backfill{}, err
+	}
+
+	if req.MaxPerCycle <= 0 {
+		req.MaxPerCycle = m.config.Sync.Backfill.MaxPerCycle
+	}
+	if req.PauseSeconds <= 0 {
+		req.PauseSeconds = m.config.Sync.Backfill.PauseSeconds
+	}
+
+	id := req.ID()
+	checkpoint, err := m.state.Checkpoint(id)
+	if err != nil {
+		return Backfill{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.runCtx == nil {
+		return Backfill{}, ErrNotRunning
+	}
+	if run, ok := m.backfills[id]; ok && run.progress.State == BackfillRunning {
+		return Backfill{}, fmt.Errorf("%w: %s", ErrBackfillRunning, id)
+	}
+
+	ctx, cancel := context.WithCancel(m.runCtx)
+	run := &backfillRun{
+		progress: Backfill{
+			BackfillRequest: req,
+			ID:              id,
+			State:           BackfillRunning,
+			Checkpoint:      checkpoint,
+			Resumed:         checkpoint != "",
+			StartedAt:       time.Now(),
+		},
+		cancel: cancel,
+	}
+	m.backfills[id] = run
+
+	log.Info().
+		Str("source", req.Source).
+		Str("id", id).
+		Str("checkpoint", checkpoint).
+		Msg("Backfill started")
+
+	m.backfillWG.Add(1)
+	go func() {
+		defer m.backfillWG.Done()
+		defer cancel()
+		m.runBackfill(ctx, run, src)
+	}()
+
+	return run.progress, nil
+}
+
+// Backfills returns the backfills started since the daemon came up, newest first
+func (m *Manager) Backfills() []Backfill {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]Backfill, 0, len(m.backfills))
+	for _, run := range m.backfills {
+		result = append(result, run.progress)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.After(result[j].StartedAt)
+	})
+	return result
+}
+
+// Backfill returns the progress of a backfill
+func (m *Manager) Backfill(id string) (Backfill, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	run, ok := m.backfills[id]
+	if !ok {
+		return Backfill{}, ErrBackfillNotFound
+	}
+	return run.progress, nil
+}
+
+// CancelBackfill stops a running backfill. Its checkpoint is kept, so
+// starting it again resumes it.
+func (m *Manager) CancelBackfill(id string) (Backfill, error) {
+	m.mu.Lock()
+	run, ok := m.backfills[id]
+	m.mu.Unlock()
+	if !ok {
+		return Backfill{}, ErrBackfillNotFound
+	}
+	run.cancel()
+	return m.Backfill(id)
+}
+
+// updateBackfill changes the progress of a backfill under the manager's lock
+func (m *Manager) updateBackfill(run *backfillRun, fn func(b *Backfill)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&run.progress)
+}
+
+// runBackfill runs cycles of at most MaxPerCycle items, pausing between
+// them, until the source reaches the end of the range
+func (m *Manager) runBackfill(ctx context.Context, run *backfillRun, src sources.Source) {
+	id := run.progress.ID
+	pause := time.Duration(run.progress.PauseSeconds) * time.Second
+
+	var err error
+	for {
+		var done bool
+		done, err = m.backfillCycle(ctx, run, src)
+		if errors.Is(err, ErrAddressBookPending) || errors.Is(err, queue.ErrBacklogWaiting) {
+			// Nothing was sent; try again after the pause instead of failing
+			log.Info().Err(err).Str("id", id).Msg("Backfill waiting")
+			waiting := err.Error()
+			m.updateBackfill(run, func(b *Backfill) { b.Error = waiting })
+			err = nil
+		} else if err != nil || done {
+			break
+		} else {
+			m.updateBackfill(run, func(b *Backfill) { b.Error = "" })
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(pause):
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	state := BackfillDone
+	switch {
+	case errors.Is(err, context.Canceled):
+		state = BackfillCancelled
+	case err != nil:
+		state = BackfillFailed
+	default:
+		// Nothing left to resume; the same range can be backfilled again later
+		if delErr := m.state.DeleteCheckpoint(id); delErr != nil {
+			log.Warn().Err(delErr).Str("id", id).Msg("Failed to delete backfill checkpoint")
+		}
+	}
+
+	m.updateBackfill(run, func(b *Backfill) {
+		b.State = state
+		b.FinishedAt = time.Now()
+		if err != nil {
+			b.Error = err.Error()
+		}
+	})
+
+	progress, _ := m.Backfill(id)
+	event := log.Info()
+	if state == BackfillFailed {
+		event = log.Error().Err(err)
+	}
+	event.
+		Str("source", progress.Source).
+		Str("id", id).
+		Str("state", state).
+		Int64("fetched", progress.Fetched).
+		Int64("sent", progress.Sent).
+		Int64("failed", progress.Failed).
+		Msg("Backfill finished")
+}
+
+// backfillCycle sends up to MaxPerCycle items of a backfill and reports
+// whether the source reached the end of the range. It takes one of the
+// global sync slots like a regular cycle, so backfills never crowd out the
+// live sources.
+func (m *Manager) backfillCycle(ctx context.Context, run *backfillRun, src sources.Source) (bool, error) {
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	defer func() { <-m.slots }()
+
+	progress, _ := m.Backfill(run.progress.ID)
+	id := progress.ID
+	name := progress.Source
+	checkpoint := progress.Checkpoint
+
+	// Communications dropped now would not be fetched again
+	if err := m.filterReady(name); err != nil {
+		return false, err
+	}
+
+	m.updateBackfill(run, func(b *Backfill) { b.Cycles++ })
+
+	// Requests the backend failed to take are queued under the backfill ID
+	if err := m.drainBacklog(ctx, id); err != nil {
+		return false, err
+	}
+
+	total := 0
+	for total < progress.MaxPerCycle {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		comms, newCheckpoint, err := src.Sync(ctx, checkpoint, m.config.Sync.BatchSize)
+		if err != nil {
+			return false, err
+		}
+		// Sources hand back the checkpoint they were given once they run out
+		// of items
+		done := newCheckpoint == checkpoint
+		if len(comms) == 0 && done {
+			return true, nil
+		}
+
+		fetched := len(comms)
+		comms = m.filterCommunications(name, comms)
+		comms = m.classifyCommunications(name, comms)
+		m.redactCommunications(name, comms)
+
+		sent, failed, err := m.sendBackfillBatch(ctx, id, comms, newCheckpoint)
+		saved := newCheckpoint
+		if err != nil {
+			// A failed batch kept in the queue still moves the checkpoint
+			saved = m.Checkpoint(id)
+		}
+		m.updateBackfill(run, func(b *Backfill) {
+			b.Fetched += int64(fetched)
+			b.Filtered += int64(fetched - len(comms))
+			b.Sent += int64(sent)
+			b.Failed += int64(failed)
+			b.Checkpoint = saved
+		})
+		if err != nil {
+			return false, err
+		}
+		checkpoint = newCheckpoint
+
+		log.Info().
+			Str("source", name).
+			Str("id", id).
+			Int("fetched", fetched).
+			Int("sent", sent).
+			Str("checkpoint", checkpoint).
+			Msg("Backfill batch synced")
+
+		if done {
+			return true, nil
+		}
+		total += fetched
+	}
+	return false, nil
+}
+
+// sendBackfillBatch sends a batch of a backfill and saves the backfill's
+// checkpoint. Failed items are kept in the queue under the backfill ID, the
+// same way syncSource keeps those of a live source.
+func (m *Manager) sendBackfillBatch(ctx context.Context, id string, comms []api.Communication, checkpoint string) (int, int, error) {
+	if len(comms) == 0 {
+		m.saveCheckpoint(id, checkpoint)
+		return 0, 0, nil
+	}
+
+	if m.outbox() {
+		if err := m.writeOutbox(id, queue.RequestTypeBatchUpsert, api.BatchUpsertRequest{Communications: comms}, checkpoint); err != nil {
+			return 0, 0, err
+		}
+		if err := m.drainBacklog(ctx, id); err != nil {
+			return 0, 0, err
+		}
+		return len(comms), 0, nil
+	}
+
+	batchCtx, span := startBatch(ctx, id, len(comms))
+	result, err := m.sink.Communications(batchCtx, id, comms)
+	tracing.End(span, err)
+	if err != nil {
+		if m.enqueueOnError(id, queue.RequestTypeBatchUpsert, api.BatchUpsertRequest{Communications: comms}, err) {
+			m.saveCheckpoint(id, checkpoint)
+		}
+		return 0, len(comms), err
+	}
+
+	queued := keepFailedItems(m, id, queue.RequestTypeBatchUpsert, comms, result.Errors, func(items []api.Communication) interface{} {
+		return api.BatchUpsertRequest{Communications: items}
+	})
+	m.saveCheckpoint(id, checkpoint)
+
+	// The queued items must reach the backend before the rest of the range
+	if queued && m.ordered() {
+		if err := m.drainBacklog(ctx, id); err != nil {
+			return result.Inserted + result.Updated, len(result.Errors), err
+		}
+	}
+	return result.Inserted + result.Updated, len(result.Errors), nil
+}
@@ -0,0 +1,162 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/filter"
+	"pkb-daemon/internal/queue"
+)
+
+func TestBackfillID(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	tests := []struct {
+		req  BackfillRequest
+		want string
+	}{
+		{BackfillRequest{Source: "gmail"}, "backfill:gmail"},
+		{BackfillRequest{Source: "gmail", Since: day("2024-01-01"), Until: day("2024-06-30")}, "backfill:gmail:2024-01-01..2024-06-30"},
+		{BackfillRequest{Source: "gmail", Since: day("2024-01-01")}, "backfill:gmail:2024-01-01.."},
+		{BackfillRequest{Source: "gmail", Until: day("2024-06-30"), Account: "work"}, "backfill:gmail:..2024-06-30@work"},
+	}
+	for _, tt := range tests {
+		if got := tt.req.ID(); got != tt.want {
+			t.Errorf("ID() = %q, want %q", got, tt.want)
+		}
+		if !IsBackfill(tt.req.ID()) {
+			t.Errorf("IsBackfill(%q) = false", tt.req.ID())
+		}
+	}
+	if IsBackfill("gmail") {
+		t.Error("IsBackfill(gmail) = true")
+	}
+}
+
+// twoSenders returns a message from a contact and one from a stranger, then nothing
+type twoSenders struct{}
+
+func (twoSenders) Name() string { return "imessage" }
+
+func (twoSenders) Sync(_ context.Context, checkpoint string, _ int) ([]api.Communication, string, error) {
+	if checkpoint != "" {
+		return nil, checkpoint, nil
+	}
+	return []api.Communication{
+		{SourceID: "m1", ContactIdentifier: api.ContactIdentifier{Type: "email", Value: "ann@example.com"}},
+		{SourceID: "m2", ContactIdentifier: api.ContactIdentifier{Type: "email", Value: "stranger@example.com"}},
+	}, "2", nil
+}
+
+func TestBackfillWaitsForAddressBook(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{MaxConcurrent: 1, BatchSize: 10})
+	file := useFileSink(t, m)
+	f, err := filter.New(config.BlocklistConfig{}, config.AllowlistConfig{Enabled: true, AddressBook: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetFilter(f)
+
+	id := BackfillRequest{Source: "imessage"}.ID()
+	run := &backfillRun{progress: Backfill{
+		BackfillRequest: BackfillRequest{Source: "imessage", MaxPerCycle: 100},
+		ID:              id,
+		State:           BackfillRunning,
+	}}
+	m.backfills[id] = run
+
+	// Messages dropped before the contacts load would never be fetched again
+	if _, err := m.backfillCycle(context.Background(), run, twoSenders{}); !errors.Is(err, ErrAddressBookPending) {
+		t.Fatalf("err = %v, want ErrAddressBookPending", err)
+	}
+	if file.Records() != 0 || m.Checkpoint(id) != "" {
+		t.Errorf("sent %d batches, checkpoint %q, want nothing before the address book", file.Records(), m.Checkpoint(id))
+	}
+
+	f.SetAddressBook([]filter.Identifier{{Type: "email", Value: "ann@example.com"}})
+	done, err := m.backfillCycle(context.Background(), run, twoSenders{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Error("backfill not done at the end of the range")
+	}
+	progress, err := m.Backfill(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Records() != 1 || progress.Sent != 1 || progress.Filtered != 1 {
+		t.Errorf("sent %d batches, progress %+v, want the contact's message sent and the stranger's filtered", file.Records(), progress)
+	}
+	if m.Checkpoint(id) != "2" {
+		t.Errorf("checkpoint = %q, want 2", m.Checkpoint(id))
+	}
+}
+
+func TestCancelledBackfillBacklogSent(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{MaxConcurrent: 1, BatchSize: 10})
+	m.config.Queue = config.QueueConfig{
+		Enabled:       true,
+		Path:          m.config.State.DBPath,
+		MaxRetries:    10,
+		BatchSize:     10,
+		Eviction:      queue.EvictReject,
+		PreserveOrder: true,
+	}
+	if err := m.InitQueue(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.queue.Close() })
+	file := useFileSink(t, m)
+
+	id := BackfillRequest{Source: "imessage"}.ID()
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &backfillRun{
+		progress: Backfill{
+			BackfillRequest: BackfillRequest{Source: "imessage", MaxPerCycle: 100},
+			ID:              id,
+			State:           BackfillRunning,
+		},
+		cancel: cancel,
+	}
+	m.backfills[id] = run
+	for _, sourceID := range []string{"m1", "m2"} {
+		payload := api.BatchUpsertRequest{Communications: []api.Communication{{SourceID: sourceID}}}
+		if err := m.queue.Enqueue(id, queue.RequestTypeBatchUpsert, payload, "unavailable", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A running backfill sends its own backlog, in order
+	if err := m.ProcessQueue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if file.Records() != 0 {
+		t.Fatalf("sent %d batches of a running backfill, want none", file.Records())
+	}
+
+	if _, err := m.CancelBackfill(id); err != nil {
+		t.Fatal(err)
+	}
+	m.runBackfill(ctx, run, oneBatch{})
+	if progress, _ := m.Backfill(id); progress.State != BackfillCancelled {
+		t.Fatalf("state = %q, want %q", progress.State, BackfillCancelled)
+	}
+
+	// Nothing will resume the backfill, so the processor sends the backlog
+	if err := m.ProcessQueue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if file.Records() != 2 {
+		t.Errorf("sent %d batches, want the 2 queued", file.Records())
+	}
+	if backlog, err := m.queue.Backlog(id, 10); err != nil || len(backlog) != 0 {
+		t.Errorf("backlog = %d requests (%v), want none", len(backlog), err)
+	}
+}
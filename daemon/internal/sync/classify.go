@@ -0,0 +1,37 @@
+package sync
+
+import (
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/classify"
+)
+
+// SetClassifier sets the classifier that tags, redacts or drops automated messages
+func (m *Manager) SetClassifier(c *classify.Classifier) {
+	m.classifier = c
+}
+
+// classifyCommunications runs the classifier over a batch, dropping communications
+// matched by a drop rule. Tags and redactions are applied in place.
+func (m *Manager) classifyCommunications(source string, comms []api.Communication) []api.Communication {
+	if m.classifier == nil {
+		return comms
+	}
+
+	kept := comms[:0]
+	for i := range comms {
+		result := m.classifier.Classify(&comms[i])
+		if result.Drop {
+			log.Debug().
+				Str("source", source).
+				Str("source_id", comms[i].SourceID).
+				Strs("rules", result.Rules).
+				Msg("Communication dropped by classifier")
+			m.status.AddFiltered(source, 1)
+			continue
+		}
+		kept = append(kept, comms[i])
+	}
+	return kept
+}
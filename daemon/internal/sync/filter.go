@@ -0,0 +1,124 @@
+package sync
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/filter"
+	"pkb-daemon/internal/sources/calendar"
+	"pkb-daemon/internal/sources/contacts"
+)
+
+// SetFilter sets the filter applied to every communication, contact and calendar attendee
+func (m *Manager) SetFilter(f *filter.Filter) {
+	m.filter = f
+}
+
+// ErrAddressBookPending fails the cycles of sources whose allowlist needs the
+// address book until the contacts source has loaded it, so the wait shows in
+// status and metrics
+var ErrAddressBookPending = errors.New("waiting for the contacts source to load the address book")
+
+// filterReady returns ErrAddressBookPending until a source can be filtered
+func (m *Manager) filterReady(source string) error {
+	if m.filter == nil || m.filter.Ready(source) {
+		return nil
+	}
+	return ErrAddressBookPending
+}
+
+// filterCommunications drops communications with blocked or non-allowed contacts
+func (m *Manager) filterCommunications(source string, comms []api.Communication) []api.Communication {
+	if m.filter == nil {
+		return comms
+	}
+
+	kept := comms[:0]
+	for _, c := range comms {
+		name, _ := c.Metadata["display_name"].(string)
+		id := filter.Identifier{Type: c.ContactIdentifier.Type, Value: c.ContactIdentifier.Value}
+
+		if d := m.filter.Check(source, name, id); d.Blocked {
+			log.Debug().
+				Str("source", source).
+				Str("source_id", c.SourceID).
+				Str("reason", d.Reason).
+				Msg("Communication filtered")
+			m.status.AddFiltered(source, 1)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// filterContacts removes blocked identifiers from contacts and drops contacts
+// that are blocked by name or have no identifiers left. The remaining contacts
+// become the address book for allowlists.
+func (m *Manager) filterContacts(source string, imports []contacts.ContactImport) []contacts.ContactImport {
+	if m.filter == nil {
+		return imports
+	}
+
+	var kept []contacts.ContactImport
+	var book []filter.Identifier
+
+	for _, c := range imports {
+		if d := m.filter.Blocked(source, c.DisplayName); d.Blocked {
+			log.Debug().Str("source", source).Str("contact", c.DisplayName).Str("reason", d.Reason).Msg("Contact filtered")
+			m.status.AddFiltered(source, 1)
+			continue
+		}
+
+		var emails, phones []string
+		for _, email := range c.Emails {
+			id := filter.Identifier{Type: "email", Value: email}
+			if !m.filter.Blocked(source, "", id).Blocked {
+				emails = append(emails, email)
+				book = append(book, id)
+			}
+		}
+		for _, phone := range c.Phones {
+			id := filter.Identifier{Type: "phone", Value: phone}
+			if !m.filter.Blocked(source, "", id).Blocked {
+				phones = append(phones, phone)
+				book = append(book, id)
+			}
+		}
+
+		if len(emails) == 0 && len(phones) == 0 {
+			log.Debug().Str("source", source).Str("contact", c.DisplayName).Msg("Contact filtered: all identifiers blocked")
+			m.status.AddFiltered(source, 1)
+			continue
+		}
+
+		c.Emails = emails
+		c.Phones = phones
+		kept = append(kept, c)
+	}
+
+	m.filter.SetAddressBook(book)
+	return kept
+}
+
+// filterAttendees removes blocked or non-allowed attendees from calendar events
+func (m *Manager) filterAttendees(source string, events []calendar.CalendarEvent) []calendar.CalendarEvent {
+	if m.filter == nil {
+		return events
+	}
+
+	for i := range events {
+		attendees := events[i].Attendees[:0]
+		for _, email := range events[i].Attendees {
+			if d := m.filter.Check(source, "", filter.Identifier{Type: "email", Value: email}); d.Blocked {
+				m.status.AddFiltered(source, 1)
+				continue
+			}
+			attendees = append(attendees, email)
+		}
+		events[i].Attendees = attendees
+	}
+	return events
+}
@@ -3,21 +3,36 @@ package sync
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"maps"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/classify"
 	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/filter"
 	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/redact"
+	"pkb-daemon/internal/sink"
+	"pkb-daemon/internal/sources"
 	"pkb-daemon/internal/sources/calendar"
 	"pkb-daemon/internal/sources/contacts"
 	"pkb-daemon/internal/sources/notes"
+	"pkb-daemon/internal/state"
+	"pkb-daemon/internal/tracing"
 )
 
+// ErrQueueDisabled is returned by queue operations when the offline queue is disabled
+var ErrQueueDisabled = errors.New("offline queue is disabled")
+
 // Source is the interface for communication sources (incremental sync)
 type Source interface {
 	Name() string
@@ -30,10 +45,10 @@ type ContactsSource interface {
 	SyncContacts(ctx context.Context) ([]contacts.ContactImport, error)
 }
 
-// CalendarSource is the interface for calendar sources
+// CalendarSource is the interface for calendar sources (per-provider results)
 type CalendarSource interface {
 	Name() string
-	Sync(ctx context.Context, checkpoint string) ([]calendar.CalendarEvent, string, error)
+	Sync(ctx context.Context, checkpoints map[string]string) (*calendar.SyncResult, error)
 }
 
 // NotesSource is the interface for notes sources (incremental sync)
@@ -43,32 +58,86 @@ type NotesSource interface {
 }
 
 type Manager struct {
-	client           *api.Client
-	config           *config.Config
-	state            *State
-	queue            *queue.Queue
-	queueProcessor   *queue.Processor
-	sources          []Source
-	contactsSources  []ContactsSource
-	calendarSources  []CalendarSource
-	notesSources     []NotesSource
-	lastContactsSync time.Time
-	lastContactsHash string
-}
-
-func NewManager(client *api.Client, cfg *config.Config) *Manager {
+	sink           sink.Sink // where every batch goes
+	config         *config.Config
+	state          *state.Store
+	status         *Status
+	filter         *filter.Filter
+	classifier     *classify.Classifier
+	redactor       *redact.Redactor
+	queue          *queue.Queue
+	queueProcessor *queue.Processor
+
+	// Every registered source is a job with its own goroutine and schedule
+	jobs     map[string]*job
+	jobOrder []string
+	slots    chan struct{} // global concurrency limit
+
+	watchPaths map[string][]string // files that trigger a sync, keyed by source
+	ranged     map[string]sources.RangeSource
+
+	runCtx     context.Context // set by Run, parent of every backfill
+	backfills  map[string]*backfillRun
+	backfillWG sync.WaitGroup
+
+	mu             sync.Mutex
+	contactsHashes map[string]string
+	lastSynced     map[string]time.Time // newest item delivered per source, for the lag metric
+}
+
+func NewManager(s sink.Sink, cfg *config.Config) *Manager {
 	m := &Manager{
-		client:          client,
-		config:          cfg,
-		state:           NewState(cfg.State.Path),
-		sources:         []Source{},
-		contactsSources: []ContactsSource{},
-		calendarSources: []CalendarSource{},
-		notesSources:    []NotesSource{},
+		sink:           s,
+		config:         cfg,
+		status:         NewStatus(),
+		jobs:           make(map[string]*job),
+		slots:          make(chan struct{}, cfg.Sync.MaxConcurrent),
+		watchPaths:     make(map[string][]string),
+		ranged:         make(map[string]sources.RangeSource),
+		backfills:      make(map[string]*backfillRun),
+		contactsHashes: make(map[string]string),
+		lastSynced:     make(map[string]time.Time),
+	}
+	if b, ok := s.(sink.Breaker); ok {
+		b.OnCircuitChange(m.circuitChanged)
 	}
 	return m
 }
 
+// InitState opens the state database and imports the state.json of older
+// versions, or the checkpoints of the state database the outbox replaced. It
+// must be called before Run.
+func (m *Manager) InitState() error {
+	st, err := state.Open(m.config.State.DBPath)
+	if err != nil {
+		return err
+	}
+	if err := st.Migrate(m.config.State.Path); err != nil {
+		st.Close()
+		return err
+	}
+	// Without its checkpoints every source would sync again from the start
+	if from := m.config.State.PreviousDBPath; from != "" {
+		if err := st.Import(from); err != nil {
+			st.Close()
+			return fmt.Errorf("failed to import the checkpoints of %s into the outbox: %w", from, err)
+		}
+	}
+	m.state = st
+
+	// Carry the last results of each source over from the previous run
+	metas, err := st.Meta()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read source metadata")
+	}
+	for _, meta := range metas {
+		m.status.Restore(meta)
+	}
+
+	log.Info().Str("path", m.config.State.DBPath).Msg("State database opened")
+	return nil
+}
+
 // InitQueue initializes the offline queue system
 func (m *Manager) InitQueue() error {
 	if !m.config.Queue.Enabled {
@@ -76,15 +145,7 @@ func (m *Manager) InitQueue() error {
 		return nil
 	}
 
-	queueCfg := queue.Config{
-		Path:           m.config.Queue.Path,
-		MaxRetries:     m.config.Queue.MaxRetries,
-		InitialBackoff: time.Duration(m.config.Queue.InitialBackoffSecs) * time.Second,
-		MaxBackoff:     time.Duration(m.config.Queue.MaxBackoffSecs) * time.Second,
-		BackoffFactor:  m.config.Queue.BackoffFactor,
-	}
-
-	q, err := queue.New(queueCfg)
+	q, err := queue.New(queue.ConfigFrom(m.config.Queue))
 	if err != nil {
 		return err
 	}
@@ -94,19 +155,34 @@ func (m *Manager) InitQueue() error {
 	procCfg := queue.ProcessorConfig{
 		CheckInterval: time.Duration(m.config.Queue.ProcessIntervalSecs) * time.Second,
 		BatchSize:     m.config.Queue.BatchSize,
+		Ordered:       m.ordered(),
 	}
 
 	m.queueProcessor = queue.NewProcessor(q, m.handleQueuedRequest, procCfg)
 
 	// Set online checker to use health check
 	m.queueProcessor.SetOnlineChecker(func() bool {
-		err := m.client.HealthCheck()
+		err := sink.HealthCheck(context.Background(), m.sink)
 		return err == nil
 	})
 
+	// Requests the backend rejects outright go to the dead letters
+	m.queueProcessor.SetPermanentChecker(func(err error) bool {
+		return !api.IsTemporaryError(err)
+	})
+
+	// The requests of a backfill are only sent by the backfill, which
+	// may have been cancelled or lost with a restart
+	m.queueProcessor.SetOrphanChecker(m.orphanedBackfill)
+
 	log.Info().
 		Str("path", m.config.Queue.Path).
 		Int("max_retries", m.config.Queue.MaxRetries).
+		Str("compression", m.config.Queue.Compression).
+		Int("max_size_mb", m.config.Queue.MaxSizeMB).
+		Str("eviction", m.config.Queue.Eviction).
+		Bool("preserve_order", m.config.Queue.PreserveOrder).
+		Bool("outbox", m.config.Queue.Outbox).
 		Msg("Offline queue initialized")
 
 	// Log queue stats
@@ -120,131 +196,488 @@ func (m *Manager) InitQueue() error {
 	return nil
 }
 
-// handleQueuedRequest processes a request from the queue
-func (m *Manager) handleQueuedRequest(reqType queue.RequestType, payload []byte) error {
+// handleQueuedRequest processes a request from the queue. If the backend
+// rejects some of its items, only those are kept.
+func (m *Manager) handleQueuedRequest(ctx context.Context, source string, reqType queue.RequestType, payload []byte) error {
+	err := sink.Deliver(ctx, m.sink, "", reqType, payload)
+	if errors.Is(err, sink.ErrUnknownRequestType) {
+		log.Warn().Str("type", string(reqType)).Msg("Unknown queued request type")
+		return nil // Don't retry unknown types
+	}
+	var itemErrs *api.ItemErrors
+	if errors.As(err, &itemErrs) {
+		return partialFailure(source, reqType, payload, itemErrs)
+	}
+	return err
+}
+
+// partialFailure returns the *queue.PartialError of a queued request whose
+// items were rejected individually
+func partialFailure(source string, reqType queue.RequestType, payload []byte, itemErrs *api.ItemErrors) error {
+	var partial *queue.PartialError
 	switch reqType {
 	case queue.RequestTypeBatchUpsert:
-		return m.client.BatchUpsertFromPayload(payload)
+		req, err := queue.UnmarshalPayload[api.BatchUpsertRequest](payload)
+		if err != nil {
+			return err
+		}
+		partial = failedItems(source, req.Communications, itemErrs.Errors, func(items []api.Communication) interface{} {
+			return api.BatchUpsertRequest{Communications: items}
+		})
 	case queue.RequestTypeImportContacts:
-		return m.client.ImportContactsFromPayload(payload)
+		req, err := queue.UnmarshalPayload[api.ContactsImportRequest](payload)
+		if err != nil {
+			return err
+		}
+		partial = failedItems(source, req.Contacts, itemErrs.Errors, func(items []api.ContactImport) interface{} {
+			return api.ContactsImportRequest{Contacts: items}
+		})
 	case queue.RequestTypeImportCalendar:
-		return m.client.ImportCalendarEventsFromPayload(payload)
+		req, err := queue.UnmarshalPayload[api.CalendarEventsRequest](payload)
+		if err != nil {
+			return err
+		}
+		partial = failedItems(source, req.Events, itemErrs.Errors, func(items []api.CalendarEventImport) interface{} {
+			return api.CalendarEventsRequest{Events: items}
+		})
 	case queue.RequestTypeImportNotes:
-		return m.client.ImportAppleNotesFromPayload(payload)
+		req, err := queue.UnmarshalPayload[api.AppleNotesRequest](payload)
+		if err != nil {
+			return err
+		}
+		partial = failedItems(source, req.Notes, itemErrs.Errors, func(items []api.AppleNoteImport) interface{} {
+			return api.AppleNotesRequest{Notes: items}
+		})
 	default:
-		log.Warn().Str("type", string(reqType)).Msg("Unknown queued request type")
-		return nil // Don't retry unknown types
+		return itemErrs
 	}
+	partial.Err = itemErrs
+	return partial
 }
 
-// enqueueOnError queues a failed request if the queue is enabled and the error is temporary
-func (m *Manager) enqueueOnError(reqType queue.RequestType, payload interface{}, err error) {
+// enqueueOnError keeps a failed request of a source if the queue is enabled:
+// temporary errors are queued for retry, permanent ones are stored as dead
+// letters. It reports whether the request was kept.
+func (m *Manager) enqueueOnError(source string, reqType queue.RequestType, payload interface{}, err error) bool {
 	if m.queue == nil {
-		return
+		return false
 	}
 
 	if !api.IsTemporaryError(err) {
-		log.Debug().
-			Str("type", string(reqType)).
+		if dlErr := m.queue.AddDeadLetter(source, reqType, payload, err.Error()); dlErr != nil {
+			log.Error().
+				Err(dlErr).
+				Str("type", string(reqType)).
+				Msg("Failed to store rejected request as dead letter")
+			return false
+		}
+		log.Warn().
 			Err(err).
-			Msg("Not queuing permanent error")
-		return
+			Str("type", string(reqType)).
+			Msg("Request rejected by backend, stored as dead letter")
+		return true
 	}
 
-	if queueErr := m.queue.Enqueue(reqType, payload, err.Error()); queueErr != nil {
+	if queueErr := m.queue.Enqueue(source, reqType, payload, err.Error(), api.RetryAfter(err)); queueErr != nil {
+		if errors.Is(queueErr, queue.ErrQueueFull) {
+			log.Warn().
+				Err(queueErr).
+				Str("type", string(reqType)).
+				Msg("Offline queue full, request not queued")
+			return false
+		}
 		log.Error().
 			Err(queueErr).
 			Str("type", string(reqType)).
 			Msg("Failed to queue request for retry")
+		return false
+	}
+	return true
+}
+
+// queueBlocked reports whether sources should wait because the offline queue
+// is full and refuses new requests
+func (m *Manager) queueBlocked() bool {
+	if m.queue == nil || m.config.Queue.Eviction != queue.EvictReject {
+		return false
+	}
+	full, err := m.queue.Full()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to check offline queue budget")
+		return false
+	}
+	return full
+}
+
+// backendDown reports whether sources should wait because the sink's circuit
+// breaker refuses batches
+func (m *Manager) backendDown() bool {
+	b, ok := m.sink.(sink.Breaker)
+	return ok && b.CircuitOpen()
+}
+
+// circuitChanged pauses sources while the backend is down. The scheduler
+// skips their cycles until the breaker lets a probe through; once the backend
+// answers, every source catches up right away.
+func (m *Manager) circuitChanged(open bool) {
+	if open {
+		log.Warn().Msg("Pausing sources until the backend is reachable")
+		return
+	}
+	log.Info().Msg("Backend is back, resuming sources")
+	for _, name := range m.jobOrder {
+		if err := m.Trigger(name); err != nil && !errors.Is(err, ErrPaused) {
+			log.Warn().Err(err).Str("source", name).Msg("Failed to trigger sync")
+		}
+	}
+}
+
+// keepFailedItems stores the items of a batch the backend rejected
+// individually, so moving the checkpoint past the batch doesn't lose them.
+// Items isolated by bisecting a rejected batch become one dead letter each;
+// other failures are queued for retry together. wrap builds the request
+// payload for a subset of items. It reports whether items were queued.
+func keepFailedItems[T any](m *Manager, source string, reqType queue.RequestType, items []T, errs []api.BatchError, wrap func([]T) interface{}) bool {
+	partial := failedItems(source, items, errs, wrap)
+	if m.queue == nil {
+		return false
+	}
+	for _, r := range partial.Rejected {
+		if err := m.queue.AddDeadLetter(source, reqType, r.Payload, r.Error); err != nil {
+			log.Error().Err(err).Str("source", source).Msg("Failed to store rejected item as dead letter")
+		}
+	}
+
+	if partial.Retry != nil {
+		if err := m.queue.Enqueue(source, reqType, partial.Retry, partial.Error(), 0); err != nil {
+			log.Error().Err(err).Str("source", source).Msg("Failed to queue failed items for retry")
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// failedItems sorts the items of a batch the backend rejected individually
+// into those refused outright with a 4xx, a dead letter each, and the payload
+// of the others to retry together
+func failedItems[T any](source string, items []T, errs []api.BatchError, wrap func([]T) interface{}) *queue.PartialError {
+	partial := &queue.PartialError{}
+	var retry []T
+	var retryErrors []string
+	for _, e := range errs {
+		log.Warn().
+			Str("source", source).
+			Int("index", e.Index).
+			Str("error", e.Error).
+			Msg("Item rejected by backend")
+
+		if e.Index < 0 || e.Index >= len(items) {
+			continue
+		}
+		item := items[e.Index]
+
+		if e.StatusCode >= 400 && e.StatusCode < 500 {
+			partial.Rejected = append(partial.Rejected, queue.RejectedItem{Payload: wrap([]T{item}), Error: e.Error})
+			continue
+		}
+		retry = append(retry, item)
+		retryErrors = append(retryErrors, e.Error)
+	}
+
+	partial.Err = fmt.Errorf("%d items failed: %s", len(retry), strings.Join(retryErrors, "; "))
+	if len(retry) > 0 {
+		partial.Retry = wrap(retry)
+	}
+	return partial
+}
+
+// orphanedBackfill reports whether a queue source belongs to a backfill that
+// isn't running, so no backfill cycle will send its queued requests
+func (m *Manager) orphanedBackfill(source string) bool {
+	if !IsBackfill(source) {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.backfills[source]
+	return !ok || run.progress.State != BackfillRunning
+}
+
+// ordered reports whether the requests of a source are sent in the order the
+// source produced them. The outbox always is.
+func (m *Manager) ordered() bool {
+	return m.config.Queue.PreserveOrder || m.config.Queue.Outbox
+}
+
+// outbox reports whether batches go through the queue instead of straight to
+// the backend
+func (m *Manager) outbox() bool {
+	return m.queue != nil && m.config.Queue.Outbox
+}
+
+// writeOutbox stores a batch of a source in the outbox and advances the
+// source's checkpoint past it in the same transaction
+func (m *Manager) writeOutbox(source string, reqType queue.RequestType, payload interface{}, checkpoint string) error {
+	if err := m.queue.EnqueueWithCheckpoint(source, reqType, payload, checkpoint); err != nil {
+		return fmt.Errorf("failed to write batch to outbox: %w", err)
+	}
+	return nil
+}
+
+// drainBacklog sends the queued requests of a source before the source fetches
+// anything new, when the queue preserves order. Newer data never reaches the
+// backend before older data that is still waiting in the queue.
+func (m *Manager) drainBacklog(ctx context.Context, source string) error {
+	if m.queueProcessor == nil || !m.ordered() {
+		return nil
+	}
+
+	sent, err := m.queueProcessor.Drain(ctx, source)
+	if sent > 0 {
+		log.Info().Str("source", source).Int("count", sent).Msg("Queued backlog sent")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send queued backlog: %w", err)
+	}
+	return nil
+}
+
+// startBatch starts the span of a single batch sent to the backend
+func startBatch(ctx context.Context, source string, count int) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "sync.batch",
+		attribute.String("source", source),
+		attribute.Int("count", count),
+	)
+}
+
+// Queue returns the offline queue, or nil if it is disabled
+func (m *Manager) Queue() *queue.Queue {
+	return m.queue
+}
+
+// ProcessQueue retries pending queued requests right away
+func (m *Manager) ProcessQueue(ctx context.Context) error {
+	if m.queueProcessor == nil {
+		return ErrQueueDisabled
+	}
+	m.queueProcessor.ProcessNow(ctx)
+	return nil
+}
+
+// TriggerBacklog gets the queued requests of the given sources sent right
+// away. When the queue preserves order only a source's own job sends them,
+// before it syncs, so ProcessQueue skips them and the jobs are triggered
+// instead. It returns the sources triggered and those whose requests wait for
+// their next sync because they are paused or not registered.
+func (m *Manager) TriggerBacklog(sources []string) (triggered, waiting []string) {
+	if !m.ordered() {
+		return nil, nil
+	}
+	for _, name := range sources {
+		if name == "" {
+			continue
+		}
+		if err := m.Trigger(name); err != nil {
+			log.Debug().Err(err).Str("source", name).Msg("Queued backlog waits for the next sync")
+			waiting = append(waiting, name)
+			continue
+		}
+		triggered = append(triggered, name)
+	}
+	return triggered, waiting
+}
+
+// Checkpoint returns the saved checkpoint of a source
+func (m *Manager) Checkpoint(name string) string {
+	checkpoint, err := m.state.Checkpoint(name)
+	if err != nil {
+		log.Warn().Err(err).Str("source", name).Msg("Failed to read checkpoint")
+	}
+	return checkpoint
+}
+
+// Checkpoints returns the saved checkpoints of all sources
+func (m *Manager) Checkpoints() (map[string]string, error) {
+	return m.state.Checkpoints()
+}
+
+// saveCheckpoint stores the checkpoint a sync cycle reached
+func (m *Manager) saveCheckpoint(name, checkpoint string) {
+	if err := m.state.SetCheckpoint(name, checkpoint, state.ReasonSync); err != nil {
+		log.Warn().Err(err).Str("source", name).Msg("Failed to save state")
+	}
+}
+
+// SetCheckpoint overwrites the checkpoint of a source. It is refused while the
+// source is syncing, since the running cycle would overwrite it again.
+func (m *Manager) SetCheckpoint(name, checkpoint string) error {
+	if j, ok := m.jobs[name]; ok && j.running.Load() {
+		return ErrRunning
+	}
+	return m.state.SetCheckpoint(name, checkpoint, state.ReasonSet)
+}
+
+// ResetCheckpoint makes the next sync of a source start from scratch
+func (m *Manager) ResetCheckpoint(name string) error {
+	if j, ok := m.jobs[name]; ok && j.running.Load() {
+		return ErrRunning
 	}
+	return m.state.DeleteCheckpoint(name)
+}
+
+// CheckpointHistory returns the most recent checkpoint changes of a source
+func (m *Manager) CheckpointHistory(name string, limit int) ([]state.Change, error) {
+	return m.state.History(name, limit)
+}
+
+// RollbackCheckpoint restores a checkpoint from the history of a source
+func (m *Manager) RollbackCheckpoint(name string, id int64) (string, error) {
+	if j, ok := m.jobs[name]; ok && j.running.Load() {
+		return "", ErrRunning
+	}
+	return m.state.Rollback(name, id)
+}
+
+// Status returns the per-source status tracker
+func (m *Manager) Status() *Status {
+	return m.status
 }
 
 func (m *Manager) RegisterSource(src Source) {
-	m.sources = append(m.sources, src)
+	m.addJob(src.Name(), "communications", m.config.Sync.IntervalSeconds, func(ctx context.Context) error {
+		return m.syncSource(ctx, src)
+	})
+	m.watchSource(src.Name(), src)
+	m.rangeSource(src.Name(), src)
 	log.Info().Str("source", src.Name()).Msg("Registered communication source")
 }
 
 func (m *Manager) RegisterContactsSource(src ContactsSource) {
-	m.contactsSources = append(m.contactsSources, src)
+	m.addJob(src.Name(), "contacts", m.config.Sync.ContactsIntervalSeconds, func(ctx context.Context) error {
+		return m.syncContactsSource(ctx, src)
+	})
+	m.watchSource(src.Name(), src)
 	log.Info().Str("source", src.Name()).Msg("Registered contacts source")
 }
 
 func (m *Manager) RegisterCalendarSource(src CalendarSource) {
-	m.calendarSources = append(m.calendarSources, src)
+	m.addJob(src.Name(), "calendar", m.config.Sync.IntervalSeconds, func(ctx context.Context) error {
+		return m.syncCalendarSource(ctx, src)
+	})
 	log.Info().Str("source", src.Name()).Msg("Registered calendar source")
 }
 
 func (m *Manager) RegisterNotesSource(src NotesSource) {
-	m.notesSources = append(m.notesSources, src)
+	m.addJob(src.Name(), "notes", m.config.Sync.IntervalSeconds, func(ctx context.Context) error {
+		return m.syncNotesSource(ctx, src)
+	})
+	m.watchSource(src.Name(), src)
 	log.Info().Str("source", src.Name()).Msg("Registered notes source")
 }
 
 func (m *Manager) Run(ctx context.Context) error {
-	// Load saved state
-	if err := m.state.Load(); err != nil {
-		log.Warn().Err(err).Msg("Failed to load state, starting fresh")
-	}
+	m.mu.Lock()
+	m.runCtx = ctx
+	m.mu.Unlock()
 
 	// Start queue processor in background if enabled
 	if m.queueProcessor != nil {
 		go m.queueProcessor.Run(ctx)
 	}
 
-	ticker := time.NewTicker(time.Duration(m.config.Sync.IntervalSeconds) * time.Second)
-	defer ticker.Stop()
+	// Run every source in its own goroutine on its own schedule
+	var wg sync.WaitGroup
+	for _, name := range m.jobOrder {
+		j := m.jobs[name]
+		log.Info().
+			Str("source", j.name).
+			Dur("interval", j.schedule.Interval).
+			Dur("max_runtime", j.schedule.MaxRuntime).
+			Msg("Scheduling source")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runJob(ctx, j)
+		}()
+	}
 
-	// Initial sync
-	m.syncAll(ctx)
+	// Sync local sources as soon as their databases change
+	m.startWatcher(ctx, &wg)
 
-	for {
-		select {
-		case <-ctx.Done():
-			// Close queue on shutdown
-			if m.queue != nil {
-				if err := m.queue.Close(); err != nil {
-					log.Error().Err(err).Msg("Failed to close queue")
-				}
-			}
-			return nil
-		case <-ticker.C:
-			m.syncAll(ctx)
-		}
-	}
+	<-ctx.Done()
+
+	// Let in-flight cycles and backfills observe the cancellation before
+	// closing the databases
+	wg.Wait()
+	m.backfillWG.Wait()
+	m.close()
+	return nil
 }
 
-func (m *Manager) syncAll(ctx context.Context) {
-	// Sync communication sources
-	for _, src := range m.sources {
-		if err := m.syncSource(ctx, src); err != nil {
-			log.Error().Err(err).Str("source", src.Name()).Msg("Sync failed")
+// RunOnce runs a single cycle of every source that isn't paused and closes
+// the databases afterwards. Contacts run first so the address book is loaded
+// for the allowlist. Failed sources don't stop the others; their errors are
+// returned together.
+func (m *Manager) RunOnce(ctx context.Context) error {
+	defer m.close()
+
+	order := make([]*job, 0, len(m.jobOrder))
+	for _, name := range m.jobOrder {
+		if j := m.jobs[name]; j.kind == "contacts" {
+			order = append(order, j)
 		}
 	}
-
-	// Sync contacts sources
-	for _, src := range m.contactsSources {
-		if err := m.syncContactsSource(ctx, src); err != nil {
-			log.Error().Err(err).Str("source", src.Name()).Msg("Contacts sync failed")
+	for _, name := range m.jobOrder {
+		if j := m.jobs[name]; j.kind != "contacts" {
+			order = append(order, j)
 		}
 	}
 
-	// Sync calendar sources
-	for _, src := range m.calendarSources {
-		if err := m.syncCalendarSource(ctx, src); err != nil {
-			log.Error().Err(err).Str("source", src.Name()).Msg("Calendar sync failed")
+	var errs []error
+	for _, j := range order {
+		if j.paused.Load() {
+			continue
+		}
+		if err := m.runOnce(ctx, j); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, queue.ErrBacklogWaiting) {
+				log.Info().Err(err).Str("source", j.name).Msg("Skipping sync until the queued backlog is due")
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", j.name, err))
 		}
 	}
+	return errors.Join(errs...)
+}
 
-	// Sync notes sources
-	for _, src := range m.notesSources {
-		if err := m.syncNotesSource(ctx, src); err != nil {
-			log.Error().Err(err).Str("source", src.Name()).Msg("Notes sync failed")
+// close closes the queue and state databases
+func (m *Manager) close() {
+	if m.queue != nil {
+		if err := m.queue.Close(); err != nil {
+			log.Error().Err(err).Msg("Failed to close queue")
 		}
 	}
+	if err := m.state.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close state database")
+	}
 }
 
 func (m *Manager) syncSource(ctx context.Context, src Source) error {
-	checkpoint := m.state.GetCheckpoint(src.Name())
+	if err := m.filterReady(src.Name()); err != nil {
+		return err
+	}
+
+	checkpoint, err := m.state.Checkpoint(src.Name())
+	if err != nil {
+		return err
+	}
 	totalSynced := 0
+	var synced time.Time
+	caughtUp := false
 
 	for totalSynced < m.config.Sync.MaxPerCycle {
 		select {
@@ -260,30 +693,74 @@ func (m *Manager) syncSource(ctx context.Context, src Source) error {
 		}
 
 		if len(comms) == 0 {
+			caughtUp = true
 			break
 		}
+		fetched := len(comms)
+		m.status.AddFetched(src.Name(), fetched)
+
+		comms = m.filterCommunications(src.Name(), comms)
+		comms = m.classifyCommunications(src.Name(), comms)
+		m.redactCommunications(src.Name(), comms)
+		if len(comms) == 0 {
+			// Everything in this batch was filtered, move past it
+			checkpoint = newCheckpoint
+			m.saveCheckpoint(src.Name(), checkpoint)
+
+			totalSynced += fetched
+			if fetched < m.config.Sync.BatchSize {
+				caughtUp = true
+				break
+			}
+			continue
+		}
+
+		if m.outbox() {
+			if err := m.writeOutbox(src.Name(), queue.RequestTypeBatchUpsert, api.BatchUpsertRequest{Communications: comms}, newCheckpoint); err != nil {
+				return err
+			}
+			checkpoint = newCheckpoint
+			if err := m.drainBacklog(ctx, src.Name()); err != nil {
+				// The batch is safe in the outbox and is sent first next time
+				return err
+			}
+			m.status.AddSent(src.Name(), len(comms))
+			if t := newestCommunication(comms); t.After(synced) {
+				synced = t
+			}
+
+			totalSynced += fetched
+			if fetched < m.config.Sync.BatchSize {
+				caughtUp = true
+				break
+			}
+			continue
+		}
 
 		// Send to backend
-		result, err := m.client.BatchUpsert(comms)
+		batchCtx, span := startBatch(ctx, src.Name(), len(comms))
+		result, err := m.sink.Communications(batchCtx, src.Name(), comms)
+		tracing.End(span, err)
 		if err != nil {
-			// Queue the failed request for retry
-			m.enqueueOnError(queue.RequestTypeBatchUpsert, api.BatchUpsertRequest{Communications: comms}, err)
-
-			// If it's a temporary error, we should stop this sync cycle
-			// but still update checkpoint so we don't re-fetch the same data
-			if api.IsTemporaryError(err) {
+			m.status.AddFailed(src.Name(), len(comms))
+			// Queue the failed request for retry, or keep it as a dead letter
+			kept := m.enqueueOnError(src.Name(), queue.RequestTypeBatchUpsert, api.BatchUpsertRequest{Communications: comms}, err)
+
+			// Once the batch is kept in the queue or as a dead letter, stop
+			// this sync cycle but still update the checkpoint so we don't
+			// re-fetch the same data. Without a queue, temporary failures
+			// move on as well. A full queue keeps the checkpoint so the batch
+			// is fetched again later.
+			if kept || (m.queue == nil && api.IsTemporaryError(err)) {
 				log.Warn().
 					Err(err).
 					Str("source", src.Name()).
 					Int("count", len(comms)).
-					Msg("Batch queued for retry due to temporary error")
+					Msg("Batch failed, checkpoint advanced past it")
 
 				// Update checkpoint even on failure to avoid re-fetching
 				checkpoint = newCheckpoint
-				m.state.SetCheckpoint(src.Name(), checkpoint)
-				if saveErr := m.state.Save(); saveErr != nil {
-					log.Warn().Err(saveErr).Msg("Failed to save state")
-				}
+				m.saveCheckpoint(src.Name(), checkpoint)
 				return err
 			}
 			return err
@@ -295,21 +772,33 @@ func (m *Manager) syncSource(ctx context.Context, src Source) error {
 			Int("updated", result.Updated).
 			Int("errors", len(result.Errors)).
 			Msg("Batch synced")
+		m.status.AddSent(src.Name(), result.Inserted+result.Updated)
+		m.status.AddFailed(src.Name(), len(result.Errors))
+		queued := keepFailedItems(m, src.Name(), queue.RequestTypeBatchUpsert, comms, result.Errors, func(items []api.Communication) interface{} {
+			return api.BatchUpsertRequest{Communications: items}
+		})
+		if t := newestCommunication(comms); t.After(synced) {
+			synced = t
+		}
 
 		// Update checkpoint
 		checkpoint = newCheckpoint
-		m.state.SetCheckpoint(src.Name(), checkpoint)
-		if err := m.state.Save(); err != nil {
-			log.Warn().Err(err).Msg("Failed to save state")
+		m.saveCheckpoint(src.Name(), checkpoint)
+
+		// The queued items must reach the backend before anything newer
+		if queued && m.ordered() {
+			break
 		}
 
-		totalSynced += len(comms)
+		totalSynced += fetched
 
-		if len(comms) < m.config.Sync.BatchSize {
+		if fetched < m.config.Sync.BatchSize {
+			caughtUp = true
 			break // No more messages
 		}
 	}
 
+	m.recordLag(ctx, src.Name(), src, synced, caughtUp)
 	return nil
 }
 
@@ -338,28 +827,36 @@ func hashContacts(imports []contacts.ContactImport) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func (m *Manager) syncContactsSource(ctx context.Context, src ContactsSource) error {
-	// Contacts use a separate, longer sync interval
-	contactsInterval := time.Duration(m.config.Sync.ContactsIntervalSeconds) * time.Second
-	if !m.lastContactsSync.IsZero() && time.Since(m.lastContactsSync) < contactsInterval {
-		return nil
-	}
+// contactsBatchSize is how many contacts are sent at once, to avoid payload
+// size issues
+const contactsBatchSize = 50
 
+func (m *Manager) syncContactsSource(ctx context.Context, src ContactsSource) error {
 	imports, err := src.SyncContacts(ctx)
 	if err != nil {
 		return err
 	}
+	m.status.AddFetched(src.Name(), len(imports))
+
+	imports = m.filterContacts(src.Name(), imports)
 
 	if len(imports) == 0 {
-		m.lastContactsSync = time.Now()
 		return nil
 	}
 
 	// Check if contacts have changed since last sync
 	hash := hashContacts(imports)
-	if hash == m.lastContactsHash {
+	m.mu.Lock()
+	last, ok := m.contactsHashes[src.Name()]
+	m.mu.Unlock()
+	if !ok && m.outbox() {
+		// The outbox saves the hash as the checkpoint, so it survives restarts
+		if last, err = m.state.Checkpoint(src.Name()); err != nil {
+			return err
+		}
+	}
+	if hash == last {
 		log.Debug().Str("source", src.Name()).Int("count", len(imports)).Msg("Contacts unchanged, skipping import")
-		m.lastContactsSync = time.Now()
 		return nil
 	}
 
@@ -380,20 +877,25 @@ func (m *Manager) syncContactsSource(ctx context.Context, src ContactsSource) er
 		}
 	}
 
-	// Send in batches of 50 to avoid payload size issues
-	const batchSize = 50
+	if m.outbox() {
+		return m.writeContactsOutbox(ctx, src.Name(), apiImports, hash)
+	}
+
 	totalCreated, totalUpdated, totalMerged, totalErrors := 0, 0, 0, 0
 
-	for i := 0; i < len(apiImports); i += batchSize {
-		end := i + batchSize
+	for i := 0; i < len(apiImports); i += contactsBatchSize {
+		end := i + contactsBatchSize
 		if end > len(apiImports) {
 			end = len(apiImports)
 		}
 		batch := apiImports[i:end]
 
-		result, err := m.client.ImportContacts(batch)
+		batchCtx, span := startBatch(ctx, src.Name(), len(batch))
+		result, err := m.sink.Contacts(batchCtx, src.Name(), batch)
+		tracing.End(span, err)
 		if err != nil {
-			m.enqueueOnError(queue.RequestTypeImportContacts, api.ContactsImportRequest{Contacts: batch}, err)
+			m.status.AddFailed(src.Name(), len(batch))
+			m.enqueueOnError(src.Name(), queue.RequestTypeImportContacts, api.ContactsImportRequest{Contacts: batch}, err)
 			if api.IsTemporaryError(err) {
 				log.Warn().
 					Err(err).
@@ -408,23 +910,16 @@ func (m *Manager) syncContactsSource(ctx context.Context, src ContactsSource) er
 		totalUpdated += result.Updated
 		totalMerged += result.Merged
 		totalErrors += len(result.Errors)
-
-		// Log individual errors for debugging
-		for _, e := range result.Errors {
-			contactName := ""
-			if e.Index >= 0 && e.Index < len(batch) {
-				contactName = batch[e.Index].DisplayName
-			}
-			log.Warn().
-				Int("index", e.Index).
-				Str("contact", contactName).
-				Str("error", e.Error).
-				Msg("Contact import error")
-		}
+		m.status.AddSent(src.Name(), result.Created+result.Updated+result.Merged)
+		m.status.AddFailed(src.Name(), len(result.Errors))
+		keepFailedItems(m, src.Name(), queue.RequestTypeImportContacts, batch, result.Errors, func(items []api.ContactImport) interface{} {
+			return api.ContactsImportRequest{Contacts: items}
+		})
 	}
 
-	m.lastContactsSync = time.Now()
-	m.lastContactsHash = hash
+	m.mu.Lock()
+	m.contactsHashes[src.Name()] = hash
+	m.mu.Unlock()
 
 	log.Info().
 		Str("source", src.Name()).
@@ -437,47 +932,140 @@ func (m *Manager) syncContactsSource(ctx context.Context, src ContactsSource) er
 	return nil
 }
 
+// writeContactsOutbox writes contacts to the outbox in batches. Only the last
+// batch saves the hash of the address book as the checkpoint, so after a crash
+// in between the next sync writes all of them again.
+func (m *Manager) writeContactsOutbox(ctx context.Context, source string, imports []api.ContactImport, hash string) error {
+	saved, err := m.state.Checkpoint(source)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(imports); i += contactsBatchSize {
+		end := min(i+contactsBatchSize, len(imports))
+		checkpoint := saved
+		if end == len(imports) {
+			checkpoint = hash
+		}
+		if err := m.writeOutbox(source, queue.RequestTypeImportContacts, api.ContactsImportRequest{Contacts: imports[i:end]}, checkpoint); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	m.contactsHashes[source] = hash
+	m.mu.Unlock()
+
+	if err := m.drainBacklog(ctx, source); err != nil {
+		// The contacts are safe in the outbox and are sent first next time
+		return err
+	}
+	m.status.AddSent(source, len(imports))
+	log.Info().Str("source", source).Int("count", len(imports)).Msg("Contacts synced")
+	return nil
+}
+
 func (m *Manager) syncCalendarSource(ctx context.Context, src CalendarSource) error {
-	checkpoint := m.state.GetCheckpoint(src.Name())
+	// Attendees dropped now would not be fetched again
+	if err := m.filterReady(src.Name()); err != nil {
+		return err
+	}
 
-	events, newCheckpoint, err := src.Sync(ctx, checkpoint)
+	saved, err := m.state.Checkpoint(src.Name())
 	if err != nil {
 		return err
 	}
+	checkpoints := calendar.ParseCheckpoint(saved)
 
-	if len(events) == 0 {
-		return nil
+	result, err := src.Sync(ctx, checkpoints)
+	if err != nil {
+		return err
 	}
 
-	// Convert to API format
-	apiEvents := make([]api.CalendarEventImport, len(events))
-	for i, event := range events {
-		apiEvents[i] = api.CalendarEventImport{
-			SourceID:    event.SourceID,
-			Provider:    event.Provider,
-			Title:       event.Title,
-			Description: event.Description,
-			Location:    event.Location,
-			StartTime:   event.StartTime.Format("2006-01-02T15:04:05Z07:00"),
-			AllDay:      event.AllDay,
-			Attendees:   event.Attendees,
-			CalendarID:  event.CalendarID,
+	// Each provider is committed independently so a failing provider
+	// (e.g. an expired Google token) doesn't hold back the healthy ones
+	for _, pr := range result.Providers {
+		name := src.Name() + "/" + pr.Provider
+
+		if pr.Err != nil {
+			m.status.RecordFailure(name, pr.Err)
+			log.Error().
+				Err(pr.Err).
+				Str("source", src.Name()).
+				Str("provider", pr.Provider).
+				Msg("Calendar provider sync failed")
+			continue
 		}
-		if !event.EndTime.IsZero() {
-			apiEvents[i].EndTime = event.EndTime.Format("2006-01-02T15:04:05Z07:00")
+
+		events := m.filterAttendees(src.Name(), pr.Events)
+		m.redactCalendarEvents(src.Name(), events)
+		if m.outbox() {
+			err = m.writeCalendarOutbox(src.Name(), name, events, checkpoints, pr)
+		} else {
+			err = m.importCalendarEvents(ctx, src.Name(), name, events)
+		}
+		if err != nil {
+			m.status.RecordFailure(name, err)
+			continue
+		}
+
+		m.status.RecordSuccess(name)
+		checkpoints[pr.Provider] = pr.Checkpoint
+	}
+
+	// Update checkpoint for the providers that succeeded
+	m.saveCheckpoint(src.Name(), calendar.FormatCheckpoint(checkpoints))
+
+	if m.outbox() {
+		if err := m.drainBacklog(ctx, src.Name()); err != nil {
+			return err
 		}
 	}
 
+	// Surface provider failures so the source is reported as unhealthy
+	return result.Err()
+}
+
+// writeCalendarOutbox stores the events of a single calendar provider in the
+// outbox, together with the source's checkpoint including the provider's new
+// one
+func (m *Manager) writeCalendarOutbox(source, providerName string, events []calendar.CalendarEvent, checkpoints map[string]string, pr calendar.ProviderResult) error {
+	m.status.AddFetched(providerName, len(events))
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	next := maps.Clone(checkpoints)
+	next[pr.Provider] = pr.Checkpoint
+	req := api.CalendarEventsRequest{Events: calendarImports(events)}
+	return m.writeOutbox(source, queue.RequestTypeImportCalendar, req, calendar.FormatCheckpoint(next))
+}
+
+// importCalendarEvents sends the events of a single calendar provider to the
+// backend. Failed requests are queued under source, the calendar source's name.
+func (m *Manager) importCalendarEvents(ctx context.Context, source, providerName string, events []calendar.CalendarEvent) error {
+	m.status.AddFetched(providerName, len(events))
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	apiEvents := calendarImports(events)
+
 	// Send to backend
-	result, err := m.client.ImportCalendarEvents(apiEvents)
+	batchCtx, span := startBatch(ctx, providerName, len(apiEvents))
+	result, err := m.sink.CalendarEvents(batchCtx, source, apiEvents)
+	tracing.End(span, err)
 	if err != nil {
-		// Queue for retry if it's a temporary error
-		m.enqueueOnError(queue.RequestTypeImportCalendar, api.CalendarEventsRequest{Events: apiEvents}, err)
+		m.status.AddFailed(providerName, len(apiEvents))
+
+		// Queue for retry if it's a temporary error, or keep it as a dead letter
+		m.enqueueOnError(source, queue.RequestTypeImportCalendar, api.CalendarEventsRequest{Events: apiEvents}, err)
 
 		if api.IsTemporaryError(err) {
 			log.Warn().
 				Err(err).
-				Str("source", src.Name()).
+				Str("source", providerName).
 				Int("count", len(apiEvents)).
 				Msg("Calendar events queued for retry due to temporary error")
 		}
@@ -485,24 +1073,50 @@ func (m *Manager) syncCalendarSource(ctx context.Context, src CalendarSource) er
 	}
 
 	log.Info().
-		Str("source", src.Name()).
+		Str("source", providerName).
 		Int("inserted", result.Inserted).
 		Int("updated", result.Updated).
 		Int("errors", len(result.Errors)).
 		Msg("Calendar events synced")
-
-	// Update checkpoint
-	m.state.SetCheckpoint(src.Name(), newCheckpoint)
-	if err := m.state.Save(); err != nil {
-		log.Warn().Err(err).Msg("Failed to save state")
-	}
+	m.status.AddSent(providerName, result.Inserted+result.Updated)
+	m.status.AddFailed(providerName, len(result.Errors))
+	keepFailedItems(m, source, queue.RequestTypeImportCalendar, apiEvents, result.Errors, func(items []api.CalendarEventImport) interface{} {
+		return api.CalendarEventsRequest{Events: items}
+	})
 
 	return nil
 }
 
+// calendarImports converts calendar events to the API format
+func calendarImports(events []calendar.CalendarEvent) []api.CalendarEventImport {
+	apiEvents := make([]api.CalendarEventImport, len(events))
+	for i, event := range events {
+		apiEvents[i] = api.CalendarEventImport{
+			SourceID:    event.SourceID,
+			Provider:    event.Provider,
+			Title:       event.Title,
+			Description: event.Description,
+			Location:    event.Location,
+			StartTime:   event.StartTime.Format("2006-01-02T15:04:05Z07:00"),
+			AllDay:      event.AllDay,
+			Attendees:   event.Attendees,
+			CalendarID:  event.CalendarID,
+		}
+		if !event.EndTime.IsZero() {
+			apiEvents[i].EndTime = event.EndTime.Format("2006-01-02T15:04:05Z07:00")
+		}
+	}
+	return apiEvents
+}
+
 func (m *Manager) syncNotesSource(ctx context.Context, src NotesSource) error {
-	checkpoint := m.state.GetCheckpoint(src.Name())
+	checkpoint, err := m.state.Checkpoint(src.Name())
+	if err != nil {
+		return err
+	}
 	totalSynced := 0
+	var synced time.Time
+	caughtUp := false
 
 	for totalSynced < m.config.Sync.MaxPerCycle {
 		select {
@@ -517,8 +1131,11 @@ func (m *Manager) syncNotesSource(ctx context.Context, src NotesSource) error {
 		}
 
 		if len(noteImports) == 0 {
+			caughtUp = true
 			break
 		}
+		m.status.AddFetched(src.Name(), len(noteImports))
+		m.redactNotes(src.Name(), noteImports)
 
 		// Convert to API format
 		apiNotes := make([]api.AppleNoteImport, len(noteImports))
@@ -537,25 +1154,49 @@ func (m *Manager) syncNotesSource(ctx context.Context, src NotesSource) error {
 			}
 		}
 
+		if m.outbox() {
+			if err := m.writeOutbox(src.Name(), queue.RequestTypeImportNotes, api.AppleNotesRequest{Notes: apiNotes}, newCheckpoint); err != nil {
+				return err
+			}
+			checkpoint = newCheckpoint
+			if err := m.drainBacklog(ctx, src.Name()); err != nil {
+				// The batch is safe in the outbox and is sent first next time
+				return err
+			}
+			m.status.AddSent(src.Name(), len(apiNotes))
+			for _, note := range noteImports {
+				if note.CreatedAt.After(synced) {
+					synced = note.CreatedAt
+				}
+			}
+
+			totalSynced += len(noteImports)
+			if len(noteImports) < m.config.Sync.BatchSize {
+				caughtUp = true
+				break
+			}
+			continue
+		}
+
 		// Send to backend
-		result, err := m.client.ImportAppleNotes(apiNotes)
+		batchCtx, span := startBatch(ctx, src.Name(), len(apiNotes))
+		result, err := m.sink.Notes(batchCtx, src.Name(), apiNotes)
+		tracing.End(span, err)
 		if err != nil {
-			// Queue for retry if it's a temporary error
-			m.enqueueOnError(queue.RequestTypeImportNotes, api.AppleNotesRequest{Notes: apiNotes}, err)
+			m.status.AddFailed(src.Name(), len(apiNotes))
+			// Queue for retry if it's a temporary error, or keep it as a dead letter
+			kept := m.enqueueOnError(src.Name(), queue.RequestTypeImportNotes, api.AppleNotesRequest{Notes: apiNotes}, err)
 
-			if api.IsTemporaryError(err) {
+			if kept || (m.queue == nil && api.IsTemporaryError(err)) {
 				log.Warn().
 					Err(err).
 					Str("source", src.Name()).
 					Int("count", len(apiNotes)).
-					Msg("Notes queued for retry due to temporary error")
+					Msg("Notes batch failed, checkpoint advanced past it")
 
 				// Update checkpoint even on failure to avoid re-fetching
 				checkpoint = newCheckpoint
-				m.state.SetCheckpoint(src.Name(), checkpoint)
-				if saveErr := m.state.Save(); saveErr != nil {
-					log.Warn().Err(saveErr).Msg("Failed to save state")
-				}
+				m.saveCheckpoint(src.Name(), checkpoint)
 			}
 			return err
 		}
@@ -566,20 +1207,34 @@ func (m *Manager) syncNotesSource(ctx context.Context, src NotesSource) error {
 			Int("updated", result.Updated).
 			Int("errors", len(result.Errors)).
 			Msg("Notes synced")
+		m.status.AddSent(src.Name(), result.Inserted+result.Updated)
+		m.status.AddFailed(src.Name(), len(result.Errors))
+		queued := keepFailedItems(m, src.Name(), queue.RequestTypeImportNotes, apiNotes, result.Errors, func(items []api.AppleNoteImport) interface{} {
+			return api.AppleNotesRequest{Notes: items}
+		})
+		for _, note := range noteImports {
+			if note.CreatedAt.After(synced) {
+				synced = note.CreatedAt
+			}
+		}
 
 		// Update checkpoint
 		checkpoint = newCheckpoint
-		m.state.SetCheckpoint(src.Name(), checkpoint)
-		if err := m.state.Save(); err != nil {
-			log.Warn().Err(err).Msg("Failed to save state")
+		m.saveCheckpoint(src.Name(), checkpoint)
+
+		// The queued items must reach the backend before anything newer
+		if queued && m.ordered() {
+			break
 		}
 
 		totalSynced += len(noteImports)
 
 		if len(noteImports) < m.config.Sync.BatchSize {
+			caughtUp = true
 			break
 		}
 	}
 
+	m.recordLag(ctx, src.Name(), src, synced, caughtUp)
 	return nil
 }
@@ -0,0 +1,293 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/sink"
+	"pkb-daemon/internal/sources/calendar"
+	"pkb-daemon/internal/state"
+)
+
+// fixedCalendar returns the same provider results on every sync
+type fixedCalendar struct {
+	results []calendar.ProviderResult
+}
+
+func (c *fixedCalendar) Name() string { return "calendar" }
+
+func (c *fixedCalendar) Sync(context.Context, map[string]string) (*calendar.SyncResult, error) {
+	return &calendar.SyncResult{Providers: c.results}, nil
+}
+
+// newTestManager returns a manager with its state in a temporary directory
+func newTestManager(t *testing.T, syncCfg config.SyncConfig) *Manager {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{Sync: syncCfg}
+	cfg.State.Path = filepath.Join(dir, "state.json")
+	cfg.State.DBPath = filepath.Join(dir, "state.db")
+
+	m := NewManager(nil, cfg)
+	if err := m.InitState(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.state.Close() })
+	return m
+}
+
+// useFileSink makes m deliver to a JSONL file
+func useFileSink(t *testing.T, m *Manager) *sink.File {
+	t.Helper()
+	file, err := sink.OpenFile(filepath.Join(t.TempDir(), "export.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	m.sink = file
+	return file
+}
+
+func TestCalendarProviderFailure(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{MaxConcurrent: 1})
+	file := useFileSink(t, m)
+	if err := m.SetCheckpoint("calendar", `{"work":"2024-01-01T00:00:00Z"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := errors.New("oauth2: token expired")
+	now := time.Now().UTC().Format(time.RFC3339)
+	src := &fixedCalendar{results: []calendar.ProviderResult{
+		{Provider: "work", Err: expired},
+		{Provider: "apple", Checkpoint: now, Events: []calendar.CalendarEvent{{SourceID: "e1", Title: "Lunch"}}},
+	}}
+
+	if err := m.syncCalendarSource(context.Background(), src); !errors.Is(err, expired) {
+		t.Errorf("err = %v, want the failed provider's error", err)
+	}
+	if file.Records() != 1 {
+		t.Errorf("sent %d batches, want the healthy provider's", file.Records())
+	}
+
+	// The failing provider keeps its checkpoint and is retried next time
+	checkpoints := calendar.ParseCheckpoint(m.Checkpoint("calendar"))
+	if checkpoints["work"] != "2024-01-01T00:00:00Z" || checkpoints["apple"] != now {
+		t.Errorf("checkpoints = %v", checkpoints)
+	}
+
+	work, _ := m.status.Get("calendar/work")
+	if work.LastError == "" || work.ConsecutiveFailures != 1 {
+		t.Errorf("calendar/work status = %+v, want the failure", work)
+	}
+	apple, _ := m.status.Get("calendar/apple")
+	if apple.LastSuccess.IsZero() || apple.LastError != "" {
+		t.Errorf("calendar/apple status = %+v, want a success", apple)
+	}
+}
+
+func TestEnqueueOnError(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{})
+	q, err := queue.New(queue.Config{Path: filepath.Join(t.TempDir(), "queue.db"), MaxRetries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	m.queue = q
+
+	rejected := &api.APIError{StatusCode: http.StatusBadRequest}
+	if !m.enqueueOnError("gmail", queue.RequestTypeBatchUpsert, "c1", rejected) {
+		t.Error("rejected request not kept")
+	}
+	unavailable := &api.APIError{StatusCode: http.StatusServiceUnavailable, Temporary: true}
+	if !m.enqueueOnError("gmail", queue.RequestTypeBatchUpsert, "c2", unavailable) {
+		t.Error("failed request not kept")
+	}
+
+	// A rejected request would only be rejected again, so it isn't retried
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PendingCount != 1 || stats.DeadLetters != 1 {
+		t.Errorf("pending = %d, dead letters = %d, want 1 each", stats.PendingCount, stats.DeadLetters)
+	}
+	dead, err := q.ListDeadLetters(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || string(dead[0].Payload) != `"c1"` || dead[0].Source != "gmail" {
+		t.Errorf("dead letters = %+v, want c1 of gmail", dead)
+	}
+}
+
+// oneBatch returns a single message, then nothing
+type oneBatch struct{}
+
+func (oneBatch) Name() string { return "imessage" }
+
+func (oneBatch) Sync(_ context.Context, checkpoint string, _ int) ([]api.Communication, string, error) {
+	if checkpoint != "" {
+		return nil, checkpoint, nil
+	}
+	return []api.Communication{{SourceID: "m1", Content: "hi"}}, "1", nil
+}
+
+// downSink fails every batch as if the backend were unreachable
+type downSink struct {
+	sink.Sink
+}
+
+func (downSink) Communications(context.Context, string, []api.Communication) (*api.BatchUpsertResponse, error) {
+	return nil, &api.APIError{StatusCode: http.StatusServiceUnavailable, Temporary: true}
+}
+
+func TestOutbox(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{BatchSize: 10, MaxPerCycle: 100})
+	m.config.Queue = config.QueueConfig{
+		Enabled:    true,
+		Path:       m.config.State.DBPath,
+		MaxRetries: 10,
+		BatchSize:  10,
+		Eviction:   queue.EvictReject,
+		Outbox:     true,
+	}
+	if err := m.InitQueue(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.queue.Close() })
+	file := useFileSink(t, m)
+
+	// The batch and its checkpoint are stored together before it is sent
+	m.sink = downSink{file}
+	if err := m.syncSource(context.Background(), oneBatch{}); err == nil {
+		t.Error("sync succeeded with the backend down")
+	}
+	if cp := m.Checkpoint("imessage"); cp != "1" {
+		t.Errorf("checkpoint = %q, want 1", cp)
+	}
+	if backlog, err := m.queue.Backlog("imessage", 10); err != nil || len(backlog) != 1 {
+		t.Fatalf("outbox = %d requests (%v), want the batch", len(backlog), err)
+	}
+
+	// Once the backend is back the next cycle sends the outbox first
+	m.sink = file
+	if err := m.drainBacklog(context.Background(), "imessage"); err != nil {
+		t.Fatal(err)
+	}
+	if file.Records() != 1 {
+		t.Errorf("sent %d batches, want 1", file.Records())
+	}
+	if backlog, err := m.queue.Backlog("imessage", 10); err != nil || len(backlog) != 0 {
+		t.Errorf("outbox = %d requests (%v), want none", len(backlog), err)
+	}
+}
+
+// partialSink takes every communication except m2, which fails, and m3,
+// which is rejected outright
+type partialSink struct {
+	sink.Sink
+}
+
+func (partialSink) Communications(_ context.Context, _ string, comms []api.Communication) (*api.BatchUpsertResponse, error) {
+	resp := &api.BatchUpsertResponse{}
+	for i, c := range comms {
+		switch c.SourceID {
+		case "m2":
+			resp.Errors = append(resp.Errors, api.BatchError{Index: i, Error: "deadlock"})
+		case "m3":
+			resp.Errors = append(resp.Errors, api.BatchError{Index: i, Error: "invalid", StatusCode: http.StatusUnprocessableEntity})
+		default:
+			resp.Inserted++
+		}
+	}
+	return resp, nil
+}
+
+func TestQueuedBatchKeepsFailedItems(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{})
+	m.config.Queue = config.QueueConfig{
+		Enabled:       true,
+		Path:          m.config.State.DBPath,
+		MaxRetries:    10,
+		BatchSize:     10,
+		Eviction:      queue.EvictReject,
+		PreserveOrder: true,
+	}
+	if err := m.InitQueue(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.queue.Close() })
+	m.sink = partialSink{}
+
+	batch := api.BatchUpsertRequest{Communications: []api.Communication{{SourceID: "m1"}, {SourceID: "m2"}, {SourceID: "m3"}}}
+	if err := m.queue.Enqueue("imessage", queue.RequestTypeBatchUpsert, batch, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.drainBacklog(context.Background(), "imessage"); err == nil {
+		t.Error("drain succeeded with m2 failing")
+	}
+
+	// Only the item that failed is retried; the rejected one is a dead letter
+	backlog, err := m.queue.Backlog("imessage", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || backlog[0].Retries != 1 {
+		t.Fatalf("backlog = %+v, want the request retried once", backlog)
+	}
+	retry, err := queue.UnmarshalPayload[api.BatchUpsertRequest](backlog[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retry.Communications) != 1 || retry.Communications[0].SourceID != "m2" {
+		t.Errorf("retried %+v, want only m2", retry.Communications)
+	}
+	dead, err := m.queue.ListDeadLetters(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Source != "imessage" || dead[0].Reason != queue.DeadReasonPermanent {
+		t.Fatalf("dead letters = %+v, want m3 of imessage", dead)
+	}
+	rejected, err := queue.UnmarshalPayload[api.BatchUpsertRequest](dead[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected.Communications) != 1 || rejected.Communications[0].SourceID != "m3" {
+		t.Errorf("dead letter %+v, want only m3", rejected.Communications)
+	}
+}
+
+func TestOutboxOnExistingState(t *testing.T) {
+	dir := t.TempDir()
+	previous, err := state.Open(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := previous.SetCheckpoint("imessage", "42", state.ReasonSync); err != nil {
+		t.Fatal(err)
+	}
+	previous.Close()
+
+	// Turning on the outbox moves the state into the queue database
+	cfg := &config.Config{}
+	cfg.State.Path = filepath.Join(dir, "state.json")
+	cfg.State.DBPath = filepath.Join(dir, "queue.db")
+	cfg.State.PreviousDBPath = filepath.Join(dir, "state.db")
+	m := NewManager(nil, cfg)
+	if err := m.InitState(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.state.Close() })
+
+	if cp := m.Checkpoint("imessage"); cp != "42" {
+		t.Errorf("checkpoint = %q, want 42 from the previous state database", cp)
+	}
+}
@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/metrics"
+)
+
+// NewestItemSource is implemented by sources that can cheaply report the
+// timestamp of their newest item, which is used to export checkpoint lag
+type NewestItemSource interface {
+	NewestItem(ctx context.Context) (time.Time, error)
+}
+
+// recordLag exports how far a source is behind after a cycle. synced is the
+// newest item delivered in the cycle; caughtUp is true if the cycle drained
+// the source.
+func (m *Manager) recordLag(ctx context.Context, name string, src any, synced time.Time, caughtUp bool) {
+	m.mu.Lock()
+	if synced.After(m.lastSynced[name]) {
+		m.lastSynced[name] = synced
+	}
+	last := m.lastSynced[name]
+	m.mu.Unlock()
+
+	if !last.IsZero() {
+		metrics.SetSynced(name, last)
+	}
+
+	ns, ok := src.(NewestItemSource)
+	if !ok {
+		return
+	}
+	newest, err := ns.NewestItem(ctx)
+	if err != nil || newest.IsZero() {
+		log.Debug().Err(err).Str("source", name).Msg("Failed to read newest item for lag metric")
+		return
+	}
+
+	switch {
+	case caughtUp:
+		metrics.SetLag(name, newest, 0)
+	case !last.IsZero():
+		metrics.SetLag(name, newest, newest.Sub(last))
+	}
+}
+
+// newestCommunication returns the latest timestamp in a batch
+func newestCommunication(comms []api.Communication) time.Time {
+	var newest time.Time
+	for _, c := range comms {
+		if t, err := time.Parse(time.RFC3339, c.Timestamp); err == nil && t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/redact"
+	"pkb-daemon/internal/sources/calendar"
+	"pkb-daemon/internal/sources/notes"
+)
+
+// SetRedactor sets the redaction stage applied before data leaves the machine
+func (m *Manager) SetRedactor(r *redact.Redactor) {
+	m.redactor = r
+}
+
+// redactCommunications masks sensitive content, including text in metadata
+// such as the Gmail snippet, and records the applied redactions in metadata
+func (m *Manager) redactCommunications(source string, comms []api.Communication) {
+	if m.redactor == nil {
+		return
+	}
+
+	total := redact.Report{}
+	for i := range comms {
+		c := &comms[i]
+		fields := []*string{&c.Subject, &c.Content}
+		texts := make(map[string]*string)
+		for key, value := range c.Metadata {
+			if text, ok := value.(string); ok {
+				texts[key] = &text
+				fields = append(fields, &text)
+			}
+		}
+		report := m.redactor.Redact(source, fields...)
+		if len(report) == 0 {
+			continue
+		}
+		for key, text := range texts {
+			c.Metadata[key] = *text
+		}
+		mergeReport(total, report)
+
+		if m.redactor.Mode(source) == redact.ModeRedact {
+			if c.Metadata == nil {
+				c.Metadata = make(map[string]interface{})
+			}
+			c.Metadata["redactions"] = map[string]int(report)
+		}
+	}
+	m.logRedactions(source, total)
+}
+
+// redactNotes masks sensitive content in notes
+func (m *Manager) redactNotes(source string, imports []notes.NoteImport) {
+	if m.redactor == nil {
+		return
+	}
+
+	total := redact.Report{}
+	for i := range imports {
+		mergeReport(total, m.redactor.Redact(source, &imports[i].Title, &imports[i].Content))
+	}
+	m.logRedactions(source, total)
+}
+
+// redactCalendarEvents masks sensitive content in event titles, descriptions and locations
+func (m *Manager) redactCalendarEvents(source string, events []calendar.CalendarEvent) {
+	if m.redactor == nil {
+		return
+	}
+
+	total := redact.Report{}
+	for i := range events {
+		e := &events[i]
+		mergeReport(total, m.redactor.Redact(source, &e.Title, &e.Description, &e.Location))
+	}
+	m.logRedactions(source, total)
+}
+
+func (m *Manager) logRedactions(source string, report redact.Report) {
+	if len(report) == 0 {
+		return
+	}
+
+	event := log.Info().Str("source", source).Str("mode", string(m.redactor.Mode(source)))
+	for name, count := range report {
+		event = event.Int(name, count)
+	}
+	if m.redactor.Mode(source) == redact.ModeReport {
+		event.Msg("Redaction report (dry run, content unchanged)")
+	} else {
+		event.Msg("Redacted sensitive content")
+	}
+}
+
+func mergeReport(dst, src redact.Report) {
+	for name, count := range src {
+		dst[name] += count
+	}
+}
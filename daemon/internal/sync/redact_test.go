@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+
+	"pkb-daemon/internal/api"
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/redact"
+)
+
+func TestRedactCommunicationsMetadata(t *testing.T) {
+	r, err := redact.New(config.RedactionConfig{Mode: string(redact.ModeRedact)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{}
+	m.SetRedactor(r)
+
+	comms := []api.Communication{{
+		Subject: "Your order",
+		Content: "Paid with 4111 1111 1111 1111",
+		Metadata: map[string]interface{}{
+			"account": "personal",
+			"snippet": "Paid with 4111 1111 1111 1111",
+		},
+	}}
+	m.redactCommunications("gmail", comms)
+
+	c := comms[0]
+	if strings.Contains(c.Content, "4111") {
+		t.Errorf("content not redacted: %q", c.Content)
+	}
+	if snippet := c.Metadata["snippet"].(string); strings.Contains(snippet, "4111") {
+		t.Errorf("snippet not redacted: %q", snippet)
+	}
+	if c.Metadata["account"] != "personal" {
+		t.Errorf("account = %v, want it unchanged", c.Metadata["account"])
+	}
+	if got := c.Metadata["redactions"].(map[string]int)[redact.DetectorCreditCard]; got != 2 {
+		t.Errorf("card redactions = %d, want 2", got)
+	}
+}
@@ -0,0 +1,344 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/metrics"
+	"pkb-daemon/internal/queue"
+	"pkb-daemon/internal/tracing"
+)
+
+var (
+	// ErrPaused is returned when triggering a paused source
+	ErrPaused = errors.New("source is paused")
+	// ErrRunning is returned when changing the checkpoint of a source mid-sync
+	ErrRunning = errors.New("source is running")
+	// ErrUnknownSource is returned for a source that isn't registered
+	ErrUnknownSource = errors.New("unknown source")
+)
+
+// Schedule controls when a single source runs
+type Schedule struct {
+	Interval   time.Duration // time between successful runs
+	Jitter     time.Duration // random delay added to every wait
+	MaxRuntime time.Duration // a run is cancelled after this long
+	BackoffMax time.Duration // upper bound of the wait after consecutive failures
+}
+
+// next returns the wait before the next run given the number of consecutive failures.
+// Failures double the interval up to BackoffMax.
+func (s Schedule) next(failures int) time.Duration {
+	wait := s.Interval
+	for i := 0; i < failures && wait < s.BackoffMax; i++ {
+		wait *= 2
+	}
+	if failures > 0 && wait > s.BackoffMax {
+		wait = s.BackoffMax
+	}
+	if s.Jitter > 0 {
+		wait += jitter(s.Jitter)
+	}
+	return wait
+}
+
+// after returns the wait before the next cycle of a source whose cycle ended
+// with err, and its consecutive failures. A source waiting for its queued
+// backlog to be due isn't failing; it runs again when the backlog is due.
+func (s Schedule) after(err error, failures int) (time.Duration, int) {
+	var waiting *queue.WaitingError
+	switch {
+	case err == nil:
+		return s.next(0), 0
+	case errors.As(err, &waiting):
+		return max(time.Until(waiting.Until), 0), failures
+	default:
+		return s.next(failures + 1), failures + 1
+	}
+}
+
+// jitter returns a random delay below max. Tests replace it to get fixed waits.
+var jitter = func(max time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// job is a registered source that runs in its own goroutine on its own schedule
+type job struct {
+	name     string
+	kind     string // "communications", "contacts", "calendar" or "notes"
+	run      func(ctx context.Context) error
+	schedule Schedule
+	trigger  chan struct{}
+	running  atomic.Bool
+	paused   atomic.Bool
+}
+
+// scheduleFor builds the schedule of a source from the global sync settings
+// and its entry under sync.sources, if any
+func scheduleFor(cfg config.SyncConfig, name string, defaultInterval int) Schedule {
+	interval := defaultInterval
+	jitter := cfg.JitterSeconds
+	maxRuntime := cfg.MaxRuntimeSeconds
+	backoffMax := cfg.BackoffMaxSeconds
+
+	if sc, ok := cfg.Sources[name]; ok {
+		if sc.IntervalSeconds > 0 {
+			interval = sc.IntervalSeconds
+		}
+		if sc.JitterSeconds > 0 {
+			jitter = sc.JitterSeconds
+		}
+		if sc.MaxRuntimeSeconds > 0 {
+			maxRuntime = sc.MaxRuntimeSeconds
+		}
+		if sc.BackoffMaxSeconds > 0 {
+			backoffMax = sc.BackoffMaxSeconds
+		}
+	}
+	if backoffMax < interval {
+		backoffMax = interval
+	}
+
+	return Schedule{
+		Interval:   time.Duration(interval) * time.Second,
+		Jitter:     time.Duration(jitter) * time.Second,
+		MaxRuntime: time.Duration(maxRuntime) * time.Second,
+		BackoffMax: time.Duration(backoffMax) * time.Second,
+	}
+}
+
+// addJob registers a source with the scheduler
+func (m *Manager) addJob(name, kind string, defaultInterval int, run func(ctx context.Context) error) {
+	if _, exists := m.jobs[name]; exists {
+		log.Warn().Str("source", name).Msg("Source registered twice, ignoring duplicate")
+		return
+	}
+
+	j := &job{
+		name:     name,
+		kind:     kind,
+		run:      run,
+		schedule: scheduleFor(m.config.Sync, name, defaultInterval),
+		trigger:  make(chan struct{}, 1),
+	}
+	m.jobs[name] = j
+	m.jobOrder = append(m.jobOrder, name)
+}
+
+// job returns the registered job of a source
+func (m *Manager) job(name string) (*job, error) {
+	j, ok := m.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSource, name)
+	}
+	return j, nil
+}
+
+// Trigger requests an immediate run of a source. If the source is already
+// running, a single follow-up run is scheduled once it finishes.
+func (m *Manager) Trigger(name string) error {
+	j, err := m.job(name)
+	if err != nil {
+		return err
+	}
+	if j.paused.Load() {
+		return ErrPaused
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+		// A run is already pending
+	}
+	return nil
+}
+
+// SourceInfo describes a registered source
+type SourceInfo struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// Sources returns the registered sources in registration order
+func (m *Manager) Sources() []SourceInfo {
+	sources := make([]SourceInfo, 0, len(m.jobOrder))
+	for _, name := range m.jobOrder {
+		sources = append(sources, SourceInfo{Name: name, Kind: m.jobs[name].kind})
+	}
+	return sources
+}
+
+// Pause stops scheduled and triggered runs of a source. A run already in
+// progress finishes normally.
+func (m *Manager) Pause(name string) error {
+	j, err := m.job(name)
+	if err != nil {
+		return err
+	}
+	if !j.paused.Swap(true) {
+		m.status.SetPaused(name, true)
+		log.Info().Str("source", name).Msg("Source paused")
+	}
+	return nil
+}
+
+// Resume re-enables a paused source and runs it right away
+func (m *Manager) Resume(name string) error {
+	j, err := m.job(name)
+	if err != nil {
+		return err
+	}
+	if j.paused.Swap(false) {
+		m.status.SetPaused(name, false)
+		log.Info().Str("source", name).Msg("Source resumed")
+		return m.Trigger(name)
+	}
+	return nil
+}
+
+// runJob runs a source until ctx is cancelled. Each source has a single
+// goroutine, so its cycles never overlap.
+func (m *Manager) runJob(ctx context.Context, j *job) {
+	// Spread out the first runs so sources don't all start at once
+	var initial time.Duration
+	if j.schedule.Jitter > 0 {
+		initial = jitter(j.schedule.Jitter)
+	}
+	timer := time.NewTimer(initial)
+	defer timer.Stop()
+
+	failures := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-j.trigger:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		if j.paused.Load() {
+			// Keep the schedule ticking so resuming doesn't need to wake the loop
+			timer.Reset(j.schedule.Interval)
+			m.status.SetNextRun(j.name, time.Time{})
+			continue
+		}
+
+		if m.queueBlocked() {
+			// Nothing could be kept if the backend fails, so wait for the
+			// queue to drain instead of fetching
+			log.Info().Str("source", j.name).Msg("Offline queue full, skipping sync")
+			m.status.SetBlocked(j.name, true)
+			timer.Reset(j.schedule.Interval)
+			m.status.SetNextRun(j.name, time.Now().Add(j.schedule.Interval))
+			continue
+		}
+		m.status.SetBlocked(j.name, false)
+
+		if m.backendDown() {
+			// Everything would fail fast; wait for the circuit to let a probe through
+			log.Debug().Str("source", j.name).Msg("Backend down, skipping sync")
+			m.status.SetBackendDown(j.name, true)
+			timer.Reset(j.schedule.Interval)
+			m.status.SetNextRun(j.name, time.Now().Add(j.schedule.Interval))
+			continue
+		}
+		m.status.SetBackendDown(j.name, false)
+
+		err := m.runOnce(ctx, j)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+
+		var wait time.Duration
+		wait, failures = j.schedule.after(err, failures)
+		m.status.SetNextRun(j.name, time.Now().Add(wait))
+		if err != nil && !errors.Is(err, queue.ErrBacklogWaiting) {
+			log.Warn().
+				Str("source", j.name).
+				Int("failures", failures).
+				Dur("retry_in", wait).
+				Msg("Backing off after sync failure")
+		}
+		timer.Reset(wait)
+	}
+}
+
+// runOnce runs a single cycle of a source, respecting the global concurrency limit
+func (m *Manager) runOnce(ctx context.Context, j *job) error {
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-m.slots }()
+
+	j.running.Store(true)
+	m.status.SetRunning(j.name, true)
+	defer func() {
+		j.running.Store(false)
+		m.status.SetRunning(j.name, false)
+	}()
+
+	runCtx := ctx
+	if j.schedule.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, j.schedule.MaxRuntime)
+		defer cancel()
+	}
+
+	runCtx, span := tracing.Start(runCtx, "sync.cycle",
+		attribute.String("source", j.name),
+		attribute.String("kind", j.kind),
+	)
+
+	before, _ := m.status.Get(j.name)
+	start := time.Now()
+	err := m.drainBacklog(runCtx, j.name)
+	if errors.Is(err, queue.ErrBacklogWaiting) {
+		// The source waits for its own retry schedule; nothing failed
+		tracing.End(span, nil)
+		log.Debug().Err(err).Str("source", j.name).Msg("Sync waiting for queued backlog")
+		return err
+	}
+	if err == nil {
+		err = j.run(runCtx)
+	}
+	metrics.ObserveSync(j.name, time.Since(start), err)
+	tracing.End(span, err)
+	m.recordRun(j.name, before, err)
+	if err != nil {
+		m.status.RecordFailure(j.name, err)
+		log.Error().Err(err).Str("source", j.name).Str("kind", j.kind).Msg("Sync failed")
+		return err
+	}
+
+	m.status.RecordSuccess(j.name)
+	log.Debug().Str("source", j.name).Dur("duration", time.Since(start)).Msg("Sync cycle complete")
+	return nil
+}
+
+// recordRun keeps the outcome and item counts of a cycle in the state database
+func (m *Manager) recordRun(name string, before SourceStatus, err error) {
+	after, _ := m.status.Get(name)
+	if err := m.state.RecordRun(name, err,
+		after.ItemsFetched-before.ItemsFetched,
+		after.ItemsSent-before.ItemsSent,
+		after.ItemsFailed-before.ItemsFailed,
+	); err != nil {
+		log.Warn().Err(err).Str("source", name).Msg("Failed to save source metadata")
+	}
+}
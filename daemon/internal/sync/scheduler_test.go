@@ -0,0 +1,174 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/config"
+	"pkb-daemon/internal/queue"
+)
+
+func TestScheduleNext(t *testing.T) {
+	defer func(orig func(time.Duration) time.Duration) { jitter = orig }(jitter)
+	// Half the allowed jitter every time
+	jitter = func(max time.Duration) time.Duration { return max / 2 }
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		failures int
+		want     time.Duration
+	}{
+		{"success", Schedule{Interval: time.Minute, BackoffMax: time.Hour}, 0, time.Minute},
+		{"one failure", Schedule{Interval: time.Minute, BackoffMax: time.Hour}, 1, 2 * time.Minute},
+		{"three failures", Schedule{Interval: time.Minute, BackoffMax: time.Hour}, 3, 8 * time.Minute},
+		{"capped", Schedule{Interval: time.Minute, BackoffMax: 5 * time.Minute}, 3, 5 * time.Minute},
+		{"many failures", Schedule{Interval: time.Minute, BackoffMax: time.Hour}, 100, time.Hour},
+		{"jitter", Schedule{Interval: time.Minute, Jitter: 10 * time.Second, BackoffMax: time.Hour}, 0, time.Minute + 5*time.Second},
+		{"jitter after the cap", Schedule{Interval: time.Minute, Jitter: 10 * time.Second, BackoffMax: 5 * time.Minute}, 3, 5*time.Minute + 5*time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.next(tt.failures); got != tt.want {
+				t.Errorf("next(%d) = %s, want %s", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleFor(t *testing.T) {
+	cfg := config.SyncConfig{
+		JitterSeconds:     5,
+		MaxRuntimeSeconds: 600,
+		BackoffMaxSeconds: 900,
+		Sources: map[string]config.SourceScheduleConfig{
+			"gmail": {IntervalSeconds: 300, JitterSeconds: 30},
+			"notes": {IntervalSeconds: 3600},
+		},
+	}
+	tests := []struct {
+		name string
+		want Schedule
+	}{
+		{"imessage", Schedule{Interval: time.Minute, Jitter: 5 * time.Second, MaxRuntime: 10 * time.Minute, BackoffMax: 15 * time.Minute}},
+		{"gmail", Schedule{Interval: 5 * time.Minute, Jitter: 30 * time.Second, MaxRuntime: 10 * time.Minute, BackoffMax: 15 * time.Minute}},
+		// Backoff never waits less than the interval
+		{"notes", Schedule{Interval: time.Hour, Jitter: 5 * time.Second, MaxRuntime: 10 * time.Minute, BackoffMax: time.Hour}},
+	}
+	for _, tt := range tests {
+		if got := scheduleFor(cfg, tt.name, 60); got != tt.want {
+			t.Errorf("scheduleFor(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{MaxConcurrent: 1})
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	run := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			started <- name
+			<-release
+			return nil
+		}
+	}
+	m.addJob("first", "communications", 60, run("first"))
+	m.addJob("second", "communications", 60, run("second"))
+
+	ctx := context.Background()
+	done := make(chan error, 2)
+	go func() { done <- m.runOnce(ctx, m.jobs["first"]) }()
+	if name := <-started; name != "first" {
+		t.Fatalf("%s started first", name)
+	}
+	go func() { done <- m.runOnce(ctx, m.jobs["second"]) }()
+
+	select {
+	case name := <-started:
+		t.Fatalf("%s started while first was running", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if name := <-started; name != "second" {
+		t.Errorf("%s started, want second", name)
+	}
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTriggerCoalesces(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{MaxConcurrent: 1})
+	m.addJob("imessage", "communications", 60, func(context.Context) error { return nil })
+
+	for range 3 {
+		if err := m.Trigger("imessage"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(m.jobs["imessage"].trigger); n != 1 {
+		t.Errorf("%d runs pending, want 1", n)
+	}
+
+	if err := m.Pause("imessage"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Trigger("imessage"); !errors.Is(err, ErrPaused) {
+		t.Errorf("Trigger paused source = %v, want ErrPaused", err)
+	}
+	if err := m.Trigger("gmail"); !errors.Is(err, ErrUnknownSource) {
+		t.Errorf("Trigger unknown source = %v, want ErrUnknownSource", err)
+	}
+}
+
+func TestBacklogWaitingIsNotAFailure(t *testing.T) {
+	m := newTestManager(t, config.SyncConfig{MaxConcurrent: 1})
+	m.config.Queue = config.QueueConfig{
+		Enabled:       true,
+		Path:          m.config.State.DBPath,
+		MaxRetries:    10,
+		BatchSize:     10,
+		Eviction:      queue.EvictReject,
+		PreserveOrder: true,
+	}
+	if err := m.InitQueue(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.queue.Close() })
+	useFileSink(t, m)
+	m.addJob("imessage", "communications", 60, func(context.Context) error {
+		t.Error("source synced before its queued backlog")
+		return nil
+	})
+	if err := m.queue.Enqueue("imessage", queue.RequestTypeBatchUpsert, "c1", "backend down", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.runOnce(context.Background(), m.jobs["imessage"])
+	if !errors.Is(err, queue.ErrBacklogWaiting) {
+		t.Fatalf("err = %v, want ErrBacklogWaiting", err)
+	}
+	if status, _ := m.status.Get("imessage"); status.ConsecutiveFailures != 0 || status.LastError != "" {
+		t.Errorf("status = %+v, want no failure recorded", status)
+	}
+
+	// The source runs again when the backlog is due, without backing off
+	schedule := m.jobs["imessage"].schedule
+	wait, failures := schedule.after(err, 2)
+	if failures != 2 || wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("after waiting = %s with %d failures, want about 1h with 2", wait, failures)
+	}
+	if _, failures := schedule.after(errors.New("boom"), 2); failures != 3 {
+		t.Errorf("after an error = %d failures, want 3", failures)
+	}
+	if _, failures := schedule.after(nil, 2); failures != 0 {
+		t.Errorf("after success = %d failures, want 0", failures)
+	}
+}
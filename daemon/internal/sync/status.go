@@ -0,0 +1,188 @@
+package sync
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"pkb-daemon/internal/metrics"
+	"pkb-daemon/internal/state"
+)
+
+// SourceStatus tracks the health and throughput of a single source.
+// Calendar providers are tracked individually as "calendar/<provider>".
+type SourceStatus struct {
+	Name                string    `json:"name"`
+	LastRun             time.Time `json:"last_run"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorAt         time.Time `json:"last_error_at"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Running             bool      `json:"running"`
+	Paused              bool      `json:"paused"`
+	Blocked             bool      `json:"blocked"`      // waiting for room in the offline queue
+	BackendDown         bool      `json:"backend_down"` // waiting for the backend's circuit to close
+	NextRun             time.Time `json:"next_run"`
+	ItemsFetched        int64     `json:"items_fetched"`
+	ItemsSent           int64     `json:"items_sent"`
+	ItemsFailed         int64     `json:"items_failed"`
+	ItemsFiltered       int64     `json:"items_filtered"`
+	Errors              int64     `json:"errors"`
+}
+
+// Status holds per-source status for the lifetime of the daemon.
+// Every update is mirrored to the Prometheus metrics.
+type Status struct {
+	mu      sync.RWMutex
+	sources map[string]*SourceStatus
+}
+
+func NewStatus() *Status {
+	return &Status{
+		sources: make(map[string]*SourceStatus),
+	}
+}
+
+// get returns the status entry for a source, creating it if needed. Caller must hold mu.
+func (s *Status) get(name string) *SourceStatus {
+	st, ok := s.sources[name]
+	if !ok {
+		st = &SourceStatus{Name: name}
+		s.sources[name] = st
+	}
+	return st
+}
+
+// RecordSuccess marks a successful run of a source
+func (s *Status) RecordSuccess(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	st := s.get(name)
+	st.LastRun = now
+	st.LastSuccess = now
+	st.ConsecutiveFailures = 0
+	metrics.SetSourceHealth(name, now, 0)
+}
+
+// RecordFailure marks a failed run of a source
+func (s *Status) RecordFailure(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	st := s.get(name)
+	st.LastRun = now
+	st.LastError = err.Error()
+	st.LastErrorAt = now
+	st.ConsecutiveFailures++
+	st.Errors++
+	metrics.SetSourceHealth(name, st.LastSuccess, st.ConsecutiveFailures)
+}
+
+// Restore seeds the status of a source with what the state database kept
+// from previous runs
+func (s *Status) Restore(meta state.Meta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.get(meta.Source)
+	st.LastSuccess = meta.LastSuccess
+	st.LastError = meta.LastError
+	st.LastErrorAt = meta.LastErrorAt
+}
+
+// SetRunning marks whether a source is currently running
+func (s *Status) SetRunning(name string, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).Running = running
+}
+
+// SetPaused marks whether a source is paused
+func (s *Status) SetPaused(name string, paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).Paused = paused
+}
+
+// SetBlocked marks whether a source waits for room in the offline queue
+func (s *Status) SetBlocked(name string, blocked bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).Blocked = blocked
+}
+
+// SetBackendDown marks whether a source waits for the backend to come back
+func (s *Status) SetBackendDown(name string, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).BackendDown = down
+}
+
+// SetNextRun records when a source is next scheduled to run
+func (s *Status) SetNextRun(name string, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).NextRun = next
+}
+
+// AddFetched increments the number of items read from a source
+func (s *Status) AddFetched(name string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).ItemsFetched += int64(n)
+	metrics.AddItems(name, "fetched", n)
+}
+
+// AddSent increments the number of items accepted by the backend
+func (s *Status) AddSent(name string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).ItemsSent += int64(n)
+	metrics.AddItems(name, "sent", n)
+}
+
+// AddFailed increments the number of items that could not be delivered
+func (s *Status) AddFailed(name string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).ItemsFailed += int64(n)
+	metrics.AddItems(name, "failed", n)
+}
+
+// AddFiltered increments the number of items dropped by the filter
+func (s *Status) AddFiltered(name string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(name).ItemsFiltered += int64(n)
+	metrics.AddItems(name, "filtered", n)
+}
+
+// Get returns a copy of the status of a single source
+func (s *Status) Get(name string) (SourceStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st, ok := s.sources[name]
+	if !ok {
+		return SourceStatus{Name: name}, false
+	}
+	return *st, true
+}
+
+// Snapshot returns a copy of all source statuses sorted by name
+func (s *Status) Snapshot() []SourceStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]SourceStatus, 0, len(s.sources))
+	for _, st := range s.sources {
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
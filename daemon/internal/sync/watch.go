@@ -0,0 +1,52 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/watch"
+)
+
+// WatchedSource is implemented by sources that read local files. A change to
+// any of the files triggers a sync of the source ahead of its schedule.
+type WatchedSource interface {
+	// WatchPaths returns the SQLite database and its -wal file, which sees
+	// new writes first
+	WatchPaths() []string
+}
+
+// watchSource records the files of a source if it has any
+func (m *Manager) watchSource(name string, src any) {
+	if ws, ok := src.(WatchedSource); ok {
+		m.watchPaths[name] = ws.WatchPaths()
+	}
+}
+
+// startWatcher triggers debounced syncs of sources whose files change
+func (m *Manager) startWatcher(ctx context.Context, wg *sync.WaitGroup) {
+	cfg := m.config.Sync.Watch
+	if !cfg.Enabled || len(m.watchPaths) == 0 {
+		return
+	}
+
+	w := watch.New(cfg, watch.RealClock, func(source string) {
+		log.Debug().Str("source", source).Msg("Triggering sync after file change")
+		if err := m.Trigger(source); err != nil && !errors.Is(err, ErrPaused) {
+			log.Warn().Err(err).Str("source", source).Msg("Failed to trigger sync")
+		}
+	})
+	for _, name := range m.jobOrder {
+		if paths, ok := m.watchPaths[name]; ok {
+			w.Add(name, paths...)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.Run(ctx)
+	}()
+}
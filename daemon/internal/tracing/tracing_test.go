@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"pkb-daemon/internal/config"
+)
+
+func TestSetupDisabledPropagates(t *testing.T) {
+	shutdown, err := Setup(context.Background(), config.TracingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans of a recording provider still carry traceparent to the backend
+	provider := sdktrace.NewTracerProvider()
+	defer provider.Shutdown(context.Background())
+	ctx, span := provider.Tracer("test").Start(context.Background(), "cycle")
+	defer span.End()
+
+	header := http.Header{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	traceparent := header.Get("traceparent")
+	if !strings.Contains(traceparent, span.SpanContext().TraceID().String()) {
+		t.Errorf("traceparent = %q, want trace %s", traceparent, span.SpanContext().TraceID())
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	ratio := 1.0
+	_, err := Setup(context.Background(), config.TracingConfig{Enabled: true, Exporter: "zipkin", SampleRatio: &ratio})
+	if err == nil {
+		t.Error("Setup succeeded, want an error for an unknown exporter")
+	}
+}
+
+func TestEndRecordsError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	otel.SetTracerProvider(provider)
+
+	_, span := Start(context.Background(), "sync.cycle", attribute.String("source", "imessage"))
+	End(span, errors.New("backend down"))
+	_, span = Start(context.Background(), "sync.batch")
+	End(span, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if s := spans[0]; s.Status().Code != codes.Error || s.Status().Description != "backend down" || len(s.Events()) != 1 {
+		t.Errorf("failed span status = %+v with %d events, want the error", s.Status(), len(s.Events()))
+	}
+	if s := spans[0]; len(s.Attributes()) != 1 || s.Attributes()[0] != attribute.String("source", "imessage") {
+		t.Errorf("attributes = %v", s.Attributes())
+	}
+	if s := spans[1]; s.Status().Code != codes.Unset {
+		t.Errorf("successful span status = %+v, want unset", s.Status())
+	}
+}
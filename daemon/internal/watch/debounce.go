@@ -0,0 +1,113 @@
+package watch
+
+import (
+	"sync"
+	"time"
+)
+
+// Timer is the subset of *time.Timer used by the debouncer
+type Timer interface {
+	Stop() bool
+}
+
+// Clock abstracts time so the debounce logic can be tested without sleeping
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// RealClock is the wall clock
+var RealClock Clock = realClock{}
+
+// pending is a burst of changes to one key that has not fired yet
+type pending struct {
+	first time.Time // first change of the burst
+	timer Timer
+	gen   int // bumped on every change so a stale timer doesn't fire
+}
+
+// Debouncer collapses bursts of changes per key into a single call of fire.
+// fire runs once a key has been quiet for delay, or at the latest maxDelay
+// after the first change of a burst, so a database that is written
+// continuously (e.g. an active chat.db-wal) still syncs.
+type Debouncer struct {
+	delay    time.Duration
+	maxDelay time.Duration
+	clock    Clock
+	fire     func(key string)
+
+	mu      sync.Mutex
+	pending map[string]*pending
+}
+
+func NewDebouncer(delay, maxDelay time.Duration, clock Clock, fire func(key string)) *Debouncer {
+	if clock == nil {
+		clock = RealClock
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	return &Debouncer{
+		delay:    delay,
+		maxDelay: maxDelay,
+		clock:    clock,
+		fire:     fire,
+		pending:  make(map[string]*pending),
+	}
+}
+
+// Notify records a change to key and (re)starts its quiet period
+func (d *Debouncer) Notify(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	p, ok := d.pending[key]
+	if !ok {
+		p = &pending{first: now}
+		d.pending[key] = p
+	} else {
+		p.timer.Stop()
+	}
+
+	wait := d.delay
+	if remaining := p.first.Add(d.maxDelay).Sub(now); remaining < wait {
+		wait = remaining
+	}
+	if wait < 0 {
+		wait = 0
+	}
+
+	p.gen++
+	gen := p.gen
+	p.timer = d.clock.AfterFunc(wait, func() { d.flush(key, p, gen) })
+}
+
+// flush fires key if no change arrived since the timer was started
+func (d *Debouncer) flush(key string, p *pending, gen int) {
+	d.mu.Lock()
+	if d.pending[key] != p || p.gen != gen {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	d.mu.Unlock()
+
+	d.fire(key)
+}
+
+// Stop cancels all pending calls
+func (d *Debouncer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, p := range d.pending {
+		p.timer.Stop()
+		delete(d.pending, key)
+	}
+}
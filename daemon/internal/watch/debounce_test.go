@@ -0,0 +1,175 @@
+package watch
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock runs timers only when the test advances time
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Advance moves time forward, running due timers in order
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.stopped && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		next.stopped = true
+		c.now = next.at
+		c.mu.Unlock()
+
+		next.f()
+	}
+}
+
+// recorder collects the keys fired by a debouncer
+type recorder struct {
+	mu    sync.Mutex
+	fired []string
+}
+
+func (r *recorder) fire(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fired = append(r.fired, key)
+}
+
+func (r *recorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fired := r.fired
+	r.fired = nil
+	sort.Strings(fired)
+	return fired
+}
+
+func expectFired(t *testing.T, r *recorder, want ...string) {
+	t.Helper()
+	got := r.take()
+	if len(got) != len(want) {
+		t.Fatalf("fired %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("fired %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDebouncerCollapsesBurst(t *testing.T) {
+	clock := newFakeClock()
+	r := &recorder{}
+	d := NewDebouncer(2*time.Second, 10*time.Second, clock, r.fire)
+
+	for i := 0; i < 5; i++ {
+		d.Notify("imessage")
+		clock.Advance(500 * time.Millisecond)
+	}
+	expectFired(t, r)
+
+	// Quiet period starts after the last change
+	clock.Advance(1499 * time.Millisecond)
+	expectFired(t, r)
+	clock.Advance(time.Millisecond)
+	expectFired(t, r, "imessage")
+
+	// Nothing left pending
+	clock.Advance(time.Minute)
+	expectFired(t, r)
+}
+
+func TestDebouncerMaxDelay(t *testing.T) {
+	clock := newFakeClock()
+	r := &recorder{}
+	d := NewDebouncer(2*time.Second, 10*time.Second, clock, r.fire)
+
+	// A change every second never leaves a quiet period, but the sync
+	// must still happen 10s after the first change
+	for i := 0; i < 10; i++ {
+		d.Notify("imessage")
+		clock.Advance(time.Second)
+	}
+	expectFired(t, r, "imessage")
+
+	// The next change starts a new burst
+	d.Notify("imessage")
+	clock.Advance(2 * time.Second)
+	expectFired(t, r, "imessage")
+}
+
+func TestDebouncerKeysAreIndependent(t *testing.T) {
+	clock := newFakeClock()
+	r := &recorder{}
+	d := NewDebouncer(2*time.Second, 10*time.Second, clock, r.fire)
+
+	d.Notify("imessage")
+	clock.Advance(time.Second)
+	d.Notify("calls")
+	clock.Advance(time.Second)
+	expectFired(t, r, "imessage")
+	clock.Advance(time.Second)
+	expectFired(t, r, "calls")
+}
+
+func TestDebouncerStop(t *testing.T) {
+	clock := newFakeClock()
+	r := &recorder{}
+	d := NewDebouncer(2*time.Second, 10*time.Second, clock, r.fire)
+
+	d.Notify("imessage")
+	d.Stop()
+	clock.Advance(time.Minute)
+	expectFired(t, r)
+}
@@ -0,0 +1,181 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+
+	"pkb-daemon/internal/config"
+)
+
+// fileState is what polling compares to detect a change
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// Watcher maps changes of source database files to debounced per-source
+// notifications. It uses filesystem notifications where available and
+// falls back to polling the files' size and modification time.
+type Watcher struct {
+	paths        map[string]string // cleaned file path -> source name
+	debouncer    *Debouncer
+	pollInterval time.Duration
+	forcePolling bool
+	states       map[string]fileState
+}
+
+// New creates a watcher that calls notify with the source name after its files change
+func New(cfg config.WatchConfig, clock Clock, notify func(source string)) *Watcher {
+	return &Watcher{
+		paths: make(map[string]string),
+		debouncer: NewDebouncer(
+			time.Duration(cfg.DebounceMillis)*time.Millisecond,
+			time.Duration(cfg.MaxDelayMillis)*time.Millisecond,
+			clock,
+			notify,
+		),
+		pollInterval: time.Duration(cfg.PollIntervalSeconds) * time.Second,
+		forcePolling: cfg.Polling,
+		states:       make(map[string]fileState),
+	}
+}
+
+// Add watches paths on behalf of a source. Paths don't need to exist yet,
+// e.g. a SQLite -wal file that is only created on the next write.
+func (w *Watcher) Add(source string, paths ...string) {
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		w.paths[p] = source
+		w.states[p] = statFile(p)
+	}
+}
+
+// Sources returns the names of all watched sources
+func (w *Watcher) Sources() []string {
+	seen := make(map[string]bool)
+	var sources []string
+	for _, source := range w.paths {
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Run watches until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.debouncer.Stop()
+
+	if len(w.paths) == 0 {
+		return
+	}
+
+	if !w.forcePolling {
+		err := w.runNotify(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Msg("Filesystem notifications unavailable, falling back to polling")
+	}
+
+	w.runPoll(ctx)
+}
+
+// runNotify watches the parent directories of all paths, since SQLite creates,
+// truncates and removes its -wal and -journal files next to the database
+func (w *Watcher) runNotify(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+
+	dirs := make(map[string]bool)
+	for p := range w.paths {
+		dirs[filepath.Dir(p)] = true
+	}
+	for dir := range dirs {
+		if err := fw.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Strs("sources", w.Sources()).Int("directories", len(dirs)).Msg("Watching source databases for changes")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fw.Events:
+			if !ok {
+				return errors.New("fsnotify event channel closed")
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if source, ok := w.paths[filepath.Clean(event.Name)]; ok {
+				log.Debug().Str("source", source).Str("file", event.Name).Str("op", event.Op.String()).Msg("Source database changed")
+				w.debouncer.Notify(source)
+			}
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return errors.New("fsnotify error channel closed")
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost, so any source may have changed
+				log.Warn().Msg("Filesystem event queue overflowed, syncing all watched sources")
+				for _, source := range w.Sources() {
+					w.debouncer.Notify(source)
+				}
+				continue
+			}
+			log.Warn().Err(err).Msg("Filesystem watcher error")
+		}
+	}
+}
+
+func (w *Watcher) runPoll(ctx context.Context) {
+	log.Info().Strs("sources", w.Sources()).Dur("interval", w.pollInterval).Msg("Polling source databases for changes")
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// poll stats every path once and notifies the sources whose files changed
+func (w *Watcher) poll() {
+	for p, source := range w.paths {
+		st := statFile(p)
+		if st != w.states[p] {
+			w.states[p] = st
+			log.Debug().Str("source", source).Str("file", p).Msg("Source database changed")
+			w.debouncer.Notify(source)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkb-daemon/internal/config"
+)
+
+func newTestWatcher(clock Clock, r *recorder) *Watcher {
+	return New(config.WatchConfig{
+		DebounceMillis:      2000,
+		MaxDelayMillis:      10000,
+		Polling:             true,
+		PollIntervalSeconds: 1,
+	}, clock, r.fire)
+}
+
+func writeFile(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Set the modification time explicitly so the test doesn't depend on
+	// the filesystem's timestamp resolution
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollDetectsWrites(t *testing.T) {
+	dir := t.TempDir()
+	chatDB := filepath.Join(dir, "chat.db")
+	notesDB := filepath.Join(dir, "NoteStore.sqlite")
+	base := time.Now().Add(-time.Hour)
+	writeFile(t, chatDB, "initial", base)
+	writeFile(t, notesDB, "initial", base)
+
+	clock := newFakeClock()
+	r := &recorder{}
+	w := newTestWatcher(clock, r)
+	w.Add("imessage", chatDB, chatDB+"-wal")
+	w.Add("notes", notesDB, notesDB+"-wal")
+
+	// No changes since Add
+	w.poll()
+	clock.Advance(time.Minute)
+	expectFired(t, r)
+
+	// The -wal file appearing counts as a change
+	writeFile(t, chatDB+"-wal", "message 1", base.Add(time.Second))
+	w.poll()
+	clock.Advance(time.Second)
+	expectFired(t, r)
+
+	// Further writes within the quiet period are collapsed into one sync
+	writeFile(t, chatDB+"-wal", "message 1 message 2", base.Add(2*time.Second))
+	w.poll()
+	clock.Advance(2 * time.Second)
+	expectFired(t, r, "imessage")
+
+	// Only the source whose file changed is synced
+	writeFile(t, notesDB, "updated", base.Add(3*time.Second))
+	w.poll()
+	clock.Advance(2 * time.Second)
+	expectFired(t, r, "notes")
+}
+
+func TestPollDetectsRemoval(t *testing.T) {
+	dir := t.TempDir()
+	wal := filepath.Join(dir, "CallHistory.storedata-wal")
+	writeFile(t, wal, "calls", time.Now())
+
+	clock := newFakeClock()
+	r := &recorder{}
+	w := newTestWatcher(clock, r)
+	w.Add("calls", wal)
+
+	// SQLite removes the -wal file on checkpoint
+	if err := os.Remove(wal); err != nil {
+		t.Fatal(err)
+	}
+	w.poll()
+	clock.Advance(2 * time.Second)
+	expectFired(t, r, "calls")
+}
+
+func TestSources(t *testing.T) {
+	w := newTestWatcher(newFakeClock(), &recorder{})
+	w.Add("notes", "/tmp/NoteStore.sqlite", "/tmp/NoteStore.sqlite-wal")
+	w.Add("imessage", "/tmp/chat.db")
+
+	got := w.Sources()
+	if len(got) != 2 || got[0] != "imessage" || got[1] != "notes" {
+		t.Errorf("Sources() = %v, want [imessage notes]", got)
+	}
+}
@@ -27,7 +27,13 @@ export function create_app(): express.Application {
     origin: 'http://localhost:3000',
     credentials: true,
   }));
-  app.use(express.json({ limit: '100mb' }));
+  app.use(express.json({
+    limit: '100mb',
+    // Kept for request signatures, which cover the body as sent
+    verify: (req, _res, buf) => {
+      (req as express.Request).raw_body = buf;
+    },
+  }));
   app.use(express.urlencoded({ limit: '100mb', extended: true }));
   app.use(cookie_parser());
   app.use(logging_middleware);
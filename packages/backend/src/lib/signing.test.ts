@@ -0,0 +1,68 @@
+import { describe, it, expect } from 'vitest';
+import { sign_request, verify_request_signature } from './signing.js';
+
+const SECRET = 'test-signing-secret';
+const NOW = 1_700_000_000_000;
+const PATH = '/api/sync/notes';
+const BODY = Buffer.from('{"notes":[]}');
+
+function signed(body = BODY, now = NOW) {
+  return { method: 'POST', path: PATH, headers: sign_request(SECRET, 'POST', PATH, body, now), body };
+}
+
+describe('verify_request_signature', () => {
+  it('accepts a valid signature', () => {
+    expect(verify_request_signature(SECRET, signed(), NOW)).toBeNull();
+  });
+
+  it('accepts a signature made by the daemon', () => {
+    // Same vector as TestSignature in daemon/internal/api/sign_test.go
+    const req = {
+      method: 'POST',
+      path: PATH,
+      headers: {
+        'x-pkb-timestamp': '1700000000',
+        'x-pkb-nonce': '000102030405060708090a0b0c0d0e0f',
+        'x-pkb-signature': 'v1=dc2a0183c354ca3a0d3355b4b13bce86f4b3871b3a59638066f18111397c33e2',
+      },
+      body: BODY,
+    };
+    expect(verify_request_signature(SECRET, req, NOW)).toBeNull();
+  });
+
+  it('refuses a missing signature', () => {
+    expect(verify_request_signature(SECRET, { method: 'POST', path: PATH, headers: {}, body: BODY }, NOW)).toBe(
+      'missing signature'
+    );
+  });
+
+  it('refuses a stale timestamp', () => {
+    const req = signed(BODY, NOW - 301_000);
+    expect(verify_request_signature(SECRET, req, NOW)).toBe('stale timestamp');
+  });
+
+  it('refuses a timestamp from the future', () => {
+    const req = signed(BODY, NOW + 301_000);
+    expect(verify_request_signature(SECRET, req, NOW)).toBe('stale timestamp');
+  });
+
+  it('refuses a replayed nonce', () => {
+    const req = signed();
+    expect(verify_request_signature(SECRET, req, NOW)).toBeNull();
+    expect(verify_request_signature(SECRET, req, NOW + 1000)).toBe('replayed nonce');
+  });
+
+  it('refuses a changed body', () => {
+    const req = { ...signed(), body: Buffer.from('{"notes":[{"source_id":"n1"}]}') };
+    expect(verify_request_signature(SECRET, req, NOW)).toBe('invalid signature');
+  });
+
+  it('refuses a changed path', () => {
+    const req = { ...signed(), path: '/api/sync/contacts' };
+    expect(verify_request_signature(SECRET, req, NOW)).toBe('invalid signature');
+  });
+
+  it('refuses another secret', () => {
+    expect(verify_request_signature('other-secret', signed(), NOW)).toBe('invalid signature');
+  });
+});
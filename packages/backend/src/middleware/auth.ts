@@ -2,11 +2,13 @@ import { Request, Response, NextFunction } from 'express';
 import { get_pool } from '../db/index.js';
 import { hash_api_key } from '../lib/auth.js';
 import { logger } from '../lib/logger.js';
+import { verify_request_signature } from '../lib/signing.js';
 
 declare global {
   namespace Express {
     interface Request {
       user_id?: string;
+      raw_body?: Buffer;
     }
   }
 }
@@ -57,6 +59,21 @@ export async function require_api_key(req: Request, res: Response, next: NextFun
   // Check service API key from environment (for daemon/service-to-service auth)
   const service_api_key = process.env.API_KEY;
   if (service_api_key && api_key === service_api_key) {
+    // With a signing secret, the daemon's requests must also be signed
+    const signing_secret = process.env.API_SIGNING_SECRET;
+    if (signing_secret) {
+      const reason = verify_request_signature(signing_secret, {
+        method: req.method,
+        path: req.originalUrl, // the canonical signed path; see SignedRequest
+        headers: req.headers,
+        body: req.raw_body ?? Buffer.alloc(0),
+      });
+      if (reason) {
+        logger.warn('auth: rejected request signature', { request_id: req.request_id, path: req.path, reason });
+        res.status(401).json({ error: 'Invalid request signature' });
+        return;
+      }
+    }
     next();
     return;
   }